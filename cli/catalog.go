@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+)
+
+// importCatalog is the `import` subcommand: it imports the catalog items in a CSV or JSON Lines file
+func importCatalog(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "csv or jsonl (default: from the file extension)")
+	dryRun := fs.Bool("dry-run", false, "check the file, and print what would change, without changing anything")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: cli import [-dry-run] [-format csv|jsonl] FILE")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(fs.Arg(0)), ".")
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	query := url.Values{"format": {*format}}
+	if *dryRun {
+		query.Set("dry_run", "true")
+	}
+	resp, err := client.Post(fmt.Sprintf("%s/catalog/import?%s", *apiGateway, query.Encode()), "", file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		messages.ImportCatalogResult
+		Description string                        `json:"description"`
+		Details     *messages.ImportCatalogResult `json:"details"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		fmt.Fprintln(os.Stderr, "unexpected response:", resp.Status)
+		return 1
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, cmp.Or(body.Description, resp.Status))
+		if body.Details != nil {
+			for _, rowErr := range body.Details.Errors {
+				for _, v := range rowErr.Violations {
+					fmt.Fprintf(os.Stderr, "line %d", rowErr.Line)
+					if rowErr.SKU != "" {
+						fmt.Fprintf(os.Stderr, " (%s)", rowErr.SKU)
+					}
+					if v.Field != "" {
+						fmt.Fprintf(os.Stderr, ", %s", v.Field)
+					}
+					fmt.Fprintf(os.Stderr, ": %s\n", v.Message)
+				}
+			}
+		}
+		return 1
+	}
+
+	result := body.ImportCatalogResult
+	if result.DryRun {
+		fmt.Print("dry run, nothing was changed: ")
+	}
+	fmt.Printf("%d created, %d updated, %d unchanged\n", result.Created, result.Updated, result.Unchanged)
+	return 0
+}
+
+// exportCatalog is the `export` subcommand: it writes the whole catalog in CSV or JSON Lines
+func exportCatalog(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "csv or jsonl")
+	output := fs.String("o", "", "file to write the catalog to (default: standard output)")
+	_ = fs.Parse(args)
+
+	resp, err := client.Get(fmt.Sprintf("%s/catalog/export?%s", *apiGateway, url.Values{"format": {*format}}.Encode()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "export failed:", resp.Status)
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer out.Close()
+	}
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
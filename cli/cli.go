@@ -1,21 +1,27 @@
 package main
 
 import (
+	"cmp"
 	"flag"
 	"fmt"
+	"github.com/alimitedgroup/PoC/common/messages"
 	"github.com/charmbracelet/bubbles/help"
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/table"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"maps"
 	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
 var (
 	baseStyle  = lipgloss.NewStyle().BorderStyle(lipgloss.NormalBorder()).BorderForeground(lipgloss.Color("240"))
 	apiGateway = flag.String("api-gateway", "http://localhost", "API Gateway URL")
+	lang       = flag.String("lang", "", "Preferred languages of the names of the goods, as in Accept-Language (e.g. \"it,en\")")
 )
 
 type TickMsg struct {
@@ -37,7 +43,9 @@ type model struct {
 	// selectedWarehouse is empty if no warehouse is selected (and we're
 	// browsing all of them), otherwise, if the stock of a warehouse is
 	// currently shown, it contains the id of that warehouse
-	selectedWarehouse  string
+	selectedWarehouse string
+	// items are the catalog items of the stock currently shown, by id
+	items              map[string]messages.CatalogItem
 	fetchingWarehouses bool
 	fetchingStock      bool
 }
@@ -74,9 +82,14 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		var rows []table.Row
 		for id, row := range msg.stock {
-			rows = append(rows, []string{id, row[0], row[1]})
+			rows = append(rows, append([]string{id}, row...))
 		}
+		// sorted by name, so that rows do not move around at every refresh
+		slices.SortFunc(rows, func(a, b table.Row) int {
+			return cmp.Or(strings.Compare(a[2], b[2]), strings.Compare(a[0], b[0]))
+		})
 		m.stock.SetRows(rows)
+		m.items = msg.items
 
 	case TickMsg:
 		m.keys.Select.SetEnabled(false)
@@ -94,13 +107,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case key.Matches(msg, m.keys.Quit):
 			return m, tea.Quit
 		case key.Matches(msg, m.keys.Up):
-			m.warehouses.MoveUp(1)
+			m.currentTable().MoveUp(1)
 		case key.Matches(msg, m.keys.Down):
-			m.warehouses.MoveDown(1)
+			m.currentTable().MoveDown(1)
 		case key.Matches(msg, m.keys.PageUp):
-			m.warehouses.GotoTop()
+			m.currentTable().GotoTop()
 		case key.Matches(msg, m.keys.PageDown):
-			m.warehouses.GotoBottom()
+			m.currentTable().GotoBottom()
 
 		case key.Matches(msg, m.keys.Select):
 			m.fetchingStock = true
@@ -121,6 +134,43 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// currentTable returns the table being browsed
+func (m *model) currentTable() *table.Model {
+	if m.selectedWarehouse != "" {
+		return &m.stock
+	}
+	return &m.warehouses
+}
+
+// itemDetails describes the catalog item fields that do not fit in the stock table
+func itemDetails(item messages.CatalogItem) string {
+	var details []string
+	if item.Weight > 0 {
+		details = append(details, fmt.Sprintf("%d g", item.Weight))
+	}
+	if d := item.Dimensions; d != nil {
+		details = append(details, fmt.Sprintf("%d×%d×%d mm", d.Length, d.Width, d.Height))
+	}
+	if len(item.Barcodes) > 0 {
+		details = append(details, "barcode "+strings.Join(item.Barcodes, ", "))
+	}
+	for _, u := range item.Units {
+		details = append(details, fmt.Sprintf("1 %s = %d %s", u.Unit, u.Factor, item.Unit))
+	}
+	if item.Serialised {
+		details = append(details, "serialised")
+	}
+	for _, k := range slices.Sorted(maps.Keys(item.Attributes)) {
+		details = append(details, k+": "+item.Attributes[k])
+	}
+
+	out := strings.Join(details, " · ")
+	if item.Description != "" {
+		out = item.Description + "\n" + out
+	}
+	return out
+}
+
 type keyMap struct {
 	Up       key.Binding
 	Down     key.Binding
@@ -144,6 +194,11 @@ func (m model) View() string {
 
 	if m.selectedWarehouse != "" {
 		out = baseStyle.Render(m.stock.View()) + "\n"
+		if row := m.stock.SelectedRow(); row != nil {
+			if details := itemDetails(m.items[row[0]]); details != "" {
+				out += details + "\n"
+			}
+		}
 	} else {
 		out = baseStyle.Render(m.warehouses.View()) + "\n"
 	}
@@ -162,6 +217,13 @@ func (m model) View() string {
 func main() {
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "import":
+		os.Exit(importCatalog(flag.Args()[1:]))
+	case "export":
+		os.Exit(exportCatalog(flag.Args()[1:]))
+	}
+
 	tableStyle := table.DefaultStyles()
 	tableStyle.Header = tableStyle.Header.
 		BorderStyle(lipgloss.NormalBorder()).
@@ -179,8 +241,11 @@ func main() {
 	}), table.WithStyles(tableStyle))
 	stock := table.New(table.WithColumns([]table.Column{
 		{Title: "ID", Width: 36},
-		{Title: "Name", Width: 10},
-		{Title: "Amount", Width: 24},
+		{Title: "SKU", Width: 14},
+		{Title: "Name", Width: 20},
+		{Title: "Amount", Width: 8},
+		{Title: "Unit", Width: 6},
+		{Title: "Status", Width: 9},
 	}), table.WithStyles(tableStyle))
 
 	h := help.New()
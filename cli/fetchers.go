@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/alimitedgroup/PoC/common/messages"
 	tea "github.com/charmbracelet/bubbletea"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -17,6 +19,20 @@ type NewWarehousesMsg struct {
 
 type NewStockMsg struct {
 	stock map[string][]string
+	// items are the catalog items of the goods in stock, by id
+	items map[string]messages.CatalogItem
+}
+
+// get sends a GET request to the API Gateway, asking for the languages of the --lang flag
+func get(target string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if *lang != "" {
+		req.Header.Set("Accept-Language", *lang)
+	}
+	return client.Do(req)
 }
 
 func FetchWarehouses() tea.Msg {
@@ -35,21 +51,38 @@ func FetchWarehouses() tea.Msg {
 	return NewWarehousesMsg{warehouses}
 }
 
-func FetchStock(warehouse string) tea.Cmd {
-	return func() tea.Msg {
-		resp, err := client.Get(fmt.Sprintf("%s/catalog", *apiGateway))
+// FetchCatalog returns every catalog item by id, following the pages of the catalog search
+func FetchCatalog() map[string]messages.CatalogItem {
+	catalog := make(map[string]messages.CatalogItem)
+	query := url.Values{"limit": {"500"}}
+	for {
+		resp, err := get(fmt.Sprintf("%s/catalog?%s", *apiGateway, query.Encode()))
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer resp.Body.Close()
 
-		var catalog map[string]string
-		err = json.NewDecoder(resp.Body).Decode(&catalog)
+		var page messages.CatalogPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		resp, err = client.Get(fmt.Sprintf("%s/stock/%s", *apiGateway, warehouse))
+		for _, item := range page.Items {
+			catalog[item.Id] = item
+		}
+		if page.NextCursor == "" {
+			return catalog
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+}
+
+func FetchStock(warehouse string) tea.Cmd {
+	return func() tea.Msg {
+		catalog := FetchCatalog()
+
+		resp, err := client.Get(fmt.Sprintf("%s/stock/%s", *apiGateway, warehouse))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -63,12 +96,20 @@ func FetchStock(warehouse string) tea.Cmd {
 
 		stock2 := make(map[string][]string)
 		for id, amount := range stock {
+			item, ok := catalog[id]
+			if !ok {
+				// the item was deleted from the catalog while there was still stock of it
+				item.Name = "(unknown good)"
+			}
 			stock2[id] = []string{
-				catalog[id],
+				item.SKU,
+				item.Name,
 				strconv.Itoa(amount),
+				item.Unit,
+				string(item.Status),
 			}
 		}
 
-		return NewStockMsg{stock2}
+		return NewStockMsg{stock2, catalog}
 	}
 }
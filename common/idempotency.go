@@ -0,0 +1,167 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// IdempotencyHeader is the NATS header carrying the idempotency key of a request.
+// It is the same header used by JetStream for publish deduplication.
+const IdempotencyHeader = jetstream.MsgIDHeader
+
+// errRequestInProgress is returned when another request with the same idempotency key has not completed yet
+var errRequestInProgress = errors.New("request with the same idempotency key is in progress")
+
+// errKeyReused is returned when the idempotency key was used by a request with a different body
+var errKeyReused = errors.New("idempotency key used by a different request")
+
+// idempotencyRecord is the value stored in the idempotency bucket for each key
+type idempotencyRecord struct {
+	Done     bool   `json:"done"`
+	Response []byte `json:"response,omitempty"`
+	// Id identifies the request, and is the same for all of its retries
+	Id uuid.UUID `json:"id"`
+	// Request is the hash of the body of the request, which retries must repeat
+	Request string `json:"request"`
+	// At is when the request was claimed, or zero once it is released for a retry
+	At time.Time `json:"at"`
+}
+
+// IdempotencyStore remembers the responses to requests carrying an idempotency key, so that
+// retried requests get the original response instead of being executed again.
+//
+// Responses are remembered for as long as the bucket keeps them (see IdempotencyKeyValueConfig).
+type IdempotencyStore struct {
+	kv jetstream.KeyValue
+	// staleAfter is how long a request can stay in progress before a retry is allowed to take over,
+	// e.g. because the service handling it crashed
+	staleAfter time.Duration
+}
+
+func NewIdempotencyStore(kv jetstream.KeyValue, staleAfter time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{kv: kv, staleAfter: staleAfter}
+}
+
+// idempotencyKey returns the KV key for the given idempotency key. Keys are hashed, as clients may send
+// characters that are not valid in KV keys.
+func idempotencyKey(scope string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s.%s", scope, hex.EncodeToString(sum[:]))
+}
+
+// Do calls fn and returns its response, unless a request with the same idempotency key has already been
+// handled in the same scope: in that case the original response is returned without calling fn.
+//
+// fn gets the id of the request, which is the same for all of its retries, so that they can find what
+// a previous attempt did. Keys are tied to the body of the request: reusing one for a different body is refused.
+//
+// Requests without an idempotency key are always executed, with a new id. Internal errors are not remembered,
+// so that the request can be retried.
+func (st *IdempotencyStore) Do(ctx context.Context, scope string, msg *nats.Msg, fn func(id uuid.UUID) []byte) []byte {
+	key := msg.Header.Get(IdempotencyHeader)
+	if key == "" {
+		return fn(uuid.New())
+	}
+
+	k := idempotencyKey(scope, key)
+	sum := sha256.Sum256(msg.Data)
+	record, err := st.begin(ctx, k, hex.EncodeToString(sum[:]))
+	switch {
+	case errors.Is(err, errRequestInProgress):
+		return natsutil.ErrorResponse(natsutil.RequestInProgress)
+	case errors.Is(err, errKeyReused):
+		return natsutil.ErrorResponse(natsutil.IdempotencyKeyReused)
+	case err != nil:
+		slog.ErrorContext(ctx, "Error claiming idempotency key", "error", err, "scope", scope)
+		return natsutil.ErrorResponse(natsutil.KvError)
+	case record.Done:
+		slog.InfoContext(ctx, "Returning response of an already handled request", "scope", scope, "key", key)
+		return record.Response
+	}
+
+	response := fn(record.Id)
+
+	// the response must be stored even if the request context was cancelled meanwhile
+	ctx = context.WithoutCancel(ctx)
+	if code, _, ok := natsutil.ParseError(response); ok && code == "internal_error" {
+		// release the key, keeping the id for the retry
+		record.At = time.Time{}
+	} else {
+		record.Done, record.Response, record.At = true, response, time.Now()
+	}
+	if err = st.put(ctx, k, record); err != nil {
+		slog.ErrorContext(ctx, "Error storing idempotent response", "error", err, "scope", scope)
+	}
+	return response
+}
+
+// begin claims the key for a request whose body has the given hash, and returns its record.
+// If a request with the same key has already completed, the record holds its response instead.
+func (st *IdempotencyStore) begin(ctx context.Context, k string, request string) (idempotencyRecord, error) {
+	record := idempotencyRecord{Id: uuid.New(), Request: request, At: time.Now()}
+	claim, err := json.Marshal(record)
+	if err != nil {
+		return record, fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	_, err = st.kv.Create(ctx, k, claim)
+	if err == nil {
+		return record, nil
+	}
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return record, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	entry, err := st.kv.Get(ctx, k)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		// the record expired just now
+		return record, errRequestInProgress
+	}
+	if err != nil {
+		return record, fmt.Errorf("failed to get idempotency record: %w", err)
+	}
+
+	if err := json.Unmarshal(entry.Value(), &record); err != nil {
+		return record, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+	}
+	if record.Request != request {
+		return record, errKeyReused
+	}
+	if record.Done {
+		return record, nil
+	}
+	if !record.At.IsZero() && time.Since(record.At) < st.staleAfter {
+		return record, errRequestInProgress
+	}
+
+	// the request was released, or never completed: take over, unless another retry already did
+	record.At = time.Now()
+	claim, err = json.Marshal(record)
+	if err != nil {
+		return record, fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	if _, err := st.kv.Update(ctx, k, claim, entry.Revision()); err != nil {
+		return record, errRequestInProgress
+	}
+	return record, nil
+}
+
+func (st *IdempotencyStore) put(ctx context.Context, k string, record idempotencyRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	_, err = st.kv.Put(ctx, k, body)
+	return err
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIdempotencyStore(t *testing.T, ctx context.Context) *IdempotencyStore {
+	nc := NewInProcessNATSServer(t)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	kv, err := js.CreateOrUpdateKeyValue(ctx, IdempotencyKeyValueConfig)
+	require.NoError(t, err)
+
+	return NewIdempotencyStore(kv, time.Minute)
+}
+
+func requestWithKey(key string) *nats.Msg {
+	return requestWithBody(key, nil)
+}
+
+func requestWithBody(key string, body []byte) *nats.Msg {
+	msg := nats.NewMsg("subject")
+	msg.Data = body
+	if key != "" {
+		msg.Header.Set(IdempotencyHeader, key)
+	}
+	return msg
+}
+
+func TestIdempotencyStore_Do(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	st := newTestIdempotencyStore(t, ctx)
+
+	calls := 0
+	fn := func(uuid.UUID) []byte {
+		calls++
+		return []byte("ok")
+	}
+
+	require.Equal(t, []byte("ok"), st.Do(ctx, "scope", requestWithKey("key"), fn))
+	require.Equal(t, []byte("ok"), st.Do(ctx, "scope", requestWithKey("key"), fn))
+	require.Equal(t, 1, calls)
+
+	// keys are separate for every scope
+	st.Do(ctx, "other", requestWithKey("key"), fn)
+	require.Equal(t, 2, calls)
+
+	// requests without a key are always executed
+	st.Do(ctx, "scope", requestWithKey(""), fn)
+	st.Do(ctx, "scope", requestWithKey(""), fn)
+	require.Equal(t, 4, calls)
+}
+
+func TestIdempotencyStore_InternalErrorsAreNotRemembered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	st := newTestIdempotencyStore(t, ctx)
+
+	response := st.Do(ctx, "scope", requestWithKey("key"), func(uuid.UUID) []byte {
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	})
+	require.Equal(t, natsutil.ErrorResponse(natsutil.NatsError), response)
+
+	response = st.Do(ctx, "scope", requestWithKey("key"), func(uuid.UUID) []byte {
+		return natsutil.ErrorResponse(natsutil.InsufficientStock)
+	})
+	require.Equal(t, natsutil.ErrorResponse(natsutil.InsufficientStock), response)
+
+	// errors that are not internal are the outcome of the request, and are remembered
+	response = st.Do(ctx, "scope", requestWithKey("key"), func(uuid.UUID) []byte {
+		return []byte("ok")
+	})
+	require.Equal(t, natsutil.ErrorResponse(natsutil.InsufficientStock), response)
+}
+
+func TestIdempotencyStore_InProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	st := newTestIdempotencyStore(t, ctx)
+
+	response := st.Do(ctx, "scope", requestWithKey("key"), func(uuid.UUID) []byte {
+		return st.Do(ctx, "scope", requestWithKey("key"), func(uuid.UUID) []byte {
+			return []byte("executed twice")
+		})
+	})
+	require.Equal(t, natsutil.ErrorResponse(natsutil.RequestInProgress), response)
+}
+
+func TestIdempotencyStore_RetriesShareTheRequestId(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	st := newTestIdempotencyStore(t, ctx)
+
+	ids := make([]uuid.UUID, 0)
+	fn := func(id uuid.UUID) []byte {
+		ids = append(ids, id)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	st.Do(ctx, "scope", requestWithKey("key"), fn)
+	st.Do(ctx, "scope", requestWithKey("key"), fn)
+	st.Do(ctx, "scope", requestWithKey("other"), fn)
+	st.Do(ctx, "scope", requestWithKey(""), fn)
+
+	require.Len(t, ids, 4)
+	require.Equal(t, ids[0], ids[1])
+	require.NotEqual(t, ids[0], ids[2])
+	require.NotEqual(t, ids[0], ids[3])
+}
+
+func TestIdempotencyStore_KeyReusedWithAnotherRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	st := newTestIdempotencyStore(t, ctx)
+
+	calls := 0
+	fn := func(uuid.UUID) []byte {
+		calls++
+		return []byte("ok")
+	}
+
+	require.Equal(t, []byte("ok"), st.Do(ctx, "scope", requestWithBody("key", []byte("first")), fn))
+	response := st.Do(ctx, "scope", requestWithBody("key", []byte("second")), fn)
+	require.Equal(t, natsutil.ErrorResponse(natsutil.IdempotencyKeyReused), response)
+	require.Equal(t, 1, calls)
+}
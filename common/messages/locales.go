@@ -0,0 +1,104 @@
+package messages
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxLanguages is how many of the languages of an Accept-Language header are kept by ParseAcceptLanguage
+const maxLanguages = 10
+
+// localeRegex matches normalized locales: a language, optionally followed by a region or other subtags, e.g. "it" or "de-ch"
+var localeRegex = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8}){0,3}$`)
+
+// ItemTranslation is the name and description of a catalog item in a locale. Empty fields fall back
+// to the next locale in the chain, see CatalogItem.Localised.
+type ItemTranslation struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// NormalizeLocale returns a locale in the form used by the catalog: lowercase, with dashes, e.g. "it-IT" or "it_IT" become "it-it"
+func NormalizeLocale(locale string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+}
+
+// ValidLocale returns whether locale is a normalized locale, e.g. "it", "en-gb" or "zh-hant-tw"
+func ValidLocale(locale string) bool {
+	return localeRegex.MatchString(locale)
+}
+
+// LocaleFallbacks returns the chain of locales looked up for a locale, from the most specific one:
+// "de-ch" falls back to "de"
+func LocaleFallbacks(locale string) []string {
+	chain := []string{locale}
+	for {
+		i := strings.LastIndex(locale, "-")
+		if i == -1 {
+			return chain
+		}
+		locale = locale[:i]
+		chain = append(chain, locale)
+	}
+}
+
+// Localised returns the item with the name and description of the first of the given locales that has them,
+// in order of preference. Each locale falls back to its language (see LocaleFallbacks) before the next one,
+// and the untranslated name and description are used when no locale has them.
+func (item CatalogItem) Localised(locales []string) CatalogItem {
+	if len(item.Translations) == 0 {
+		return item
+	}
+
+	name, description := "", ""
+	for _, locale := range locales {
+		for _, fallback := range LocaleFallbacks(NormalizeLocale(locale)) {
+			t := item.Translations[fallback]
+			name = cmp.Or(name, t.Name)
+			description = cmp.Or(description, t.Description)
+		}
+	}
+	item.Name = cmp.Or(name, item.Name)
+	item.Description = cmp.Or(description, item.Description)
+	return item
+}
+
+// ParseAcceptLanguage returns the normalized locales of an Accept-Language header, by decreasing quality.
+// The wildcard, locales with quality 0 and malformed entries are left out.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale  string
+		quality float64
+	}
+	entries := make([]weighted, 0)
+	for _, part := range strings.Split(header, ",") {
+		locale, params, _ := strings.Cut(part, ";")
+		locale = NormalizeLocale(locale)
+		if !ValidLocale(locale) {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			quality = parsed
+		}
+		if quality > 0 && !slices.ContainsFunc(entries, func(e weighted) bool { return e.locale == locale }) {
+			entries = append(entries, weighted{locale, quality})
+		}
+	}
+
+	// locales with the same quality keep the order of the header
+	slices.SortStableFunc(entries, func(a, b weighted) int { return cmp.Compare(b.quality, a.quality) })
+	locales := make([]string, 0, min(len(entries), maxLanguages))
+	for _, e := range entries[:min(len(entries), maxLanguages)] {
+		locales = append(locales, e.locale)
+	}
+	return locales
+}
@@ -0,0 +1,47 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalised(t *testing.T) {
+	item := CatalogItem{
+		Name:        "Woollen hat",
+		Description: "A warm hat",
+		Translations: map[string]ItemTranslation{
+			"it":    {Name: "Cappello di lana", Description: "Un cappello caldo"},
+			"de":    {Name: "Wollmütze"},
+			"de-ch": {Name: "Wollchappe"},
+		},
+	}
+
+	it := item.Localised([]string{"it"})
+	require.Equal(t, "Cappello di lana", it.Name)
+	require.Equal(t, "Un cappello caldo", it.Description)
+
+	// regions fall back to their language, and missing fields to the next locale
+	it = item.Localised([]string{"it-CH", "en"})
+	require.Equal(t, "Cappello di lana", it.Name)
+	it = item.Localised([]string{"de-ch", "it"})
+	require.Equal(t, "Wollchappe", it.Name)
+	require.Equal(t, "Un cappello caldo", it.Description)
+	it = item.Localised([]string{"de-at"})
+	require.Equal(t, "Wollmütze", it.Name)
+	require.Equal(t, "A warm hat", it.Description)
+
+	it = item.Localised([]string{"fr"})
+	require.Equal(t, "Woollen hat", it.Name)
+	it = item.Localised(nil)
+	require.Equal(t, "Woollen hat", it.Name)
+	require.Len(t, it.Translations, 3)
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	require.Equal(t, []string{"it-ch", "it", "en"}, ParseAcceptLanguage("it-CH, it;q=0.9, en;q=0.8, *;q=0.5"))
+	require.Equal(t, []string{"en", "de"}, ParseAcceptLanguage("de;q=0.5, fr;q=0, en, de"))
+	require.Equal(t, []string{"en-gb"}, ParseAcceptLanguage("en_GB, ??, it;q=abc"))
+	require.Empty(t, ParseAcceptLanguage(""))
+	require.Equal(t, []string{"de-ch", "de"}, LocaleFallbacks("de-ch"))
+}
@@ -1,25 +1,360 @@
 package messages
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type CatalogItem struct {
 	Id   string `json:"id" db:"id"`
 	Name string `json:"name" db:"name"`
+	// SKU is the stock keeping unit of the item, unique in the catalog
+	SKU         string `json:"sku,omitempty" db:"sku"`
+	Description string `json:"description,omitempty" db:"description"`
+	// Translations are the name and description of the item in other locales, by normalized locale (see NormalizeLocale).
+	// Name and Description are used where no translation applies.
+	Translations map[string]ItemTranslation `json:"translations,omitempty" db:"-"`
+	// Unit is the unit of measure the stock of the item is counted in, e.g. "pcs" or "kg"
+	Unit string `json:"unit,omitempty" db:"unit"`
+	// Units are the alternative units of measure of the item, e.g. boxes: stock is always counted in Unit,
+	// and amounts in other units are converted with their factor
+	Units []ItemUnit `json:"units,omitempty" db:"-"`
+	// Weight is the weight of a unit of the item, in grams
+	Weight     int         `json:"weight,omitempty" db:"weight"`
+	Dimensions *Dimensions `json:"dimensions,omitempty" db:"-"`
+	// Barcodes are the GTIN codes of the item (GTIN-8, UPC-A, EAN-13 or GTIN-14), unique in the catalog
+	Barcodes []string `json:"barcodes,omitempty" db:"-"`
+	// Attributes are free-form properties of the item, e.g. "color" or "size"
+	Attributes map[string]string `json:"attributes,omitempty" db:"-"`
+	// Categories are the ids of the categories the item is tagged with: it also belongs to their ancestors
+	Categories []string `json:"categories,omitempty" db:"-"`
+	// Components make the item a kit: kits have no stock of their own, and orders for them reserve their components
+	Components []KitComponent `json:"components,omitempty" db:"-"`
+	// Serialised items have a serial number for each unit in stock, which is tracked from when it is received
+	// until it is shipped (see SerialEvent). Stock added before the item was serialised has no serials.
+	Serialised bool `json:"serialised,omitempty" db:"serialised"`
+	// Status is empty for items created before statuses were introduced, which are active
+	Status CatalogItemStatus `json:"status,omitempty" db:"status"`
+	// Prices is the price list of the item: orders use the price in their currency effective when they are created
+	Prices []ItemPrice `json:"prices,omitempty" db:"-"`
+	// Revision is the revision of the item in the catalog bucket. Updates must carry the revision
+	// of the item they change, and fail if the item was changed in the meantime.
+	Revision uint64 `json:"revision,omitempty" db:"-"`
+}
+
+// KitComponent is a good contained in a kit, with its amount in a single kit. Kits cannot contain other kits.
+type KitComponent struct {
+	GoodId string `json:"good_id"`
+	Amount int    `json:"amount"`
+}
+
+// ItemUnit is an alternative unit of measure of a catalog item, worth Factor units of the base unit
+// (e.g. a "box" of 12 "pcs")
+type ItemUnit struct {
+	Unit   string `json:"unit"`
+	Factor int    `json:"factor"`
+}
+
+// CatalogItemVersion is a version of a catalog item, returned by `catalog.history`
+type CatalogItemVersion struct {
+	Revision  uint64    `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	// Deleted is set for the version that deleted the item, which has no Item
+	Deleted bool         `json:"deleted,omitempty"`
+	Item    *CatalogItem `json:"item,omitempty"`
 }
 
+// ItemPrice is the price of a catalog item in a currency, effective from EffectiveFrom (included)
+// until EffectiveTo (excluded), or forever if EffectiveTo is not set
+type ItemPrice struct {
+	// Currency is an ISO 4217 code, e.g. "EUR"
+	Currency string `json:"currency"`
+	// Amount is the price in minor units of the currency (e.g. cents)
+	Amount        int64      `json:"amount"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"`
+}
+
+// Dimensions are the sizes of a unit of a catalog item, in millimetres
+type Dimensions struct {
+	Length int `json:"length"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// CatalogViolation is a problem found while validating a catalog item
+type CatalogViolation struct {
+	// Field is the path of the invalid field in the request (e.g. "attributes.color"), if any
+	Field string `json:"field,omitempty"`
+	// Code identifies the kind of problem (e.g. "missing_name", "duplicate_sku")
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// CatalogItemStatus tells whether a catalog item can still be ordered
+type CatalogItemStatus string
+
+const (
+	CatalogItemActive CatalogItemStatus = "active"
+	// CatalogItemArchived items are kept for existing orders, but cannot be ordered anymore
+	CatalogItemArchived CatalogItemStatus = "archived"
+)
+
+// CreateCatalogItem is the request of `catalog.create`: the fields are the same of CatalogItem
 type CreateCatalogItem struct {
-	Name string `json:"name" required:"true"`
+	Name         string                     `json:"name"`
+	SKU          string                     `json:"sku"`
+	Description  string                     `json:"description,omitempty"`
+	Translations map[string]ItemTranslation `json:"translations,omitempty"`
+	Unit         string                     `json:"unit,omitempty"`
+	Units        []ItemUnit                 `json:"units,omitempty"`
+	Weight       int                        `json:"weight,omitempty"`
+	Dimensions   *Dimensions                `json:"dimensions,omitempty"`
+	Barcodes     []string                   `json:"barcodes,omitempty"`
+	Status       CatalogItemStatus          `json:"status,omitempty"`
+	Attributes   map[string]string          `json:"attributes,omitempty"`
+	Categories   []string                   `json:"categories,omitempty"`
+	Components   []KitComponent             `json:"components,omitempty"`
+	Serialised   bool                       `json:"serialised,omitempty"`
+	Prices       []ItemPrice                `json:"prices,omitempty"`
+}
+
+// SetCatalogPrices is the request of `catalog.prices.set`: it replaces the price list of an item
+type SetCatalogPrices struct {
+	Id     string      `json:"id"`
+	Prices []ItemPrice `json:"prices"`
+	// Revision is optional: if set, the prices are only replaced if the item still has this revision
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// SearchCatalog is the request of `catalog.search`. Every field is optional.
+type SearchCatalog struct {
+	// Query matches the items whose SKU or name start with it, and the items whose name, SKU, description
+	// or attribute values contain every word of it (as the start of a word)
+	Query string `json:"q,omitempty"`
+	// Attributes only matches the items with every given attribute set to the given value
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Status     CatalogItemStatus `json:"status,omitempty"`
+	// Category only matches the items in the category with this id, or in its subcategories
+	Category string `json:"category,omitempty"`
+	// Sort is one of "name", "-name", "sku", "-sku" and "relevance". The default is "relevance"
+	// when there is a query, and "name" otherwise.
+	Sort  string `json:"sort,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page, and must be used with the same query, filters, sort and languages
+	Cursor string `json:"cursor,omitempty"`
+	// Languages are the preferred locales of the names and descriptions of the items, see CatalogItem.Localised.
+	// Sorting by name uses the localised names.
+	Languages []string `json:"languages,omitempty"`
+}
+
+// CatalogPage is the response of `catalog.search`
+type CatalogPage struct {
+	Items []CatalogItem `json:"items"`
+	// Total is the number of items matching the search, in every page
+	Total int `json:"total"`
+	// NextCursor is set when there are more items, see SearchCatalog.Cursor
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// CatalogFormat is the format of catalog imports and exports
+type CatalogFormat string
+
+const (
+	// CatalogCSV has a header row, and a row for each item: attributes are in "attr.<name>" columns,
+	// translations in "name.<locale>" and "description.<locale>" columns, category ids are separated
+	// by semicolons, and prices are a JSON list in the "prices" column
+	CatalogCSV CatalogFormat = "csv"
+	// CatalogJSONLines has an item per line, with the same fields of CatalogItem
+	CatalogJSONLines CatalogFormat = "jsonl"
+)
+
+// ImportCatalog is the request of `catalog.import`. Rows are matched to the items with the same SKU,
+// which are updated with the fields (or columns) in the row, and new SKUs create new items.
+// Either every row is imported, or none is.
+type ImportCatalog struct {
+	Format CatalogFormat `json:"format"`
+	// DryRun checks the rows, and returns what would change, without changing anything
+	DryRun bool   `json:"dry_run,omitempty"`
+	Data   string `json:"data"`
+}
+
+// ImportCatalogResult is the response of `catalog.import`, which is sent as the details of the
+// error when some rows cannot be imported
+type ImportCatalogResult struct {
+	DryRun    bool             `json:"dry_run,omitempty"`
+	Created   int              `json:"created"`
+	Updated   int              `json:"updated"`
+	Unchanged int              `json:"unchanged"`
+	Errors    []ImportRowError `json:"errors,omitempty"`
+}
+
+// ImportRowError lists the problems found in a row of an import
+type ImportRowError struct {
+	// Line is the line of the row in the data, starting from 1 (the header, for CSV)
+	Line       int                `json:"line"`
+	SKU        string             `json:"sku,omitempty"`
+	Violations []CatalogViolation `json:"violations"`
+}
+
+// ExportCatalog is the request of `catalog.export`. The export is sent in chunks to the reply
+// subject, and an empty message ends it.
+type ExportCatalog struct {
+	Format CatalogFormat `json:"format"`
+}
+
+// Category is a node of the category tree. Catalog items can be tagged with any number of categories,
+// and belong to the ancestors of their categories too.
+type Category struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// ParentId is empty for root categories
+	ParentId string `json:"parent_id,omitempty"`
+	// Path is the name of every category from the root to this one. It is only set in responses.
+	Path []string `json:"path,omitempty"`
+}
+
+// CreateCategory is the request of `catalog.categories.create`
+type CreateCategory struct {
+	Name     string `json:"name"`
+	ParentId string `json:"parent_id,omitempty"`
+}
+
+// UpdateCategory is the request of `catalog.categories.update`: it renames a category, moves it (along with
+// its subcategories) under another parent, or both. Fields left out are not changed.
+type UpdateCategory struct {
+	Id   string  `json:"id"`
+	Name *string `json:"name,omitempty"`
+	// ParentId is the id of the new parent, or empty to move the category to the root
+	ParentId *string `json:"parent_id,omitempty"`
+}
+
+// GetCategory is the request of `catalog.categories.delete`, and of `catalog.categories.goods`
+// (where the id is optional, and selects a subtree)
+type GetCategory struct {
+	Id string `json:"id"`
+}
+
+// CategoryGoods is returned by `catalog.categories.goods`, and lists the goods in a category or in its subcategories
+type CategoryGoods struct {
+	Category Category `json:"category"`
+	Goods    []string `json:"goods"`
+}
+
+// CategoryStock is the stock of the goods in a category (or in its subcategories), by warehouse
+type CategoryStock struct {
+	Category Category       `json:"category"`
+	Stock    map[string]int `json:"stock"`
 }
 
 type GetCatalogItem struct {
 	Id string `json:"id"`
+	// Languages are the preferred locales of the name and description of the item, see CatalogItem.Localised
+	Languages []string `json:"languages,omitempty"`
+}
+
+// LookupCatalogItem is the request of `catalog.lookup`, which returns the item with the given barcode
+type LookupCatalogItem struct {
+	Barcode   string   `json:"barcode"`
+	Languages []string `json:"languages,omitempty"`
+}
+
+// DeleteCatalogItem is the request of `catalog.delete`
+type DeleteCatalogItem struct {
+	Id string `json:"id"`
+	// Force deletes the item even if there is stock of it, or open orders for it
+	Force bool `json:"force,omitempty"`
+}
+
+// ArchiveCatalogItem is the request of `catalog.archive` and `catalog.unarchive`
+type ArchiveCatalogItem struct {
+	Id string `json:"id"`
+	// Revision is optional: when set, the item is changed only if it still has this revision
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// CatalogEventType is the kind of change described by a CatalogEvent
+type CatalogEventType string
+
+const (
+	CatalogItemCreatedEvent CatalogEventType = "created"
+	// CatalogItemUpdatedEvent is sent for every change that is not described by another event type
+	CatalogItemUpdatedEvent    CatalogEventType = "updated"
+	CatalogItemArchivedEvent   CatalogEventType = "archived"
+	CatalogItemUnarchivedEvent CatalogEventType = "unarchived"
+	CatalogItemDeletedEvent    CatalogEventType = "deleted"
+)
+
+// CatalogEvent is published on `catalog.events.<type>` (in the catalog_events stream) for every change
+// of a catalog item
+type CatalogEvent struct {
+	Type CatalogEventType `json:"type"`
+	Id   string           `json:"id"`
+	// Before is the item before the change, and is not set for creations
+	Before *CatalogItem `json:"before,omitempty"`
+	// After is the item after the change, and is not set for deletions
+	After *CatalogItem `json:"after,omitempty"`
+	// Forced is set when the item was deleted even if it was still in use
+	Forced    bool      `json:"forced,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// GetGoodUsage is the request of `order.good_usage`
+type GetGoodUsage struct {
+	GoodId string `json:"good_id"`
+}
+
+// GoodUsage tells whether a good is still in use: catalog items in use cannot be deleted
+type GoodUsage struct {
+	GoodId string `json:"good_id"`
+	// Stock is the stock of the good, by warehouse. Warehouses without stock of the good are omitted.
+	Stock map[string]int `json:"stock"`
+	// OpenOrders are the orders with the good that have not been shipped, cancelled or failed yet
+	OpenOrders []uuid.UUID `json:"open_orders"`
+}
+
+// InUse returns whether there is stock of the good, or open orders for it
+func (u GoodUsage) InUse() bool {
+	return len(u.Stock) > 0 || len(u.OpenOrders) > 0
+}
+
+// GetKitAvailability is the request of `order.kit_availability`
+type GetKitAvailability struct {
+	GoodId string `json:"good_id"`
+}
+
+// KitAvailability is how many kits can be ordered with the stock of their components. A kit is available
+// when each of its components is, even if they are stocked in different warehouses.
+type KitAvailability struct {
+	GoodId    string `json:"good_id"`
+	Available int    `json:"available"`
+	// Warehouses is how many whole kits each warehouse can ship on its own. Warehouses that cannot ship a whole kit are omitted.
+	Warehouses map[string]int          `json:"warehouses"`
+	Components []ComponentAvailability `json:"components"`
+}
+
+// ComponentAvailability is the available stock of a component of a kit, across every warehouse
+type ComponentAvailability struct {
+	KitComponent
+	Stock int `json:"stock"`
 }
 
 type StockUpdate []StockUpdateItem
 
 type StockUpdateItem struct {
 	GoodId string `json:"good_id"`
-	Amount int    `json:"amount"`
+	// Barcode identifies the good in place of GoodId in `warehouse.add_stock` and `warehouse.adjust` requests.
+	// Stock updates always carry the GoodId.
+	Barcode string `json:"barcode,omitempty"`
+	Amount  int    `json:"amount"`
+	// Unit is a unit of measure of the good in `warehouse.add_stock` and `warehouse.adjust` requests,
+	// converted to the base unit of the good. Stock updates are always in the base unit.
+	Unit string `json:"unit,omitempty"`
+	// Serials are the serial numbers of the units of serialised goods added (or removed, by negative adjustments)
+	// in `warehouse.add_stock` and `warehouse.adjust` requests: there must be one for each unit, in the base unit.
+	// Requests with serials need an idempotency key.
+	Serials []string `json:"serials,omitempty"`
 }
 
 type Reservation struct {
@@ -42,16 +377,319 @@ type ReserveStockItem struct {
 	Amount int    `json:"amount"`
 }
 
+// ReleaseReservation asks a warehouse to release a reservation made with ReserveStock.
+// It is also the payload of the events that remove a reservation from the `reservations` stream.
+type ReleaseReservation struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// AdjustStock is the request of `warehouse.adjust`: it changes the stock of some goods by the given (signed) amounts
+type AdjustStock struct {
+	Items []StockUpdateItem `json:"items"`
+	// Reason explains the adjustment, e.g. the return that brought the goods back
+	Reason string `json:"reason"`
+}
+
 type CreateOrder struct {
-	Items []struct {
-		GoodId string `json:"good_id"`
-		Amount int    `json:"amount"`
-	} `json:"items"`
+	Items      []CreateOrderItem `json:"items"`
+	Allocation AllocationOptions `json:"allocation"`
+	// AllowPartial accepts the order even if there is not enough stock: what is missing becomes a backorder,
+	// which is allocated as soon as new stock arrives
+	AllowPartial bool `json:"allow_partial,omitempty"`
+	// CustomerId is the customer placing the order, if any
+	CustomerId *uuid.UUID `json:"customer_id,omitempty"`
+	// ShipTo is where the order is shipped: either an address of the customer, referenced by its id only,
+	// or a full address. Orders of a customer without ShipTo go to its first address.
+	ShipTo *Address `json:"ship_to,omitempty"`
+	// Currency of the prices of the order. It defaults to the currency configured in the order service
+	Currency string `json:"currency,omitempty"`
+	// ShipDate is when the order should be shipped. Orders shipping far enough in the future are scheduled:
+	// their stock is only reserved shortly before ShipDate
+	ShipDate *time.Time `json:"ship_date,omitempty"`
+	// Priority decides which order gets the stock when there is not enough for every order: higher is more important
+	Priority int `json:"priority,omitempty"`
+}
+
+// CreateOrderItem is a line of an order. Lines with the same good are merged
+type CreateOrderItem struct {
+	GoodId string `json:"good_id"`
+	Amount int    `json:"amount"`
+	// Unit is a unit of measure of the good: orders store the amount converted to its base unit
+	Unit string `json:"unit,omitempty"`
+}
+
+// OrderViolation is a problem found while validating an order
+type OrderViolation struct {
+	// Field is the path of the invalid field in the request (e.g. "items[1].amount"), if any
+	Field  string `json:"field,omitempty"`
+	GoodId string `json:"good_id,omitempty"`
+	// Code identifies the kind of problem (e.g. "unknown_good", "invalid_amount")
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AllocationOptions controls how an order is split among warehouses.
+// Every field is optional: missing values are taken from the order service configuration.
+type AllocationOptions struct {
+	// Strategy is the name of the allocation strategy (e.g. "fewest_warehouses", "home", "nearest", "balance", "priority")
+	Strategy string `json:"strategy,omitempty"`
+	// HomeWarehouse is the warehouse preferred by the "home" strategy
+	HomeWarehouse string `json:"home_warehouse,omitempty"`
+	// Destination is the delivery location used by the "nearest" strategy
+	Destination *Coordinates `json:"destination,omitempty"`
+	// Priority is the ordered list of warehouses used by the "priority" strategy
+	Priority []string `json:"priority,omitempty"`
+}
+
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// OrderQuote is the response to `order.quote`: the split that `order.create` would use, without any reservation
+type OrderQuote struct {
+	Strategy   string                `json:"strategy"`
+	Warehouses []OrderQuoteWarehouse `json:"warehouses"`
+	Missing    []OrderCreatedItem    `json:"missing"`
+	Pricing    *OrderPricing         `json:"pricing,omitempty"`
+	Kits       []OrderKitLine        `json:"kits,omitempty"`
 }
 
+// OrderPricing contains the prices of the lines of an order, taken when the lines were added, and its totals.
+// Every amount is in minor units of Currency.
+type OrderPricing struct {
+	Currency string            `json:"currency"`
+	Lines    []OrderPricedLine `json:"lines"`
+	Subtotal int64             `json:"subtotal"`
+	// TaxRate is in basis points, e.g. 2200 is 22%
+	TaxRate int   `json:"tax_rate"`
+	Tax     int64 `json:"tax"`
+	Total   int64 `json:"total"`
+}
+
+// OrderPricedLine is a line of an order with its price
+type OrderPricedLine struct {
+	GoodId    string `json:"good_id"`
+	Amount    int    `json:"amount"`
+	UnitPrice int64  `json:"unit_price"`
+	Total     int64  `json:"total"`
+}
+
+type OrderQuoteWarehouse struct {
+	WarehouseId string             `json:"warehouse_id"`
+	Parts       []OrderCreatedItem `json:"parts"`
+}
+
+// OrderStatus is the stage of the lifecycle an order is in
+type OrderStatus string
+
+const (
+	// OrderStatusScheduled orders are waiting for their ship date to come closer, before reserving their stock
+	OrderStatusScheduled  OrderStatus = "scheduled"
+	OrderStatusPending    OrderStatus = "pending"
+	OrderStatusReserved   OrderStatus = "reserved"
+	OrderStatusConfirmed  OrderStatus = "confirmed"
+	OrderStatusFulfilling OrderStatus = "fulfilling"
+	OrderStatusShipped    OrderStatus = "shipped"
+	OrderStatusDelivered  OrderStatus = "delivered"
+	OrderStatusCancelled  OrderStatus = "cancelled"
+	OrderStatusFailed     OrderStatus = "failed"
+)
+
+// BackorderStatus is the status of the part of an order that could not be allocated when it was created
+type BackorderStatus string
+
+const (
+	// BackorderOpen means that some goods are still waiting for new stock
+	BackorderOpen      BackorderStatus = "open"
+	BackorderFulfilled BackorderStatus = "fulfilled"
+	// BackorderCancelled means that the order was cancelled (or failed) before its backorder was allocated
+	BackorderCancelled BackorderStatus = "cancelled"
+)
+
+// OrderCreated is the payload of `orders.<id>.created`: the order has been accepted, and its stock is being reserved
 type OrderCreated struct {
+	ID    uuid.UUID          `json:"id"`
+	Items []OrderCreatedItem `json:"items"`
+	// Kits are the kit lines of the order, whose components are in Items
+	Kits []OrderKitLine `json:"kits,omitempty"`
+	// Backorder lists the goods that were not available, for orders that allow partial fulfillment
+	Backorder  []OrderCreatedItem `json:"backorder,omitempty"`
+	CustomerId *uuid.UUID         `json:"customer_id,omitempty"`
+	// ShipTo is a copy of the shipping address, taken when the order is created
+	ShipTo   *Address      `json:"ship_to,omitempty"`
+	Pricing  *OrderPricing `json:"pricing,omitempty"`
+	ShipDate *time.Time    `json:"ship_date,omitempty"`
+	Priority int           `json:"priority,omitempty"`
+	// Scheduled orders do not reserve their stock now, but when they are released
+	Scheduled bool `json:"scheduled,omitempty"`
+	// AllowPartial and Allocation are the options used to release a scheduled order
+	AllowPartial bool               `json:"allow_partial,omitempty"`
+	Allocation   *AllocationOptions `json:"allocation,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+}
+
+// OrderSoftReserved is the payload of `orders.<id>.soft_reserved`: stock is set aside for a scheduled order,
+// without reserving it in the warehouses. Orders with a higher priority can still take it.
+type OrderSoftReserved struct {
+	ID         uuid.UUID             `json:"id"`
+	Warehouses []OrderQuoteWarehouse `json:"warehouses"`
+}
+
+// OrderPreempted is the payload of `orders.<id>.preempted`: the soft reservation of a scheduled order was
+// taken by an order with a higher priority
+type OrderPreempted struct {
+	ID uuid.UUID `json:"id"`
+	By uuid.UUID `json:"by"`
+}
+
+// OrderReleased is the payload of `orders.<id>.released`: the stock of a scheduled order has been reserved,
+// and the order is confirmed. Warehouses commit the listed reservations, as for `orders.<id>.confirmed`
+type OrderReleased struct {
 	ID         uuid.UUID              `json:"id"`
 	Warehouses []OrderCreateWarehouse `json:"warehouses"`
+	// Backorder lists the goods that were not available, for orders that allow partial fulfillment
+	Backorder []OrderCreatedItem `json:"backorder,omitempty"`
+}
+
+// OrderReserved is the payload of `orders.<id>.reserved`: all the stock of the order has been reserved
+type OrderReserved struct {
+	ID         uuid.UUID              `json:"id"`
+	Warehouses []OrderCreateWarehouse `json:"warehouses"`
+}
+
+// OrderConfirmed is the payload of `orders.<id>.confirmed`: warehouses commit the listed reservations
+type OrderConfirmed struct {
+	ID         uuid.UUID              `json:"id"`
+	Warehouses []OrderCreateWarehouse `json:"warehouses"`
+}
+
+// OrderBackorderAllocated is the payload of `orders.<id>.backorder_allocated`: new stock has been reserved
+// for the backorder of the order, and warehouses commit the listed reservations
+type OrderBackorderAllocated struct {
+	ID         uuid.UUID              `json:"id"`
+	Warehouses []OrderCreateWarehouse `json:"warehouses"`
+	// Remaining lists the goods still missing: the backorder is fulfilled when it is empty
+	Remaining []OrderCreatedItem `json:"remaining"`
+}
+
+// OrderAmended is the payload of `orders.<id>.amended`: the lines of the order changed.
+// Warehouses commit the new reservations, and put back in stock the parts that are no longer needed.
+type OrderAmended struct {
+	ID     uuid.UUID          `json:"id"`
+	Before []OrderCreatedItem `json:"before"`
+	After  []OrderCreatedItem `json:"after"`
+	// Warehouses lists the reservations made for the goods that were added
+	Warehouses []OrderCreateWarehouse `json:"warehouses"`
+	// Restock lists the parts that were removed from the order
+	Restock []OrderCreateWarehouse `json:"restock"`
+	// Backorder lists the goods still waiting for new stock after the amendment
+	Backorder []OrderCreatedItem `json:"backorder"`
+	// Pricing is the pricing of the order after the amendment. Lines that were already in the order keep their price
+	Pricing *OrderPricing `json:"pricing,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+}
+
+// OrderStatusChanged is the payload of the events that only change the status of an order
+// (`orders.<id>.fulfilling`, `orders.<id>.shipped`, `orders.<id>.delivered`, `orders.<id>.failed`)
+type OrderStatusChanged struct {
+	ID     uuid.UUID   `json:"id"`
+	Status OrderStatus `json:"status"`
+	// WarehouseId is set when only the part of the order handled by that warehouse changed status (e.g. it was shipped)
+	WarehouseId string `json:"warehouse_id,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// OrderCancelled is the payload of `orders.<id>.cancelled`: warehouses release the listed
+// reservations, and put back in stock the listed parts
+type OrderCancelled struct {
+	ID     uuid.UUID `json:"id"`
+	Reason string    `json:"reason,omitempty"`
+	// Forced is true if the order was cancelled even though some of its parts had already been shipped
+	Forced bool `json:"forced"`
+	// Release lists the reservations that had not been committed yet
+	Release []OrderCreateWarehouse `json:"release"`
+	// Restock lists the parts that had already been removed from the stock, but were not shipped
+	Restock []OrderCreateWarehouse `json:"restock"`
+}
+
+// CancelOrder is the request of `order.cancel`
+type CancelOrder struct {
+	ID     uuid.UUID `json:"id"`
+	Reason string    `json:"reason,omitempty"`
+	// Force allows cancelling an order whose parts have already been shipped
+	Force bool `json:"force"`
+}
+
+// AmendOrder is the request of `order.amend`
+type AmendOrder struct {
+	ID uuid.UUID `json:"id"`
+	// Items contains the new amount of each changed good: goods not listed are left unchanged,
+	// and goods with amount 0 are removed from the order
+	Items  []OrderCreatedItem `json:"items"`
+	Reason string             `json:"reason,omitempty"`
+}
+
+// UpdateOrderStatus is the request of `order.update_status`
+type UpdateOrderStatus struct {
+	ID          uuid.UUID   `json:"id"`
+	Status      OrderStatus `json:"status"`
+	WarehouseId string      `json:"warehouse_id,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+}
+
+type GetOrder struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// ListOrders is the request of `order.list`. An empty Status returns orders in any status
+type ListOrders struct {
+	Status     OrderStatus `json:"status,omitempty"`
+	CustomerId *uuid.UUID  `json:"customer_id,omitempty"`
+}
+
+// Order is the current state of an order, as returned by `order.get` and `order.list`
+type Order struct {
+	ID     uuid.UUID          `json:"id"`
+	Status OrderStatus        `json:"status"`
+	Items  []OrderCreatedItem `json:"items"`
+	// Kits are the kit lines of the order, shown instead of their components: Items has the components
+	Kits       []OrderKitLine      `json:"kits,omitempty"`
+	Warehouses []OrderWarehouse    `json:"warehouses"`
+	History    []OrderHistoryEntry `json:"history"`
+	// Backorder lists the goods still waiting for new stock
+	Backorder       []OrderCreatedItem `json:"backorder,omitempty"`
+	BackorderStatus BackorderStatus    `json:"backorder_status,omitempty"`
+	Amendments      []OrderAmendment   `json:"amendments,omitempty"`
+	CustomerId      *uuid.UUID         `json:"customer_id,omitempty"`
+	ShipTo          *Address           `json:"ship_to,omitempty"`
+	Pricing         *OrderPricing      `json:"pricing,omitempty"`
+	ShipDate        *time.Time         `json:"ship_date,omitempty"`
+	Priority        int                `json:"priority,omitempty"`
+	// SoftReservation is the stock set aside for a scheduled order
+	SoftReservation []OrderQuoteWarehouse `json:"soft_reservation,omitempty"`
+	CreatedAt       time.Time             `json:"created_at"`
+	UpdatedAt       time.Time             `json:"updated_at"`
+}
+
+// OrderAmendment records how the lines of an order were changed by `order.amend`
+type OrderAmendment struct {
+	Before []OrderCreatedItem `json:"before"`
+	After  []OrderCreatedItem `json:"after"`
+	Reason string             `json:"reason,omitempty"`
+	At     time.Time          `json:"at"`
+}
+
+// OrderWarehouse is the part of an order handled by a single warehouse
+type OrderWarehouse struct {
+	OrderCreateWarehouse
+	Shipped bool `json:"shipped"`
+}
+
+type OrderHistoryEntry struct {
+	Status OrderStatus `json:"status"`
+	Reason string      `json:"reason,omitempty"`
+	At     time.Time   `json:"at"`
 }
 
 type OrderCreateWarehouse struct {
@@ -64,3 +702,162 @@ type OrderCreatedItem struct {
 	GoodId string `json:"good_id"`
 	Amount int    `json:"amount"`
 }
+
+// OrderKitLine is a kit ordered as a single line, with the components of a single kit when it was ordered
+type OrderKitLine struct {
+	GoodId     string         `json:"good_id"`
+	Amount     int            `json:"amount"`
+	Components []KitComponent `json:"components"`
+}
+
+// ReturnStatus is the stage of the lifecycle a return (RMA) is in
+type ReturnStatus string
+
+const (
+	// ReturnStatusOpen means that the return was authorized, and the goods are on their way back
+	ReturnStatusOpen ReturnStatus = "open"
+	// ReturnStatusReceived means that the goods arrived at a warehouse, and are waiting to be inspected
+	ReturnStatusReceived  ReturnStatus = "received"
+	ReturnStatusInspected ReturnStatus = "inspected"
+)
+
+// OpenReturn is the request of `return.open`: it authorizes returning some goods of a line of a shipped order
+type OpenReturn struct {
+	OrderId uuid.UUID `json:"order_id"`
+	GoodId  string    `json:"good_id"`
+	Amount  int       `json:"amount"`
+	Reason  string    `json:"reason,omitempty"`
+	// Serials are required for serialised goods: the serial numbers of the returned units, shipped with the order
+	Serials []string `json:"serials,omitempty"`
+}
+
+// ReceiveReturn is the request of `return.receive`
+type ReceiveReturn struct {
+	ID          uuid.UUID `json:"id"`
+	WarehouseId string    `json:"warehouse_id"`
+}
+
+// InspectReturn is the request of `return.inspect`: every returned good is either resellable or damaged
+type InspectReturn struct {
+	ID         uuid.UUID `json:"id"`
+	Resellable int       `json:"resellable"`
+	Damaged    int       `json:"damaged"`
+	// Serials are the serial numbers of the resellable units, for returns of serialised goods
+	Serials []string `json:"serials,omitempty"`
+}
+
+type GetReturn struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// ListReturns is the request of `return.list`. An empty OrderId returns the returns of every order
+type ListReturns struct {
+	OrderId uuid.UUID `json:"order_id,omitempty"`
+}
+
+// ReturnOpened is the payload of `returns.<id>.opened`
+type ReturnOpened struct {
+	ID        uuid.UUID `json:"id"`
+	OrderId   uuid.UUID `json:"order_id"`
+	GoodId    string    `json:"good_id"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason,omitempty"`
+	Serials   []string  `json:"serials,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReturnReceived is the payload of `returns.<id>.received`
+type ReturnReceived struct {
+	ID          uuid.UUID `json:"id"`
+	WarehouseId string    `json:"warehouse_id"`
+}
+
+// ReturnInspected is the payload of `returns.<id>.inspected`: resellable goods have been put back in stock
+type ReturnInspected struct {
+	ID         uuid.UUID `json:"id"`
+	Resellable int       `json:"resellable"`
+	Damaged    int       `json:"damaged"`
+	// Serials are the serial numbers of the resellable units, for returns of serialised goods
+	Serials []string `json:"serials,omitempty"`
+}
+
+// Return is the current state of a return, as returned by `return.get` and `return.list`
+type Return struct {
+	ID      uuid.UUID    `json:"id"`
+	OrderId uuid.UUID    `json:"order_id"`
+	GoodId  string       `json:"good_id"`
+	Amount  int          `json:"amount"`
+	Reason  string       `json:"reason,omitempty"`
+	Status  ReturnStatus `json:"status"`
+	// Serials are the serial numbers of the returned units of serialised goods
+	Serials []string `json:"serials,omitempty"`
+	// WarehouseId is the warehouse that received the goods
+	WarehouseId string `json:"warehouse_id,omitempty"`
+	Resellable  int    `json:"resellable"`
+	Damaged     int    `json:"damaged"`
+	// ResellableSerials are the serial numbers of the resellable units, put back in stock
+	ResellableSerials []string  `json:"resellable_serials,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// Customer is a customer, as stored in the `customers` KV bucket
+type Customer struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Email string    `json:"email,omitempty"`
+	Phone string    `json:"phone,omitempty"`
+	// Addresses are the shipping addresses of the customer: the first one is used when an order has no ship_to
+	Addresses []Address `json:"addresses"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Address is a shipping address
+type Address struct {
+	// ID identifies the address among the ones of its customer
+	ID uuid.UUID `json:"id"`
+	// Label is a name chosen by the customer, e.g. "home" or "office"
+	Label      string `json:"label,omitempty"`
+	Recipient  string `json:"recipient,omitempty"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"`
+	// Coordinates are used as the destination of the "nearest" allocation strategy
+	Coordinates *Coordinates `json:"coordinates,omitempty"`
+}
+
+// CreateCustomer is the request of `customer.create`
+type CreateCustomer struct {
+	Name      string    `json:"name"`
+	Email     string    `json:"email,omitempty"`
+	Phone     string    `json:"phone,omitempty"`
+	Addresses []Address `json:"addresses,omitempty"`
+}
+
+// UpdateCustomer is the request of `customer.update`: it replaces the contact info of the customer
+type UpdateCustomer struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Email string    `json:"email,omitempty"`
+	Phone string    `json:"phone,omitempty"`
+}
+
+// GetCustomer is the request of `customer.get` and `customer.delete`
+type GetCustomer struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// AddAddress is the request of `customer.address.add`
+type AddAddress struct {
+	CustomerId uuid.UUID `json:"customer_id"`
+	Address    Address   `json:"address"`
+}
+
+// RemoveAddress is the request of `customer.address.remove`
+type RemoveAddress struct {
+	CustomerId uuid.UUID `json:"customer_id"`
+	AddressId  uuid.UUID `json:"address_id"`
+}
@@ -0,0 +1,75 @@
+package messages
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// serialRegex matches valid serial numbers, which are also valid tokens of NATS subjects
+var serialRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// ValidSerial returns whether serial is a valid serial number: at most 64 letters, digits, dashes and underscores
+func ValidSerial(serial string) bool {
+	return serialRegex.MatchString(serial)
+}
+
+// SerialEventType is what happened to a serial number, see SerialEvent
+type SerialEventType string
+
+const (
+	// SerialReceived serials entered the stock of a warehouse for the first time
+	SerialReceived SerialEventType = "received"
+	// SerialMoved serials entered the stock of a warehouse after being removed from another one
+	SerialMoved SerialEventType = "moved"
+	// SerialReserved serials were assigned to a reservation
+	SerialReserved SerialEventType = "reserved"
+	// SerialReleased serials were freed by a released or expired reservation
+	SerialReleased SerialEventType = "released"
+	// SerialShipped serials left the warehouse with an order
+	SerialShipped SerialEventType = "shipped"
+	// SerialRestocked serials went back to the stock after being shipped
+	SerialRestocked SerialEventType = "restocked"
+	// SerialReturned serials were received back from the customer with a return, and wait to be inspected
+	SerialReturned SerialEventType = "returned"
+	// SerialRemoved serials were taken out of the stock by an adjustment
+	SerialRemoved SerialEventType = "removed"
+)
+
+// InStock returns whether a serial is in the stock of its warehouse (either available or reserved) after an event of type t
+func (t SerialEventType) InStock() bool {
+	switch t {
+	case SerialReceived, SerialMoved, SerialReserved, SerialReleased, SerialRestocked:
+		return true
+	default:
+		return false
+	}
+}
+
+// SerialEvent is an event in the history of a serial number of a serialised good,
+// published on the `serials` stream as `serials.<good id>.<serial>`.
+//
+// Serials are shipped when the reservation holding them is committed for an order, and restocked when
+// the order is cancelled or amended before being shipped, or when a return is inspected as resellable.
+type SerialEvent struct {
+	Serial      string          `json:"serial"`
+	GoodId      string          `json:"good_id"`
+	Type        SerialEventType `json:"type"`
+	WarehouseId string          `json:"warehouse_id"`
+	// FromWarehouseId is the warehouse serials were moved from
+	FromWarehouseId string     `json:"from_warehouse_id,omitempty"`
+	ReservationId   *uuid.UUID `json:"reservation_id,omitempty"`
+	OrderId         *uuid.UUID `json:"order_id,omitempty"`
+	ReturnId        *uuid.UUID `json:"return_id,omitempty"`
+	// Reason explains adjustments, as given in AdjustStock
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TraceSerial is the request of `serial.trace`: it returns every SerialEvent of a serial number, oldest first.
+// Serials are unique for each good: without GoodId, the history of the serial for every good is returned.
+type TraceSerial struct {
+	Serial string `json:"serial"`
+	GoodId string `json:"good_id,omitempty"`
+}
@@ -0,0 +1,66 @@
+package messages
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+var (
+	// ErrUnknownUnit is returned when converting amounts in a unit the catalog item does not declare
+	ErrUnknownUnit = errors.New("unknown unit of measure")
+	// ErrFractionalAmount is returned when an amount in base units is not a whole number of the requested unit
+	ErrFractionalAmount = errors.New("amount is not a whole number of the unit of measure")
+	// ErrAmountTooLarge is returned when an amount converted to base units does not fit an int
+	ErrAmountTooLarge = errors.New("amount too large")
+)
+
+// UnitFactor returns how many base units are in one unit of the item. The base unit (and an empty unit,
+// which stands for it) has factor 1; units the item does not declare have none.
+func (item CatalogItem) UnitFactor(unit string) (int, bool) {
+	unit = strings.ToLower(strings.TrimSpace(unit))
+	if unit == "" || unit == item.Unit {
+		return 1, true
+	}
+	for _, u := range item.Units {
+		if u.Unit == unit {
+			return u.Factor, true
+		}
+	}
+	return 0, false
+}
+
+// ToBaseUnits converts a (signed) amount in the given unit of the item to its base unit
+func (item CatalogItem) ToBaseUnits(amount int, unit string) (int, error) {
+	factor, ok := item.UnitFactor(unit)
+	if !ok {
+		return 0, ErrUnknownUnit
+	}
+	if factor > 1 && (amount > math.MaxInt/factor || amount < math.MinInt/factor) {
+		return 0, ErrAmountTooLarge
+	}
+	return amount * factor, nil
+}
+
+// FromBaseUnits converts a (signed) amount in the base unit of the item to the given unit.
+// Conversions are exact: amounts that are not a whole number of the unit fail with ErrFractionalAmount.
+func (item CatalogItem) FromBaseUnits(amount int, unit string) (int, error) {
+	factor, ok := item.UnitFactor(unit)
+	if !ok {
+		return 0, ErrUnknownUnit
+	}
+	if amount%factor != 0 {
+		return 0, ErrFractionalAmount
+	}
+	return amount / factor, nil
+}
+
+// GoodStock is the stock of a good in every warehouse, in a unit of measure of the good (see `GET /stock/goods/:goodId`)
+type GoodStock struct {
+	GoodId string `json:"good_id"`
+	// Name is the name of the good, localised in the languages of the request
+	Name       string         `json:"name"`
+	Unit       string         `json:"unit"`
+	Total      int            `json:"total"`
+	Warehouses map[string]int `json:"warehouses"`
+}
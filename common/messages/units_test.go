@@ -0,0 +1,37 @@
+package messages
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitConversion(t *testing.T) {
+	item := CatalogItem{Unit: "pcs", Units: []ItemUnit{{Unit: "box", Factor: 12}, {Unit: "pallet", Factor: 480}}}
+
+	amount, err := item.ToBaseUnits(3, "box")
+	require.NoError(t, err)
+	require.Equal(t, 36, amount)
+	amount, err = item.ToBaseUnits(-2, " Pallet")
+	require.NoError(t, err)
+	require.Equal(t, -960, amount)
+	amount, err = item.ToBaseUnits(7, "")
+	require.NoError(t, err)
+	require.Equal(t, 7, amount)
+	_, err = item.ToBaseUnits(1, "crate")
+	require.ErrorIs(t, err, ErrUnknownUnit)
+	_, err = item.ToBaseUnits(math.MaxInt/2, "box")
+	require.ErrorIs(t, err, ErrAmountTooLarge)
+
+	amount, err = item.FromBaseUnits(36, "box")
+	require.NoError(t, err)
+	require.Equal(t, 3, amount)
+	amount, err = item.FromBaseUnits(0, "pallet")
+	require.NoError(t, err)
+	require.Equal(t, 0, amount)
+	_, err = item.FromBaseUnits(30, "box")
+	require.ErrorIs(t, err, ErrFractionalAmount)
+	_, err = item.FromBaseUnits(30, "crate")
+	require.ErrorIs(t, err, ErrUnknownUnit)
+}
@@ -1,7 +1,9 @@
 package natsutil
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
 
 	"github.com/nats-io/nats.go"
 )
@@ -15,16 +17,127 @@ var (
 	InvalidRequest    = Description{"invalid_request", "Failed to deserialize request body"}
 	NatsError         = Description{"internal_error", "Failed to publish data to NATS"}
 	InsufficientStock = Description{"insufficient_stock", "Not enough stock to fulfill order"}
+	InvalidAllocation = Description{"invalid_request", "Invalid allocation options"}
+	ReservationFailed = Description{"reservation_failed", "Warehouses refused to reserve the stock for the order"}
 	CatalogIdNotFound = Description{"not_found", "Failed to find catalog item with given id"}
+	InvalidPrices     = Description{"invalid_request", "Prices need an ISO 4217 currency, a non-negative amount, and must end after they start"}
+	OrderNotFound     = Description{"not_found", "Failed to find order with given id"}
+	InvalidStatus     = Description{"invalid_request", "Status cannot be set manually"}
+	InvalidTransition = Description{"invalid_transition", "Order cannot move to the requested status"}
+	OrderShipped      = Description{"order_shipped", "Order has already been (partially) shipped, use force to cancel it"}
+	OrderNotAmendable = Description{"invalid_transition", "Only confirmed orders that are not being fulfilled can be amended"}
+	// OrderHasKits is sent by order.amend for orders with kits, whose lines are the components of the kits
+	OrderHasKits = Description{"invalid_request", "Orders with kits cannot be amended, cancel them and order again"}
+	EmptyOrder   = Description{"invalid_request", "An order must contain at least one item, cancel it instead"}
+	// OrderChanged is sent when the order was modified by another request while being amended
+	OrderChanged            = Description{"conflict", "Order was modified concurrently, retry the request"}
+	ReturnNotFound          = Description{"not_found", "Failed to find return with given id"}
+	ReturnExceedsShipped    = Description{"invalid_request", "Returned amount exceeds the shipped amount not yet returned"}
+	ReturnInvalidTransition = Description{"invalid_transition", "Return is not in the right status for this operation"}
+	InvalidInspection       = Description{"invalid_request", "Resellable and damaged goods must add up to the returned amount"}
+	UnknownWarehouse        = Description{"invalid_request", "Unknown warehouse"}
+	AdjustmentFailed        = Description{"internal_error", "Failed to adjust the stock of the warehouse"}
+	CustomerNotFound        = Description{"not_found", "Failed to find customer with given id"}
+	AddressNotFound         = Description{"not_found", "Failed to find address with given id"}
+	InvalidCustomer         = Description{"invalid_request", "Customers need a name, and addresses need line1, city and country"}
+	// CustomerChanged is sent when the customer was modified by another request while being updated
+	CustomerChanged = Description{"conflict", "Customer was modified concurrently, retry the request"}
+	// InvalidOrder is sent with the list of every problem found in the order
+	InvalidOrder = Description{"invalid_request", "Order validation failed"}
+	// InvalidCatalogItem is sent with the list of every problem found in the catalog item
+	InvalidCatalogItem = Description{"invalid_request", "Catalog item validation failed"}
+	InvalidSearch      = Description{"invalid_request", "Invalid sort, limit or cursor"}
+	// CatalogItemChanged is sent when the item was modified after the revision carried by the update
+	CatalogItemChanged = Description{"conflict", "Catalog item was modified after the given revision, fetch it and retry"}
+	MissingRevision    = Description{"invalid_request", "Updates must carry the revision of the item they change"}
+	// InvalidImport is sent by catalog.import, along with the problems found in each row
+	InvalidImport = Description{"invalid_request", "Catalog import failed, no item was changed"}
+	// CatalogItemInUse is sent by catalog.delete, along with the usage of the item, when it cannot be deleted
+	CatalogItemInUse = Description{"conflict", "Catalog item has stock or open orders: archive it, or use force to delete it"}
+	// InvalidBarcode is sent by catalog.lookup for codes that are not GTINs, which cannot belong to any item
+	InvalidBarcode  = Description{"invalid_request", "Barcodes must be GTIN-8, UPC-A, EAN-13 or GTIN-14 codes with a valid check digit"}
+	BarcodeNotFound = Description{"not_found", "Failed to find catalog item with given barcode"}
+	// UnknownUnit is sent, along with the offending lines, for amounts in units of measure their goods do not have
+	UnknownUnit = Description{"invalid_request", "Unit of measure not declared by the catalog item"}
+	// InvalidSerials is sent, along with the offending items, when the serial numbers of items do not match their goods
+	InvalidSerials = Description{"invalid_request", "Serialised goods need a distinct, valid serial number for each unit, and other goods none"}
+	// SerialInStock and SerialUnavailable are sent, along with the offending serial numbers, when stock cannot be
+	// added or removed because of where the serials are
+	SerialInStock     = Description{"conflict", "Serial numbers are already in stock"}
+	SerialUnavailable = Description{"conflict", "Serial numbers are not available in the stock of the warehouse"}
+	SerialNotFound    = Description{"not_found", "Failed to find serial number"}
+	// SerialsNeedIdempotencyKey is sent when stock is added or removed with serial numbers, but without an idempotency key
+	SerialsNeedIdempotencyKey = Description{"invalid_request", "Stock with serial numbers can only be added or removed with an idempotency key, so that it can be retried"}
+
+	// KitComponentInUse is sent by catalog.delete, along with the ids of the kits, when the item is a component of kits
+	KitComponentInUse = Description{"conflict", "Catalog item is a component of kits: remove it from them first"}
+	// KitNotFound is sent by order.kit_availability when the good is not a kit in the catalog
+	KitNotFound      = Description{"not_found", "Failed to find a kit with the given id"}
+	CategoryNotFound = Description{"not_found", "Category not found"}
+	InvalidCategory  = Description{"invalid_request", "Categories need a name of at most 100 characters, and an existing parent"}
+	// CategoryCycle is sent when moving a category under itself, or under one of its subcategories
+	CategoryCycle     = Description{"invalid_request", "A category cannot be moved under itself or its subcategories"}
+	DuplicateCategory = Description{"conflict", "Another category with the same parent has the same name"}
+	CategoryNotEmpty  = Description{"conflict", "Category has subcategories or items: move or untag them first"}
+	// CatalogIndexLoading is sent by catalog.search while the search index is being loaded
+	CatalogIndexLoading = Description{"unavailable", "Catalog search index is still loading, retry shortly"}
+	// OrderCancelledDuringCreation is sent by order.create when the order is cancelled before its stock is reserved
+	OrderCancelledDuringCreation = Description{"order_cancelled", "Order was cancelled while being created"}
+	// OrderFailed is sent, along with the order id, by order.create when retrying the creation of an order that failed
+	OrderFailed = Description{"order_failed", "Order was created, but failed: see its history for the reason"}
+	// IdempotencyKeyReused is sent when an idempotency key is sent again along with a different request
+	IdempotencyKeyReused = Description{"conflict", "The idempotency key was already used for a different request"}
+	// RequestInProgress is sent when a request with the same idempotency key is still being handled
+	RequestInProgress = Description{"request_in_progress", "A request with the same idempotency key is still being processed"}
 	MarshalError      = Description{"internal_error", "Failed to serialize response body"}
 	SendResponseError = Description{"internal_error", "Failed to send response data"}
 	QueryError        = Description{"internal_error", "Failed to query database"}
 	KvError           = Description{"internal_error", "Failed to query KV"}
 )
 
+// ErrorResponse returns the body of the error response sent by Respond
+func ErrorResponse(err Description) []byte {
+	return []byte(fmt.Sprintf("%s: %s", err.code, err.description))
+}
+
 func Respond(request *nats.Msg, err Description) {
-	_ = request.Respond([]byte(fmt.Sprintf("%s: %s", err.code, err.description)))
+	_ = request.Respond(ErrorResponse(err))
 	if err == SendResponseError || err == QueryError {
 		_ = request.Nak()
 	}
 }
+
+// ErrorResponseWithDetails returns the body of an error response carrying details about the error
+// (e.g. every problem found in a request), serialized as JSON on the line after the description
+func ErrorResponseWithDetails(err Description, details any) []byte {
+	body, marshalErr := json.Marshal(details)
+	if marshalErr != nil {
+		return ErrorResponse(err)
+	}
+	return append(append(ErrorResponse(err), '\n'), body...)
+}
+
+// RespondWithDetails is like Respond, but includes the given details in the response
+func RespondWithDetails(request *nats.Msg, err Description, details any) {
+	_ = request.Respond(ErrorResponseWithDetails(err, details))
+}
+
+var errorResponse = regexp.MustCompile(`(?s)^([a-z][a-z_]*): ([^\n]*)(?:\n(.*))?$`)
+
+// ParseError checks whether data is an error response sent by Respond, and if so returns its code and description
+func ParseError(data []byte) (code string, description string, ok bool) {
+	code, description, _, ok = ParseErrorDetails(data)
+	return code, description, ok
+}
+
+// ParseErrorDetails is like ParseError, but also returns the details sent by RespondWithDetails (if any)
+func ParseErrorDetails(data []byte) (code string, description string, details json.RawMessage, ok bool) {
+	m := errorResponse.FindSubmatch(data)
+	if m == nil {
+		return "", "", nil, false
+	}
+	if len(m[3]) > 0 && json.Valid(m[3]) {
+		details = m[3]
+	}
+	return string(m[1]), string(m[2]), details, true
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// LastSerialEvent returns the last event of a serial number of a good, along with its stream sequence,
+// or nil if the serial has no events
+func LastSerialEvent(ctx context.Context, js jetstream.JetStream, goodId, serial string) (*messages.SerialEvent, uint64, error) {
+	stream, err := js.Stream(ctx, SerialsStreamConfig.Name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get serials stream: %w", err)
+	}
+	msg, err := stream.GetLastMsgForSubject(ctx, SerialSubject(goodId, serial))
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get last event of serial %s: %w", serial, err)
+	}
+
+	var event messages.SerialEvent
+	if err = json.Unmarshal(msg.Data, &event); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal serial event: %w", err)
+	}
+	return &event, msg.Sequence, nil
+}
+
+// SerialHistory returns the events of a serial number, oldest first: those of the given good, or of any good
+// if goodId is empty
+func SerialHistory(ctx context.Context, js jetstream.JetStream, goodId, serial string) ([]messages.SerialEvent, error) {
+	stream, err := js.Stream(ctx, SerialsStreamConfig.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get serials stream: %w", err)
+	}
+	if goodId == "" {
+		goodId = "*"
+	}
+
+	events := make([]messages.SerialEvent, 0)
+	for seq := uint64(1); ; {
+		// the server returns the first message with the subject starting from seq
+		msg, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(SerialSubject(goodId, serial)))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get event of serial %s: %w", serial, err)
+		}
+
+		var event messages.SerialEvent
+		if err = json.Unmarshal(msg.Data, &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal serial event: %w", err)
+		}
+		events = append(events, event)
+		seq = msg.Sequence + 1
+	}
+}
+
+// PublishSerialEvent publishes an event of a serial number, and returns its stream sequence
+func PublishSerialEvent(ctx context.Context, js jetstream.JetStream, event messages.SerialEvent, opts ...jetstream.PublishOpt) (uint64, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal serial event: %w", err)
+	}
+	ack, err := js.Publish(ctx, SerialSubject(event.GoodId, event.Serial), body, opts...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish serial event: %w", err)
+	}
+	return ack.Sequence, nil
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerialHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	nc := NewInProcessNATSServer(t)
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	require.NoError(t, CreateStream(ctx, js, SerialsStreamConfig))
+
+	event, seq, err := LastSerialEvent(ctx, js, "phone", "SN-1")
+	require.NoError(t, err)
+	require.Nil(t, event)
+	require.Zero(t, seq)
+
+	received := messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialReceived, WarehouseId: "41"}
+	first, err := PublishSerialEvent(ctx, js, received, jetstream.WithExpectLastSequencePerSubject(0))
+	require.NoError(t, err)
+	_, err = PublishSerialEvent(ctx, js, received, jetstream.WithExpectLastSequencePerSubject(0))
+	require.Error(t, err, "the serial already has an event")
+
+	_, err = PublishSerialEvent(ctx, js, messages.SerialEvent{Serial: "SN-2", GoodId: "phone", Type: messages.SerialReceived, WarehouseId: "41"})
+	require.NoError(t, err)
+	_, err = PublishSerialEvent(ctx, js, messages.SerialEvent{Serial: "SN-1", GoodId: "tablet", Type: messages.SerialReceived, WarehouseId: "42"})
+	require.NoError(t, err)
+	last, err := PublishSerialEvent(ctx, js, messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialRemoved, WarehouseId: "41"},
+		jetstream.WithExpectLastSequencePerSubject(first))
+	require.NoError(t, err)
+
+	event, seq, err = LastSerialEvent(ctx, js, "phone", "SN-1")
+	require.NoError(t, err)
+	require.Equal(t, messages.SerialRemoved, event.Type)
+	require.Equal(t, last, seq)
+
+	history, err := SerialHistory(ctx, js, "phone", "SN-1")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, messages.SerialReceived, history[0].Type)
+	require.Equal(t, messages.SerialRemoved, history[1].Type)
+
+	history, err = SerialHistory(ctx, js, "", "SN-1")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, "tablet", history[1].GoodId)
+
+	history, err = SerialHistory(ctx, js, "", "SN-3")
+	require.NoError(t, err)
+	require.Empty(t, history)
+}
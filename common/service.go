@@ -92,7 +92,8 @@ func (s *Service[S]) RegisterJsHandler(subject string, handler JsHandler[S], opt
 		opt(&cfg)
 	}
 
-	consumer, err := s.JetStream().CreateConsumer(s.ctx, subject, cfg)
+	// durable consumers are updated if they already exist, so that their configuration can change between versions
+	consumer, err := s.JetStream().CreateOrUpdateConsumer(s.ctx, subject, cfg)
 	if err != nil {
 		slog.ErrorContext(s.ctx, "Failed to create consumer", "subject", subject, "error", err, "consumerConfig", cfg)
 		panic(err)
@@ -188,6 +189,21 @@ func WithDeliverAll() JsHandlerOpt {
 	}
 }
 
+// WithDurable will make the consumer durable with the given name, so that it resumes from where it stopped
+func WithDurable(name string) JsHandlerOpt {
+	return func(config *jetstream.ConsumerConfig) {
+		config.Durable = name
+	}
+}
+
+// WithStartSequence will make the consumer start delivering from the given stream sequence
+func WithStartSequence(seq uint64) JsHandlerOpt {
+	return func(config *jetstream.ConsumerConfig) {
+		config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		config.OptStartSeq = seq
+	}
+}
+
 // WithSubjectFilter will filter the delivered messages to those specified. Mutually exclusive with WithSubjectsFilter
 func WithSubjectFilter(subject string) JsHandlerOpt {
 	return func(config *jetstream.ConsumerConfig) {
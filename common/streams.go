@@ -3,15 +3,45 @@ package common
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/nats-io/nats.go/jetstream"
 )
 
 var CatalogKeyValueConfig = jetstream.KeyValueConfig{
-	Bucket:  "catalog",
+	Bucket: "catalog",
+	// the previous versions of items are returned by `catalog.history`
+	History: jetstream.KeyValueMaxHistory,
 	Storage: jetstream.FileStorage,
 }
 
+// CategoriesKeyValueConfig is the bucket where the catalog service projects the category tree, keyed by category id
+var CategoriesKeyValueConfig = jetstream.KeyValueConfig{
+	Bucket:  "catalog_categories",
+	Storage: jetstream.FileStorage,
+}
+
+// CustomersKeyValueConfig is the bucket where the customer service stores customers, keyed by their id
+var CustomersKeyValueConfig = jetstream.KeyValueConfig{
+	Bucket:  "customers",
+	Storage: jetstream.FileStorage,
+}
+
+// OrderSagasKeyValueConfig is the bucket where the order service persists the progress of its sagas
+var OrderSagasKeyValueConfig = jetstream.KeyValueConfig{
+	Bucket:  "order_sagas",
+	Storage: jetstream.FileStorage,
+	TTL:     24 * time.Hour,
+}
+
+// IdempotencyKeyValueConfig is the bucket where the responses to requests carrying an idempotency key are
+// remembered: retries within the TTL get the original response
+var IdempotencyKeyValueConfig = jetstream.KeyValueConfig{
+	Bucket:  "idempotency",
+	Storage: jetstream.FileStorage,
+	TTL:     24 * time.Hour,
+}
+
 var ReservationStreamConfig = jetstream.StreamConfig{
 	Name:     "reservations",
 	Subjects: []string{"reservations.>"},
@@ -30,6 +60,37 @@ var OrdersStreamConfig = jetstream.StreamConfig{
 	Storage:  jetstream.FileStorage,
 }
 
+// ReturnsStreamConfig is the stream of the events of returns (RMAs), published as `returns.<id>.<event>`
+var ReturnsStreamConfig = jetstream.StreamConfig{
+	Name:     "returns",
+	Subjects: []string{"returns.>"},
+	Storage:  jetstream.FileStorage,
+}
+
+// CatalogEventsStreamConfig is the stream of the changes of catalog items, published as `catalog.events.<type>`
+// (see messages.CatalogEvent). Consumers falling behind by more than MaxAge resync from the catalog bucket.
+var CatalogEventsStreamConfig = jetstream.StreamConfig{
+	Name:     "catalog_events",
+	Subjects: []string{"catalog.events.>"},
+	Storage:  jetstream.FileStorage,
+	MaxAge:   30 * 24 * time.Hour,
+	// publishes retried after a failure are dropped
+	Duplicates: 10 * time.Minute,
+}
+
+// SerialsStreamConfig is the stream of the history of the serial numbers of serialised goods, published as
+// `serials.<good id>.<serial>` (see messages.SerialEvent), so that the last event of each serial tells where it is
+var SerialsStreamConfig = jetstream.StreamConfig{
+	Name:     "serials",
+	Subjects: []string{"serials.>"},
+	Storage:  jetstream.FileStorage,
+}
+
+// SerialSubject returns the subject of the events of a serial number of a good
+func SerialSubject(goodId, serial string) string {
+	return fmt.Sprintf("serials.%s.%s", goodId, serial)
+}
+
 func CreateStream(ctx context.Context, js jetstream.JetStream, cfg jetstream.StreamConfig) error {
 	_, err := js.CreateStream(ctx, cfg)
 	if err != nil {
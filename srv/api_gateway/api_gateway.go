@@ -2,22 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/alimitedgroup/PoC/common"
-	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
 	"github.com/gin-gonic/gin"
 	"github.com/nats-io/nats.go"
-	"github.com/nats-io/nats.go/jetstream"
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
 type ApiGatewayState struct {
-	stock     *xsync.MapOf[string, *xsync.MapOf[string, int]]
-	orders    *xsync.MapOf[string, messages.OrderCreated]
-	catalogKV jetstream.KeyValue
+	stock *xsync.MapOf[string, *xsync.MapOf[string, int]]
 }
 
 func main() {
@@ -32,41 +32,119 @@ func main() {
 	}
 
 	svc := common.NewService(ctx, nc, ApiGatewayState{
-		stock:  xsync.NewMapOf[string, *xsync.MapOf[string, int]](),
-		orders: xsync.NewMapOf[string, messages.OrderCreated](),
+		stock: xsync.NewMapOf[string, *xsync.MapOf[string, int]](),
 	})
 
 	if common.CreateStream(ctx, svc.JetStream(), common.StockUpdatesStreamConfig) != nil {
 		slog.ErrorContext(ctx, "Failed to create stream", "stream", common.StockUpdatesStreamConfig.Name)
 		return
 	}
-	if common.CreateStream(ctx, svc.JetStream(), common.OrdersStreamConfig) != nil {
-		slog.ErrorContext(ctx, "Failed to create stream", "stream", common.OrdersStreamConfig.Name)
-		return
-	}
-
-	kv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.CatalogKeyValueConfig)
-	if err != nil {
-		slog.ErrorContext(ctx, "Failed to create key-value store", "error", err)
-		return
-	}
-	svc.State().catalogKV = kv
 
 	svc.RegisterJsHandler("stock_updates", StockUpdateHandler)
-	svc.RegisterJsHandler("orders", OrderCreateHandler)
 
 	r := gin.Default()
 	r.GET("/ping", PingHandler)
 	r.GET("/catalog", CatalogHandler(svc))
 	r.POST("/catalog", CatalogCreateHandler(svc))
+	r.POST("/catalog/import", CatalogImportRoute(svc))
+	r.GET("/catalog/export", CatalogExportRoute(svc))
+	r.GET("/catalog/lookup", CatalogLookupRoute(svc))
+	r.GET("/catalog/:catalogId", CatalogGetRoute(svc))
+	r.PUT("/catalog/:catalogId", CatalogPutRoute(svc))
+	r.DELETE("/catalog/:catalogId", CatalogDeleteRoute(svc))
+	r.POST("/catalog/:catalogId/archive", CatalogStatusRoute(svc, "catalog.archive"))
+	r.POST("/catalog/:catalogId/unarchive", CatalogStatusRoute(svc, "catalog.unarchive"))
+	r.PUT("/catalog/:catalogId/prices", CatalogPricesPutRoute(svc))
+	r.GET("/catalog/:catalogId/history", CatalogHistoryRoute(svc))
+	r.GET("/categories", CategoryListRoute(svc))
+	r.POST("/categories", CategoryPostRoute(svc))
+	r.PATCH("/categories/:categoryId", CategoryPatchRoute(svc))
+	r.DELETE("/categories/:categoryId", CategoryDeleteRoute(svc))
 	r.GET("/warehouses", WarehouseListRoute(svc))
+	r.GET("/stock/categories", StockByCategoryRoute(svc))
+	r.GET("/stock/kits/:kitId", KitStockRoute(svc))
+	r.GET("/stock/goods/:goodId", GoodStockRoute(svc))
 	r.GET("/stock/:warehouseId", StockGetRoute(svc))
 	r.POST("/stock/:warehouseId", StockPostRoute(svc))
+	r.GET("/serials/:serial", SerialTraceRoute(svc))
 	r.GET("/orders", OrderListRoute(svc))
 	r.GET("/orders/:orderId", OrderGetRoute(svc))
 	r.POST("/orders", OrderPostRoute(svc))
+	r.POST("/orders/quote", OrderQuoteRoute(svc))
+	r.POST("/orders/:orderId/status", OrderStatusRoute(svc))
+	r.PATCH("/orders/:orderId", OrderAmendRoute(svc))
+	r.DELETE("/orders/:orderId", OrderDeleteRoute(svc))
+	r.GET("/orders/:orderId/returns", OrderReturnsRoute(svc))
+	r.GET("/returns", ReturnListRoute(svc))
+	r.GET("/returns/:returnId", ReturnGetRoute(svc))
+	r.POST("/returns", ReturnPostRoute(svc))
+	r.POST("/returns/:returnId/receive", ReturnReceiveRoute(svc))
+	r.POST("/returns/:returnId/inspect", ReturnInspectRoute(svc))
+	r.GET("/customers", CustomerListRoute(svc))
+	r.GET("/customers/:customerId", CustomerGetRoute(svc))
+	r.POST("/customers", CustomerPostRoute(svc))
+	r.PUT("/customers/:customerId", CustomerPutRoute(svc))
+	r.DELETE("/customers/:customerId", CustomerDeleteRoute(svc))
+	r.POST("/customers/:customerId/addresses", CustomerAddressPostRoute(svc))
+	r.DELETE("/customers/:customerId/addresses/:addressId", CustomerAddressDeleteRoute(svc))
+	r.GET("/customers/:customerId/orders", CustomerOrdersRoute(svc))
 	err = r.Run(":8080")
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// statusForCode maps the error codes used by natsutil.Respond to HTTP status codes
+var statusForCode = map[string]int{
+	"invalid_request":    http.StatusBadRequest,
+	"not_found":          http.StatusNotFound,
+	"insufficient_stock": http.StatusConflict,
+	"reservation_failed": http.StatusConflict,
+	"invalid_transition": http.StatusConflict,
+	"order_shipped":      http.StatusConflict,
+	"order_cancelled":    http.StatusConflict,
+	"order_failed":       http.StatusConflict,
+	"conflict":           http.StatusConflict,
+	// a request with the same Idempotency-Key is still running: the client should retry later
+	"request_in_progress": http.StatusConflict,
+	"unavailable":         http.StatusServiceUnavailable,
+}
+
+// RespondNats writes a NATS response to the HTTP client: JSON payloads are passed through as-is,
+// error responses are mapped to the matching HTTP status (along with their details, if any),
+// and anything else is wrapped in a JSON object.
+func RespondNats(c *gin.Context, r *nats.Msg) {
+	if code, description, details, ok := natsutil.ParseErrorDetails(r.Data); ok {
+		status, found := statusForCode[code]
+		if !found {
+			status = http.StatusInternalServerError
+		}
+		body := map[string]any{"error": code, "description": description}
+		if details != nil {
+			body["details"] = details
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	if json.Valid(r.Data) {
+		c.Data(http.StatusOK, "application/json", r.Data)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]any{"response": string(r.Data)})
+}
+
+// IdempotencyKeyHeader is the HTTP header clients use to make a request safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RequestIdempotent sends a NATS request, forwarding the idempotency key of the HTTP request (if any),
+// so that the service returns the original response when the request is retried
+func RequestIdempotent(s *common.Service[ApiGatewayState], c *gin.Context, subject string, body []byte, timeout time.Duration) (*nats.Msg, error) {
+	msg := nats.NewMsg(subject)
+	msg.Data = body
+	if key := c.GetHeader(IdempotencyKeyHeader); key != "" {
+		msg.Header.Set(common.IdempotencyHeader, key)
+	}
+	return s.NatsConn().RequestMsg(msg, timeout)
+}
@@ -1,56 +1,63 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
 	"github.com/gin-gonic/gin"
-	"github.com/nats-io/nats.go/jetstream"
 )
 
 func PingHandler(c *gin.Context) {
 	c.JSON(200, gin.H{})
 }
 
+// acceptLanguages returns the locales of the Accept-Language header of the request, by preference.
+// The response varies with them.
+func acceptLanguages(c *gin.Context) []string {
+	c.Header("Vary", "Accept-Language")
+	return messages.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+}
+
+// CatalogHandler searches the catalog: every query parameter is optional, and attribute filters
+// are passed as `attr=name:value`, see messages.SearchCatalog. Items are localised as in Accept-Language.
 func CatalogHandler(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		state := s.State()
-		watcher, err := state.catalogKV.WatchAll(c, jetstream.IgnoreDeletes())
-		if err != nil {
-			slog.ErrorContext(context.Background(), "Failed to watch kv bucket", "bucket", "catalog", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
-			return
+		req := messages.SearchCatalog{
+			Query:     c.Query("q"),
+			Status:    messages.CatalogItemStatus(c.Query("status")),
+			Category:  c.Query("category"),
+			Sort:      c.Query("sort"),
+			Cursor:    c.Query("cursor"),
+			Languages: acceptLanguages(c),
 		}
-
-		out := make(map[string]string)
-		for i := range watcher.Updates() {
-			if i == nil {
-				if err := watcher.Stop(); err != nil {
-					slog.ErrorContext(context.Background(), "Failed to stop kv watcher", "bucket", "catalog", "error", err)
-				}
-				break
-			}
-
-			var row struct {
-				Id   string `json:"id"`
-				Name string `json:"name"`
-			}
-			err := json.Unmarshal(i.Value(), &row)
+		if limit := c.Query("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
 			if err != nil {
-				slog.ErrorContext(context.Background(), "Failed to unmarshal kv payload", "bucket", "catalog", "error", err, "data", string(i.Value()))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+				c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid limit"})
 				return
 			}
-
-			out[row.Id] = row.Name
+			req.Limit = n
 		}
-
-		c.JSON(http.StatusOK, out)
+		for _, attr := range c.QueryArray("attr") {
+			name, value, ok := strings.Cut(attr, ":")
+			if !ok {
+				c.JSON(http.StatusBadRequest, map[string]string{"error": "attribute filters must be name:value"})
+				return
+			}
+			if req.Attributes == nil {
+				req.Attributes = make(map[string]string)
+			}
+			req.Attributes[name] = value
+		}
+		requestJSON(s, c, "catalog.search", req)
 	}
 }
 
@@ -71,6 +78,219 @@ func CatalogCreateHandler(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, map[string]any{"response": string(r.Data)})
+		RespondNats(c, r)
+	}
+}
+
+// CatalogPutRoute replaces a catalog item with the one in the request body. The revision of the item
+// being replaced is taken from the body, or from the If-Match header.
+func CatalogPutRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var item messages.CatalogItem
+		if err := c.ShouldBindJSON(&item); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		item.Id = c.Param("catalogId")
+		if item.Revision == 0 {
+			revision, ok := ifMatchRevision(c)
+			if !ok {
+				return
+			}
+			item.Revision = revision
+		}
+		requestJSON(s, c, "catalog.update", item)
+	}
+}
+
+// ifMatchRevision returns the revision in the If-Match header, or 0 if there is none.
+// If the header is not a revision, it responds with an error and returns false.
+func ifMatchRevision(c *gin.Context) (uint64, bool) {
+	ifMatch := strings.Trim(c.GetHeader("If-Match"), `"`)
+	if ifMatch == "" {
+		return 0, true
+	}
+	revision, err := strconv.ParseUint(ifMatch, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]string{"error": "If-Match must be the revision of the item"})
+		return 0, false
+	}
+	return revision, true
+}
+
+// CatalogDeleteRoute deletes a catalog item. Items with stock or open orders are only deleted with force=true.
+func CatalogDeleteRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "catalog.delete", messages.DeleteCatalogItem{
+			Id:    c.Param("catalogId"),
+			Force: c.Query("force") == "true",
+		})
+	}
+}
+
+// CatalogStatusRoute returns the route that archives or unarchives (depending on subject) a catalog item.
+// If-Match makes the change conditional on the revision of the item.
+func CatalogStatusRoute(s *common.Service[ApiGatewayState], subject string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revision, ok := ifMatchRevision(c)
+		if !ok {
+			return
+		}
+		requestJSON(s, c, subject, messages.ArchiveCatalogItem{Id: c.Param("catalogId"), Revision: revision})
+	}
+}
+
+// CatalogHistoryRoute returns the previous versions of a catalog item
+func CatalogHistoryRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "catalog.history", messages.GetCatalogItem{Id: c.Param("catalogId")})
+	}
+}
+
+// CatalogGetRoute returns a catalog item, localised as in Accept-Language
+func CatalogGetRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "catalog.get", messages.GetCatalogItem{Id: c.Param("catalogId"), Languages: acceptLanguages(c)})
+	}
+}
+
+// CatalogLookupRoute returns the catalog item with the barcode given in the query, e.g. a scanned EAN-13,
+// localised as in Accept-Language
+func CatalogLookupRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "catalog.lookup", messages.LookupCatalogItem{Barcode: c.Query("barcode"), Languages: acceptLanguages(c)})
+	}
+}
+
+// CatalogPricesPutRoute replaces the price list of a catalog item
+func CatalogPricesPutRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var prices []messages.ItemPrice
+		if err := c.ShouldBindJSON(&prices); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		requestJSON(s, c, "catalog.prices.set", messages.SetCatalogPrices{Id: c.Param("catalogId"), Prices: prices})
+	}
+}
+
+const (
+	// catalogImportTimeout is how long imports can take: they are checked and stored in a single transaction
+	catalogImportTimeout = 30 * time.Second
+	// catalogExportTimeout is how long the gateway waits for each chunk of an export
+	catalogExportTimeout = 5 * time.Second
+)
+
+// contentTypes are the content types of the catalog import and export formats
+var contentTypes = map[messages.CatalogFormat]string{
+	messages.CatalogCSV:       "text/csv",
+	messages.CatalogJSONLines: "application/jsonl",
+}
+
+// catalogFormat returns the format in the format query parameter, or the one of the given content type
+func catalogFormat(c *gin.Context, contentType string) (messages.CatalogFormat, bool) {
+	if format := messages.CatalogFormat(c.Query("format")); format != "" {
+		_, ok := contentTypes[format]
+		return format, ok
+	}
+	switch contentType {
+	case "text/csv":
+		return messages.CatalogCSV, true
+	case "application/jsonl", "application/x-ndjson":
+		return messages.CatalogJSONLines, true
+	}
+	return "", false
+}
+
+// CatalogImportRoute imports the catalog items in the request body, see messages.ImportCatalog.
+// The format is taken from the format query parameter, or from the Content-Type header.
+func CatalogImportRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, ok := catalogFormat(c, c.ContentType())
+		if !ok {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv or jsonl"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		req, err := json.Marshal(messages.ImportCatalog{Format: format, DryRun: c.Query("dry_run") == "true", Data: string(body)})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if len(req) > int(s.NatsConn().MaxPayload()) {
+			c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "the import is too large, split it in smaller ones"})
+			return
+		}
+
+		r, err := s.NatsConn().Request("catalog.import", req, catalogImportTimeout)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
+}
+
+// CatalogExportRoute streams the whole catalog, in the format of the format query parameter (csv by default)
+func CatalogExportRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, ok := catalogFormat(c, "text/csv")
+		if !ok {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv or jsonl"})
+			return
+		}
+		req, err := json.Marshal(messages.ExportCatalog{Format: format})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		inbox := s.NatsConn().NewRespInbox()
+		sub, err := s.NatsConn().SubscribeSync(inbox)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer func() { _ = sub.Unsubscribe() }()
+		if err = s.NatsConn().PublishRequest("catalog.export", inbox, req); err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		first := true
+		for {
+			msg, err := sub.NextMsg(catalogExportTimeout)
+			if err != nil {
+				if first {
+					c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				} else {
+					// the status was already sent, so the export can only be cut short
+					_ = c.Error(err)
+				}
+				return
+			}
+			if first {
+				if _, _, ok := natsutil.ParseError(msg.Data); ok {
+					RespondNats(c, msg)
+					return
+				}
+				c.Header("Content-Type", contentTypes[format])
+				c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="catalog.%s"`, format))
+				c.Status(http.StatusOK)
+				first = false
+			}
+			if len(msg.Data) == 0 {
+				return
+			}
+			if _, err = c.Writer.Write(msg.Data); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
 	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/gin-gonic/gin"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+func CategoryListRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "catalog.categories.list", struct{}{})
+	}
+}
+
+func CategoryPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req messages.CreateCategory
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		requestJSON(s, c, "catalog.categories.create", req)
+	}
+}
+
+// CategoryPatchRoute renames a category, or moves it (along with its subcategories) under another parent:
+// `"parent_id": ""` moves it to the root
+func CategoryPatchRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req messages.UpdateCategory
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.Id = c.Param("categoryId")
+		requestJSON(s, c, "catalog.categories.update", req)
+	}
+}
+
+func CategoryDeleteRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "catalog.categories.delete", messages.GetCategory{Id: c.Param("categoryId")})
+	}
+}
+
+// StockByCategoryRoute returns the stock of each category by warehouse, counting the goods of its subcategories too.
+// The category query parameter restricts the report to the subtree of a category.
+func StockByCategoryRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := json.Marshal(messages.GetCategory{Id: c.Query("category")})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("catalog.categories.goods", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, _, ok := natsutil.ParseError(r.Data); ok {
+			RespondNats(c, r)
+			return
+		}
+
+		var categories []messages.CategoryGoods
+		if err = json.Unmarshal(r.Data, &categories); err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		report := make([]messages.CategoryStock, 0, len(categories))
+		for _, category := range categories {
+			stock := make(map[string]int)
+			for _, goodId := range category.Goods {
+				s.State().stock.Range(func(warehouseId string, goods *xsync.MapOf[string, int]) bool {
+					if amount, ok := goods.Load(goodId); ok && amount > 0 {
+						stock[warehouseId] += amount
+					}
+					return true
+				})
+			}
+			report = append(report, messages.CategoryStock{Category: category.Category, Stock: stock})
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// customerParam parses the customer id in the path, responding with 404 if it is not valid
+func customerParam(c *gin.Context) (uuid.UUID, bool) {
+	id, err := uuid.Parse(c.Param("customerId"))
+	if err != nil {
+		c.String(404, "Not Found")
+		return id, false
+	}
+	return id, true
+}
+
+func CustomerListRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, err := s.NatsConn().Request("customer.list", nil, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
+}
+
+func CustomerGetRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, ok := customerParam(c); ok {
+			requestJSON(s, c, "customer.get", messages.GetCustomer{ID: id})
+		}
+	}
+}
+
+func CustomerPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("customer.create", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
+}
+
+// CustomerPutRoute replaces the contact info of a customer
+func CustomerPutRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := customerParam(c)
+		if !ok {
+			return
+		}
+
+		var req messages.UpdateCustomer
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.ID = id
+		requestJSON(s, c, "customer.update", req)
+	}
+}
+
+func CustomerDeleteRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, ok := customerParam(c); ok {
+			requestJSON(s, c, "customer.delete", messages.GetCustomer{ID: id})
+		}
+	}
+}
+
+func CustomerAddressPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := customerParam(c)
+		if !ok {
+			return
+		}
+
+		var address messages.Address
+		if err := c.ShouldBindJSON(&address); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		requestJSON(s, c, "customer.address.add", messages.AddAddress{CustomerId: id, Address: address})
+	}
+}
+
+func CustomerAddressDeleteRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := customerParam(c)
+		if !ok {
+			return
+		}
+
+		addressId, err := uuid.Parse(c.Param("addressId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+		requestJSON(s, c, "customer.address.remove", messages.RemoveAddress{CustomerId: id, AddressId: addressId})
+	}
+}
+
+// CustomerOrdersRoute lists the orders of a single customer, optionally filtered by status
+func CustomerOrdersRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, ok := customerParam(c); ok {
+			requestJSON(s, c, "order.list", messages.ListOrders{
+				Status:     messages.OrderStatus(c.Query("status")),
+				CustomerId: &id,
+			})
+		}
+	}
+}
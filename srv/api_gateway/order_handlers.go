@@ -1,56 +1,119 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/alimitedgroup/PoC/common/messages"
 	"github.com/gin-gonic/gin"
-	"github.com/nats-io/nats.go/jetstream"
+	"github.com/google/uuid"
 )
 
-func OrderCreateHandler(_ context.Context, s *common.Service[ApiGatewayState], msg jetstream.Msg) error {
-	slog.Info("Order create Handler", "subject", msg.Subject())
-
-	var req messages.OrderCreated
-	err := json.Unmarshal(msg.Data(), &req)
-	if err != nil {
-		err = fmt.Errorf("failed to unmarshal order created: %w", err)
-		err2 := msg.TermWithReason(fmt.Sprintf("Failed to unmarshal order created: %v", err))
-		if err2 != nil {
-			return fmt.Errorf(
-				"while handling %w, another error happened: %w",
-				err,
-				fmt.Errorf("failed to term message: %w", err2),
-			)
-		}
-		return err
+func OrderGetRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("orderId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+
+		body, err := json.Marshal(messages.GetOrder{ID: id})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("order.get", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
 	}
+}
+
+// OrderCreateTimeout is how long to wait for order.create. It must cover the worst case of the order service,
+// which may try reserving the stock up to 3 times, with a deadline of 3 seconds each, and then release it.
+const OrderCreateTimeout = 15 * time.Second
 
-	s.State().orders.Store(req.ID.String(), req)
+func OrderPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
 
-	return nil
+		r, err := RequestIdempotent(s, c, "order.create", body, OrderCreateTimeout)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
 }
 
-func OrderGetRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+func OrderListRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := messages.ListOrders{Status: messages.OrderStatus(c.Query("status"))}
+		if customerId := c.Query("customer_id"); customerId != "" {
+			id, err := uuid.Parse(customerId)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			req.CustomerId = &id
+		}
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("order.list", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
+}
+
+func OrderStatusRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		order, ok := s.State().orders.Load(c.Param("orderId"))
-		if !ok {
+		id, err := uuid.Parse(c.Param("orderId"))
+		if err != nil {
 			c.String(404, "Not Found")
 			return
 		}
 
-		c.JSON(http.StatusOK, order)
+		var req messages.UpdateOrderStatus
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.ID = id
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("order.update_status", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
 	}
 }
 
-func OrderPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+func OrderQuoteRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
@@ -59,7 +122,7 @@ func OrderPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 		}
 
 		r, err := s.NatsConn().Request(
-			"order.create",
+			"order.quote",
 			body,
 			time.Second*2,
 		)
@@ -67,17 +130,64 @@ func OrderPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, map[string]any{"response": string(r.Data)})
+		RespondNats(c, r)
 	}
 }
 
-func OrderListRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+func OrderDeleteRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		keys := []string{}
-		s.State().orders.Range(func(key string, _ messages.OrderCreated) bool {
-			keys = append(keys, key)
-			return true
+		id, err := uuid.Parse(c.Param("orderId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+
+		body, err := json.Marshal(messages.CancelOrder{
+			ID:     id,
+			Reason: c.Query("reason"),
+			Force:  c.Query("force") == "true",
 		})
-		c.JSON(http.StatusOK, keys)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("order.cancel", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
+}
+
+func OrderAmendRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("orderId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+
+		var req messages.AmendOrder
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.ID = id
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		// amending may reserve stock, so it can take as long as creating an order
+		r, err := s.NatsConn().Request("order.amend", body, OrderCreateTimeout)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
 	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requestJSON sends req to subject as JSON, and writes the response to the HTTP client
+func requestJSON(s *common.Service[ApiGatewayState], c *gin.Context, subject string, req any) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	r, err := s.NatsConn().Request(subject, body, time.Second*2)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	RespondNats(c, r)
+}
+
+func ReturnListRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req messages.ListReturns
+		if orderId := c.Query("order_id"); orderId != "" {
+			id, err := uuid.Parse(orderId)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			req.OrderId = id
+		}
+		requestJSON(s, c, "return.list", req)
+	}
+}
+
+// OrderReturnsRoute lists the returns of a single order
+func OrderReturnsRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("orderId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+		requestJSON(s, c, "return.list", messages.ListReturns{OrderId: id})
+	}
+}
+
+func ReturnGetRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("returnId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+		requestJSON(s, c, "return.get", messages.GetReturn{ID: id})
+	}
+}
+
+func ReturnPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("return.open", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		RespondNats(c, r)
+	}
+}
+
+func ReturnReceiveRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("returnId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+
+		var req messages.ReceiveReturn
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.ID = id
+		requestJSON(s, c, "return.receive", req)
+	}
+}
+
+func ReturnInspectRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("returnId"))
+		if err != nil {
+			c.String(404, "Not Found")
+			return
+		}
+
+		var req messages.InspectReturn
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.ID = id
+		requestJSON(s, c, "return.inspect", req)
+	}
+}
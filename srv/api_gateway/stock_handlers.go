@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
 	"github.com/gin-gonic/gin"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/puzpuzpuz/xsync/v3"
@@ -89,16 +91,12 @@ func StockPostRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 			return
 		}
 
-		r, err := s.NatsConn().Request(
-			fmt.Sprintf("warehouse.add_stock.%s", warehouseId),
-			body,
-			time.Second*2,
-		)
+		r, err := RequestIdempotent(s, c, fmt.Sprintf("warehouse.add_stock.%s", warehouseId), body, time.Second*2)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, map[string]any{"response": string(r.Data)})
+		RespondNats(c, r)
 	}
 }
 
@@ -112,3 +110,86 @@ func WarehouseListRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
 		c.JSON(http.StatusOK, keys)
 	}
 }
+
+// KitStockRoute returns how many kits can be ordered with the stock of their components
+func KitStockRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "order.kit_availability", messages.GetKitAvailability{GoodId: c.Param("kitId")})
+	}
+}
+
+// GoodStockRoute returns the stock of a good in every warehouse, in the unit of measure given by the unit
+// query parameter (the base unit of the good by default). Stock that is not a whole number of the unit is refused,
+// along with the stock in the base unit. The name of the good is localised as in Accept-Language.
+func GoodStockRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := json.Marshal(messages.GetCatalogItem{Id: c.Param("goodId"), Languages: acceptLanguages(c)})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		r, err := s.NatsConn().Request("catalog.get", body, time.Second*2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, _, ok := natsutil.ParseError(r.Data); ok {
+			RespondNats(c, r)
+			return
+		}
+
+		var item messages.CatalogItem
+		if err = json.Unmarshal(r.Data, &item); err != nil {
+			c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		base := messages.GoodStock{GoodId: item.Id, Name: item.Name, Unit: item.Unit, Warehouses: make(map[string]int)}
+		s.State().stock.Range(func(warehouseId string, goods *xsync.MapOf[string, int]) bool {
+			if amount, ok := goods.Load(item.Id); ok {
+				base.Warehouses[warehouseId] = amount
+				base.Total += amount
+			}
+			return true
+		})
+
+		unit := c.DefaultQuery("unit", item.Unit)
+		res, err := goodStockIn(item, base, unit)
+		switch {
+		case errors.Is(err, messages.ErrUnknownUnit):
+			c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid_request", "description": fmt.Sprintf("%q is not a unit of measure of the good", unit)})
+		case errors.Is(err, messages.ErrFractionalAmount):
+			c.JSON(http.StatusBadRequest, map[string]any{
+				"error":       "fractional_amount",
+				"description": fmt.Sprintf("the stock is not a whole number of %s", unit),
+				"details":     base,
+			})
+		default:
+			c.JSON(http.StatusOK, res)
+		}
+	}
+}
+
+// goodStockIn converts stock in the base unit of item to the given unit, failing if any amount is not a whole number of it
+func goodStockIn(item messages.CatalogItem, base messages.GoodStock, unit string) (messages.GoodStock, error) {
+	res := messages.GoodStock{GoodId: base.GoodId, Name: base.Name, Unit: strings.ToLower(strings.TrimSpace(unit)), Warehouses: make(map[string]int, len(base.Warehouses))}
+	var err error
+	if res.Total, err = item.FromBaseUnits(base.Total, unit); err != nil {
+		return res, err
+	}
+	for warehouseId, amount := range base.Warehouses {
+		if res.Warehouses[warehouseId], err = item.FromBaseUnits(amount, unit); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// SerialTraceRoute returns the history of a serial number, optionally restricted to the good given by
+// the good_id query parameter
+func SerialTraceRoute(s *common.Service[ApiGatewayState]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestJSON(s, c, "serial.trace", messages.TraceSerial{Serial: c.Param("serial"), GoodId: c.Query("good_id")})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const maxBarcodes = 10
+
+// validGTIN returns whether code is a GTIN-8, UPC-A (GTIN-12), EAN-13 or GTIN-14 code with a valid check digit
+func validGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+
+	// digits are weighted 3 and 1 alternately, starting with 3 from the one before the check digit
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		d := code[i]
+		if d < '0' || d > '9' {
+			return false
+		}
+		if i == len(code)-1 {
+			continue
+		}
+		weight := 1
+		if (len(code)-1-i)%2 == 1 {
+			weight = 3
+		}
+		sum += int(d-'0') * weight
+	}
+	return (10-sum%10)%10 == int(code[len(code)-1]-'0')
+}
+
+// gtin14 returns a valid GTIN as a GTIN-14: the same product has the same GTIN-14,
+// whether it is written as a UPC-A or as an EAN-13
+func gtin14(code string) string {
+	return strings.Repeat("0", 14-len(code)) + code
+}
+
+// itemGTINs returns the barcodes of a valid item as GTIN-14s, as stored in the database
+func itemGTINs(item messages.CatalogItem) []string {
+	gtins := make([]string, 0, len(item.Barcodes))
+	for _, code := range item.Barcodes {
+		gtins = append(gtins, gtin14(code))
+	}
+	return gtins
+}
+
+// itemBarcodes returns the barcodes of item, as passed to the database
+func itemBarcodes(item messages.CatalogItem) []string {
+	if item.Barcodes == nil {
+		return []string{}
+	}
+	return item.Barcodes
+}
+
+// barcodeViolations returns a violation for each barcode of a valid item that belongs to another item.
+// Concurrent changes are caught by the primary key of catalog_item_barcodes, see isDuplicateBarcode.
+func barcodeViolations(ctx context.Context, db querier, item messages.CatalogItem) ([]messages.CatalogViolation, error) {
+	if len(item.Barcodes) == 0 {
+		return nil, nil
+	}
+	rows, err := db.Query(ctx, "select barcode from catalog_item_barcodes where gtin = any($1) and item_id <> $2::uuid order by barcode",
+		itemGTINs(item), item.Id)
+	if err != nil {
+		return nil, err
+	}
+	taken, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	violations := make([]messages.CatalogViolation, 0, len(taken))
+	for _, code := range taken {
+		violations = append(violations, violation("barcodes", "duplicate_barcode", fmt.Sprintf("another item has the barcode %s", code)))
+	}
+	return violations, nil
+}
+
+// validBarcodes returns a violationsError if the barcodes of a valid item belong to other items, like validItem
+func validBarcodes(ctx context.Context, db querier, item messages.CatalogItem) error {
+	violations, err := barcodeViolations(ctx, db, item)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return violationsError(violations)
+	}
+	return nil
+}
+
+// isDuplicateBarcode returns whether err was caused by storing an item with the barcode of another one
+func isDuplicateBarcode(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23505 is unique_violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "catalog_item_barcodes_pkey"
+}
+
+// lookupBarcode returns the id of the item with the given barcode, or an empty string if there is none
+func lookupBarcode(ctx context.Context, db querier, code string) (string, error) {
+	var id string
+	err := db.QueryRow(ctx, "select item_id::text from catalog_item_barcodes where gtin = $1", gtin14(code)).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
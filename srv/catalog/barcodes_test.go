@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidGTIN(t *testing.T) {
+	for _, code := range []string{"96385074", "036000291452", "4006381333931", "10036000291459"} {
+		require.True(t, validGTIN(code), code)
+	}
+	for _, code := range []string{"", "4006381333932", "400638133393", "400638133393a", "123456789"} {
+		require.False(t, validGTIN(code), code)
+	}
+
+	require.Equal(t, "00036000291452", gtin14("036000291452"))
+	require.Equal(t, gtin14("036000291452"), gtin14("0036000291452"))
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// MaxImportRows is the largest number of rows of a `catalog.import`
+	MaxImportRows = 10000
+	// exportChunkSize is the size of the chunks `catalog.export` is sent in, well below the NATS payload limit
+	exportChunkSize = 64 * 1024
+	// attributeColumnPrefix is the prefix of the CSV columns of attributes, e.g. "attr.color"
+	attributeColumnPrefix = "attr."
+)
+
+// translationColumnFields are the fields of translations, whose CSV columns are followed by the locale, e.g. "name.it"
+var translationColumnFields = []string{"name", "description"}
+
+var errInvalidFormat = errors.New("invalid format")
+
+// csvColumns are the columns of CSV exports, which are followed by a column for each attribute, and two for each locale.
+// The id is only exported for reference: imports match items by SKU.
+var csvColumns = []string{"id", "sku", "name", "description", "unit", "units", "weight", "length", "width", "height", "barcodes", "status", "categories", "components", "serialised", "prices"}
+
+var dimensionColumns = []string{"length", "width", "height"}
+
+// importFields are the fields of CatalogItem that can be imported, by JSON name
+var importFields = []string{"name", "sku", "description", "translations", "unit", "units", "weight", "dimensions", "barcodes", "status", "attributes", "categories", "components", "serialised", "prices"}
+
+// importRow is a row of an import, which sets the fields it contains in the item with its SKU
+type importRow struct {
+	line int
+	item messages.CatalogItem
+	// fields are the fields set by the row. "attributes.<name>" sets a single attribute, removing it if empty,
+	// and "translations.<locale>.<name|description>" a single field of a translation.
+	fields map[string]bool
+}
+
+// translationColumn returns the locale and the field of the CSV column of a translation, e.g. "description.de-ch"
+func translationColumn(column string) (string, string, bool) {
+	for _, field := range translationColumnFields {
+		if locale, ok := strings.CutPrefix(column, field+"."); ok {
+			return messages.NormalizeLocale(locale), field, true
+		}
+	}
+	return "", "", false
+}
+
+// apply returns item, with the fields of the row set
+func (r importRow) apply(item messages.CatalogItem) messages.CatalogItem {
+	item.SKU = r.item.SKU
+	if r.fields["name"] {
+		item.Name = r.item.Name
+	}
+	if r.fields["description"] {
+		item.Description = r.item.Description
+	}
+	if r.fields["unit"] {
+		item.Unit = r.item.Unit
+	}
+	if r.fields["units"] {
+		item.Units = r.item.Units
+	}
+	if r.fields["weight"] {
+		item.Weight = r.item.Weight
+	}
+	if r.fields["dimensions"] {
+		item.Dimensions = r.item.Dimensions
+	}
+	if r.fields["barcodes"] {
+		item.Barcodes = r.item.Barcodes
+	}
+	if r.fields["status"] {
+		item.Status = r.item.Status
+	}
+	if r.fields["categories"] {
+		item.Categories = r.item.Categories
+	}
+	if r.fields["components"] {
+		item.Components = r.item.Components
+	}
+	if r.fields["serialised"] {
+		item.Serialised = r.item.Serialised
+	}
+	if r.fields["prices"] {
+		item.Prices = r.item.Prices
+	}
+
+	if r.fields["attributes"] {
+		item.Attributes = maps.Clone(r.item.Attributes)
+	} else {
+		item.Attributes = maps.Clone(item.Attributes)
+	}
+	for field := range r.fields {
+		name, ok := strings.CutPrefix(field, "attributes.")
+		if !ok {
+			continue
+		}
+		if value := r.item.Attributes[name]; value != "" {
+			if item.Attributes == nil {
+				item.Attributes = make(map[string]string)
+			}
+			item.Attributes[name] = value
+		} else {
+			delete(item.Attributes, name)
+		}
+	}
+	if len(item.Attributes) == 0 {
+		item.Attributes = nil
+	}
+
+	if r.fields["translations"] {
+		item.Translations = maps.Clone(r.item.Translations)
+	} else {
+		item.Translations = maps.Clone(item.Translations)
+	}
+	for field := range r.fields {
+		rest, ok := strings.CutPrefix(field, "translations.")
+		if !ok {
+			continue
+		}
+		// empty translations are dropped when the item is normalized
+		locale, name, _ := strings.Cut(rest, ".")
+		if item.Translations == nil {
+			item.Translations = make(map[string]messages.ItemTranslation)
+		}
+		t := item.Translations[locale]
+		if name == "name" {
+			t.Name = r.item.Translations[locale].Name
+		} else {
+			t.Description = r.item.Translations[locale].Description
+		}
+		item.Translations[locale] = t
+	}
+
+	return item
+}
+
+// importErrors collects the problems found in the rows of an import, by line
+type importErrors map[int]*messages.ImportRowError
+
+func (e importErrors) add(line int, sku string, violations ...messages.CatalogViolation) {
+	rowErr, ok := e[line]
+	if !ok {
+		rowErr = &messages.ImportRowError{Line: line, SKU: sku}
+		e[line] = rowErr
+	}
+	rowErr.Violations = append(rowErr.Violations, violations...)
+}
+
+// sorted returns the problems found, sorted by line
+func (e importErrors) sorted() []messages.ImportRowError {
+	res := make([]messages.ImportRowError, 0, len(e))
+	for _, line := range slices.Sorted(maps.Keys(e)) {
+		res = append(res, *e[line])
+	}
+	return res
+}
+
+func violation(field, code, message string) messages.CatalogViolation {
+	return messages.CatalogViolation{Field: field, Code: code, Message: message}
+}
+
+// parseImport returns the rows of an import that could be read, and the problems found in the others
+func parseImport(format messages.CatalogFormat, data string) ([]importRow, importErrors, error) {
+	switch format {
+	case messages.CatalogCSV:
+		rows, errs := parseCSV(data)
+		return rows, errs, nil
+	case messages.CatalogJSONLines:
+		rows, errs := parseJSONLines(data)
+		return rows, errs, nil
+	default:
+		return nil, nil, errInvalidFormat
+	}
+}
+
+// parseCSV reads an import with a header row, naming the columns in csvColumns (or attribute columns) found in the rows
+func parseCSV(data string) ([]importRow, importErrors) {
+	errs := make(importErrors)
+	r := csv.NewReader(strings.NewReader(data))
+
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errs
+	}
+	if err != nil {
+		errs.add(1, "", violation("", "invalid_csv", err.Error()))
+		return nil, errs
+	}
+
+	seen := make(map[string]bool)
+	for _, column := range header {
+		name, isAttribute := strings.CutPrefix(column, attributeColumnPrefix)
+		locale, _, isTranslation := translationColumn(column)
+		switch {
+		case seen[column]:
+			errs.add(1, "", violation(column, "duplicate_column", "the column is repeated"))
+		case isAttribute && !attributeRegex.MatchString(name):
+			errs.add(1, "", violation(column, "invalid_attribute", "attribute names must be lowercase letters, digits and underscores"))
+		case isTranslation && !messages.ValidLocale(locale):
+			errs.add(1, "", violation(column, "invalid_locale", "translation columns must end with a locale, e.g. \"name.it\" or \"description.de-ch\""))
+		case !isAttribute && !isTranslation && !slices.Contains(csvColumns, column):
+			errs.add(1, "", violation(column, "unknown_column", "the column is not part of the catalog"))
+		}
+		seen[column] = true
+	}
+	if !seen["sku"] {
+		errs.add(1, "", violation("sku", "missing_sku", "the sku column is required to match the items"))
+	}
+	if dims := slices.DeleteFunc(slices.Clone(dimensionColumns), func(c string) bool { return !seen[c] }); len(dims) != 0 && len(dims) != len(dimensionColumns) {
+		errs.add(1, "", violation("dimensions", "invalid_dimensions", "length, width and height must be imported together"))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	rows := make([]importRow, 0)
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			errs.add(parseErr.StartLine, "", violation("", "invalid_csv", parseErr.Err.Error()))
+			continue
+		}
+		if err != nil {
+			errs.add(0, "", violation("", "invalid_csv", err.Error()))
+			break
+		}
+		line, _ := r.FieldPos(0)
+		if len(rows) == MaxImportRows {
+			errs.add(line, "", violation("", "too_many_rows", fmt.Sprintf("an import can have at most %d rows", MaxImportRows)))
+			break
+		}
+
+		if row, violations := parseRecord(header, record); len(violations) > 0 {
+			errs.add(line, row.item.SKU, violations...)
+		} else {
+			row.line = line
+			rows = append(rows, row)
+		}
+	}
+	return rows, errs
+}
+
+// parseRecord reads a CSV row, whose columns are named by header
+func parseRecord(header []string, record []string) (importRow, []messages.CatalogViolation) {
+	row := importRow{fields: make(map[string]bool)}
+	violations := make([]messages.CatalogViolation, 0)
+	var dims [3]string
+
+	for i, column := range header {
+		value := record[i]
+		if name, ok := strings.CutPrefix(column, attributeColumnPrefix); ok {
+			if row.item.Attributes == nil {
+				row.item.Attributes = make(map[string]string)
+			}
+			row.item.Attributes[name] = value
+			row.fields["attributes."+name] = true
+			continue
+		}
+		if locale, field, ok := translationColumn(column); ok {
+			if row.item.Translations == nil {
+				row.item.Translations = make(map[string]messages.ItemTranslation)
+			}
+			t := row.item.Translations[locale]
+			if field == "name" {
+				t.Name = value
+			} else {
+				t.Description = value
+			}
+			row.item.Translations[locale] = t
+			row.fields["translations."+locale+"."+field] = true
+			continue
+		}
+
+		switch column {
+		case "id":
+			continue
+		case "sku":
+			row.item.SKU = strings.TrimSpace(value)
+		case "name":
+			row.item.Name = value
+		case "description":
+			row.item.Description = value
+		case "unit":
+			row.item.Unit = value
+		case "units":
+			// alternative units are separated by semicolons, and written as <unit>:<factor>
+			for _, unit := range strings.Split(value, ";") {
+				if unit = strings.TrimSpace(unit); unit == "" {
+					continue
+				}
+				name, raw, _ := strings.Cut(unit, ":")
+				factor, err := strconv.Atoi(strings.TrimSpace(raw))
+				if err != nil {
+					violations = append(violations, violation("units", "invalid_factor", "units must be written as <unit>:<factor>"))
+					break
+				}
+				row.item.Units = append(row.item.Units, messages.ItemUnit{Unit: name, Factor: factor})
+			}
+		case "barcodes":
+			// barcodes are separated by semicolons, like categories
+			for _, code := range strings.Split(value, ";") {
+				if code = strings.TrimSpace(code); code != "" {
+					row.item.Barcodes = append(row.item.Barcodes, code)
+				}
+			}
+		case "status":
+			// an empty status keeps the one of the item, instead of reactivating it
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			row.item.Status = messages.CatalogItemStatus(strings.TrimSpace(value))
+		case "weight":
+			if strings.TrimSpace(value) != "" {
+				weight, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil {
+					violations = append(violations, violation("weight", "invalid_weight", "the weight must be a whole number of grams"))
+				}
+				row.item.Weight = weight
+			}
+		case "length", "width", "height":
+			dims[slices.Index(dimensionColumns, column)] = strings.TrimSpace(value)
+			row.fields["dimensions"] = true
+			continue
+		case "categories":
+			// category ids are separated by semicolons
+			for _, id := range strings.Split(value, ";") {
+				if id = strings.TrimSpace(id); id != "" {
+					row.item.Categories = append(row.item.Categories, id)
+				}
+			}
+		case "components":
+			// components are separated by semicolons, and written as <good id>:<amount>
+			for _, component := range strings.Split(value, ";") {
+				if component = strings.TrimSpace(component); component == "" {
+					continue
+				}
+				goodId, raw, _ := strings.Cut(component, ":")
+				amount, err := strconv.Atoi(strings.TrimSpace(raw))
+				if err != nil {
+					violations = append(violations, violation("components", "invalid_component", "components must be written as <good id>:<amount>"))
+					break
+				}
+				row.item.Components = append(row.item.Components, messages.KitComponent{GoodId: goodId, Amount: amount})
+			}
+		case "serialised":
+			if strings.TrimSpace(value) != "" {
+				serialised, err := strconv.ParseBool(strings.TrimSpace(value))
+				if err != nil {
+					violations = append(violations, violation("serialised", "invalid_serialised", "serialised must be either true or false"))
+				}
+				row.item.Serialised = serialised
+			}
+		case "prices":
+			if strings.TrimSpace(value) != "" {
+				if err := json.Unmarshal([]byte(value), &row.item.Prices); err != nil {
+					violations = append(violations, violation("prices", "invalid_prices", "the prices must be a JSON list of prices"))
+				}
+			}
+		}
+		row.fields[column] = true
+	}
+
+	if dims != [3]string{} {
+		var sizes [3]int
+		for i, d := range dims {
+			size, err := strconv.Atoi(d)
+			if err != nil {
+				violations = append(violations, violation("dimensions", "invalid_dimensions", "length, width and height must be whole numbers of millimetres"))
+				break
+			}
+			sizes[i] = size
+		}
+		row.item.Dimensions = &messages.Dimensions{Length: sizes[0], Width: sizes[1], Height: sizes[2]}
+	}
+
+	return row, violations
+}
+
+// parseJSONLines reads an import with an item per line
+func parseJSONLines(data string) ([]importRow, importErrors) {
+	errs := make(importErrors)
+	rows := make([]importRow, 0)
+
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(rows) == MaxImportRows {
+			errs.add(i+1, "", violation("", "too_many_rows", fmt.Sprintf("an import can have at most %d rows", MaxImportRows)))
+			break
+		}
+
+		row := importRow{line: i + 1, fields: make(map[string]bool)}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			errs.add(row.line, "", violation("", "invalid_json", "the line must be a JSON object"))
+			continue
+		}
+		if err := json.Unmarshal([]byte(line), &row.item); err != nil {
+			errs.add(row.line, "", violation("", "invalid_json", err.Error()))
+			continue
+		}
+		row.item.SKU = strings.TrimSpace(row.item.SKU)
+
+		for _, field := range slices.Sorted(maps.Keys(fields)) {
+			switch {
+			case field == "id" || field == "revision":
+				// exported for reference: items are matched by SKU
+			case slices.Contains(importFields, field):
+				row.fields[field] = true
+			default:
+				errs.add(row.line, row.item.SKU, violation(field, "unknown_field", "the field is not part of the catalog"))
+			}
+		}
+		if _, ok := errs[row.line]; !ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows, errs
+}
+
+// importItems imports the rows of req in a single transaction: either every row is imported, or none is,
+// and the result lists the problems found in each row
+func importItems(ctx context.Context, s *common.Service[catalogState], req messages.ImportCatalog) (messages.ImportCatalogResult, error) {
+	result := messages.ImportCatalogResult{DryRun: req.DryRun}
+
+	rows, errs, err := parseImport(req.Format, req.Data)
+	if err != nil {
+		return result, err
+	}
+
+	skus := make([]string, 0, len(rows))
+	lines := make(map[string]int)
+	for _, row := range rows {
+		sku := row.item.SKU
+		if sku == "" {
+			errs.add(row.line, sku, violation("sku", "missing_sku", "the SKU is required to match the item"))
+		} else if line, ok := lines[sku]; ok {
+			errs.add(row.line, sku, violation("sku", "duplicate_sku", fmt.Sprintf("the SKU is already imported on line %d", line)))
+		} else {
+			lines[sku] = row.line
+			skus = append(skus, sku)
+		}
+	}
+
+	tx, err := s.State().db.Begin(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	existing, err := lockItemsBySKU(ctx, tx, skus)
+	if err != nil {
+		return result, err
+	}
+
+	// changed are the items to store, and before the ones they replace (if any), by id
+	changed := make([]messages.CatalogItem, 0)
+	before := make(map[string]messages.CatalogItem)
+	for _, row := range rows {
+		if _, ok := errs[row.line]; ok {
+			continue
+		}
+
+		if !validPrices(row.item.Prices) {
+			errs.add(row.line, row.item.SKU, violation("prices", "invalid_prices", "prices need an ISO 4217 currency, a non-negative amount, and must end after they start"))
+			continue
+		}
+
+		current, found := existing[row.item.SKU]
+		if !found {
+			current = messages.CatalogItem{Id: uuid.NewString()}
+		}
+		item, err := validItem(row.apply(current))
+		if err == nil {
+			err = validKit(ctx, tx, item)
+		}
+		if err == nil {
+			err = validBarcodes(ctx, tx, item)
+		}
+		var violations violationsError
+		if errors.As(err, &violations) {
+			errs.add(row.line, row.item.SKU, violations...)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		switch {
+		case !found:
+			result.Created++
+		case sameItem(current, item):
+			result.Unchanged++
+			continue
+		default:
+			result.Updated++
+			before[item.Id] = current
+		}
+		changed = append(changed, item)
+	}
+
+	nestedKits(changed, lines, errs)
+	duplicateBarcodes(changed, lines, errs)
+	if len(errs) > 0 {
+		result.Errors = errs.sorted()
+		return result, nil
+	}
+	if req.DryRun {
+		return result, nil
+	}
+
+	for _, item := range changed {
+		if _, err = saveItem(ctx, tx, item); err != nil {
+			return result, err
+		}
+	}
+
+	// as in changeItem, the bucket is updated before committing: if that fails, it is rebuilt from the database.
+	// The events are only published once every item is committed, see commitChange.
+	kv := s.State().kv
+	events := make([]messages.CatalogEvent, 0, len(changed))
+	for _, item := range changed {
+		var previous *messages.CatalogItem
+		if current, ok := before[item.Id]; ok {
+			previous = &current
+		}
+		if err = projectLatest(ctx, kv, &item, previous); err != nil {
+			_ = tx.Rollback(ctx)
+			if _, rebuildErr := rebuildProjection(ctx, s.State().db, kv); rebuildErr != nil {
+				slog.ErrorContext(ctx, "Error rebuilding catalog projection after a failed import", "error", rebuildErr)
+			}
+			return result, err
+		}
+		events = append(events, catalogEvent(previous, &item))
+	}
+	return result, commitChange(ctx, s, tx, events...)
+}
+
+// nestedKits adds an error for the imported kits with imported kits as components, which validKit cannot
+// find since they are not stored yet. lines are the lines of the items, by SKU.
+func nestedKits(items []messages.CatalogItem, lines map[string]int, errs importErrors) {
+	kits := make(map[string]bool)
+	for _, item := range items {
+		if len(item.Components) > 0 {
+			kits[item.Id] = true
+		}
+	}
+	for _, item := range items {
+		for _, c := range item.Components {
+			if kits[c.GoodId] {
+				errs.add(lines[item.SKU], item.SKU, violation("components", "nested_kit", fmt.Sprintf("%s is a kit, and kits cannot contain other kits", c.GoodId)))
+			}
+		}
+	}
+}
+
+// duplicateBarcodes adds an error for the imported items with the barcode of an item imported before them,
+// which validBarcodes cannot find since they are not stored yet. lines are the lines of the items, by SKU.
+func duplicateBarcodes(items []messages.CatalogItem, lines map[string]int, errs importErrors) {
+	owners := make(map[string]string)
+	for _, item := range items {
+		for _, code := range item.Barcodes {
+			if sku, ok := owners[gtin14(code)]; ok {
+				errs.add(lines[item.SKU], item.SKU, violation("barcodes", "duplicate_barcode", fmt.Sprintf("the barcode %s is already imported for %s", code, sku)))
+				continue
+			}
+			owners[gtin14(code)] = item.SKU
+		}
+	}
+}
+
+// sameItem returns whether a and b are projected in the same way
+func sameItem(a, b messages.CatalogItem) bool {
+	pa, errA := projection(a)
+	pb, errB := projection(b)
+	return errA == nil && errB == nil && bytes.Equal(pa, pb)
+}
+
+// projectLatest stores item in the catalog bucket, whatever its current revision, and sets the revisions
+// of item and of previous (the item it replaces, if any). It must only be used while the item is locked in the database.
+func projectLatest(ctx context.Context, kv jetstream.KeyValue, item *messages.CatalogItem, previous *messages.CatalogItem) error {
+	var revision uint64
+	entry, err := kv.Get(ctx, item.Id)
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return err
+	}
+	if entry != nil {
+		revision = entry.Revision()
+	}
+	if previous != nil {
+		previous.Revision = revision
+	}
+	item.Revision, err = project(ctx, kv, *item, revision)
+	return err
+}
+
+// writeExport writes items to w in the given format
+func writeExport(w io.Writer, format messages.CatalogFormat, items []messages.CatalogItem) error {
+	switch format {
+	case messages.CatalogCSV:
+		return writeCSV(w, items)
+	case messages.CatalogJSONLines:
+		for _, item := range items {
+			data, err := projection(item)
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(append(data, '\n')); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errInvalidFormat
+	}
+}
+
+func writeCSV(w io.Writer, items []messages.CatalogItem) error {
+	attributes := make(map[string]bool)
+	for _, item := range items {
+		for name := range item.Attributes {
+			attributes[name] = true
+		}
+	}
+	names := slices.Sorted(maps.Keys(attributes))
+	translated := make(map[string]bool)
+	for _, item := range items {
+		for locale := range item.Translations {
+			translated[locale] = true
+		}
+	}
+	locales := slices.Sorted(maps.Keys(translated))
+
+	cw := csv.NewWriter(w)
+	header := slices.Clone(csvColumns)
+	for _, name := range names {
+		header = append(header, attributeColumnPrefix+name)
+	}
+	for _, locale := range locales {
+		for _, field := range translationColumnFields {
+			header = append(header, field+"."+locale)
+		}
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	number := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	for _, item := range items {
+		var prices string
+		if len(item.Prices) > 0 {
+			data, err := json.Marshal(item.Prices)
+			if err != nil {
+				return err
+			}
+			prices = string(data)
+		}
+		units := make([]string, 0, len(item.Units))
+		for _, u := range item.Units {
+			units = append(units, fmt.Sprintf("%s:%d", u.Unit, u.Factor))
+		}
+		components := make([]string, 0, len(item.Components))
+		for _, c := range item.Components {
+			components = append(components, fmt.Sprintf("%s:%d", c.GoodId, c.Amount))
+		}
+		var dims [3]string
+		if d := item.Dimensions; d != nil {
+			dims = [3]string{strconv.Itoa(d.Length), strconv.Itoa(d.Width), strconv.Itoa(d.Height)}
+		}
+
+		record := []string{item.Id, item.SKU, item.Name, item.Description, item.Unit, strings.Join(units, ";"), number(item.Weight),
+			dims[0], dims[1], dims[2], strings.Join(item.Barcodes, ";"), string(itemStatus(item)), strings.Join(item.Categories, ";"),
+			strings.Join(components, ";"), strconv.FormatBool(item.Serialised), prices}
+		for _, name := range names {
+			record = append(record, item.Attributes[name])
+		}
+		for _, locale := range locales {
+			record = append(record, item.Translations[locale].Name, item.Translations[locale].Description)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// chunkWriter publishes what is written to it on subject, in chunks of exportChunkSize
+type chunkWriter struct {
+	nc      *nats.Conn
+	subject string
+	buf     []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= exportChunkSize {
+		if err := w.nc.Publish(w.subject, w.buf[:exportChunkSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[exportChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close publishes what is left, followed by the empty message ending the export
+func (w *chunkWriter) Close() error {
+	if len(w.buf) > 0 {
+		if err := w.nc.Publish(w.subject, w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	return w.nc.Publish(w.subject, nil)
+}
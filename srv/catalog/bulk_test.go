@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCSV(t *testing.T) {
+	rows, errs := parseCSV("sku,name,weight,length,width,height,status,attr.color\n" +
+		"HAT-01,Hat,120,300,250,120,,red\n" +
+		"SCARF-01,Scarf,heavy,,,,archived,\n" +
+		"SOCK-01,\"Sock, wool\",,,,,archived,\n")
+	require.Len(t, rows, 2)
+
+	hat := rows[0]
+	require.Equal(t, 2, hat.line)
+	require.Equal(t, "HAT-01", hat.item.SKU)
+	require.Equal(t, &messages.Dimensions{Length: 300, Width: 250, Height: 120}, hat.item.Dimensions)
+	require.True(t, hat.fields["attributes.color"])
+	require.False(t, hat.fields["status"], "empty statuses keep the status of the item")
+
+	require.Equal(t, 4, rows[1].line)
+	require.Equal(t, "Sock, wool", rows[1].item.Name)
+	require.Nil(t, rows[1].item.Dimensions)
+	require.True(t, rows[1].fields["dimensions"])
+
+	require.Equal(t, []messages.ImportRowError{{
+		Line:       3,
+		SKU:        "SCARF-01",
+		Violations: []messages.CatalogViolation{violation("weight", "invalid_weight", "the weight must be a whole number of grams")},
+	}}, errs.sorted())
+
+	_, errs = parseCSV("name,length,colour\nHat,1,red\n")
+	require.Len(t, errs, 1)
+	require.Equal(t, []string{"unknown_column", "missing_sku", "invalid_dimensions"}, violationCodes(errs[1].Violations))
+
+	_, errs = parseCSV("sku,name\nHAT-01,Hat,extra\n")
+	require.Equal(t, 2, errs.sorted()[0].Line)
+
+	_, errs = parseCSV("sku,components\nSET-01,hat:1;scarf\n")
+	require.Equal(t, []string{"invalid_component"}, violationCodes(errs[2].Violations))
+
+	rows, errs = parseCSV("sku,units\nHAT-01,box:12; pallet:480\nSCARF-01,box\n")
+	require.Equal(t, []messages.ItemUnit{{Unit: "box", Factor: 12}, {Unit: "pallet", Factor: 480}}, rows[0].item.Units)
+	require.Equal(t, []string{"invalid_factor"}, violationCodes(errs[3].Violations))
+
+	// translation columns set a single field of a translation, keeping the others
+	rows, errs = parseCSV("sku,name.it,name.de_CH\nHAT-01,Cappello,\n")
+	require.Empty(t, errs)
+	require.True(t, rows[0].fields["translations.de-ch.name"])
+	item := rows[0].apply(messages.CatalogItem{Translations: map[string]messages.ItemTranslation{
+		"it":    {Name: "Berretto", Description: "Un cappello rosso"},
+		"de-ch": {Name: "Chappe"},
+	}})
+	require.Equal(t, map[string]messages.ItemTranslation{"it": {Name: "Cappello", Description: "Un cappello rosso"}, "de-ch": {}}, item.Translations)
+	require.Equal(t, map[string]messages.ItemTranslation{"it": {Name: "Cappello", Description: "Un cappello rosso"}}, normalizeItem(item).Translations)
+
+	_, errs = parseCSV("sku,name.english\nHAT-01,Hat\n")
+	require.Equal(t, []string{"invalid_locale"}, violationCodes(errs[1].Violations))
+}
+
+func TestNestedKits(t *testing.T) {
+	items := []messages.CatalogItem{
+		{Id: "1", SKU: "SET-01", Components: []messages.KitComponent{{GoodId: "2", Amount: 1}, {GoodId: "3", Amount: 1}}},
+		{Id: "2", SKU: "SET-02", Components: []messages.KitComponent{{GoodId: "3", Amount: 1}}},
+		{Id: "3", SKU: "HAT-01"},
+	}
+	errs := make(importErrors)
+	nestedKits(items, map[string]int{"SET-01": 2, "SET-02": 3, "HAT-01": 4}, errs)
+	require.Len(t, errs, 1)
+	require.Equal(t, "nested_kit", errs[2].Violations[0].Code)
+}
+
+func TestDuplicateBarcodes(t *testing.T) {
+	items := []messages.CatalogItem{
+		{Id: "1", SKU: "HAT-01", Barcodes: []string{"036000291452"}},
+		{Id: "2", SKU: "SCARF-01", Barcodes: []string{"0036000291452", "4006381333931"}},
+	}
+	errs := make(importErrors)
+	duplicateBarcodes(items, map[string]int{"HAT-01": 2, "SCARF-01": 3}, errs)
+	require.Len(t, errs, 1)
+	require.Equal(t, "duplicate_barcode", errs[3].Violations[0].Code)
+}
+
+func TestParseJSONLines(t *testing.T) {
+	rows, errs := parseJSONLines(`{"id": "x", "sku": "HAT-01", "name": "Hat", "attributes": {"color": "red"}}
+
+{"sku": "SCARF-01", "colour": "red"}
+not json
+{"sku": "SOCK-01", "weight": "heavy"}
+`)
+	require.Len(t, rows, 1)
+	require.Equal(t, 1, rows[0].line)
+	require.Equal(t, map[string]bool{"sku": true, "name": true, "attributes": true}, rows[0].fields)
+
+	sorted := errs.sorted()
+	require.Len(t, sorted, 3)
+	require.Equal(t, 3, sorted[0].Line)
+	require.Equal(t, "unknown_field", sorted[0].Violations[0].Code)
+	require.Equal(t, 4, sorted[1].Line)
+	require.Equal(t, 5, sorted[2].Line)
+}
+
+func TestImportRow_Apply(t *testing.T) {
+	existing := messages.CatalogItem{
+		Id:         "1",
+		SKU:        "HAT-01",
+		Name:       "Hat",
+		Weight:     120,
+		Status:     messages.CatalogItemArchived,
+		Attributes: map[string]string{"color": "red", "size": "L"},
+	}
+	rows, errs := parseCSV("sku,name,attr.color,attr.size,attr.fabric\nHAT-01,Red hat,blue,,wool\n")
+	require.Empty(t, errs)
+
+	item := rows[0].apply(existing)
+	require.Equal(t, "1", item.Id)
+	require.Equal(t, "Red hat", item.Name)
+	require.Equal(t, 120, item.Weight, "fields missing from the import are kept")
+	require.Equal(t, messages.CatalogItemArchived, item.Status)
+	require.Equal(t, map[string]string{"color": "blue", "fabric": "wool"}, item.Attributes)
+	require.Equal(t, map[string]string{"color": "red", "size": "L"}, existing.Attributes, "the existing item is not changed")
+
+	rows, errs = parseJSONLines(`{"sku": "HAT-01", "attributes": {}}`)
+	require.Empty(t, errs)
+	require.Nil(t, rows[0].apply(existing).Attributes)
+}
+
+func TestWriteExport_RoundTrip(t *testing.T) {
+	items := []messages.CatalogItem{
+		normalizeItem(messages.CatalogItem{
+			Id:         "1",
+			SKU:        "HAT-01",
+			Name:       "Hat, red",
+			Weight:     120,
+			Units:      []messages.ItemUnit{{Unit: "box", Factor: 12}, {Unit: "pallet", Factor: 480}},
+			Dimensions: &messages.Dimensions{Length: 300, Width: 250, Height: 120},
+			Barcodes:   []string{"036000291452", "4006381333931"},
+			Attributes: map[string]string{"color": "red"},
+			Translations: map[string]messages.ItemTranslation{
+				"it":    {Name: "Cappello, rosso", Description: "Un cappello di lana"},
+				"de-ch": {Name: "Chappe"},
+			},
+			Categories: []string{"0b1b9a1e-5f0e-4c8e-9d3a-1f2e3d4c5b6a", "5d0c6b8e-2a1f-4b3c-8d9e-0f1a2b3c4d5e"},
+			Components: []messages.KitComponent{{GoodId: "2b3c4d5e-6f70-4812-9a3b-4c5d6e7f8091", Amount: 2}, {GoodId: "9a8b7c6d-5e4f-4321-8fed-cba987654321", Amount: 1}},
+			Prices:     []messages.ItemPrice{{Currency: "EUR", Amount: 1999, EffectiveFrom: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		}),
+		normalizeItem(messages.CatalogItem{Id: "2", SKU: "SCARF-01", Name: "Scarf", Status: messages.CatalogItemArchived, Serialised: true}),
+	}
+
+	for _, format := range []messages.CatalogFormat{messages.CatalogCSV, messages.CatalogJSONLines} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, writeExport(&buf, format, items))
+
+			rows, errs, err := parseImport(format, buf.String())
+			require.NoError(t, err)
+			require.Empty(t, errs)
+			require.Len(t, rows, len(items))
+			for i, row := range rows {
+				item, err := validItem(row.apply(messages.CatalogItem{Id: items[i].Id}))
+				require.NoError(t, err)
+				require.True(t, sameItem(items[i], item), "exports have every field of the items")
+			}
+		})
+	}
+
+	require.ErrorIs(t, writeExport(&bytes.Buffer{}, "xml", items), errInvalidFormat)
+}
+
+func TestChunkWriter(t *testing.T) {
+	nc := common.NewInProcessNATSServer(t)
+	sub, err := nc.SubscribeSync("export")
+	require.NoError(t, err)
+
+	w := &chunkWriter{nc: nc, subject: "export"}
+	data := strings.Repeat("x", exportChunkSize+10)
+	_, err = w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	var received []byte
+	for {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		if len(msg.Data) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(msg.Data), exportChunkSize)
+		received = append(received, msg.Data...)
+	}
+	require.Equal(t, data, string(received))
+}
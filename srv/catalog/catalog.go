@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -15,8 +16,10 @@ import (
 )
 
 type catalogState struct {
-	db *pgxpool.Pool
-	kv jetstream.KeyValue
+	db         *pgxpool.Pool
+	kv         jetstream.KeyValue
+	categories jetstream.KeyValue
+	index      *searchIndex
 }
 
 var meter = otel.Meter("github.com/alimitedgroup/PoC/srv/catalog")
@@ -39,6 +42,7 @@ func setupObservability(ctx context.Context, otlpUrl string) func(context.Contex
 }
 
 func main() {
+	flag.Parse()
 	ctx, cancel := context.WithCancel(context.Background())
 	dbConnStr := os.Getenv("DB_URL")
 	natsUrl := os.Getenv("NATS_URL")
@@ -53,6 +57,11 @@ func main() {
 		return
 	}
 
+	if err = migrate(ctx, pool); err != nil {
+		slog.ErrorContext(ctx, "Failed to migrate database", "error", err)
+		return
+	}
+
 	nc, err := nats.Connect(natsUrl)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to connect to NATS", "error", err)
@@ -68,12 +77,64 @@ func main() {
 	}
 	svc.State().kv = kv
 
+	categories, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.CategoriesKeyValueConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create key-value store", "bucket", common.CategoriesKeyValueConfig.Bucket, "error", err)
+		return
+	}
+	svc.State().categories = categories
+
+	if err = common.CreateStream(ctx, svc.JetStream(), common.CatalogEventsStreamConfig); err != nil {
+		slog.ErrorContext(ctx, "Failed to create stream", "stream", common.CatalogEventsStreamConfig.Name, "error", err)
+		return
+	}
+
+	if err = seedFromProjection(ctx, pool, kv); err != nil {
+		slog.ErrorContext(ctx, "Failed to import catalog items from KV", "error", err)
+		return
+	}
+
+	// the projection may have missed the changes committed right before a crash, so it is rebuilt at startup,
+	// and `catalog rebuild` rebuilds it and exits
+	_, err = rebuildProjection(ctx, pool, kv)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to rebuild catalog projection", "error", err)
+		return
+	}
+	if err = rebuildCategories(ctx, pool, categories); err != nil {
+		slog.ErrorContext(ctx, "Failed to rebuild categories projection", "error", err)
+		return
+	}
+	if flag.Arg(0) == "rebuild" {
+		return
+	}
+	go RelayEventsLoop(ctx, svc)
+
+	svc.State().index = newSearchIndex()
+	if err = watchIndex(ctx, kv, categories, svc.State().index); err != nil {
+		slog.ErrorContext(ctx, "Failed to watch catalog for the search index", "error", err)
+		return
+	}
+
 	svc.RegisterHandler("catalog.ping", PingHandler)
 	svc.RegisterHandler("catalog.create", CreateHandler)
 	svc.RegisterHandler("catalog.list", ListHandler)
+	svc.RegisterHandler("catalog.search", SearchHandler)
 	svc.RegisterHandler("catalog.get", GetHandler)
+	svc.RegisterHandler("catalog.lookup", LookupHandler)
 	svc.RegisterHandler("catalog.update", UpdateHandler)
+	svc.RegisterHandler("catalog.prices.set", SetPricesHandler)
+	svc.RegisterHandler("catalog.history", HistoryHandler)
 	svc.RegisterHandler("catalog.delete", DeleteHandler)
+	svc.RegisterHandler("catalog.archive", ArchiveHandler)
+	svc.RegisterHandler("catalog.unarchive", UnarchiveHandler)
+	svc.RegisterHandler("catalog.import", ImportHandler)
+	svc.RegisterHandler("catalog.export", ExportHandler)
+	svc.RegisterHandler("catalog.categories.list", ListCategoriesHandler)
+	svc.RegisterHandler("catalog.categories.create", CreateCategoryHandler)
+	svc.RegisterHandler("catalog.categories.update", UpdateCategoryHandler)
+	svc.RegisterHandler("catalog.categories.delete", DeleteCategoryHandler)
+	svc.RegisterHandler("catalog.categories.goods", CategoryGoodsHandler)
 
 	// Wait for ctrl-c, and gracefully stop service
 	c := make(chan os.Signal, 1)
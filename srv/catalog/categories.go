@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// categoriesLock is the key of the advisory lock taken while changing the category tree, so that
+// concurrent moves cannot create cycles
+const categoriesLock = 0x63617465676f72
+
+const maxCategoryNameLength = 100
+
+var (
+	errCategoryNotFound  = errors.New("category not found")
+	errInvalidCategory   = errors.New("invalid category")
+	errCategoryCycle     = errors.New("category moved under itself")
+	errDuplicateCategory = errors.New("duplicate category name")
+	errCategoryNotEmpty  = errors.New("category has subcategories or items")
+)
+
+// categoryTree is the category tree, by id
+type categoryTree map[string]messages.Category
+
+func newCategoryTree(categories []messages.Category) categoryTree {
+	t := make(categoryTree, len(categories))
+	for _, c := range categories {
+		t[c.Id] = c
+	}
+	return t
+}
+
+// contains returns whether the category with the given id is ancestor, or one of its descendants
+func (t categoryTree) contains(ancestor, id string) bool {
+	// a path is never longer than the tree, even if the tree is broken and has a cycle
+	for range len(t) + 1 {
+		if id == ancestor {
+			return true
+		}
+		c, ok := t[id]
+		if !ok || c.ParentId == "" {
+			return false
+		}
+		id = c.ParentId
+	}
+	return false
+}
+
+// path returns the names of the categories from the root to the one with the given id
+func (t categoryTree) path(id string) []string {
+	path := make([]string, 0)
+	for range len(t) {
+		c, ok := t[id]
+		if !ok {
+			break
+		}
+		path = append(path, c.Name)
+		if c.ParentId == "" {
+			break
+		}
+		id = c.ParentId
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// withPath returns the category with the given id, along with its path
+func (t categoryTree) withPath(id string) messages.Category {
+	c := t[id]
+	c.Path = t.path(id)
+	return c
+}
+
+// subtree returns the ids of the category with the given id, and of its descendants
+func (t categoryTree) subtree(id string) map[string]bool {
+	res := make(map[string]bool)
+	for other := range t {
+		if t.contains(id, other) {
+			res[other] = true
+		}
+	}
+	return res
+}
+
+// sorted returns every category along with its path, sorted by path
+func (t categoryTree) sorted() []messages.Category {
+	res := make([]messages.Category, 0, len(t))
+	for id := range t {
+		res = append(res, t.withPath(id))
+	}
+	slices.SortFunc(res, func(a, b messages.Category) int {
+		if c := slices.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+	return res
+}
+
+// validate normalizes c, and checks that it can be stored in the tree, replacing the category with its id (if any)
+func (t categoryTree) validate(c messages.Category) (messages.Category, error) {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Path = nil
+	if c.Name == "" || utf8.RuneCountInString(c.Name) > maxCategoryNameLength {
+		return c, errInvalidCategory
+	}
+
+	if c.ParentId != "" {
+		parent, err := uuid.Parse(c.ParentId)
+		if err != nil {
+			return c, errInvalidCategory
+		}
+		c.ParentId = parent.String()
+		if _, ok := t[c.ParentId]; !ok {
+			return c, errInvalidCategory
+		}
+		if t.contains(c.Id, c.ParentId) {
+			return c, errCategoryCycle
+		}
+	}
+
+	for _, other := range t {
+		if other.Id != c.Id && other.ParentId == c.ParentId && strings.EqualFold(other.Name, c.Name) {
+			return c, errDuplicateCategory
+		}
+	}
+	return c, nil
+}
+
+// listCategories returns every category, without paths
+func listCategories(ctx context.Context, db querier) ([]messages.Category, error) {
+	rows, err := db.Query(ctx, "select id::text, coalesce(parent_id::text, ''), name from categories order by name, id")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (messages.Category, error) {
+		var c messages.Category
+		err := row.Scan(&c.Id, &c.ParentId, &c.Name)
+		return c, err
+	})
+}
+
+// lockCategories starts a transaction holding the lock on the category tree, and returns the tree
+func lockCategories(ctx context.Context, db *pgxpool.Pool) (pgx.Tx, categoryTree, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = tx.Exec(ctx, "select pg_advisory_xact_lock($1)", categoriesLock); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, nil, err
+	}
+	categories, err := listCategories(ctx, tx)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, nil, err
+	}
+	return tx, newCategoryTree(categories), nil
+}
+
+// saveCategory stores c (in the database and in the categories bucket), and returns it along with its path
+func saveCategory(ctx context.Context, s *common.Service[catalogState], tx pgx.Tx, tree categoryTree, c messages.Category) (messages.Category, error) {
+	_, err := tx.Exec(ctx, `insert into categories (id, parent_id, name) values ($1, nullif($2, '')::uuid, $3)
+		on conflict (id) do update set parent_id = excluded.parent_id, name = excluded.name, updated_at = now()`,
+		c.Id, c.ParentId, c.Name)
+	if err != nil {
+		return c, err
+	}
+	if err = projectCategory(ctx, s.State().categories, c); err != nil {
+		return c, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return c, err
+	}
+
+	tree[c.Id] = c
+	return tree.withPath(c.Id), nil
+}
+
+// createCategory creates a new category, and returns it
+func createCategory(ctx context.Context, s *common.Service[catalogState], req messages.CreateCategory) (messages.Category, error) {
+	tx, tree, err := lockCategories(ctx, s.State().db)
+	if err != nil {
+		return messages.Category{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	c, err := tree.validate(messages.Category{Id: uuid.NewString(), Name: req.Name, ParentId: req.ParentId})
+	if err != nil {
+		return c, err
+	}
+	return saveCategory(ctx, s, tx, tree, c)
+}
+
+// updateCategory renames a category, or moves it under another parent, and returns it.
+// Its subcategories are moved along with it, since they keep referencing it.
+func updateCategory(ctx context.Context, s *common.Service[catalogState], req messages.UpdateCategory) (messages.Category, error) {
+	tx, tree, err := lockCategories(ctx, s.State().db)
+	if err != nil {
+		return messages.Category{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	c, ok := tree[req.Id]
+	if !ok {
+		return c, errCategoryNotFound
+	}
+	if req.Name != nil {
+		c.Name = *req.Name
+	}
+	if req.ParentId != nil {
+		c.ParentId = *req.ParentId
+	}
+	if c, err = tree.validate(c); err != nil {
+		return c, err
+	}
+	return saveCategory(ctx, s, tx, tree, c)
+}
+
+// deleteCategory deletes a category without subcategories nor items
+func deleteCategory(ctx context.Context, s *common.Service[catalogState], id string) error {
+	tx, tree, err := lockCategories(ctx, s.State().db)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, ok := tree[id]; !ok {
+		return errCategoryNotFound
+	}
+	if len(tree.subtree(id)) > 1 {
+		return errCategoryNotEmpty
+	}
+	var tagged bool
+	if err = tx.QueryRow(ctx, "select exists (select 1 from catalog_item_categories where category_id = $1)", id).Scan(&tagged); err != nil {
+		return err
+	}
+	if tagged {
+		return errCategoryNotEmpty
+	}
+
+	if _, err = tx.Exec(ctx, "delete from categories where id = $1", id); err != nil {
+		return err
+	}
+	if err = unproject(ctx, s.State().categories, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// projectCategory writes c to the categories bucket. Changes to categories are serialized by
+// categoriesLock, so revisions do not need to be checked.
+func projectCategory(ctx context.Context, kv jetstream.KeyValue, c messages.Category) error {
+	c.Path = nil
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(ctx, c.Id, body)
+	return err
+}
+
+// rebuildCategories writes every category of the database to the categories bucket, and removes the
+// categories that are not in the database anymore, like rebuildProjection does for items
+func rebuildCategories(ctx context.Context, db *pgxpool.Pool, kv jetstream.KeyValue) error {
+	categories, err := listCategories(ctx, db)
+	if err != nil {
+		return err
+	}
+	projected, err := projectedEntries(ctx, kv)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range categories {
+		body, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		entry, found := projected[c.Id]
+		delete(projected, c.Id)
+		if found && bytes.Equal(entry.Value(), body) {
+			continue
+		}
+		if err = projectCategory(ctx, kv, c); err != nil {
+			return err
+		}
+	}
+
+	for id := range projected {
+		if err = unproject(ctx, kv, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respondCategoryError responds to req with the reason a change to the category tree failed
+func respondCategoryError(ctx context.Context, req *nats.Msg, err error) {
+	switch {
+	case errors.Is(err, errCategoryNotFound):
+		natsutil.Respond(req, natsutil.CategoryNotFound)
+	case errors.Is(err, errInvalidCategory):
+		natsutil.Respond(req, natsutil.InvalidCategory)
+	case errors.Is(err, errCategoryCycle):
+		natsutil.Respond(req, natsutil.CategoryCycle)
+	case errors.Is(err, errDuplicateCategory):
+		natsutil.Respond(req, natsutil.DuplicateCategory)
+	case errors.Is(err, errCategoryNotEmpty):
+		natsutil.Respond(req, natsutil.CategoryNotEmpty)
+	default:
+		slog.ErrorContext(ctx, "Error storing category", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+	}
+}
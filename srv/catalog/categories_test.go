@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	apparelId = "7c0f6f4e-0d8a-4f4b-9a57-3a0c3f1f8c01"
+	hatsId    = "7c0f6f4e-0d8a-4f4b-9a57-3a0c3f1f8c02"
+	capsId    = "7c0f6f4e-0d8a-4f4b-9a57-3a0c3f1f8c03"
+	toysId    = "7c0f6f4e-0d8a-4f4b-9a57-3a0c3f1f8c04"
+)
+
+func testTree() categoryTree {
+	return newCategoryTree([]messages.Category{
+		{Id: apparelId, Name: "Apparel"},
+		{Id: hatsId, Name: "Hats", ParentId: apparelId},
+		{Id: capsId, Name: "Caps", ParentId: hatsId},
+		{Id: toysId, Name: "Toys"},
+	})
+}
+
+func TestCategoryTree(t *testing.T) {
+	tree := testTree()
+
+	require.Equal(t, []string{"Apparel", "Hats", "Caps"}, tree.path(capsId))
+	require.True(t, tree.contains(apparelId, capsId))
+	require.True(t, tree.contains(capsId, capsId))
+	require.False(t, tree.contains(capsId, apparelId))
+	require.Equal(t, map[string]bool{hatsId: true, capsId: true}, tree.subtree(hatsId))
+
+	paths := make([][]string, 0)
+	for _, c := range tree.sorted() {
+		paths = append(paths, c.Path)
+	}
+	require.Equal(t, [][]string{{"Apparel"}, {"Apparel", "Hats"}, {"Apparel", "Hats", "Caps"}, {"Toys"}}, paths)
+
+	// broken trees do not loop forever
+	tree[apparelId] = messages.Category{Id: apparelId, Name: "Apparel", ParentId: capsId}
+	require.False(t, tree.contains(toysId, capsId))
+	require.Len(t, tree.path(capsId), len(tree))
+}
+
+func TestCategoryTree_Validate(t *testing.T) {
+	tree := testTree()
+
+	c, err := tree.validate(messages.Category{Id: "new", Name: " Scarves ", ParentId: apparelId})
+	require.NoError(t, err)
+	require.Equal(t, "Scarves", c.Name)
+
+	// renaming a category to its own name, or moving it along with its subtree
+	_, err = tree.validate(messages.Category{Id: hatsId, Name: "hats", ParentId: apparelId})
+	require.NoError(t, err)
+	_, err = tree.validate(messages.Category{Id: hatsId, Name: "Hats", ParentId: toysId})
+	require.NoError(t, err)
+	_, err = tree.validate(messages.Category{Id: hatsId, Name: "Hats"})
+	require.NoError(t, err)
+
+	_, err = tree.validate(messages.Category{Id: "new", Name: " "})
+	require.ErrorIs(t, err, errInvalidCategory)
+	_, err = tree.validate(messages.Category{Id: "new", Name: "Scarves", ParentId: "nope"})
+	require.ErrorIs(t, err, errInvalidCategory)
+	_, err = tree.validate(messages.Category{Id: "new", Name: "HATS", ParentId: apparelId})
+	require.ErrorIs(t, err, errDuplicateCategory)
+	_, err = tree.validate(messages.Category{Id: apparelId, Name: "Apparel", ParentId: capsId})
+	require.ErrorIs(t, err, errCategoryCycle)
+	_, err = tree.validate(messages.Category{Id: hatsId, Name: "Hats", ParentId: hatsId})
+	require.ErrorIs(t, err, errCategoryCycle)
+}
+
+func TestSearchIndex_CategoryGoods(t *testing.T) {
+	idx := newSearchIndex()
+	for _, c := range testTree() {
+		idx.putCategory(c)
+	}
+	idx.put(messages.CatalogItem{Id: "cap", Name: "Cap", Categories: []string{capsId}})
+	idx.put(messages.CatalogItem{Id: "hat", Name: "Hat", Categories: []string{hatsId, toysId}})
+	idx.put(messages.CatalogItem{Id: "car", Name: "Car"})
+
+	goods, ok := idx.categoryGoods("")
+	require.True(t, ok)
+	byPath := make(map[string][]string)
+	for _, g := range goods {
+		byPath[g.Category.Name] = g.Goods
+	}
+	require.Equal(t, map[string][]string{
+		"Apparel": {"cap", "hat"},
+		"Hats":    {"cap", "hat"},
+		"Caps":    {"cap"},
+		"Toys":    {"hat"},
+	}, byPath)
+
+	goods, ok = idx.categoryGoods(capsId)
+	require.True(t, ok)
+	require.Len(t, goods, 1)
+	require.Equal(t, []string{"Apparel", "Hats", "Caps"}, goods[0].Category.Path)
+
+	_, ok = idx.categoryGoods("nope")
+	require.False(t, ok)
+}
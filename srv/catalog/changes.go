@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/jackc/pgx/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	errItemNotFound = errors.New("catalog item not found")
+	errItemChanged  = errors.New("catalog item was changed concurrently")
+)
+
+// violationsError is returned when a change makes an item invalid
+type violationsError []messages.CatalogViolation
+
+func (v violationsError) Error() string {
+	return "invalid catalog item"
+}
+
+// validItem normalizes item, and returns a violationsError if it is not valid
+func validItem(item messages.CatalogItem) (messages.CatalogItem, error) {
+	item = normalizeItem(item)
+	if violations := validateItem(item); len(violations) > 0 {
+		return item, violationsError(violations)
+	}
+	return item, nil
+}
+
+// createItem stores a new item, and returns it as stored, along with its revision
+func createItem(ctx context.Context, s *common.Service[catalogState], item messages.CatalogItem) (messages.CatalogItem, error) {
+	item, err := validItem(item)
+	if err != nil {
+		return item, err
+	}
+
+	tx, err := s.State().db.Begin(ctx)
+	if err != nil {
+		return item, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err = validKit(ctx, tx, item); err != nil {
+		return item, err
+	}
+	if err = validBarcodes(ctx, tx, item); err != nil {
+		return item, err
+	}
+	if item, err = saveItem(ctx, tx, item); err != nil {
+		return item, err
+	}
+	if item.Revision, err = project(ctx, s.State().kv, item, 0); err != nil {
+		return item, err
+	}
+	return item, commitChange(ctx, s, tx, catalogEvent(nil, &item))
+}
+
+// changeItem applies change to the item with the given id. revision is the revision of the item the change
+// is based on, and errItemChanged is returned if the item has another one; 0 applies the change to the
+// current item instead. The item is locked in the database while changing it, and the catalog bucket is
+// updated before committing the change, so that the two agree on every revision (see commitChange). Changes that leave the
+// item as it was are not stored, and return the current item.
+func changeItem(ctx context.Context, s *common.Service[catalogState], id string, revision uint64, change func(*messages.CatalogItem) error) (messages.CatalogItem, error) {
+	kv := s.State().kv
+
+	tx, err := s.State().db.Begin(ctx)
+	if err != nil {
+		return messages.CatalogItem{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockItem(ctx, tx, id)
+	if err != nil {
+		return messages.CatalogItem{}, err
+	}
+	if current == nil {
+		return messages.CatalogItem{}, errItemNotFound
+	}
+
+	// items missing from the bucket (e.g. before a rebuild) have no revision, and are created by project
+	entry, err := kv.Get(ctx, id)
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return *current, err
+	}
+	if entry != nil {
+		current.Revision = entry.Revision()
+	}
+	if revision != 0 && revision != current.Revision {
+		return *current, errItemChanged
+	}
+
+	item := *current
+	if err = change(&item); err != nil {
+		return item, err
+	}
+	item.Id = current.Id
+	if item, err = validItem(item); err != nil {
+		return item, err
+	}
+	if sameItem(*current, item) {
+		return *current, nil
+	}
+	if err = validKit(ctx, tx, item); err != nil {
+		return item, err
+	}
+	if err = validBarcodes(ctx, tx, item); err != nil {
+		return item, err
+	}
+
+	if item, err = saveItem(ctx, tx, item); err != nil {
+		return item, err
+	}
+	item.Revision, err = project(ctx, kv, item, current.Revision)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return item, errItemChanged
+	}
+	if err != nil {
+		return item, err
+	}
+	return item, commitChange(ctx, s, tx, catalogEvent(current, &item))
+}
+
+// commitChange queues the events of a change to the outbox and commits it, then publishes them.
+// The items of the events are already in the catalog bucket: if the change cannot be committed, they are
+// reprojected from the database, so that neither the bucket nor the events show a change that never happened.
+func commitChange(ctx context.Context, s *common.Service[catalogState], tx pgx.Tx, events ...messages.CatalogEvent) error {
+	var err error
+	for _, event := range events {
+		if err = queueEvent(ctx, tx, event); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err == nil {
+		relayCommitted(ctx, s)
+		return nil
+	}
+
+	_ = tx.Rollback(ctx)
+	// the bucket must be repaired even if the request context was cancelled meanwhile
+	repairCtx := context.WithoutCancel(ctx)
+	for _, event := range events {
+		if repairErr := reproject(repairCtx, s.State().db, s.State().kv, event.Id); repairErr != nil {
+			slog.ErrorContext(ctx, "Error repairing the projection of an uncommitted change, it will be repaired by the next rebuild",
+				"error", repairErr, "id", event.Id)
+		}
+	}
+	return err
+}
+
+// respondStoreError responds to req with the reason createItem or changeItem failed
+func respondStoreError(ctx context.Context, req *nats.Msg, err error) {
+	var violations violationsError
+	switch {
+	case errors.As(err, &violations):
+		natsutil.RespondWithDetails(req, natsutil.InvalidCatalogItem, violations)
+	case isDuplicateSKU(err):
+		natsutil.RespondWithDetails(req, natsutil.InvalidCatalogItem, []messages.CatalogViolation{{
+			Field:   "sku",
+			Code:    "duplicate_sku",
+			Message: "another item has the same SKU",
+		}})
+	case isDuplicateBarcode(err):
+		natsutil.RespondWithDetails(req, natsutil.InvalidCatalogItem, []messages.CatalogViolation{{
+			Field:   "barcodes",
+			Code:    "duplicate_barcode",
+			Message: "another item has the same barcode",
+		}})
+	case isUnknownCategory(err):
+		natsutil.RespondWithDetails(req, natsutil.InvalidCatalogItem, []messages.CatalogViolation{{
+			Field:   "categories",
+			Code:    "unknown_category",
+			Message: "the item is tagged with a category that does not exist",
+		}})
+	case isUnknownComponent(err):
+		natsutil.RespondWithDetails(req, natsutil.InvalidCatalogItem, []messages.CatalogViolation{{
+			Field:   "components",
+			Code:    "unknown_component",
+			Message: "a component of the kit is not in the catalog",
+		}})
+	case errors.Is(err, errItemNotFound):
+		natsutil.Respond(req, natsutil.CatalogIdNotFound)
+	case errors.Is(err, errItemChanged):
+		natsutil.Respond(req, natsutil.CatalogItemChanged)
+	default:
+		slog.ErrorContext(ctx, "Error storing catalog item", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// usageTimeout is how long `catalog.delete` waits for the order service to tell whether an item is in use,
+// well within the timeout of the API gateway
+const usageTimeout = time.Second
+
+// goodUsage asks the order service for the stock of the good with the given id, and the open orders for it
+func goodUsage(nc *nats.Conn, id string) (messages.GoodUsage, error) {
+	var usage messages.GoodUsage
+
+	body, err := json.Marshal(messages.GetGoodUsage{GoodId: id})
+	if err != nil {
+		return usage, err
+	}
+
+	r, err := nc.Request("order.good_usage", body, usageTimeout)
+	if err != nil {
+		return usage, fmt.Errorf("request to order.good_usage failed: %w", err)
+	}
+	if code, description, ok := natsutil.ParseError(r.Data); ok {
+		return usage, fmt.Errorf("order.good_usage refused the request: %s: %s", code, description)
+	}
+	if err = json.Unmarshal(r.Data, &usage); err != nil {
+		return usage, fmt.Errorf("failed to unmarshal good usage: %w", err)
+	}
+	return usage, nil
+}
+
+// catalogEvent returns the event describing the change of an item from before to after:
+// before is nil for creations, and after is nil for deletions
+func catalogEvent(before, after *messages.CatalogItem) messages.CatalogEvent {
+	event := messages.CatalogEvent{Before: before, After: after, Timestamp: time.Now()}
+	switch {
+	case before == nil:
+		event.Type, event.Id = messages.CatalogItemCreatedEvent, after.Id
+	case after == nil:
+		event.Type, event.Id = messages.CatalogItemDeletedEvent, before.Id
+	case itemStatus(*before) != messages.CatalogItemArchived && itemStatus(*after) == messages.CatalogItemArchived:
+		event.Type, event.Id = messages.CatalogItemArchivedEvent, after.Id
+	case itemStatus(*before) == messages.CatalogItemArchived && itemStatus(*after) != messages.CatalogItemArchived:
+		event.Type, event.Id = messages.CatalogItemUnarchivedEvent, after.Id
+	default:
+		event.Type, event.Id = messages.CatalogItemUpdatedEvent, after.Id
+	}
+	return event
+}
+
+// eventMsgId identifies event in the catalog events stream, which drops the events published twice
+func eventMsgId(event messages.CatalogEvent) string {
+	var before, after uint64
+	if event.Before != nil {
+		before = event.Before.Revision
+	}
+	if event.After != nil {
+		after = event.After.Revision
+	}
+	return fmt.Sprintf("%s:%s:%d:%d", event.Id, event.Type, before, after)
+}
+
+// publishEvent publishes event on the catalog events stream
+func publishEvent(ctx context.Context, js jetstream.JetStream, event messages.CatalogEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = js.Publish(ctx, fmt.Sprintf("catalog.events.%s", event.Type), body, jetstream.WithMsgID(eventMsgId(event)))
+	return err
+}
+
+// Events are not published while changing items: a change that is rolled back must not be seen by consumers,
+// and a committed one must not be lost. queueEvent writes the event to the outbox in the transaction of the
+// change, and relayEvents publishes it once the change is committed. Events left in the outbox (e.g. because
+// the stream was unavailable) are published by RelayEventsLoop.
+
+// relayInterval is how often RelayEventsLoop publishes the events left in the outbox
+const relayInterval = 5 * time.Second
+
+// queueEvent adds event to the outbox, in the transaction of the change it describes
+func queueEvent(ctx context.Context, tx querier, event messages.CatalogEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "insert into catalog_event_outbox (event) values ($1)", body)
+	return err
+}
+
+// relayEvents publishes the events in the outbox in the order they were queued, and removes them.
+// The outbox is locked meanwhile, so that concurrent relays do not change the order of the events.
+// It returns the number of events published.
+func relayEvents(ctx context.Context, db *pgxpool.Pool, js jetstream.JetStream) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, "select id, event from catalog_event_outbox order by id for update")
+	if err != nil {
+		return 0, err
+	}
+	type queued struct {
+		id    int64
+		event messages.CatalogEvent
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (queued, error) {
+		var q queued
+		err := row.Scan(&q.id, &q.event)
+		return q, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// events published twice, e.g. when removing them from the outbox fails, are dropped by the stream
+	published := make([]int64, 0, len(events))
+	for _, q := range events {
+		if err = publishEvent(ctx, js, q.event); err != nil {
+			break
+		}
+		published = append(published, q.id)
+	}
+	// the events published so far are removed even if publishing the next ones failed
+	if _, removeErr := tx.Exec(ctx, "delete from catalog_event_outbox where id = any($1)", published); removeErr != nil {
+		return 0, removeErr
+	}
+	if commitErr := tx.Commit(ctx); commitErr != nil {
+		return 0, commitErr
+	}
+	return len(published), err
+}
+
+// relayCommitted publishes the events of a change that was just committed. If that fails, they are
+// published by RelayEventsLoop: the change is committed anyway.
+func relayCommitted(ctx context.Context, s *common.Service[catalogState]) {
+	// the events must be published even if the request context was cancelled meanwhile
+	if _, err := relayEvents(context.WithoutCancel(ctx), s.State().db, s.JetStream()); err != nil {
+		slog.ErrorContext(ctx, "Error publishing catalog events, they will be retried", "error", err)
+	}
+}
+
+// RelayEventsLoop publishes the events left in the outbox, e.g. by a crash right after committing a change,
+// at startup and then periodically, until ctx is done
+func RelayEventsLoop(ctx context.Context, s *common.Service[catalogState]) {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := relayEvents(ctx, s.State().db, s.JetStream())
+		if err != nil {
+			slog.ErrorContext(ctx, "Error publishing catalog events", "error", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "Published catalog events left in the outbox", "events", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
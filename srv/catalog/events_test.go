@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogEvent(t *testing.T) {
+	active := messages.CatalogItem{Id: "1", SKU: "HAT-01", Name: "Hat", Revision: 1}
+	renamed := messages.CatalogItem{Id: "1", SKU: "HAT-01", Name: "Red hat", Revision: 2}
+	archived := messages.CatalogItem{Id: "1", SKU: "HAT-01", Name: "Hat", Status: messages.CatalogItemArchived, Revision: 3}
+
+	cases := []struct {
+		before, after *messages.CatalogItem
+		want          messages.CatalogEventType
+	}{
+		{nil, &active, messages.CatalogItemCreatedEvent},
+		{&active, &renamed, messages.CatalogItemUpdatedEvent},
+		{&active, &archived, messages.CatalogItemArchivedEvent},
+		{&archived, &active, messages.CatalogItemUnarchivedEvent},
+		{&archived, nil, messages.CatalogItemDeletedEvent},
+	}
+	for _, c := range cases {
+		event := catalogEvent(c.before, c.after)
+		require.Equal(t, c.want, event.Type)
+		require.Equal(t, "1", event.Id)
+		require.Equal(t, c.before, event.Before)
+		require.Equal(t, c.after, event.After)
+	}
+}
+
+func TestPublishEvent(t *testing.T) {
+	ctx := context.Background()
+	nc := common.NewInProcessNATSServer(t)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	require.NoError(t, common.CreateStream(ctx, js, common.CatalogEventsStreamConfig))
+
+	before := messages.CatalogItem{Id: "1", SKU: "HAT-01", Name: "Hat", Revision: 1}
+	after := messages.CatalogItem{Id: "1", SKU: "HAT-01", Name: "Red hat", Revision: 2}
+	event := catalogEvent(&before, &after)
+	require.NoError(t, publishEvent(ctx, js, event))
+	require.NoError(t, publishEvent(ctx, js, event), "events published twice are dropped by the stream")
+
+	stream, err := js.Stream(ctx, common.CatalogEventsStreamConfig.Name)
+	require.NoError(t, err)
+	info, err := stream.Info(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), info.State.Msgs)
+
+	msg, err := stream.GetMsg(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "catalog.events.updated", msg.Subject)
+
+	var received messages.CatalogEvent
+	require.NoError(t, json.Unmarshal(msg.Data, &received))
+	require.Equal(t, "Hat", received.Before.Name)
+	require.Equal(t, "Red hat", received.After.Name)
+	require.WithinDuration(t, event.Timestamp, received.Timestamp, time.Millisecond)
+}
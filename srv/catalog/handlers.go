@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/google/uuid"
@@ -14,11 +18,41 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 )
 
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// validPrices returns whether every price of a price list is well-formed
+func validPrices(prices []messages.ItemPrice) bool {
+	for _, p := range prices {
+		if !currencyRegex.MatchString(p.Currency) || p.Amount < 0 {
+			return false
+		}
+		if p.EffectiveTo != nil && !p.EffectiveTo.After(p.EffectiveFrom) {
+			return false
+		}
+	}
+	return true
+}
+
 // PingHandler is the handler for `catalog.ping`
 func PingHandler(_ context.Context, s *common.Service[catalogState], req *nats.Msg) {
 	_ = req.Respond([]byte("pong"))
 }
 
+// respondItem responds to req with item
+func respondItem(ctx context.Context, req *nats.Msg, item messages.CatalogItem) {
+	body, err := json.Marshal(item)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling catalog item", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	err = req.Respond(body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
 // CreateHandler is the handler for `catalog.create`
 func CreateHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
 	var msg messages.CreateCatalogItem
@@ -29,25 +63,18 @@ func CreateHandler(ctx context.Context, s *common.Service[catalogState], req *na
 		return
 	}
 
-	id := uuid.New().String()
-	body, err := json.Marshal(messages.CatalogItem{
-		Id:   id,
-		Name: msg.Name,
-	})
-	if err != nil {
-		slog.ErrorContext(ctx, "Error marshaling catalog item", "error", err)
-		natsutil.Respond(req, natsutil.MarshalError)
+	if !validPrices(msg.Prices) {
+		natsutil.Respond(req, natsutil.InvalidPrices)
 		return
 	}
 
-	_, err = s.State().kv.Put(ctx, id, body)
+	item, err := createItem(ctx, s, newItem(uuid.New().String(), msg))
 	if err != nil {
-		slog.ErrorContext(ctx, "Error storing catalog item in KV", "error", err)
-		natsutil.Respond(req, natsutil.KvError)
+		respondStoreError(ctx, req, err)
 		return
 	}
 
-	err = req.Respond([]byte(id))
+	err = req.Respond([]byte(item.Id))
 	if err != nil {
 		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
 	}
@@ -62,23 +89,51 @@ func GetHandler(ctx context.Context, s *common.Service[catalogState], req *nats.
 		natsutil.Respond(req, natsutil.InvalidRequest)
 		return
 	}
+	respondProjected(ctx, s, req, msg.Id, msg.Languages)
+}
 
-	v, err := s.State().kv.Get(ctx, msg.Id)
-	if err != nil {
+// respondProjected responds to req with the item with the given id, along with its revision,
+// localised in the given languages
+func respondProjected(ctx context.Context, s *common.Service[catalogState], req *nats.Msg, id string, languages []string) {
+	// the item is read from the bucket, which has its revision
+	entry, err := s.State().kv.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrInvalidKey) {
+		natsutil.Respond(req, natsutil.CatalogIdNotFound)
+		return
+	}
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
 		slog.ErrorContext(ctx, "Error getting catalog item", "error", err)
 		natsutil.Respond(req, natsutil.KvError)
 		return
 	}
 
 	var item messages.CatalogItem
-	err = json.Unmarshal(v.Value(), &item)
-	if err != nil {
-		slog.ErrorContext(ctx, "Error unmarshaling catalog item", "error", err)
-		natsutil.Respond(req, natsutil.MarshalError)
-		return
+	if entry == nil {
+		// the database is the source of truth: items missing from the bucket until the next rebuild
+		// are returned without a revision, as changeItem does
+		stored, err := getItem(ctx, s.State().db, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting catalog item", "error", err)
+			natsutil.Respond(req, natsutil.QueryError)
+			return
+		}
+		if stored == nil {
+			natsutil.Respond(req, natsutil.CatalogIdNotFound)
+			return
+		}
+		slog.WarnContext(ctx, "Catalog item missing from the projection, read from the database", "id", id)
+		item = *stored
+	} else {
+		if err = json.Unmarshal(entry.Value(), &item); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling catalog item", "error", err)
+			natsutil.Respond(req, natsutil.MarshalError)
+			return
+		}
+		item.Revision = entry.Revision()
 	}
+	item = item.Localised(languages)
 
-	data, err := json.Marshal(&item)
+	data, err := json.Marshal(item)
 	if err != nil {
 		slog.ErrorContext(ctx, "Error marshaling catalog item", "error", err)
 		natsutil.Respond(req, natsutil.MarshalError)
@@ -92,29 +147,42 @@ func GetHandler(ctx context.Context, s *common.Service[catalogState], req *nats.
 	}
 }
 
-// ListHandler is the handler for `catalog.list`
-func ListHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
-	w, err := s.State().kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+// LookupHandler is the handler for `catalog.lookup`: it returns the item with the given barcode, written
+// in any of the GTIN formats
+func LookupHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.LookupCatalogItem
+	err := json.Unmarshal(req.Data, &msg)
 	if err != nil {
-		slog.ErrorContext(ctx, "Error watching keys", "error", err)
-		natsutil.Respond(req, natsutil.KvError)
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
 		return
 	}
 
-	res := make([]messages.CatalogItem, 0)
-	var item messages.CatalogItem
+	code := strings.TrimSpace(msg.Barcode)
+	if !validGTIN(code) {
+		natsutil.Respond(req, natsutil.InvalidBarcode)
+		return
+	}
+	id, err := lookupBarcode(ctx, s.State().db, code)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error looking up barcode", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+	if id == "" {
+		natsutil.Respond(req, natsutil.BarcodeNotFound)
+		return
+	}
+	respondProjected(ctx, s, req, id, msg.Languages)
+}
 
-	for v := range w.Updates() {
-		if v == nil {
-			break
-		}
-		err = json.Unmarshal(v.Value(), &item)
-		if err != nil {
-			slog.ErrorContext(ctx, "Error unmarshaling catalog item", "error", err)
-			natsutil.Respond(req, natsutil.MarshalError)
-			return
-		}
-		res = append(res, item)
+// ListHandler is the handler for `catalog.list`
+func ListHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	res, err := listItems(ctx, s.State().db)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing catalog items", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
 	}
 
 	resBody, err := json.Marshal(res)
@@ -130,6 +198,43 @@ func ListHandler(ctx context.Context, s *common.Service[catalogState], req *nats
 	}
 }
 
+// SearchHandler is the handler for `catalog.search`, which is served by the search index instead of the database
+func SearchHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.SearchCatalog
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	index := s.State().index
+	select {
+	case <-index.ready:
+	case <-time.After(indexLoadWait):
+		natsutil.Respond(req, natsutil.CatalogIndexLoading)
+		return
+	}
+
+	page, err := index.search(msg)
+	if err != nil {
+		natsutil.Respond(req, natsutil.InvalidSearch)
+		return
+	}
+
+	resBody, err := json.Marshal(page)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling catalog page", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	err = req.Respond(resBody)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
 // UpdateHandler is the handler for `catalog.update`
 func UpdateHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
 	var msg messages.CatalogItem
@@ -140,29 +245,111 @@ func UpdateHandler(ctx context.Context, s *common.Service[catalogState], req *na
 		return
 	}
 
-	body, err := json.Marshal(msg)
+	if !validPrices(msg.Prices) {
+		natsutil.Respond(req, natsutil.InvalidPrices)
+		return
+	}
+
+	if msg.Revision == 0 {
+		natsutil.Respond(req, natsutil.MissingRevision)
+		return
+	}
+
+	item, err := changeItem(ctx, s, msg.Id, msg.Revision, func(item *messages.CatalogItem) error {
+		*item = msg
+		return nil
+	})
 	if err != nil {
-		slog.ErrorContext(ctx, "Error marshaling catalog item", "error", err)
-		natsutil.Respond(req, natsutil.MarshalError)
+		respondStoreError(ctx, req, err)
+		return
+	}
+	respondItem(ctx, req, item)
+}
+
+// SetPricesHandler is the handler for `catalog.prices.set`: it replaces the price list of an item.
+// Orders already placed keep the prices they were created with.
+func SetPricesHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.SetCatalogPrices
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	if !validPrices(msg.Prices) {
+		natsutil.Respond(req, natsutil.InvalidPrices)
+		return
+	}
+
+	item, err := changeItem(ctx, s, msg.Id, msg.Revision, func(item *messages.CatalogItem) error {
+		item.Prices = msg.Prices
+		return nil
+	})
+	if err != nil {
+		respondStoreError(ctx, req, err)
+		return
+	}
+	respondItem(ctx, req, item)
+}
+
+// HistoryHandler is the handler for `catalog.history`: it returns the versions of an item kept by
+// the catalog bucket, from the oldest to the current one
+func HistoryHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.GetCatalogItem
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
 		return
 	}
 
-	_, err = s.State().kv.Put(ctx, msg.Id, body)
+	entries, err := s.State().kv.History(ctx, msg.Id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrInvalidKey) {
+		natsutil.Respond(req, natsutil.CatalogIdNotFound)
+		return
+	}
 	if err != nil {
-		slog.ErrorContext(ctx, "Error storing catalog item in KV", "error", err)
+		slog.ErrorContext(ctx, "Error getting catalog item history", "error", err)
 		natsutil.Respond(req, natsutil.KvError)
 		return
 	}
 
-	err = req.Respond([]byte("ok"))
+	res := make([]messages.CatalogItemVersion, 0, len(entries))
+	for _, entry := range entries {
+		version := messages.CatalogItemVersion{Revision: entry.Revision(), Timestamp: entry.Created()}
+		if entry.Operation() != jetstream.KeyValuePut {
+			version.Deleted = true
+		} else {
+			var item messages.CatalogItem
+			if err = json.Unmarshal(entry.Value(), &item); err != nil {
+				slog.ErrorContext(ctx, "Error unmarshaling catalog item", "error", err)
+				natsutil.Respond(req, natsutil.MarshalError)
+				return
+			}
+			item.Revision = entry.Revision()
+			version.Item = &item
+		}
+		res = append(res, version)
+	}
+
+	resBody, err := json.Marshal(res)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling catalog item history", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	err = req.Respond(resBody)
 	if err != nil {
 		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
 	}
 }
 
-// DeleteHandler is the handler for `catalog.delete`
+// DeleteHandler is the handler for `catalog.delete`. Items with stock or open orders are not deleted,
+// unless the request forces it: archiving them keeps them resolvable instead.
 func DeleteHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
-	var msg messages.GetCatalogItem
+	var msg messages.DeleteCatalogItem
 	err := json.Unmarshal(req.Data, &msg)
 	if err != nil {
 		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
@@ -170,10 +357,243 @@ func DeleteHandler(ctx context.Context, s *common.Service[catalogState], req *na
 		return
 	}
 
-	err = s.State().kv.Delete(ctx, msg.Id)
+	if !msg.Force {
+		usage, err := goodUsage(s.NatsConn(), msg.Id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error checking whether catalog item is in use", "error", err)
+			natsutil.Respond(req, natsutil.NatsError)
+			return
+		}
+		if usage.InUse() {
+			natsutil.RespondWithDetails(req, natsutil.CatalogItemInUse, usage)
+			return
+		}
+	}
+
+	tx, err := s.State().db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error starting transaction", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	item, err := lockItem(ctx, tx, msg.Id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting catalog item", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+	if item == nil {
+		natsutil.Respond(req, natsutil.CatalogIdNotFound)
+		return
+	}
+
+	// even forced deletions cannot leave kits with missing components
+	kits, err := kitsContaining(ctx, tx, item.Id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting the kits of catalog item", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+	if len(kits) > 0 {
+		natsutil.RespondWithDetails(req, natsutil.KitComponentInUse, kits)
+		return
+	}
+
+	if entry, err := s.State().kv.Get(ctx, item.Id); err == nil {
+		item.Revision = entry.Revision()
+	}
+	event := catalogEvent(item, nil)
+	event.Forced = msg.Force
+
+	// the item stays in the bucket until the deletion is committed
+	if err = deleteItem(ctx, tx, msg.Id); err == nil {
+		err = commitChange(ctx, s, tx, event)
+	}
 	if err != nil {
 		slog.ErrorContext(ctx, "Error deleting catalog item", "error", err)
-		natsutil.Respond(req, natsutil.KvError)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+	if err = unproject(ctx, s.State().kv, msg.Id); err != nil {
+		slog.ErrorContext(ctx, "Error removing catalog item from KV, it will be removed by the next rebuild", "error", err)
+	}
+
+	err = req.Respond([]byte("ok"))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// setStatusHandler returns the handler that moves items to the given status
+func setStatusHandler(status messages.CatalogItemStatus) common.Handler[catalogState] {
+	return func(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+		var msg messages.ArchiveCatalogItem
+		err := json.Unmarshal(req.Data, &msg)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+			natsutil.Respond(req, natsutil.InvalidRequest)
+			return
+		}
+
+		item, err := changeItem(ctx, s, msg.Id, msg.Revision, func(item *messages.CatalogItem) error {
+			item.Status = status
+			return nil
+		})
+		if err != nil {
+			respondStoreError(ctx, req, err)
+			return
+		}
+		respondItem(ctx, req, item)
+	}
+}
+
+// ArchiveHandler is the handler for `catalog.archive`: archived items cannot be ordered anymore,
+// but are kept for the stock and the orders that still refer to them
+var ArchiveHandler = setStatusHandler(messages.CatalogItemArchived)
+
+// UnarchiveHandler is the handler for `catalog.unarchive`
+var UnarchiveHandler = setStatusHandler(messages.CatalogItemActive)
+
+// ImportHandler is the handler for `catalog.import`
+func ImportHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.ImportCatalog
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	result, err := importItems(ctx, s, msg)
+	if errors.Is(err, errInvalidFormat) {
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+	if err != nil {
+		respondStoreError(ctx, req, err)
+		return
+	}
+	if len(result.Errors) > 0 {
+		natsutil.RespondWithDetails(req, natsutil.InvalidImport, result)
+		return
+	}
+
+	resBody, err := json.Marshal(result)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling import result", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	err = req.Respond(resBody)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// ExportHandler is the handler for `catalog.export`: the export is sent in chunks to the reply subject,
+// followed by an empty message
+func ExportHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.ExportCatalog
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil || (msg.Format != messages.CatalogCSV && msg.Format != messages.CatalogJSONLines) {
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	items, err := listItems(ctx, s.State().db)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing catalog items", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+
+	w := &chunkWriter{nc: s.NatsConn(), subject: req.Reply}
+	if err = writeExport(w, msg.Format, items); err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		// the client may have received part of the export already, and waits for the rest until it times out
+		slog.ErrorContext(ctx, "Error sending catalog export", "error", err)
+	}
+}
+
+// respondJSON responds to req with res, serialized as JSON
+func respondJSON(ctx context.Context, req *nats.Msg, res any) {
+	resBody, err := json.Marshal(res)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	err = req.Respond(resBody)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// ListCategoriesHandler is the handler for `catalog.categories.list`: it returns every category, sorted by path
+func ListCategoriesHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	categories, err := listCategories(ctx, s.State().db)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing categories", "error", err)
+		natsutil.Respond(req, natsutil.QueryError)
+		return
+	}
+	respondJSON(ctx, req, newCategoryTree(categories).sorted())
+}
+
+// CreateCategoryHandler is the handler for `catalog.categories.create`
+func CreateCategoryHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.CreateCategory
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	c, err := createCategory(ctx, s, msg)
+	if err != nil {
+		respondCategoryError(ctx, req, err)
+		return
+	}
+	respondJSON(ctx, req, c)
+}
+
+// UpdateCategoryHandler is the handler for `catalog.categories.update`
+func UpdateCategoryHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.UpdateCategory
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	c, err := updateCategory(ctx, s, msg)
+	if err != nil {
+		respondCategoryError(ctx, req, err)
+		return
+	}
+	respondJSON(ctx, req, c)
+}
+
+// DeleteCategoryHandler is the handler for `catalog.categories.delete`
+func DeleteCategoryHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.GetCategory
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	if err = deleteCategory(ctx, s, msg.Id); err != nil {
+		respondCategoryError(ctx, req, err)
 		return
 	}
 
@@ -182,3 +602,30 @@ func DeleteHandler(ctx context.Context, s *common.Service[catalogState], req *na
 		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
 	}
 }
+
+// CategoryGoodsHandler is the handler for `catalog.categories.goods`: it returns the goods in each category
+// (or in the subtree of the requested one), which the API gateway sums the stock of
+func CategoryGoodsHandler(ctx context.Context, s *common.Service[catalogState], req *nats.Msg) {
+	var msg messages.GetCategory
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	index := s.State().index
+	select {
+	case <-index.ready:
+	case <-time.After(indexLoadWait):
+		natsutil.Respond(req, natsutil.CatalogIndexLoading)
+		return
+	}
+
+	goods, ok := index.categoryGoods(msg.Id)
+	if !ok {
+		natsutil.Respond(req, natsutil.CategoryNotFound)
+		return
+	}
+	respondJSON(ctx, req, goods)
+}
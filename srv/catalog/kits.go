@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// kitViolations checks the components of a normalized item against the catalog. Kits cannot be nested:
+// the components of a kit cannot be kits, and kits cannot be components of other kits.
+func kitViolations(ctx context.Context, db querier, item messages.CatalogItem) ([]messages.CatalogViolation, error) {
+	if len(item.Components) == 0 {
+		return nil, nil
+	}
+	violations := make([]messages.CatalogViolation, 0)
+
+	var component bool
+	if err := db.QueryRow(ctx, "select exists (select 1 from catalog_kit_components where good_id = $1)", item.Id).Scan(&component); err != nil {
+		return nil, err
+	}
+	if component {
+		violations = append(violations, violation("components", "nested_kit", "the item is a component of other kits, and cannot be a kit itself"))
+	}
+
+	goods, _ := itemComponents(item)
+	rows, err := db.Query(ctx, `select id::text, exists (select 1 from catalog_kit_components where kit_id = catalog_items.id)
+		from catalog_items where id = any($1::uuid[])`, goods)
+	if err != nil {
+		return nil, err
+	}
+	// kits tells, for each component in the catalog, whether it is a kit
+	kits := make(map[string]bool)
+	var id string
+	var kit bool
+	if _, err = pgx.ForEachRow(rows, []any{&id, &kit}, func() error {
+		kits[id] = kit
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, c := range item.Components {
+		kit, found := kits[c.GoodId]
+		switch {
+		case !found:
+			violations = append(violations, violation("components", "unknown_component", fmt.Sprintf("%s is not in the catalog", c.GoodId)))
+		case kit:
+			violations = append(violations, violation("components", "nested_kit", fmt.Sprintf("%s is a kit, and kits cannot contain other kits", c.GoodId)))
+		}
+	}
+	return violations, nil
+}
+
+// kitsContaining returns the ids of the kits the item with the given id is a component of
+func kitsContaining(ctx context.Context, db querier, id string) ([]string, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+	rows, err := db.Query(ctx, "select kit_id::text from catalog_kit_components where good_id = $1 order by kit_id", parsed)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// validKit returns a violationsError if the components of a normalized item are not valid, like validItem
+func validKit(ctx context.Context, db querier, item messages.CatalogItem) error {
+	violations, err := kitViolations(ctx, db, item)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return violationsError(violations)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationsLock is the key of the advisory lock taken while migrating, so that replicas starting
+// together do not apply the same migration twice
+const migrationsLock = 0x636174616c6f67
+
+var migrationName = regexp.MustCompile(`^(\d+)_[a-z0-9_]+\.sql$`)
+
+// migration is a versioned change to the database schema, read from migrations/<version>_<name>.sql
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the migrations in the migrations directory of fsys, sorted by version
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration name %q: must be <version>_<name>.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %q: %w", entry.Name(), err)
+		}
+
+		sql, err := fs.ReadFile(fsys, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, migration{version: version, name: entry.Name(), sql: string(sql)})
+	}
+
+	slices.SortFunc(res, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(res); i++ {
+		if res[i].version == res[i-1].version {
+			return nil, fmt.Errorf("migrations %q and %q have the same version", res[i-1].name, res[i].name)
+		}
+	}
+	return res, nil
+}
+
+// migrate applies the embedded migrations that were not applied yet, each one in its own transaction
+func migrate(ctx context.Context, db *pgxpool.Pool) error {
+	migrations, err := loadMigrations(migrationsFS)
+	if err != nil {
+		return err
+	}
+
+	// advisory locks belong to a session, so everything runs on the same connection
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "select pg_advisory_lock($1)", migrationsLock); err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.Exec(context.WithoutCancel(ctx), "select pg_advisory_unlock($1)", migrationsLock)
+	}()
+
+	_, err = conn.Exec(ctx, `create table if not exists schema_migrations (
+		version int primary key,
+		name text not null,
+		applied_at timestamptz not null default now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(ctx, "select version from schema_migrations")
+	if err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, m.sql)
+		if err == nil {
+			_, err = tx.Exec(ctx, "insert into schema_migrations (version, name) values ($1, $2)", m.version, m.name)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			return fmt.Errorf("failed to apply migration %s: %w", m.name, err)
+		}
+		slog.InfoContext(ctx, "Applied migration", "migration", m.name)
+	}
+
+	return nil
+}
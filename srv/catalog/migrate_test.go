@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	// the embedded migrations are versioned from 1, without gaps
+	migrations, err := loadMigrations(migrationsFS)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.version, m.name)
+		require.NotEmpty(t, m.sql)
+	}
+
+	migrations, err = loadMigrations(fstest.MapFS{
+		"migrations/0010_later.sql":  {Data: []byte("select 10")},
+		"migrations/0002_second.sql": {Data: []byte("select 2")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []migration{
+		{version: 2, name: "0002_second.sql", sql: "select 2"},
+		{version: 10, name: "0010_later.sql", sql: "select 10"},
+	}, migrations)
+
+	_, err = loadMigrations(fstest.MapFS{"migrations/second.sql": {}})
+	require.ErrorContains(t, err, "invalid migration name")
+
+	_, err = loadMigrations(fstest.MapFS{"migrations/0002_a.sql": {}, "migrations/002_b.sql": {}})
+	require.ErrorContains(t, err, "same version")
+}
@@ -0,0 +1,13 @@
+-- the catalog table created by the old schema.sql used serial ids, while items have always been
+-- identified by UUIDs, and was never written to
+drop table if exists catalog;
+
+create table catalog_items (
+    id uuid primary key,
+    name text not null,
+    status text not null default 'active',
+    -- prices is the price list of the item, see messages.ItemPrice
+    prices jsonb not null default '[]',
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
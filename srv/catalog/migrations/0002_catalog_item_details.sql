@@ -0,0 +1,13 @@
+alter table catalog_items
+    -- items created before SKUs were introduced have none, and null SKUs are not unique
+    add column sku text unique,
+    add column description text not null default '',
+    add column unit text not null default 'pcs',
+    -- in grams
+    add column weight int not null default 0,
+    -- in millimetres, all set or all null
+    add column length int,
+    add column width int,
+    add column height int,
+    add column barcode text not null default '',
+    add column attributes jsonb not null default '{}';
@@ -0,0 +1,16 @@
+create table categories (
+    id uuid primary key,
+    -- root categories have no parent
+    parent_id uuid references categories (id),
+    name text not null,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now()
+);
+
+create table catalog_item_categories (
+    item_id uuid not null references catalog_items (id) on delete cascade,
+    -- categories with items cannot be deleted
+    category_id uuid not null references categories (id),
+    primary key (item_id, category_id)
+);
+create index catalog_item_categories_category_id on catalog_item_categories (category_id);
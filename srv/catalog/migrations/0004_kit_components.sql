@@ -0,0 +1,8 @@
+create table catalog_kit_components (
+    kit_id uuid not null references catalog_items (id) on delete cascade,
+    -- components of kits cannot be deleted
+    good_id uuid not null references catalog_items (id),
+    amount int not null check (amount > 0),
+    primary key (kit_id, good_id)
+);
+create index catalog_kit_components_good_id on catalog_kit_components (good_id);
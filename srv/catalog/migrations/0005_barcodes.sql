@@ -0,0 +1,21 @@
+create table catalog_item_barcodes (
+    -- gtin is the barcode as a GTIN-14, so that the same product cannot be added twice with codes of different lengths
+    gtin text primary key,
+    -- barcode is the code as entered, e.g. an EAN-13
+    barcode text not null,
+    item_id uuid not null references catalog_items (id) on delete cascade
+);
+create index catalog_item_barcodes_item_id on catalog_item_barcodes (item_id);
+
+-- barcodes were only required to be 8 to 14 digits: the valid GTINs are kept, by the first item that had them
+insert into catalog_item_barcodes (gtin, barcode, item_id)
+select distinct on (lpad(barcode, 14, '0')) lpad(barcode, 14, '0'), barcode, id
+from catalog_items
+where length(barcode) in (8, 12, 13, 14)
+    and (10 - (
+        select sum(substr(lpad(barcode, 14, '0'), i, 1)::int * (case when i % 2 = 1 then 3 else 1 end))
+        from generate_series(1, 13) as i
+    ) % 10) % 10 = right(barcode, 1)::int
+order by lpad(barcode, 14, '0'), created_at;
+
+alter table catalog_items drop column barcode;
@@ -0,0 +1,3 @@
+-- alternative units of measure of the items, e.g. [{"unit": "box", "factor": 12}]
+alter table catalog_items
+    add column units jsonb not null default '[]';
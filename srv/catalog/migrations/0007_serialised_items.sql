@@ -0,0 +1,3 @@
+-- serialised items have a serial number for each unit in stock, tracked by the warehouses
+alter table catalog_items
+    add column serialised boolean not null default false;
@@ -0,0 +1,3 @@
+-- names and descriptions of the items in other locales, e.g. {"it": {"name": "Cappello", "description": "..."}}
+alter table catalog_items
+    add column translations jsonb not null default '{}';
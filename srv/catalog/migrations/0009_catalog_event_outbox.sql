@@ -0,0 +1,6 @@
+-- catalog events waiting to be published on the catalog_events stream: they are written in the transaction
+-- of the change they describe, and published once it is committed, in order (see relayEvents)
+create table catalog_event_outbox (
+    id bigserial primary key,
+    event jsonb not null
+);
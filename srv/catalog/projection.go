@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// The database is the source of truth of the catalog, while the catalog bucket is a projection of it,
+// read by the other services. Changes are written to the bucket right before committing them to the
+// database (see changeItem), and reprojected if the commit fails. rebuildProjection repairs the projection
+// when it is lost.
+
+// projection returns the value of item in the catalog bucket
+func projection(item messages.CatalogItem) ([]byte, error) {
+	// the revision is the one of the entry
+	item.Revision = 0
+	return json.Marshal(item)
+}
+
+// project writes item to the catalog bucket. revision is the revision of the entry it replaces, or 0 if
+// there is none. It returns the revision of the new entry, and fails if the entry was changed in the meantime.
+func project(ctx context.Context, kv jetstream.KeyValue, item messages.CatalogItem, revision uint64) (uint64, error) {
+	body, err := projection(item)
+	if err != nil {
+		return 0, err
+	}
+	if revision == 0 {
+		return kv.Create(ctx, item.Id, body)
+	}
+	return kv.Update(ctx, item.Id, body, revision)
+}
+
+// unproject removes the item with the given id from the catalog bucket, if it is there
+func unproject(ctx context.Context, kv jetstream.KeyValue, id string) error {
+	// deleting a deleted key would add another delete marker to its history
+	_, err := kv.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return kv.Delete(ctx, id)
+}
+
+// reproject writes the item with the given id to the catalog bucket as it is in the database, or removes
+// it if it is not there: it repairs the projection of a change that was not committed
+func reproject(ctx context.Context, db querier, kv jetstream.KeyValue, id string) error {
+	item, err := getItem(ctx, db, id)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return unproject(ctx, kv, id)
+	}
+
+	body, err := projection(*item)
+	if err != nil {
+		return err
+	}
+	entry, err := kv.Get(ctx, id)
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return err
+	}
+	if entry != nil && bytes.Equal(entry.Value(), body) {
+		return nil
+	}
+	_, err = kv.Put(ctx, id, body)
+	return err
+}
+
+// projectedEntries returns the entry of every item in the catalog bucket, by id
+func projectedEntries(ctx context.Context, kv jetstream.KeyValue) (map[string]jetstream.KeyValueEntry, error) {
+	w, err := kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = w.Stop() }()
+
+	res := make(map[string]jetstream.KeyValueEntry)
+	for v := range w.Updates() {
+		if v == nil {
+			break
+		}
+		res[v.Key()] = v
+	}
+	return res, nil
+}
+
+// rebuildProjection writes every item of the database to the catalog bucket, and removes the items
+// that are not in the database anymore. Items that are already up-to-date are left alone, so that
+// they keep their revision and their history. It returns the number of items written.
+func rebuildProjection(ctx context.Context, db *pgxpool.Pool, kv jetstream.KeyValue) (int, error) {
+	items, err := listItems(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	projected, err := projectedEntries(ctx, kv)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, item := range items {
+		body, err := projection(item)
+		if err != nil {
+			return 0, err
+		}
+		entry, found := projected[item.Id]
+		delete(projected, item.Id)
+		if found && bytes.Equal(entry.Value(), body) {
+			continue
+		}
+		if _, err = kv.Put(ctx, item.Id, body); err != nil {
+			return 0, err
+		}
+		written++
+	}
+
+	// what is left is not in the database anymore
+	for id := range projected {
+		if err = unproject(ctx, kv, id); err != nil {
+			return 0, err
+		}
+	}
+
+	slog.InfoContext(ctx, "Rebuilt catalog projection", "items", len(items), "written", written, "removed", len(projected))
+	return written, nil
+}
+
+// seedFromProjection imports the items of the catalog bucket into an empty database: before the
+// database became the source of truth, items were only stored in the bucket, and would otherwise
+// be removed by the first rebuild
+func seedFromProjection(ctx context.Context, db *pgxpool.Pool, kv jetstream.KeyValue) error {
+	var empty bool
+	if err := db.QueryRow(ctx, "select not exists (select 1 from catalog_items)").Scan(&empty); err != nil {
+		return err
+	}
+	if !empty {
+		return nil
+	}
+
+	projected, err := projectedEntries(ctx, kv)
+	if err != nil || len(projected) == 0 {
+		return err
+	}
+	items := make([]messages.CatalogItem, 0, len(projected))
+	for _, entry := range projected {
+		var item messages.CatalogItem
+		if err = json.Unmarshal(entry.Value(), &item); err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	for _, item := range items {
+		if uuid.Validate(item.Id) != nil {
+			slog.WarnContext(ctx, "Skipping catalog item with an invalid id", "id", item.Id)
+			continue
+		}
+		if _, err = saveItem(ctx, tx, normalizeItem(item)); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Imported catalog items from the KV bucket", "items", len(items))
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProject(t *testing.T) {
+	ctx := context.Background()
+	js, err := jetstream.New(common.NewInProcessNATSServer(t))
+	require.NoError(t, err)
+	kv, err := js.CreateOrUpdateKeyValue(ctx, common.CatalogKeyValueConfig)
+	require.NoError(t, err)
+
+	item := messages.CatalogItem{Id: "hat", Name: "Hat", SKU: "HAT-01"}
+	first, err := project(ctx, kv, item, 0)
+	require.NoError(t, err)
+
+	// items are only created once
+	_, err = project(ctx, kv, item, 0)
+	require.ErrorIs(t, err, jetstream.ErrKeyExists)
+
+	item.Name = "Red hat"
+	item.Revision = first
+	second, err := project(ctx, kv, item, first)
+	require.NoError(t, err)
+
+	// updates based on an old revision are refused
+	item.Name = "Blue hat"
+	_, err = project(ctx, kv, item, first)
+	require.ErrorIs(t, err, jetstream.ErrKeyExists)
+
+	// the revision is not part of the projected item
+	entry, err := kv.Get(ctx, "hat")
+	require.NoError(t, err)
+	require.Equal(t, second, entry.Revision())
+	require.NotContains(t, string(entry.Value()), "revision")
+
+	require.NoError(t, unproject(ctx, kv, "hat"))
+	require.NoError(t, unproject(ctx, kv, "hat"))
+	history, err := kv.History(ctx, "hat")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, jetstream.KeyValueDelete, history[2].Operation())
+
+	// deleted items can be created again
+	_, err = project(ctx, kv, item, 0)
+	require.NoError(t, err)
+}
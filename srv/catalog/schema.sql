@@ -1,2 +0,0 @@
-create table
-    catalog (id serial primary key, name text not null);
\ No newline at end of file
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DefaultSearchLimit is the number of items in a page of `catalog.search`, when the request does not set one
+	DefaultSearchLimit = 50
+	// MaxSearchLimit is the largest page of `catalog.search`
+	MaxSearchLimit = 500
+	// indexLoadWait is how long `catalog.search` waits for the search index to be loaded
+	indexLoadWait = 2 * time.Second
+)
+
+var (
+	errInvalidSort   = errors.New("invalid sort")
+	errInvalidLimit  = errors.New("invalid limit")
+	errInvalidCursor = errors.New("invalid cursor")
+)
+
+var searchSorts = []string{"name", "-name", "sku", "-sku", "relevance"}
+
+// indexedItem is a catalog item, along with the lowercase text searched by queries
+type indexedItem struct {
+	item messages.CatalogItem
+	name string
+	// names are the translated names of the item, which queries match as well
+	names  []string
+	sku    string
+	tokens []string
+}
+
+// searchIndex is an in-memory index of the catalog, kept current from the catalog and categories buckets by watchIndex
+type searchIndex struct {
+	mu         sync.RWMutex
+	items      map[string]indexedItem
+	categories categoryTree
+	// ready is closed once both buckets have been loaded
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{items: make(map[string]indexedItem), categories: make(categoryTree), ready: make(chan struct{})}
+}
+
+// tokenize splits text in lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (idx *searchIndex) put(item messages.CatalogItem) {
+	tokens := tokenize(item.Name + " " + item.SKU + " " + item.Description)
+	for _, v := range item.Attributes {
+		tokens = append(tokens, tokenize(v)...)
+	}
+	names := make([]string, 0, len(item.Translations))
+	for _, t := range item.Translations {
+		tokens = append(tokens, tokenize(t.Name+" "+t.Description)...)
+		if t.Name != "" {
+			names = append(names, strings.ToLower(t.Name))
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.items[item.Id] = indexedItem{
+		item:   item,
+		name:   strings.ToLower(item.Name),
+		names:  names,
+		sku:    strings.ToLower(item.SKU),
+		tokens: tokens,
+	}
+}
+
+func (idx *searchIndex) remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.items, id)
+}
+
+func (idx *searchIndex) putCategory(c messages.Category) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.categories[c.Id] = c
+}
+
+func (idx *searchIndex) removeCategory(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.categories, id)
+}
+
+func (idx *searchIndex) markReady() {
+	idx.readyOnce.Do(func() { close(idx.ready) })
+}
+
+// watchIndex loads the catalog and categories buckets into idx, and keeps it current in background until ctx is done
+func watchIndex(ctx context.Context, kv jetstream.KeyValue, categories jetstream.KeyValue, idx *searchIndex) error {
+	var loading sync.WaitGroup
+	loading.Add(2)
+
+	err := watchBucket(ctx, kv, loading.Done, func(v jetstream.KeyValueEntry) {
+		if v.Operation() != jetstream.KeyValuePut {
+			idx.remove(v.Key())
+			return
+		}
+		var item messages.CatalogItem
+		if err := json.Unmarshal(v.Value(), &item); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling catalog item, not indexing it", "key", v.Key(), "error", err)
+			return
+		}
+		item.Revision = v.Revision()
+		idx.put(item)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = watchBucket(ctx, categories, loading.Done, func(v jetstream.KeyValueEntry) {
+		if v.Operation() != jetstream.KeyValuePut {
+			idx.removeCategory(v.Key())
+			return
+		}
+		var c messages.Category
+		if err := json.Unmarshal(v.Value(), &c); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling category, not indexing it", "key", v.Key(), "error", err)
+			return
+		}
+		idx.putCategory(c)
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		loading.Wait()
+		idx.markReady()
+	}()
+	return nil
+}
+
+// watchBucket passes every entry of kv to apply in background, until ctx is done, and calls loaded
+// once the entries that were in the bucket when it started have been applied
+func watchBucket(ctx context.Context, kv jetstream.KeyValue, loaded func(), apply func(jetstream.KeyValueEntry)) error {
+	w, err := kv.WatchAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer func() { _ = w.Stop() }()
+		var loadedOnce sync.Once
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case v, ok := <-w.Updates():
+				if !ok {
+					return
+				}
+				// the watcher sends nil after the values that were in the bucket when it started
+				if v == nil {
+					loadedOnce.Do(loaded)
+					continue
+				}
+				apply(v)
+			}
+		}
+	}()
+	return nil
+}
+
+// relevance returns how relevant it is for a lowercase query, split in words, or 0 if it does not match it
+func (it indexedItem) relevance(query string, words []string) int {
+	switch {
+	case query == "":
+		return 1
+	case it.sku == query:
+		return 4
+	case strings.HasPrefix(it.sku, query):
+		return 3
+	case strings.HasPrefix(it.name, query), slices.ContainsFunc(it.names, func(n string) bool { return strings.HasPrefix(n, query) }):
+		return 2
+	}
+
+	if len(words) == 0 {
+		return 0
+	}
+	for _, w := range words {
+		if !slices.ContainsFunc(it.tokens, func(t string) bool { return strings.HasPrefix(t, w) }) {
+			return 0
+		}
+	}
+	return 1
+}
+
+// matches returns whether it has the status and attributes requested, and belongs to one of the
+// given categories, unless they are nil
+func (it indexedItem) matches(req messages.SearchCatalog, categories map[string]bool) bool {
+	if req.Status != "" && itemStatus(it.item) != req.Status {
+		return false
+	}
+	if categories != nil && !slices.ContainsFunc(it.item.Categories, func(id string) bool { return categories[id] }) {
+		return false
+	}
+	for k, v := range req.Attributes {
+		if value, ok := it.item.Attributes[k]; !ok || !strings.EqualFold(value, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// position is where an item is in the results of a search, and is encoded in cursors
+type position struct {
+	Sort  string `json:"sort"`
+	Score int    `json:"score,omitempty"`
+	Key   string `json:"key"`
+	Id    string `json:"id"`
+}
+
+// position returns the position of the item in a search, given its name in the languages of the search
+func (it indexedItem) position(sort string, score int, name string) position {
+	key := strings.ToLower(name)
+	if strings.TrimPrefix(sort, "-") == "sku" {
+		key = it.sku
+	}
+	return position{Sort: sort, Score: score, Key: key, Id: it.item.Id}
+}
+
+// comparePositions sorts by relevance (for "relevance" only), then by key, and finally by id,
+// so that two items never have the same position
+func comparePositions(a, b position) int {
+	c := 0
+	if a.Sort == "relevance" {
+		c = b.Score - a.Score
+	}
+	if c == 0 {
+		c = strings.Compare(a.Key, b.Key)
+		if strings.HasPrefix(a.Sort, "-") {
+			c = -c
+		}
+	}
+	if c == 0 {
+		c = strings.Compare(a.Id, b.Id)
+	}
+	return c
+}
+
+func encodeCursor(p position) string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string, sort string) (position, error) {
+	var p position
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(data, &p) != nil || p.Sort != sort {
+		return p, errInvalidCursor
+	}
+	return p, nil
+}
+
+// search returns the page of items matching req. Pages start after the position in the cursor,
+// so they do not skip nor repeat items when the catalog changes in between.
+func (idx *searchIndex) search(req messages.SearchCatalog) (messages.CatalogPage, error) {
+	sort := req.Sort
+	if sort == "" {
+		sort = "name"
+		if strings.TrimSpace(req.Query) != "" {
+			sort = "relevance"
+		}
+	}
+	if !slices.Contains(searchSorts, sort) {
+		return messages.CatalogPage{}, errInvalidSort
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit < 0 || limit > MaxSearchLimit {
+		return messages.CatalogPage{}, errInvalidLimit
+	}
+
+	var after *position
+	if req.Cursor != "" {
+		p, err := decodeCursor(req.Cursor, sort)
+		if err != nil {
+			return messages.CatalogPage{}, err
+		}
+		after = &p
+	}
+
+	query := strings.ToLower(strings.TrimSpace(req.Query))
+	words := tokenize(query)
+
+	type hit struct {
+		item     messages.CatalogItem
+		position position
+	}
+	hits := make([]hit, 0)
+
+	idx.mu.RLock()
+	var categories map[string]bool
+	if req.Category != "" {
+		categories = idx.categories.subtree(req.Category)
+	}
+	for _, it := range idx.items {
+		if !it.matches(req, categories) {
+			continue
+		}
+		if score := it.relevance(query, words); score > 0 {
+			item := it.item.Localised(req.Languages)
+			hits = append(hits, hit{item: item, position: it.position(sort, score, item.Name)})
+		}
+	}
+	idx.mu.RUnlock()
+
+	slices.SortFunc(hits, func(a, b hit) int { return comparePositions(a.position, b.position) })
+
+	start := 0
+	if after != nil {
+		start, _ = slices.BinarySearchFunc(hits, *after, func(h hit, p position) int {
+			// positions equal to the cursor are the last item of the previous page
+			if c := comparePositions(h.position, p); c != 0 {
+				return c
+			}
+			return -1
+		})
+	}
+	end := min(start+limit, len(hits))
+
+	page := messages.CatalogPage{Items: make([]messages.CatalogItem, 0, end-start), Total: len(hits)}
+	for _, h := range hits[start:end] {
+		page.Items = append(page.Items, h.item)
+	}
+	if end < len(hits) {
+		page.NextCursor = encodeCursor(hits[end-1].position)
+	}
+	return page, nil
+}
+
+// categoryGoods returns the goods in each category of the subtree of the category with the given id,
+// or of every category if the id is empty. It returns false if there is no category with the given id.
+func (idx *searchIndex) categoryGoods(id string) ([]messages.CategoryGoods, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var selected map[string]bool
+	if id != "" {
+		if _, ok := idx.categories[id]; !ok {
+			return nil, false
+		}
+		selected = idx.categories.subtree(id)
+	}
+
+	goods := make(map[string][]string)
+	for _, it := range idx.items {
+		for categoryId := range idx.categories {
+			if selected != nil && !selected[categoryId] {
+				continue
+			}
+			if slices.ContainsFunc(it.item.Categories, func(tag string) bool { return idx.categories.contains(categoryId, tag) }) {
+				goods[categoryId] = append(goods[categoryId], it.item.Id)
+			}
+		}
+	}
+
+	res := make([]messages.CategoryGoods, 0)
+	for _, c := range idx.categories.sorted() {
+		if selected != nil && !selected[c.Id] {
+			continue
+		}
+		items := goods[c.Id]
+		if items == nil {
+			items = make([]string, 0)
+		}
+		slices.Sort(items)
+		res = append(res, messages.CategoryGoods{Category: c, Goods: items})
+	}
+	return res, true
+}
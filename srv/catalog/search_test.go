@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+// itemIds returns the id of every item of a page, in order
+func itemIds(page messages.CatalogPage) []string {
+	ids := make([]string, 0, len(page.Items))
+	for _, item := range page.Items {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+func testIndex() *searchIndex {
+	idx := newSearchIndex()
+	idx.put(messages.CatalogItem{Id: "1", Name: "Red hat", SKU: "HAT-01", Attributes: map[string]string{"color": "red"}})
+	idx.put(messages.CatalogItem{Id: "2", Name: "Blue hat", SKU: "HAT-02", Attributes: map[string]string{"color": "blue"}})
+	idx.put(messages.CatalogItem{Id: "3", Name: "Hatchback toy car", SKU: "TOY-01", Description: "A red car"})
+	idx.put(messages.CatalogItem{Id: "4", Name: "Scarf", SKU: "SCARF-01", Status: messages.CatalogItemArchived, Attributes: map[string]string{"color": "red"}})
+	return idx
+}
+
+func TestSearchIndex_Search(t *testing.T) {
+	idx := testIndex()
+	search := func(req messages.SearchCatalog) []string {
+		page, err := idx.search(req)
+		require.NoError(t, err)
+		return itemIds(page)
+	}
+
+	require.Equal(t, []string{"2", "3", "1", "4"}, search(messages.SearchCatalog{}))
+	require.Equal(t, []string{"4", "1", "3", "2"}, search(messages.SearchCatalog{Sort: "-name"}))
+	require.Equal(t, []string{"1", "2", "4", "3"}, search(messages.SearchCatalog{Sort: "sku"}))
+
+	// the exact SKU first, then SKU prefixes, name prefixes and words
+	require.Equal(t, []string{"2"}, search(messages.SearchCatalog{Query: "hat-02"}))
+	require.Equal(t, []string{"2", "1", "3"}, search(messages.SearchCatalog{Query: "HAT"}))
+	require.Equal(t, []string{"1", "3", "2"}, search(messages.SearchCatalog{Query: "hat", Sort: "-name"}))
+	require.Equal(t, []string{"1", "3"}, search(messages.SearchCatalog{Query: "red ha"}))
+	require.Equal(t, []string{"3"}, search(messages.SearchCatalog{Query: "red car"}))
+	require.Empty(t, search(messages.SearchCatalog{Query: "green"}))
+
+	require.Equal(t, []string{"1", "4"}, search(messages.SearchCatalog{Attributes: map[string]string{"color": "Red"}}))
+	require.Equal(t, []string{"1"}, search(messages.SearchCatalog{Attributes: map[string]string{"color": "red"}, Status: messages.CatalogItemActive}))
+	require.Equal(t, []string{"4"}, search(messages.SearchCatalog{Status: messages.CatalogItemArchived}))
+
+	idx.putCategory(messages.Category{Id: "apparel", Name: "Apparel"})
+	idx.putCategory(messages.Category{Id: "hats", Name: "Hats", ParentId: "apparel"})
+	idx.put(messages.CatalogItem{Id: "1", Name: "Red hat", SKU: "HAT-01", Categories: []string{"hats"}})
+	idx.put(messages.CatalogItem{Id: "4", Name: "Scarf", SKU: "SCARF-01", Categories: []string{"apparel"}})
+	require.Equal(t, []string{"1"}, search(messages.SearchCatalog{Category: "hats"}))
+	require.Equal(t, []string{"1", "4"}, search(messages.SearchCatalog{Category: "apparel"}))
+	require.Empty(t, search(messages.SearchCatalog{Category: "toys"}))
+
+	_, err := idx.search(messages.SearchCatalog{Sort: "price"})
+	require.ErrorIs(t, err, errInvalidSort)
+	_, err = idx.search(messages.SearchCatalog{Limit: MaxSearchLimit + 1})
+	require.ErrorIs(t, err, errInvalidLimit)
+	_, err = idx.search(messages.SearchCatalog{Cursor: "nope"})
+	require.ErrorIs(t, err, errInvalidCursor)
+}
+
+func TestSearchIndex_Pagination(t *testing.T) {
+	idx := testIndex()
+
+	page, err := idx.search(messages.SearchCatalog{Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "3", "1"}, itemIds(page))
+	require.Equal(t, 4, page.Total)
+	require.NotEmpty(t, page.NextCursor)
+
+	// items changing between pages are neither repeated nor skipped
+	idx.remove("2")
+	idx.put(messages.CatalogItem{Id: "5", Name: "Socks", SKU: "SOCK-01"})
+
+	page, err = idx.search(messages.SearchCatalog{Limit: 3, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	require.Equal(t, []string{"4", "5"}, itemIds(page))
+	require.Empty(t, page.NextCursor)
+
+	// cursors only work with the sort they were created with
+	page, err = idx.search(messages.SearchCatalog{Limit: 1})
+	require.NoError(t, err)
+	_, err = idx.search(messages.SearchCatalog{Limit: 1, Sort: "sku", Cursor: page.NextCursor})
+	require.ErrorIs(t, err, errInvalidCursor)
+}
+
+func TestSearchIndex_Languages(t *testing.T) {
+	idx := testIndex()
+	idx.put(messages.CatalogItem{Id: "1", Name: "Red hat", SKU: "HAT-01", Translations: map[string]messages.ItemTranslation{
+		"it": {Name: "Cappello rosso", Description: "Di lana"},
+		"de": {Name: "Roter Hut"},
+	}})
+
+	// translated names and descriptions are searched whatever the languages of the request
+	page, err := idx.search(messages.SearchCatalog{Query: "cappello"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, itemIds(page))
+	require.Equal(t, "Red hat", page.Items[0].Name)
+	page, err = idx.search(messages.SearchCatalog{Query: "lana"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, itemIds(page))
+
+	// items are localised, and sorted by their localised names
+	page, err = idx.search(messages.SearchCatalog{Languages: []string{"it-IT", "en"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "1", "3", "4"}, itemIds(page))
+	require.Equal(t, "Cappello rosso", page.Items[1].Name)
+	require.Equal(t, "Di lana", page.Items[1].Description)
+	require.Equal(t, "Blue hat", page.Items[0].Name)
+
+	page, err = idx.search(messages.SearchCatalog{Languages: []string{"de"}, Limit: 3})
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "3", "1"}, itemIds(page))
+	page, err = idx.search(messages.SearchCatalog{Languages: []string{"de"}, Limit: 3, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	require.Equal(t, []string{"4"}, itemIds(page))
+}
+
+func TestWatchIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	js, err := jetstream.New(common.NewInProcessNATSServer(t))
+	require.NoError(t, err)
+	kv, err := js.CreateOrUpdateKeyValue(ctx, common.CatalogKeyValueConfig)
+	require.NoError(t, err)
+	categories, err := js.CreateOrUpdateKeyValue(ctx, common.CategoriesKeyValueConfig)
+	require.NoError(t, err)
+
+	for i := range 3 {
+		_, err := project(ctx, kv, messages.CatalogItem{Id: fmt.Sprint(i), Name: fmt.Sprint("item ", i), Categories: []string{"hats"}}, 0)
+		require.NoError(t, err)
+	}
+	require.NoError(t, projectCategory(ctx, categories, messages.Category{Id: "apparel", Name: "Apparel"}))
+	require.NoError(t, projectCategory(ctx, categories, messages.Category{Id: "hats", Name: "Hats", ParentId: "apparel"}))
+
+	idx := newSearchIndex()
+	require.NoError(t, watchIndex(ctx, kv, categories, idx))
+	select {
+	case <-idx.ready:
+	case <-time.After(time.Second):
+		t.Fatal("index not loaded")
+	}
+
+	page, err := idx.search(messages.SearchCatalog{Category: "apparel"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "1", "2"}, itemIds(page))
+
+	require.NoError(t, unproject(ctx, kv, "1"))
+	body, err := json.Marshal(messages.CatalogItem{Id: "2", Name: "renamed"})
+	require.NoError(t, err)
+	_, err = kv.Put(ctx, "2", body)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		page, err := idx.search(messages.SearchCatalog{Query: "renamed"})
+		require.NoError(t, err)
+		return len(page.Items) == 1 && page.Total == 1
+	}, time.Second, 10*time.Millisecond)
+	page, err = idx.search(messages.SearchCatalog{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "2"}, itemIds(page))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// querier is implemented by both *pgxpool.Pool and pgx.Tx
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+const itemColumns = "id, name, coalesce(sku, ''), description, unit, weight, length, width, height, " +
+	"array(select barcode from catalog_item_barcodes where item_id = catalog_items.id order by barcode), status, attributes, prices, units, serialised, translations, " +
+	"array(select category_id::text from catalog_item_categories where item_id = catalog_items.id order by category_id), " +
+	"coalesce((select jsonb_agg(jsonb_build_object('good_id', good_id::text, 'amount', amount) order by good_id::text) " +
+	"from catalog_kit_components where kit_id = catalog_items.id), '[]')"
+
+// scanItem reads a row selected with itemColumns
+func scanItem(row pgx.Row) (messages.CatalogItem, error) {
+	var item messages.CatalogItem
+	var id uuid.UUID
+	var length, width, height *int
+	err := row.Scan(&id, &item.Name, &item.SKU, &item.Description, &item.Unit, &item.Weight, &length, &width, &height,
+		&item.Barcodes, &item.Status, &item.Attributes, &item.Prices, &item.Units, &item.Serialised, &item.Translations, &item.Categories, &item.Components)
+	item.Id = id.String()
+	if length != nil && width != nil && height != nil {
+		item.Dimensions = &messages.Dimensions{Length: *length, Width: *width, Height: *height}
+	}
+	if len(item.Attributes) == 0 {
+		item.Attributes = nil
+	}
+	if len(item.Prices) == 0 {
+		item.Prices = nil
+	}
+	if len(item.Units) == 0 {
+		item.Units = nil
+	}
+	if len(item.Translations) == 0 {
+		item.Translations = nil
+	}
+	if len(item.Barcodes) == 0 {
+		item.Barcodes = nil
+	}
+	if len(item.Categories) == 0 {
+		item.Categories = nil
+	}
+	if len(item.Components) == 0 {
+		item.Components = nil
+	}
+	return item, err
+}
+
+// itemPrices returns the prices of item as stored in the database, where the price list is never null
+func itemPrices(item messages.CatalogItem) []messages.ItemPrice {
+	if item.Prices == nil {
+		return []messages.ItemPrice{}
+	}
+	return item.Prices
+}
+
+// itemUnits returns the alternative units of item as stored in the database, where they are never null
+func itemUnits(item messages.CatalogItem) []messages.ItemUnit {
+	if item.Units == nil {
+		return []messages.ItemUnit{}
+	}
+	return item.Units
+}
+
+// itemTranslations returns the translations of item as stored in the database, where they are never null
+func itemTranslations(item messages.CatalogItem) map[string]messages.ItemTranslation {
+	if item.Translations == nil {
+		return map[string]messages.ItemTranslation{}
+	}
+	return item.Translations
+}
+
+// itemAttributes returns the attributes of item as stored in the database, where they are never null
+func itemAttributes(item messages.CatalogItem) map[string]string {
+	if item.Attributes == nil {
+		return map[string]string{}
+	}
+	return item.Attributes
+}
+
+// itemStatus returns the status of item as stored in the database, where items are active unless told otherwise
+func itemStatus(item messages.CatalogItem) messages.CatalogItemStatus {
+	if item.Status == "" {
+		return messages.CatalogItemActive
+	}
+	return item.Status
+}
+
+// lockItem returns the item with the given id, or nil if it does not exist, and locks it until the end of the transaction
+func lockItem(ctx context.Context, tx pgx.Tx, id string) (*messages.CatalogItem, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	item, err := scanItem(tx.QueryRow(ctx, "select "+itemColumns+" from catalog_items where id = $1 for update", parsed))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// getItem returns the item with the given id, or nil if it does not exist
+func getItem(ctx context.Context, db querier, id string) (*messages.CatalogItem, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	item, err := scanItem(db.QueryRow(ctx, "select "+itemColumns+" from catalog_items where id = $1", parsed))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// lockItemsBySKU returns the items with the given SKUs, by SKU, and locks them until the end of the transaction
+func lockItemsBySKU(ctx context.Context, tx pgx.Tx, skus []string) (map[string]messages.CatalogItem, error) {
+	rows, err := tx.Query(ctx, "select "+itemColumns+" from catalog_items where sku = any($1) order by sku for update", skus)
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (messages.CatalogItem, error) {
+		return scanItem(row)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]messages.CatalogItem, len(items))
+	for _, item := range items {
+		res[item.SKU] = item
+	}
+	return res, nil
+}
+
+// listItems returns every item, sorted by name
+func listItems(ctx context.Context, db querier) ([]messages.CatalogItem, error) {
+	rows, err := db.Query(ctx, "select "+itemColumns+" from catalog_items order by name, id")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (messages.CatalogItem, error) {
+		return scanItem(row)
+	})
+}
+
+// saveItem stores item, creating it if it does not exist, and returns it as stored
+func saveItem(ctx context.Context, db querier, item messages.CatalogItem) (messages.CatalogItem, error) {
+	id, err := uuid.Parse(item.Id)
+	if err != nil {
+		return item, err
+	}
+
+	var length, width, height *int
+	if d := item.Dimensions; d != nil {
+		length, width, height = &d.Length, &d.Width, &d.Height
+	}
+
+	saved, err := scanItem(db.QueryRow(ctx, `insert into catalog_items
+		(id, name, sku, description, unit, weight, length, width, height, status, attributes, prices, units, serialised, translations)
+		values ($1, $2, nullif($3, ''), $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		on conflict (id) do update set name = excluded.name, sku = excluded.sku, description = excluded.description,
+			unit = excluded.unit, weight = excluded.weight, length = excluded.length, width = excluded.width,
+			height = excluded.height, status = excluded.status,
+			attributes = excluded.attributes, prices = excluded.prices, units = excluded.units,
+			serialised = excluded.serialised, translations = excluded.translations, updated_at = now()
+		returning `+itemColumns,
+		id, item.Name, item.SKU, item.Description, item.Unit, item.Weight, length, width, height,
+		itemStatus(item), itemAttributes(item), itemPrices(item), itemUnits(item), item.Serialised, itemTranslations(item),
+	))
+	if err != nil {
+		return saved, err
+	}
+
+	// the barcodes and categories returned above are the ones the item had before
+	if _, err = db.Exec(ctx, "delete from catalog_item_barcodes where item_id = $1", id); err != nil {
+		return saved, err
+	}
+	_, err = db.Exec(ctx, `insert into catalog_item_barcodes (gtin, barcode, item_id)
+		select unnest($1::text[]), unnest($2::text[]), $3`, itemGTINs(item), itemBarcodes(item), id)
+	if err != nil {
+		return saved, err
+	}
+	saved.Barcodes = item.Barcodes
+
+	if _, err = db.Exec(ctx, "delete from catalog_item_categories where item_id = $1 and category_id::text <> all($2)", id, itemCategories(item)); err != nil {
+		return saved, err
+	}
+	_, err = db.Exec(ctx, `insert into catalog_item_categories (item_id, category_id)
+		select $1, unnest($2::uuid[]) on conflict do nothing`, id, itemCategories(item))
+	if err != nil {
+		return saved, err
+	}
+	saved.Categories = item.Categories
+
+	goods, amounts := itemComponents(item)
+	if _, err = db.Exec(ctx, "delete from catalog_kit_components where kit_id = $1", id); err != nil {
+		return saved, err
+	}
+	_, err = db.Exec(ctx, `insert into catalog_kit_components (kit_id, good_id, amount)
+		select $1, unnest($2::uuid[]), unnest($3::int[])`, id, goods, amounts)
+	saved.Components = item.Components
+	return saved, err
+}
+
+// itemComponents returns the goods of the components of item, and their amounts, as passed to the database
+func itemComponents(item messages.CatalogItem) ([]string, []int) {
+	goods := make([]string, 0, len(item.Components))
+	amounts := make([]int, 0, len(item.Components))
+	for _, c := range item.Components {
+		goods = append(goods, c.GoodId)
+		amounts = append(amounts, c.Amount)
+	}
+	return goods, amounts
+}
+
+// itemCategories returns the categories of item, as passed to the database
+func itemCategories(item messages.CatalogItem) []string {
+	if item.Categories == nil {
+		return []string{}
+	}
+	return item.Categories
+}
+
+// isUnknownCategory returns whether err was caused by tagging an item with a category that does not exist
+func isUnknownCategory(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23503 is foreign_key_violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.TableName == "catalog_item_categories"
+}
+
+// isUnknownComponent returns whether err was caused by adding a good that does not exist to a kit
+func isUnknownComponent(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.ConstraintName == "catalog_kit_components_good_id_fkey"
+}
+
+// isDuplicateSKU returns whether err was caused by storing an item with the SKU of another one
+func isDuplicateSKU(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23505 is unique_violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "catalog_items_sku_key"
+}
+
+// deleteItem deletes the item with the given id, if it exists
+func deleteItem(ctx context.Context, db querier, id string) error {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil
+	}
+	_, err = db.Exec(ctx, "delete from catalog_items where id = $1", parsed)
+	return err
+}
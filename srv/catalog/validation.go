@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+)
+
+// DefaultUnit is the unit of measure of items that do not declare one
+const DefaultUnit = "pcs"
+
+const (
+	maxNameLength        = 200
+	maxDescriptionLength = 4000
+	maxAttributes        = 50
+	maxAttributeLength   = 500
+	maxCategories        = 20
+	maxComponents        = 20
+	// maxComponentAmount is the largest amount of a component in a kit, which orders multiply by the kits ordered
+	maxComponentAmount = 1000
+	maxUnits           = 10
+	maxTranslations    = 50
+	// maxUnitFactor is the largest amount of base units in an alternative unit, e.g. a pallet
+	maxUnitFactor = 1000000
+)
+
+var (
+	skuRegex       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+	unitRegex      = regexp.MustCompile(`^[a-z][a-z0-9]{0,15}$`)
+	attributeRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+// newItem returns the item created by a `catalog.create` request
+func newItem(id string, req messages.CreateCatalogItem) messages.CatalogItem {
+	return messages.CatalogItem{
+		Id:           id,
+		Name:         req.Name,
+		SKU:          req.SKU,
+		Description:  req.Description,
+		Translations: req.Translations,
+		Unit:         req.Unit,
+		Units:        req.Units,
+		Weight:       req.Weight,
+		Dimensions:   req.Dimensions,
+		Barcodes:     req.Barcodes,
+		Status:       req.Status,
+		Attributes:   req.Attributes,
+		Categories:   req.Categories,
+		Components:   req.Components,
+		Serialised:   req.Serialised,
+		Prices:       req.Prices,
+	}
+}
+
+// normalizeItem trims the text fields of item, and fills in the defaults of the missing ones
+func normalizeItem(item messages.CatalogItem) messages.CatalogItem {
+	item.Name = strings.TrimSpace(item.Name)
+	item.SKU = strings.TrimSpace(item.SKU)
+	item.Description = strings.TrimSpace(item.Description)
+	item.Unit = strings.ToLower(strings.TrimSpace(item.Unit))
+	if item.Unit == "" {
+		item.Unit = DefaultUnit
+	}
+	if item.Status == "" {
+		item.Status = messages.CatalogItemActive
+	}
+	item.Units = normalizeUnits(item.Units)
+	item.Translations = normalizeTranslations(item.Translations)
+	if len(item.Categories) > 0 {
+		categories := make([]string, 0, len(item.Categories))
+		for _, id := range item.Categories {
+			if parsed, err := uuid.Parse(strings.TrimSpace(id)); err == nil {
+				id = parsed.String()
+			}
+			categories = append(categories, id)
+		}
+		slices.Sort(categories)
+		item.Categories = slices.Compact(categories)
+	} else {
+		item.Categories = nil
+	}
+	if len(item.Barcodes) > 0 {
+		barcodes := make([]string, 0, len(item.Barcodes))
+		for _, code := range item.Barcodes {
+			barcodes = append(barcodes, strings.TrimSpace(code))
+		}
+		slices.Sort(barcodes)
+		item.Barcodes = slices.Compact(barcodes)
+	} else {
+		item.Barcodes = nil
+	}
+	item.Components = normalizeComponents(item.Components)
+	return item
+}
+
+// normalizeTranslations normalizes the locales of translations, trims their text, and drops the empty ones
+func normalizeTranslations(translations map[string]messages.ItemTranslation) map[string]messages.ItemTranslation {
+	normalized := make(map[string]messages.ItemTranslation)
+	for _, locale := range slices.Sorted(maps.Keys(translations)) {
+		t := messages.ItemTranslation{
+			Name:        strings.TrimSpace(translations[locale].Name),
+			Description: strings.TrimSpace(translations[locale].Description),
+		}
+		if t != (messages.ItemTranslation{}) {
+			normalized[messages.NormalizeLocale(locale)] = t
+		}
+	}
+	if len(normalized) == 0 {
+		return nil
+	}
+	return normalized
+}
+
+// normalizeUnits lowercases the alternative units of measure, and sorts them by factor
+func normalizeUnits(units []messages.ItemUnit) []messages.ItemUnit {
+	if len(units) == 0 {
+		return nil
+	}
+	normalized := make([]messages.ItemUnit, 0, len(units))
+	for _, u := range units {
+		normalized = append(normalized, messages.ItemUnit{Unit: strings.ToLower(strings.TrimSpace(u.Unit)), Factor: u.Factor})
+	}
+	slices.SortStableFunc(normalized, func(a, b messages.ItemUnit) int {
+		if a.Factor != b.Factor {
+			return a.Factor - b.Factor
+		}
+		return strings.Compare(a.Unit, b.Unit)
+	})
+	return normalized
+}
+
+// normalizeComponents merges the components with the same good, and sorts them by good
+func normalizeComponents(components []messages.KitComponent) []messages.KitComponent {
+	if len(components) == 0 {
+		return nil
+	}
+	amounts := make(map[string]int)
+	for _, c := range components {
+		goodId := strings.TrimSpace(c.GoodId)
+		if parsed, err := uuid.Parse(goodId); err == nil {
+			goodId = parsed.String()
+		}
+		amounts[goodId] += c.Amount
+	}
+	merged := make([]messages.KitComponent, 0, len(amounts))
+	for _, goodId := range slices.Sorted(maps.Keys(amounts)) {
+		merged = append(merged, messages.KitComponent{GoodId: goodId, Amount: amounts[goodId]})
+	}
+	return merged
+}
+
+// validateItem returns every problem found in a normalized item. Whether its SKU is unique is checked when storing it.
+func validateItem(item messages.CatalogItem) []messages.CatalogViolation {
+	violations := make([]messages.CatalogViolation, 0)
+	add := func(field, code, message string) {
+		violations = append(violations, messages.CatalogViolation{Field: field, Code: code, Message: message})
+	}
+
+	if item.Name == "" {
+		add("name", "missing_name", "the name is required")
+	} else if utf8.RuneCountInString(item.Name) > maxNameLength {
+		add("name", "invalid_name", fmt.Sprintf("the name must be at most %d characters", maxNameLength))
+	}
+
+	if item.SKU == "" {
+		add("sku", "missing_sku", "the SKU is required")
+	} else if !skuRegex.MatchString(item.SKU) {
+		add("sku", "invalid_sku", "the SKU must be at most 64 letters, digits, dots, dashes and underscores")
+	}
+
+	if utf8.RuneCountInString(item.Description) > maxDescriptionLength {
+		add("description", "invalid_description", fmt.Sprintf("the description must be at most %d characters", maxDescriptionLength))
+	}
+
+	if len(item.Translations) > maxTranslations {
+		add("translations", "too_many_translations", fmt.Sprintf("an item can have at most %d translations", maxTranslations))
+	}
+	for _, locale := range slices.Sorted(maps.Keys(item.Translations)) {
+		t := item.Translations[locale]
+		switch {
+		case !messages.ValidLocale(locale):
+			add("translations."+locale, "invalid_locale", "locales must be a language code, optionally followed by a region, e.g. \"it\" or \"de-ch\"")
+		case utf8.RuneCountInString(t.Name) > maxNameLength:
+			add("translations."+locale, "invalid_name", fmt.Sprintf("the name must be at most %d characters", maxNameLength))
+		case utf8.RuneCountInString(t.Description) > maxDescriptionLength:
+			add("translations."+locale, "invalid_description", fmt.Sprintf("the description must be at most %d characters", maxDescriptionLength))
+		}
+	}
+
+	if !unitRegex.MatchString(item.Unit) {
+		add("unit", "invalid_unit", "the unit of measure must be a short lowercase code, e.g. \"pcs\" or \"kg\"")
+	}
+
+	if len(item.Units) > maxUnits {
+		add("units", "too_many_units", fmt.Sprintf("an item can have at most %d alternative units of measure", maxUnits))
+	}
+	units := map[string]bool{item.Unit: true}
+	for _, u := range item.Units {
+		switch {
+		case !unitRegex.MatchString(u.Unit):
+			add("units", "invalid_unit", fmt.Sprintf("%q is not a short lowercase code, e.g. \"box\"", u.Unit))
+		case units[u.Unit]:
+			add("units", "duplicate_unit", fmt.Sprintf("%s is already a unit of measure of the item", u.Unit))
+		case u.Factor < 2 || u.Factor > maxUnitFactor:
+			add("units", "invalid_factor", fmt.Sprintf("the factor of %s must be between 2 and %d units of %s", u.Unit, maxUnitFactor, item.Unit))
+		}
+		units[u.Unit] = true
+	}
+
+	if item.Weight < 0 {
+		add("weight", "invalid_weight", "the weight cannot be negative")
+	}
+
+	if d := item.Dimensions; d != nil && (d.Length <= 0 || d.Width <= 0 || d.Height <= 0) {
+		add("dimensions", "invalid_dimensions", "length, width and height must be positive")
+	}
+
+	if len(item.Barcodes) > maxBarcodes {
+		add("barcodes", "too_many_barcodes", fmt.Sprintf("an item can have at most %d barcodes", maxBarcodes))
+	}
+	gtins := make(map[string]bool)
+	for _, code := range item.Barcodes {
+		switch {
+		case !validGTIN(code):
+			add("barcodes", "invalid_barcode", fmt.Sprintf("%q is not a GTIN-8, UPC-A, EAN-13 or GTIN-14 code with a valid check digit", code))
+		case gtins[gtin14(code)]:
+			add("barcodes", "duplicate_barcode", fmt.Sprintf("%s is the same GTIN as another barcode of the item", code))
+		default:
+			gtins[gtin14(code)] = true
+		}
+	}
+
+	if item.Status != messages.CatalogItemActive && item.Status != messages.CatalogItemArchived {
+		add("status", "invalid_status", "the status must be either active or archived")
+	}
+
+	if len(item.Attributes) > maxAttributes {
+		add("attributes", "too_many_attributes", fmt.Sprintf("an item can have at most %d attributes", maxAttributes))
+	}
+	for _, key := range slices.Sorted(maps.Keys(item.Attributes)) {
+		if !attributeRegex.MatchString(key) {
+			add("attributes."+key, "invalid_attribute", "attribute names must be lowercase letters, digits and underscores")
+		} else if utf8.RuneCountInString(item.Attributes[key]) > maxAttributeLength {
+			add("attributes."+key, "invalid_attribute", fmt.Sprintf("attribute values must be at most %d characters", maxAttributeLength))
+		}
+	}
+
+	if len(item.Categories) > maxCategories {
+		add("categories", "too_many_categories", fmt.Sprintf("an item can have at most %d categories", maxCategories))
+	}
+	for _, id := range item.Categories {
+		if uuid.Validate(id) != nil {
+			add("categories", "unknown_category", fmt.Sprintf("%q is not the id of a category", id))
+		}
+	}
+
+	if len(item.Components) > maxComponents {
+		add("components", "too_many_components", fmt.Sprintf("a kit can have at most %d components", maxComponents))
+	}
+	for _, c := range item.Components {
+		switch {
+		case uuid.Validate(c.GoodId) != nil:
+			add("components", "unknown_component", fmt.Sprintf("%q is not the id of a catalog item", c.GoodId))
+		case c.GoodId == item.Id:
+			add("components", "nested_kit", "a kit cannot contain itself")
+		case c.Amount <= 0 || c.Amount > maxComponentAmount:
+			add("components", "invalid_component", fmt.Sprintf("the amount of each component must be between 1 and %d", maxComponentAmount))
+		}
+	}
+	if item.Serialised && len(item.Components) > 0 {
+		add("serialised", "serialised_kit", "kits have no stock of their own, and cannot be serialised")
+	}
+
+	return violations
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+// violationCodes returns the code of every violation, in order
+func violationCodes(violations []messages.CatalogViolation) []string {
+	codes := make([]string, 0, len(violations))
+	for _, v := range violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestNormalizeItem(t *testing.T) {
+	item := normalizeItem(messages.CatalogItem{Name: " Hat ", SKU: "HAT-01 ", Unit: " KG"})
+	require.Equal(t, "Hat", item.Name)
+	require.Equal(t, "HAT-01", item.SKU)
+	require.Equal(t, "kg", item.Unit)
+	require.Equal(t, messages.CatalogItemActive, item.Status)
+
+	require.Equal(t, DefaultUnit, normalizeItem(messages.CatalogItem{}).Unit)
+
+	// categories are sorted, without duplicates
+	item = normalizeItem(messages.CatalogItem{Categories: []string{"B5C7A1E2-0000-4000-8000-000000000002", "b5c7a1e2-0000-4000-8000-000000000001", "b5c7a1e2-0000-4000-8000-000000000002"}})
+	require.Equal(t, []string{"b5c7a1e2-0000-4000-8000-000000000001", "b5c7a1e2-0000-4000-8000-000000000002"}, item.Categories)
+
+	// components with the same good are merged
+	item = normalizeItem(messages.CatalogItem{Components: []messages.KitComponent{
+		{GoodId: "B5C7A1E2-0000-4000-8000-000000000002", Amount: 1},
+		{GoodId: "b5c7a1e2-0000-4000-8000-000000000001", Amount: 2},
+		{GoodId: "b5c7a1e2-0000-4000-8000-000000000002", Amount: 3},
+	}})
+	require.Equal(t, []messages.KitComponent{
+		{GoodId: "b5c7a1e2-0000-4000-8000-000000000001", Amount: 2},
+		{GoodId: "b5c7a1e2-0000-4000-8000-000000000002", Amount: 4},
+	}, item.Components)
+	require.Nil(t, normalizeItem(messages.CatalogItem{Components: []messages.KitComponent{}}).Components)
+
+	// alternative units are sorted by factor
+	item = normalizeItem(messages.CatalogItem{Units: []messages.ItemUnit{{Unit: "Pallet ", Factor: 480}, {Unit: "box", Factor: 12}}})
+	require.Equal(t, []messages.ItemUnit{{Unit: "box", Factor: 12}, {Unit: "pallet", Factor: 480}}, item.Units)
+
+	// translations are keyed by normalized locale, and empty ones are dropped
+	item = normalizeItem(messages.CatalogItem{Translations: map[string]messages.ItemTranslation{
+		"it_IT": {Name: " Cappello "},
+		"de":    {Name: " ", Description: ""},
+	}})
+	require.Equal(t, map[string]messages.ItemTranslation{"it-it": {Name: "Cappello"}}, item.Translations)
+	require.Nil(t, normalizeItem(messages.CatalogItem{Translations: map[string]messages.ItemTranslation{"de": {}}}).Translations)
+}
+
+func TestValidateItem(t *testing.T) {
+	valid := normalizeItem(messages.CatalogItem{
+		Name:        "Hat",
+		SKU:         "HAT-01",
+		Description: "A red hat",
+		Weight:      120,
+		Dimensions:  &messages.Dimensions{Length: 300, Width: 250, Height: 120},
+		Barcodes:    []string{"4006381333931", "036000291452"},
+		Attributes:  map[string]string{"color": "red", "size": "L"},
+	})
+	require.Empty(t, validateItem(valid))
+
+	// empty names were stored before validation was enforced
+	require.Equal(t, []string{"missing_name", "missing_sku"}, violationCodes(validateItem(normalizeItem(messages.CatalogItem{Name: "  "}))))
+
+	invalid := valid
+	invalid.SKU = "HAT 01"
+	invalid.Unit = "Pieces!"
+	invalid.Weight = -1
+	invalid.Dimensions = &messages.Dimensions{Length: 300}
+	invalid.Barcodes = []string{"12ab", "4006381333932"}
+	invalid.Status = "deleted"
+	invalid.Attributes = map[string]string{"Color": "red", "notes": strings.Repeat("x", maxAttributeLength+1)}
+	invalid.Categories = []string{"hats"}
+	require.Equal(t, []string{
+		"invalid_sku", "invalid_unit", "invalid_weight", "invalid_dimensions", "invalid_barcode", "invalid_barcode", "invalid_status",
+		"invalid_attribute", "invalid_attribute", "unknown_category",
+	}, violationCodes(validateItem(invalid)))
+
+	kit := valid
+	kit.Id = "b5c7a1e2-0000-4000-8000-000000000003"
+	kit.Components = []messages.KitComponent{
+		{GoodId: "scarf", Amount: 1},
+		{GoodId: "b5c7a1e2-0000-4000-8000-000000000001", Amount: 0},
+		{GoodId: kit.Id, Amount: 1},
+		{GoodId: "b5c7a1e2-0000-4000-8000-000000000004", Amount: maxComponentAmount + 1},
+	}
+	kit.Serialised = true
+	require.Equal(t, []string{"unknown_component", "invalid_component", "nested_kit", "invalid_component", "serialised_kit"}, violationCodes(validateItem(kit)))
+
+	invalid = valid
+	invalid.Units = []messages.ItemUnit{{Unit: "box", Factor: 12}, {Unit: "pcs", Factor: 2}, {Unit: "box", Factor: 24}, {Unit: "pack", Factor: 1}, {Unit: "6-pack", Factor: 6}}
+	require.Equal(t, []string{"invalid_factor", "duplicate_unit", "invalid_unit", "duplicate_unit"},
+		violationCodes(validateItem(normalizeItem(invalid))))
+
+	// a UPC-A and the same code as an EAN-13 are the same GTIN
+	invalid = valid
+	invalid.Barcodes = []string{"036000291452", "0036000291452"}
+	require.Equal(t, []string{"duplicate_barcode"}, violationCodes(validateItem(normalizeItem(invalid))))
+
+	invalid = valid
+	invalid.Translations = map[string]messages.ItemTranslation{
+		"english": {Name: "Hat"},
+		"it":      {Name: strings.Repeat("x", maxNameLength+1)},
+		"it-ch":   {Name: "Cappello"},
+	}
+	violations := validateItem(normalizeItem(invalid))
+	require.Equal(t, []string{"invalid_locale", "invalid_name"}, violationCodes(violations))
+	require.Equal(t, "translations.it", violations[1].Field)
+
+	invalid = valid
+	invalid.Name = strings.Repeat("x", maxNameLength+1)
+	violations = validateItem(invalid)
+	require.Len(t, violations, 1)
+	require.Equal(t, "name", violations[0].Field)
+}
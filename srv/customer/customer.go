@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type customerState struct {
+	kv jetstream.KeyValue
+}
+
+var meter = otel.Meter("github.com/alimitedgroup/PoC/srv/customer")
+
+func setupObservability(ctx context.Context, otlpUrl string) func(context.Context) {
+	otelshutdown := common.SetupOTelSDK(ctx, otlpUrl)
+
+	var err error
+	common.NumRequests, err = meter.Int64Counter("num_requests", metric.WithDescription("Number of NATS requests received"))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to init metric `num_requests`", "error", err)
+	}
+
+	common.ResponseTime, err = meter.Int64Histogram("request_response_time", metric.WithDescription("Response time of request handlers in millisecond"))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to init `request_response_time`", "error", err)
+	}
+
+	return otelshutdown
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	natsUrl := os.Getenv("NATS_URL")
+	otlpUrl := os.Getenv("OTLP_URL")
+
+	otelshutdown := setupObservability(ctx, otlpUrl)
+	defer otelshutdown(context.WithoutCancel(ctx))
+
+	nc, err := nats.Connect(natsUrl)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to connect to NATS", "error", err)
+		return
+	}
+
+	svc := common.NewService(ctx, nc, customerState{})
+
+	kv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.CustomersKeyValueConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create key-value store", "error", err)
+		return
+	}
+	svc.State().kv = kv
+
+	svc.RegisterHandler("customer.ping", PingHandler)
+	svc.RegisterHandler("customer.create", CreateHandler)
+	svc.RegisterHandler("customer.get", GetHandler)
+	svc.RegisterHandler("customer.list", ListHandler)
+	svc.RegisterHandler("customer.update", UpdateHandler)
+	svc.RegisterHandler("customer.delete", DeleteHandler)
+	svc.RegisterHandler("customer.address.add", AddAddressHandler)
+	svc.RegisterHandler("customer.address.remove", RemoveAddressHandler)
+
+	// Wait for ctrl-c, and gracefully stop service
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	slog.InfoContext(ctx, "Shutting down")
+	cancel()
+}
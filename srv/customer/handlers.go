@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	errCustomerNotFound = errors.New("customer not found")
+	errAddressNotFound  = errors.New("address not found")
+	errInvalidCustomer  = errors.New("invalid customer")
+)
+
+// validAddress returns whether the address has all the fields needed to ship an order
+func validAddress(a messages.Address) bool {
+	return a.Line1 != "" && a.City != "" && a.Country != ""
+}
+
+// getCustomer returns the customer with the given id, along with its revision in the KV bucket
+func getCustomer(ctx context.Context, kv jetstream.KeyValue, id uuid.UUID) (messages.Customer, uint64, error) {
+	var c messages.Customer
+
+	entry, err := kv.Get(ctx, id.String())
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return c, 0, errCustomerNotFound
+	}
+	if err != nil {
+		return c, 0, fmt.Errorf("failed to get customer %s: %w", id, err)
+	}
+
+	if err = json.Unmarshal(entry.Value(), &c); err != nil {
+		return c, 0, fmt.Errorf("failed to unmarshal customer %s: %w", id, err)
+	}
+	return c, entry.Revision(), nil
+}
+
+// updateCustomer applies change to the customer with the given id. The update is refused with
+// jetstream.ErrKeyExists if the customer was modified after being read.
+func updateCustomer(ctx context.Context, kv jetstream.KeyValue, id uuid.UUID, change func(*messages.Customer) error) (messages.Customer, error) {
+	c, revision, err := getCustomer(ctx, kv, id)
+	if err != nil {
+		return c, err
+	}
+
+	if err = change(&c); err != nil {
+		return c, err
+	}
+	c.UpdatedAt = time.Now()
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		return c, fmt.Errorf("failed to marshal customer %s: %w", id, err)
+	}
+	if _, err = kv.Update(ctx, id.String(), body, revision); err != nil {
+		return c, fmt.Errorf("failed to update customer %s: %w", id, err)
+	}
+	return c, nil
+}
+
+// respondCustomer sends c to the client
+func respondCustomer(ctx context.Context, req *nats.Msg, c messages.Customer) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling customer", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	if err = req.Respond(body); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// respondUpdate sends the updated customer, or the error returned by updateCustomer
+func respondUpdate(ctx context.Context, req *nats.Msg, c messages.Customer, err error) {
+	switch {
+	case errors.Is(err, errCustomerNotFound):
+		natsutil.Respond(req, natsutil.CustomerNotFound)
+	case errors.Is(err, errAddressNotFound):
+		natsutil.Respond(req, natsutil.AddressNotFound)
+	case errors.Is(err, errInvalidCustomer):
+		natsutil.Respond(req, natsutil.InvalidCustomer)
+	case errors.Is(err, jetstream.ErrKeyExists):
+		natsutil.Respond(req, natsutil.CustomerChanged)
+	case err != nil:
+		slog.ErrorContext(ctx, "Error updating customer", "error", err)
+		natsutil.Respond(req, natsutil.KvError)
+	default:
+		respondCustomer(ctx, req, c)
+	}
+}
+
+// PingHandler is the handler for `customer.ping`
+func PingHandler(_ context.Context, _ *common.Service[customerState], req *nats.Msg) {
+	_ = req.Respond([]byte("pong"))
+}
+
+// CreateHandler is the handler for `customer.create`. It responds with the new customer
+func CreateHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	var msg messages.CreateCustomer
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	if msg.Name == "" {
+		natsutil.Respond(req, natsutil.InvalidCustomer)
+		return
+	}
+
+	now := time.Now()
+	c := messages.Customer{
+		ID:        uuid.New(),
+		Name:      msg.Name,
+		Email:     msg.Email,
+		Phone:     msg.Phone,
+		Addresses: make([]messages.Address, 0, len(msg.Addresses)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, a := range msg.Addresses {
+		if !validAddress(a) {
+			natsutil.Respond(req, natsutil.InvalidCustomer)
+			return
+		}
+		a.ID = uuid.New()
+		c.Addresses = append(c.Addresses, a)
+	}
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling customer", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	_, err = s.State().kv.Create(ctx, c.ID.String(), body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error storing customer in KV", "error", err)
+		natsutil.Respond(req, natsutil.KvError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Customer created", "customer", c.ID)
+	respondCustomer(ctx, req, c)
+}
+
+// GetHandler is the handler for `customer.get`
+func GetHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	var msg messages.GetCustomer
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	c, _, err := getCustomer(ctx, s.State().kv, msg.ID)
+	if errors.Is(err, errCustomerNotFound) {
+		natsutil.Respond(req, natsutil.CustomerNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting customer", "error", err)
+		natsutil.Respond(req, natsutil.KvError)
+		return
+	}
+
+	respondCustomer(ctx, req, c)
+}
+
+// ListHandler is the handler for `customer.list`. Customers are sorted by name
+func ListHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	w, err := s.State().kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error watching keys", "error", err)
+		natsutil.Respond(req, natsutil.KvError)
+		return
+	}
+	defer func() { _ = w.Stop() }()
+
+	res := make([]messages.Customer, 0)
+	for v := range w.Updates() {
+		if v == nil {
+			break
+		}
+		var c messages.Customer
+		if err = json.Unmarshal(v.Value(), &c); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling customer", "error", err)
+			natsutil.Respond(req, natsutil.MarshalError)
+			return
+		}
+		res = append(res, c)
+	}
+	slices.SortFunc(res, func(a, b messages.Customer) int {
+		if a.Name != b.Name {
+			return strings.Compare(a.Name, b.Name)
+		}
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	body, err := json.Marshal(res)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling customers", "error", err)
+		natsutil.Respond(req, natsutil.MarshalError)
+		return
+	}
+
+	if err = req.Respond(body); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// UpdateHandler is the handler for `customer.update`: it replaces the contact info of the customer
+func UpdateHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	var msg messages.UpdateCustomer
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	c, err := updateCustomer(ctx, s.State().kv, msg.ID, func(c *messages.Customer) error {
+		if msg.Name == "" {
+			return errInvalidCustomer
+		}
+		c.Name = msg.Name
+		c.Email = msg.Email
+		c.Phone = msg.Phone
+		return nil
+	})
+	respondUpdate(ctx, req, c, err)
+}
+
+// DeleteHandler is the handler for `customer.delete`. Orders of the customer keep their copy of the shipping address
+func DeleteHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	var msg messages.GetCustomer
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	_, _, err = getCustomer(ctx, s.State().kv, msg.ID)
+	if errors.Is(err, errCustomerNotFound) {
+		natsutil.Respond(req, natsutil.CustomerNotFound)
+		return
+	}
+	if err == nil {
+		err = s.State().kv.Delete(ctx, msg.ID.String())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting customer", "error", err)
+		natsutil.Respond(req, natsutil.KvError)
+		return
+	}
+
+	if err = req.Respond([]byte("ok")); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// AddAddressHandler is the handler for `customer.address.add`. It responds with the updated customer
+func AddAddressHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	var msg messages.AddAddress
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	c, err := updateCustomer(ctx, s.State().kv, msg.CustomerId, func(c *messages.Customer) error {
+		if !validAddress(msg.Address) {
+			return errInvalidCustomer
+		}
+		address := msg.Address
+		address.ID = uuid.New()
+		c.Addresses = append(c.Addresses, address)
+		return nil
+	})
+	respondUpdate(ctx, req, c, err)
+}
+
+// RemoveAddressHandler is the handler for `customer.address.remove`. It responds with the updated customer
+func RemoveAddressHandler(ctx context.Context, s *common.Service[customerState], req *nats.Msg) {
+	var msg messages.RemoveAddress
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(req, natsutil.InvalidRequest)
+		return
+	}
+
+	c, err := updateCustomer(ctx, s.State().kv, msg.CustomerId, func(c *messages.Customer) error {
+		i := slices.IndexFunc(c.Addresses, func(a messages.Address) bool { return a.ID == msg.AddressId })
+		if i < 0 {
+			return errAddressNotFound
+		}
+		c.Addresses = slices.Delete(c.Addresses, i, i+1)
+		return nil
+	})
+	respondUpdate(ctx, req, c, err)
+}
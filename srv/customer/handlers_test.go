@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t *testing.T) (*nats.Conn, *common.Service[customerState]) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nc := common.NewInProcessNATSServer(t)
+	t.Cleanup(func() { nc.Close() })
+
+	svc := common.NewService(ctx, nc, customerState{})
+	kv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.CustomersKeyValueConfig)
+	require.NoError(t, err)
+	svc.State().kv = kv
+
+	svc.RegisterHandler("customer.create", CreateHandler)
+	svc.RegisterHandler("customer.get", GetHandler)
+	svc.RegisterHandler("customer.address.add", AddAddressHandler)
+	svc.RegisterHandler("customer.address.remove", RemoveAddressHandler)
+	return nc, svc
+}
+
+func request[T any](t *testing.T, nc *nats.Conn, subject string, req any) (T, string) {
+	var res T
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+
+	r, err := nc.Request(subject, body, time.Second)
+	require.NoError(t, err)
+	if code, _, ok := natsutil.ParseError(r.Data); ok {
+		return res, code
+	}
+	require.NoError(t, json.Unmarshal(r.Data, &res))
+	return res, ""
+}
+
+func TestCustomerHandlers(t *testing.T) {
+	nc, _ := newTestService(t)
+
+	home := messages.Address{Label: "home", Line1: "Via Roma 1", City: "Padova", Country: "IT"}
+	c, code := request[messages.Customer](t, nc, "customer.create", messages.CreateCustomer{
+		Name:      "Ada",
+		Email:     "ada@example.com",
+		Addresses: []messages.Address{home},
+	})
+	require.Empty(t, code)
+	require.Len(t, c.Addresses, 1)
+	require.NotEqual(t, uuid.Nil, c.Addresses[0].ID)
+
+	_, code = request[messages.Customer](t, nc, "customer.create", messages.CreateCustomer{Name: "Bob", Addresses: []messages.Address{{City: "Padova"}}})
+	require.Equal(t, "invalid_request", code)
+
+	office := messages.Address{Label: "office", Line1: "Via Trieste 63", City: "Padova", Country: "IT"}
+	c, code = request[messages.Customer](t, nc, "customer.address.add", messages.AddAddress{CustomerId: c.ID, Address: office})
+	require.Empty(t, code)
+	require.Len(t, c.Addresses, 2)
+
+	c, code = request[messages.Customer](t, nc, "customer.address.remove", messages.RemoveAddress{CustomerId: c.ID, AddressId: c.Addresses[0].ID})
+	require.Empty(t, code)
+	require.Len(t, c.Addresses, 1)
+	require.Equal(t, "office", c.Addresses[0].Label)
+
+	_, code = request[messages.Customer](t, nc, "customer.address.remove", messages.RemoveAddress{CustomerId: c.ID, AddressId: uuid.New()})
+	require.Equal(t, "not_found", code)
+
+	got, code := request[messages.Customer](t, nc, "customer.get", messages.GetCustomer{ID: c.ID})
+	require.Empty(t, code)
+	require.Equal(t, c.Addresses, got.Addresses)
+
+	_, code = request[messages.Customer](t, nc, "customer.get", messages.GetCustomer{ID: uuid.New()})
+	require.Equal(t, "not_found", code)
+}
+
+func TestUpdateCustomer_Conflict(t *testing.T) {
+	ctx := context.Background()
+	nc, svc := newTestService(t)
+	kv := svc.State().kv
+
+	c, code := request[messages.Customer](t, nc, "customer.create", messages.CreateCustomer{Name: "Ada"})
+	require.Empty(t, code)
+
+	_, err := updateCustomer(ctx, kv, c.ID, func(c *messages.Customer) error {
+		// another request updates the customer in the meantime
+		_, err := kv.Put(ctx, c.ID.String(), []byte(`{}`))
+		require.NoError(t, err)
+		c.Name = "Ada Lovelace"
+		return nil
+	})
+	require.ErrorIs(t, err, jetstream.ErrKeyExists)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// transitions lists, for each status, the statuses an order can move to.
+// Statuses not listed here are final.
+var transitions = map[messages.OrderStatus][]messages.OrderStatus{
+	messages.OrderStatusScheduled:  {messages.OrderStatusConfirmed, messages.OrderStatusFailed, messages.OrderStatusCancelled},
+	messages.OrderStatusPending:    {messages.OrderStatusReserved, messages.OrderStatusFailed, messages.OrderStatusCancelled},
+	messages.OrderStatusReserved:   {messages.OrderStatusConfirmed, messages.OrderStatusFailed, messages.OrderStatusCancelled},
+	messages.OrderStatusConfirmed:  {messages.OrderStatusFulfilling, messages.OrderStatusCancelled},
+	messages.OrderStatusFulfilling: {messages.OrderStatusShipped, messages.OrderStatusCancelled},
+	messages.OrderStatusShipped:    {messages.OrderStatusDelivered, messages.OrderStatusCancelled},
+}
+
+// errInvalidTransition is returned when an event is not valid in the current status of the order
+var errInvalidTransition = errors.New("invalid order transition")
+
+// canTransition reports whether an order in status from can move to status to
+func canTransition(from messages.OrderStatus, to messages.OrderStatus) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// order is the aggregate built from the events of a single order
+type order struct {
+	messages.Order
+	// seq is the stream sequence of the last event applied to this order
+	seq uint64
+	// allocation and allowPartial are the options used to release a scheduled order
+	allocation   messages.AllocationOptions
+	allowPartial bool
+}
+
+// orderStore contains every order, and is rebuilt on startup by replaying the `orders` stream.
+//
+// Please note that the store should be locked before being used by calling its `Lock()` method.
+type orderStore struct {
+	sync.Mutex
+	m map[uuid.UUID]*order
+	// seq is the stream sequence of the last event applied to the store
+	seq uint64
+}
+
+func newOrderStore() orderStore {
+	return orderStore{m: make(map[uuid.UUID]*order)}
+}
+
+// orderSubject returns the subject where event is published for the order with the given id
+func orderSubject(id uuid.UUID, event string) string {
+	return fmt.Sprintf("orders.%s.%s", id, event)
+}
+
+// parseOrderSubject splits a subject in the form `orders.<id>.<event>`
+func parseOrderSubject(subject string) (uuid.UUID, string, error) {
+	parts := strings.SplitN(subject, ".", 3)
+	if len(parts) != 3 || parts[0] != "orders" {
+		return uuid.Nil, "", fmt.Errorf("unexpected order event subject %q", subject)
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid order id in subject %q: %w", subject, err)
+	}
+	return id, parts[2], nil
+}
+
+// checkStatusChange returns an error if change cannot be applied to the order
+func (o *order) checkStatusChange(change messages.OrderStatusChanged) error {
+	if change.Status == messages.OrderStatusShipped && change.WarehouseId != "" {
+		if o.Status != messages.OrderStatusFulfilling {
+			return fmt.Errorf("%w: order %s cannot be shipped while %s", errInvalidTransition, o.ID, o.Status)
+		}
+		found := false
+		for _, w := range o.Warehouses {
+			if w.WarehouseId == change.WarehouseId {
+				found = true
+				if w.Shipped {
+					return fmt.Errorf("%w: warehouse %s already shipped order %s", errInvalidTransition, change.WarehouseId, o.ID)
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: warehouse %s is not part of order %s", errInvalidTransition, change.WarehouseId, o.ID)
+		}
+		return nil
+	}
+
+	if !canTransition(o.Status, change.Status) {
+		return fmt.Errorf("%w: order %s cannot move from %s to %s", errInvalidTransition, o.ID, o.Status, change.Status)
+	}
+	if change.Status == messages.OrderStatusShipped && o.BackorderStatus == messages.BackorderOpen {
+		return fmt.Errorf("%w: order %s has an open backorder", errInvalidTransition, o.ID)
+	}
+	return nil
+}
+
+// checkBackorderAllocation returns an error if new stock cannot be allocated to the backorder of the order
+func (o *order) checkBackorderAllocation() error {
+	if o.BackorderStatus != messages.BackorderOpen {
+		return fmt.Errorf("%w: order %s has no open backorder", errInvalidTransition, o.ID)
+	}
+	if o.Status != messages.OrderStatusConfirmed && o.Status != messages.OrderStatusFulfilling {
+		return fmt.Errorf("%w: cannot allocate the backorder of order %s while %s", errInvalidTransition, o.ID, o.Status)
+	}
+	return nil
+}
+
+// errOrderShipped is returned when cancelling an order with shipped parts without forcing it
+var errOrderShipped = errors.New("order has shipped parts")
+
+// checkCancel returns an error if the order cannot be cancelled
+func (o *order) checkCancel(forced bool) error {
+	if err := o.checkStatusChange(messages.OrderStatusChanged{Status: messages.OrderStatusCancelled}); err != nil {
+		return err
+	}
+	if forced {
+		return nil
+	}
+	if o.Status == messages.OrderStatusShipped {
+		return fmt.Errorf("%w: order %s", errOrderShipped, o.ID)
+	}
+	for _, w := range o.Warehouses {
+		if w.Shipped {
+			return fmt.Errorf("%w: warehouse %s already shipped order %s", errOrderShipped, w.WarehouseId, o.ID)
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of the order that can be modified without affecting the original
+func (o *order) clone() *order {
+	c := *o
+	c.Items = slices.Clone(o.Items)
+	c.Kits = slices.Clone(o.Kits)
+	c.Warehouses = slices.Clone(o.Warehouses)
+	c.History = slices.Clone(o.History)
+	c.Backorder = slices.Clone(o.Backorder)
+	c.Amendments = slices.Clone(o.Amendments)
+	c.SoftReservation = slices.Clone(o.SoftReservation)
+	return &c
+}
+
+// setStatus changes the status of the order, recording it in the history.
+// An open backorder is cancelled when the order ends without being shipped.
+func (o *order) setStatus(status messages.OrderStatus, reason string, ts time.Time) {
+	o.Status = status
+	o.History = append(o.History, messages.OrderHistoryEntry{Status: status, Reason: reason, At: ts})
+	if o.BackorderStatus == messages.BackorderOpen && (status == messages.OrderStatusCancelled || status == messages.OrderStatusFailed) {
+		o.BackorderStatus = messages.BackorderCancelled
+	}
+	// soft reservations only hold stock while the order is scheduled
+	if status != messages.OrderStatusScheduled {
+		o.SoftReservation = nil
+	}
+}
+
+// apply applies an event read from the `orders` stream. Events that have already been applied are ignored.
+//
+// store MUST be locked
+func (st *orderStore) apply(subject string, data []byte, seq uint64, ts time.Time) error {
+	id, event, err := parseOrderSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	st.seq = max(st.seq, seq)
+	o := st.m[id]
+	if o != nil && seq <= o.seq {
+		return nil
+	}
+
+	if event == "created" {
+		if o != nil {
+			return fmt.Errorf("order %s already exists", id)
+		}
+
+		var msg messages.OrderCreated
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		o = &order{Order: messages.Order{
+			ID:         msg.ID,
+			Items:      msg.Items,
+			Kits:       msg.Kits,
+			Warehouses: make([]messages.OrderWarehouse, 0),
+			History:    make([]messages.OrderHistoryEntry, 0),
+			CustomerId: msg.CustomerId,
+			ShipTo:     msg.ShipTo,
+			Pricing:    msg.Pricing,
+			ShipDate:   msg.ShipDate,
+			Priority:   msg.Priority,
+			CreatedAt:  msg.CreatedAt,
+		}, allowPartial: msg.AllowPartial}
+		if msg.Allocation != nil {
+			o.allocation = *msg.Allocation
+		}
+		if len(msg.Backorder) > 0 {
+			o.Backorder = msg.Backorder
+			o.BackorderStatus = messages.BackorderOpen
+		}
+		if msg.Scheduled {
+			o.setStatus(messages.OrderStatusScheduled, "", msg.CreatedAt)
+		} else {
+			o.setStatus(messages.OrderStatusPending, "", msg.CreatedAt)
+		}
+		o.seq = seq
+		o.UpdatedAt = ts
+		st.m[id] = o
+		return nil
+	}
+
+	if o == nil {
+		return fmt.Errorf("received %s for unknown order", subject)
+	}
+
+	switch event {
+	case "reserved":
+		var msg messages.OrderReserved
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if err := o.checkStatusChange(messages.OrderStatusChanged{Status: messages.OrderStatusReserved}); err != nil {
+			return err
+		}
+		for _, w := range msg.Warehouses {
+			o.Warehouses = append(o.Warehouses, messages.OrderWarehouse{OrderCreateWarehouse: w})
+		}
+		o.setStatus(messages.OrderStatusReserved, "", ts)
+
+	case "soft_reserved":
+		var msg messages.OrderSoftReserved
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if o.Status != messages.OrderStatusScheduled {
+			return fmt.Errorf("%w: order %s cannot hold stock while %s", errInvalidTransition, o.ID, o.Status)
+		}
+		o.SoftReservation = msg.Warehouses
+
+	case "preempted":
+		if o.Status != messages.OrderStatusScheduled || len(o.SoftReservation) == 0 {
+			return fmt.Errorf("%w: order %s holds no stock", errInvalidTransition, o.ID)
+		}
+		o.SoftReservation = nil
+
+	case "released":
+		var msg messages.OrderReleased
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if o.Status != messages.OrderStatusScheduled {
+			return fmt.Errorf("%w: order %s cannot be released while %s", errInvalidTransition, o.ID, o.Status)
+		}
+		for _, w := range msg.Warehouses {
+			o.Warehouses = append(o.Warehouses, messages.OrderWarehouse{OrderCreateWarehouse: w})
+		}
+		if len(msg.Backorder) > 0 {
+			o.Backorder = msg.Backorder
+			o.BackorderStatus = messages.BackorderOpen
+		}
+		o.setStatus(messages.OrderStatusConfirmed, "", ts)
+
+	case "confirmed":
+		if err := o.checkStatusChange(messages.OrderStatusChanged{Status: messages.OrderStatusConfirmed}); err != nil {
+			return err
+		}
+		o.setStatus(messages.OrderStatusConfirmed, "", ts)
+
+	case "backorder_allocated":
+		var msg messages.OrderBackorderAllocated
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if err := o.checkBackorderAllocation(); err != nil {
+			return err
+		}
+		for _, w := range msg.Warehouses {
+			o.Warehouses = append(o.Warehouses, messages.OrderWarehouse{OrderCreateWarehouse: w})
+		}
+		o.Backorder = msg.Remaining
+		if len(msg.Remaining) == 0 {
+			o.BackorderStatus = messages.BackorderFulfilled
+			// the parts allocated earlier may have been shipped already
+			o.updateShipped("", ts)
+		}
+
+	case "amended":
+		var msg messages.OrderAmended
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if err := o.checkAmend(msg.Before); err != nil {
+			return err
+		}
+		o.applyAmendment(msg, ts)
+
+	case "cancelled":
+		var msg messages.OrderCancelled
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if err := o.checkCancel(msg.Forced); err != nil {
+			return err
+		}
+		o.setStatus(messages.OrderStatusCancelled, msg.Reason, ts)
+
+	case "fulfilling", "shipped", "delivered", "failed":
+		var msg messages.OrderStatusChanged
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if err := o.checkStatusChange(msg); err != nil {
+			return err
+		}
+		o.applyStatusChange(msg, ts)
+
+	default:
+		return fmt.Errorf("unknown order event %q", event)
+	}
+
+	o.seq = seq
+	o.UpdatedAt = ts
+	return nil
+}
+
+// applyStatusChange applies an already checked status change
+func (o *order) applyStatusChange(msg messages.OrderStatusChanged, ts time.Time) {
+	if msg.Status != messages.OrderStatusShipped || msg.WarehouseId == "" {
+		o.setStatus(msg.Status, msg.Reason, ts)
+		return
+	}
+
+	// only a part of the order was shipped: the whole order is shipped once every part is
+	for i := range o.Warehouses {
+		if o.Warehouses[i].WarehouseId == msg.WarehouseId {
+			o.Warehouses[i].Shipped = true
+		}
+	}
+	o.updateShipped(msg.Reason, ts)
+}
+
+// updateShipped moves a fulfilling order to shipped if every part has been shipped, and nothing is backordered
+func (o *order) updateShipped(reason string, ts time.Time) {
+	if o.Status != messages.OrderStatusFulfilling || o.BackorderStatus == messages.BackorderOpen {
+		return
+	}
+	for _, w := range o.Warehouses {
+		if !w.Shipped {
+			return
+		}
+	}
+	o.setStatus(messages.OrderStatusShipped, reason, ts)
+}
+
+// check returns the error apply would return for the given event, without modifying the store.
+//
+// store MUST be locked
+func (st *orderStore) check(subject string, data []byte) error {
+	id, _, err := parseOrderSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	dry := newOrderStore()
+	if o, ok := st.m[id]; ok {
+		dry.m[id] = o.clone()
+		dry.seq = o.seq
+	}
+	return dry.apply(subject, data, dry.seq+1, time.Now())
+}
+
+// errDuplicateEvent is returned when JetStream discards a published event as a duplicate of one with the same message id
+var errDuplicateEvent = errors.New("duplicate order event")
+
+// publishOrderEvent publishes an event of the order with the given id, and applies it to the store.
+// Events that are not valid for the current state of the order are refused without being published.
+//
+// Events discarded by JetStream deduplication are not applied: the original event is applied by OrderEventHandler.
+//
+// store MUST be locked
+func publishOrderEvent(ctx context.Context, js jetstream.JetStream, store *orderStore, id uuid.UUID, event string, payload any, opts ...jetstream.PublishOpt) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal order event: %w", err)
+	}
+
+	subject := orderSubject(id, event)
+	if err := store.check(subject, body); err != nil {
+		return err
+	}
+
+	ack, err := js.Publish(ctx, subject, body, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to publish order event: %w", err)
+	}
+	if ack.Duplicate {
+		return fmt.Errorf("%w: %s", errDuplicateEvent, subject)
+	}
+
+	return store.apply(subject, body, ack.Sequence, time.Now())
+}
+
+// OrderEventHandler applies the events of the `orders` stream to the order store
+func OrderEventHandler(ctx context.Context, s *common.Service[orderState], msg jetstream.Msg) error {
+	meta, err := msg.Metadata()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting metadata for message", "error", err, "subject", msg.Subject())
+		return nil
+	}
+
+	store := &s.State().orders
+	store.Lock()
+	defer store.Unlock()
+
+	if err := store.apply(msg.Subject(), msg.Data(), meta.Sequence.Stream, meta.Timestamp); err != nil {
+		slog.ErrorContext(ctx, "Error applying order event", "error", err, "subject", msg.Subject())
+	}
+	return nil
+}
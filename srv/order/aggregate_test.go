@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func applyEvent(t *testing.T, st *orderStore, seq uint64, id uuid.UUID, event string, payload any) error {
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+	return st.apply(orderSubject(id, event), body, seq, time.Now())
+}
+
+func TestOrderStore_Lifecycle(t *testing.T) {
+	st := newOrderStore()
+	id := uuid.New()
+	warehouses := []messages.OrderCreateWarehouse{
+		{WarehouseId: "41", ReservationId: uuid.New()},
+		{WarehouseId: "42", ReservationId: uuid.New()},
+	}
+
+	require.NoError(t, applyEvent(t, &st, 1, id, "created", messages.OrderCreated{ID: id}))
+	require.Equal(t, messages.OrderStatusPending, st.m[id].Status)
+
+	// shipping is not possible before the order is confirmed
+	require.Error(t, applyEvent(t, &st, 2, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped}))
+
+	require.NoError(t, applyEvent(t, &st, 3, id, "reserved", messages.OrderReserved{ID: id, Warehouses: warehouses}))
+	require.NoError(t, applyEvent(t, &st, 4, id, "confirmed", messages.OrderConfirmed{ID: id, Warehouses: warehouses}))
+	require.NoError(t, applyEvent(t, &st, 5, id, "fulfilling", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusFulfilling}))
+
+	// the order is shipped only once every warehouse shipped its part
+	require.NoError(t, applyEvent(t, &st, 6, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped, WarehouseId: "41"}))
+	require.Equal(t, messages.OrderStatusFulfilling, st.m[id].Status)
+	require.Error(t, applyEvent(t, &st, 7, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped, WarehouseId: "41"}))
+	require.NoError(t, applyEvent(t, &st, 8, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped, WarehouseId: "42"}))
+	require.Equal(t, messages.OrderStatusShipped, st.m[id].Status)
+
+	require.NoError(t, applyEvent(t, &st, 9, id, "delivered", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusDelivered}))
+	require.Equal(t, messages.OrderStatusDelivered, st.m[id].Status)
+	require.Equal(t, uint64(9), st.seq)
+}
+
+func TestOrderStore_IgnoresAlreadyAppliedEvents(t *testing.T) {
+	st := newOrderStore()
+	id := uuid.New()
+
+	require.NoError(t, applyEvent(t, &st, 1, id, "created", messages.OrderCreated{ID: id}))
+	require.NoError(t, applyEvent(t, &st, 2, id, "failed", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusFailed}))
+	// the same event, delivered again by the consumer
+	require.NoError(t, applyEvent(t, &st, 2, id, "failed", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusFailed}))
+	require.Len(t, st.m[id].History, 2)
+}
+
+func TestOrderStore_Cancel(t *testing.T) {
+	st := newOrderStore()
+	id := uuid.New()
+	warehouses := []messages.OrderCreateWarehouse{
+		{WarehouseId: "41", ReservationId: uuid.New()},
+		{WarehouseId: "42", ReservationId: uuid.New()},
+	}
+
+	require.NoError(t, applyEvent(t, &st, 1, id, "created", messages.OrderCreated{ID: id}))
+	require.NoError(t, applyEvent(t, &st, 2, id, "reserved", messages.OrderReserved{ID: id, Warehouses: warehouses}))
+	require.NoError(t, applyEvent(t, &st, 3, id, "confirmed", messages.OrderConfirmed{ID: id, Warehouses: warehouses}))
+	require.NoError(t, applyEvent(t, &st, 4, id, "fulfilling", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusFulfilling}))
+	require.NoError(t, applyEvent(t, &st, 5, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped, WarehouseId: "41"}))
+
+	body, err := json.Marshal(messages.OrderCancelled{ID: id})
+	require.NoError(t, err)
+	require.ErrorIs(t, st.check(orderSubject(id, "cancelled"), body), errOrderShipped)
+	// check must not modify the store
+	require.Equal(t, messages.OrderStatusFulfilling, st.m[id].Status)
+
+	require.NoError(t, applyEvent(t, &st, 6, id, "cancelled", messages.OrderCancelled{ID: id, Forced: true}))
+	require.Equal(t, messages.OrderStatusCancelled, st.m[id].Status)
+
+	err = applyEvent(t, &st, 7, id, "cancelled", messages.OrderCancelled{ID: id, Forced: true})
+	require.ErrorIs(t, err, errInvalidTransition)
+}
+
+func TestOrderStore_Backorder(t *testing.T) {
+	st := newOrderStore()
+	id := uuid.New()
+	w41 := messages.OrderCreateWarehouse{WarehouseId: "41", ReservationId: uuid.New()}
+	w42 := messages.OrderCreateWarehouse{WarehouseId: "42", ReservationId: uuid.New()}
+
+	require.NoError(t, applyEvent(t, &st, 1, id, "created", messages.OrderCreated{
+		ID:        id,
+		Backorder: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 5}},
+	}))
+	require.Equal(t, messages.BackorderOpen, st.m[id].BackorderStatus)
+
+	// backorders are allocated only after the order is confirmed
+	require.ErrorIs(t, applyEvent(t, &st, 2, id, "backorder_allocated", messages.OrderBackorderAllocated{ID: id}), errInvalidTransition)
+
+	require.NoError(t, applyEvent(t, &st, 3, id, "reserved", messages.OrderReserved{ID: id, Warehouses: []messages.OrderCreateWarehouse{w41}}))
+	require.NoError(t, applyEvent(t, &st, 4, id, "confirmed", messages.OrderConfirmed{ID: id, Warehouses: []messages.OrderCreateWarehouse{w41}}))
+	require.NoError(t, applyEvent(t, &st, 5, id, "fulfilling", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusFulfilling}))
+
+	// the order is not shipped while part of it is backordered
+	require.ErrorIs(t, applyEvent(t, &st, 6, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped}), errInvalidTransition)
+	require.NoError(t, applyEvent(t, &st, 7, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped, WarehouseId: "41"}))
+	require.Equal(t, messages.OrderStatusFulfilling, st.m[id].Status)
+
+	require.NoError(t, applyEvent(t, &st, 8, id, "backorder_allocated", messages.OrderBackorderAllocated{
+		ID:         id,
+		Warehouses: []messages.OrderCreateWarehouse{w42},
+		Remaining:  []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}},
+	}))
+	require.Equal(t, messages.BackorderOpen, st.m[id].BackorderStatus)
+	require.Equal(t, []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}}, st.m[id].Backorder)
+
+	require.NoError(t, applyEvent(t, &st, 9, id, "shipped", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusShipped, WarehouseId: "42"}))
+	require.Equal(t, messages.OrderStatusFulfilling, st.m[id].Status)
+
+	// every allocated part has already been shipped: the order is shipped as soon as the backorder is fulfilled
+	require.NoError(t, applyEvent(t, &st, 10, id, "backorder_allocated", messages.OrderBackorderAllocated{
+		ID:         id,
+		Warehouses: []messages.OrderCreateWarehouse{},
+		Remaining:  []messages.OrderCreatedItem{},
+	}))
+	require.Equal(t, messages.BackorderFulfilled, st.m[id].BackorderStatus)
+	require.Equal(t, messages.OrderStatusShipped, st.m[id].Status)
+}
+
+func TestOpenBackorders(t *testing.T) {
+	st := newOrderStore()
+	older, newer, cancelled, urgent := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	backorder := []messages.OrderCreatedItem{{GoodId: "hat", Amount: 1}}
+	now := time.Now()
+
+	for i, o := range []struct {
+		id        uuid.UUID
+		priority  int
+		createdAt time.Time
+	}{{newer, 0, now}, {older, 0, now.Add(-time.Hour)}, {cancelled, 0, now.Add(-2 * time.Hour)}, {urgent, 1, now}} {
+		seq := uint64(i * 10)
+		require.NoError(t, applyEvent(t, &st, seq+1, o.id, "created", messages.OrderCreated{ID: o.id, Backorder: backorder, Priority: o.priority, CreatedAt: o.createdAt}))
+		require.NoError(t, applyEvent(t, &st, seq+2, o.id, "reserved", messages.OrderReserved{ID: o.id}))
+		require.NoError(t, applyEvent(t, &st, seq+3, o.id, "confirmed", messages.OrderConfirmed{ID: o.id}))
+	}
+	require.NoError(t, applyEvent(t, &st, 100, cancelled, "cancelled", messages.OrderCancelled{ID: cancelled}))
+	require.Equal(t, messages.BackorderCancelled, st.m[cancelled].BackorderStatus)
+
+	queue := openBackorders(&st)
+	require.Len(t, queue, 3)
+	require.Equal(t, urgent, queue[0].id)
+	require.Equal(t, older, queue[1].id)
+	require.Equal(t, newer, queue[2].id)
+	require.Equal(t, map[string]int{"hat": 1}, queue[0].lines)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+)
+
+// Names of the built-in allocation strategies
+const (
+	StrategyFewestWarehouses = "fewest_warehouses"
+	StrategyHome             = "home"
+	StrategyNearest          = "nearest"
+	StrategyBalance          = "balance"
+	StrategyPriority         = "priority"
+)
+
+// Allocation is the result of splitting an order among warehouses
+type Allocation struct {
+	// Parts maps a warehouse id to the amount of each good taken from that warehouse
+	Parts map[string]map[string]int
+	// Missing contains, for each good, the amount that could not be allocated
+	Missing map[string]int
+}
+
+// Allocator decides which warehouses are used to fulfill an order.
+//
+// lines maps a good id to the requested amount, while stock maps a warehouse id
+// to the amount of each good available there. Implementations must not modify
+// their arguments, and must be deterministic: the same input always gives the same split.
+type Allocator interface {
+	Allocate(lines map[string]int, stock map[string]map[string]int) Allocation
+}
+
+// allocationConfig holds the service-wide defaults for allocation, which can be overridden per request
+type allocationConfig struct {
+	strategy      string
+	homeWarehouse string
+	locations     map[string]messages.Coordinates
+	priority      []string
+}
+
+// loadAllocationConfig reads the allocation defaults from the environment:
+//
+//   - ORDER_ALLOCATOR: default strategy name
+//   - ORDER_HOME_WAREHOUSE: warehouse preferred by the "home" strategy
+//   - WAREHOUSE_LOCATIONS: coordinates of warehouses, e.g. `41=45.40,11.87;42=45.46,9.19`
+//   - WAREHOUSE_PRIORITY: comma separated list of warehouses used by the "priority" strategy
+func loadAllocationConfig() (allocationConfig, error) {
+	cfg := allocationConfig{
+		strategy:      os.Getenv("ORDER_ALLOCATOR"),
+		homeWarehouse: os.Getenv("ORDER_HOME_WAREHOUSE"),
+		locations:     make(map[string]messages.Coordinates),
+	}
+	if cfg.strategy == "" {
+		cfg.strategy = StrategyFewestWarehouses
+	}
+
+	if p := os.Getenv("WAREHOUSE_PRIORITY"); p != "" {
+		cfg.priority = strings.Split(p, ",")
+	}
+
+	if l := os.Getenv("WAREHOUSE_LOCATIONS"); l != "" {
+		for _, entry := range strings.Split(l, ";") {
+			id, coords, ok := strings.Cut(entry, "=")
+			if !ok {
+				return cfg, fmt.Errorf("invalid warehouse location %q", entry)
+			}
+			lat, lon, ok := strings.Cut(coords, ",")
+			if !ok {
+				return cfg, fmt.Errorf("invalid warehouse location %q", entry)
+			}
+			latV, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid latitude for warehouse %s: %w", id, err)
+			}
+			lonV, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid longitude for warehouse %s: %w", id, err)
+			}
+			cfg.locations[strings.TrimSpace(id)] = messages.Coordinates{Lat: latV, Lon: lonV}
+		}
+	}
+
+	return cfg, nil
+}
+
+// NewAllocator builds the Allocator requested by opts, using cfg for every option not specified in the request.
+// It returns the name of the chosen strategy along with the allocator.
+func NewAllocator(opts messages.AllocationOptions, cfg allocationConfig) (string, Allocator, error) {
+	strategy := opts.Strategy
+	if strategy == "" {
+		strategy = cfg.strategy
+	}
+
+	switch strategy {
+	case StrategyFewestWarehouses:
+		return strategy, fewestWarehouses{}, nil
+	case StrategyHome:
+		home := opts.HomeWarehouse
+		if home == "" {
+			home = cfg.homeWarehouse
+		}
+		if home == "" {
+			return strategy, nil, fmt.Errorf("strategy %q requires a home warehouse", strategy)
+		}
+		return strategy, homeWarehouse{home: home}, nil
+	case StrategyNearest:
+		if opts.Destination == nil {
+			return strategy, nil, fmt.Errorf("strategy %q requires a destination", strategy)
+		}
+		return strategy, nearest{destination: *opts.Destination, locations: cfg.locations}, nil
+	case StrategyBalance:
+		return strategy, balance{}, nil
+	case StrategyPriority:
+		priority := opts.Priority
+		if len(priority) == 0 {
+			priority = cfg.priority
+		}
+		return strategy, priorityList{priority: priority}, nil
+	default:
+		return strategy, nil, fmt.Errorf("unknown allocation strategy %q", strategy)
+	}
+}
+
+// newAllocation returns an empty Allocation where every requested line is still missing
+func newAllocation(lines map[string]int) Allocation {
+	a := Allocation{
+		Parts:   make(map[string]map[string]int),
+		Missing: make(map[string]int),
+	}
+	for goodId, amount := range lines {
+		if amount > 0 {
+			a.Missing[goodId] = amount
+		}
+	}
+	return a
+}
+
+// take moves up to the missing amount of goodId from warehouseId into the allocation
+func (a *Allocation) take(warehouseId string, goodId string, available int) {
+	used := min(a.Missing[goodId], available)
+	if used <= 0 {
+		return
+	}
+
+	if a.Parts[warehouseId] == nil {
+		a.Parts[warehouseId] = make(map[string]int)
+	}
+	a.Parts[warehouseId][goodId] += used
+	a.Missing[goodId] -= used
+	if a.Missing[goodId] == 0 {
+		delete(a.Missing, goodId)
+	}
+}
+
+// available returns how much of goodId warehouseId can still give, given what was already allocated from it
+func (a *Allocation) available(stock map[string]map[string]int, warehouseId string, goodId string) int {
+	return stock[warehouseId][goodId] - a.Parts[warehouseId][goodId]
+}
+
+// fill allocates from the given warehouses in order, taking as much as possible from each
+func (a *Allocation) fill(stock map[string]map[string]int, warehouses []string) {
+	for _, warehouseId := range warehouses {
+		if len(a.Missing) == 0 {
+			return
+		}
+		for _, goodId := range sortedKeys(a.Missing) {
+			a.take(warehouseId, goodId, a.available(stock, warehouseId, goodId))
+		}
+	}
+}
+
+// coverage returns how many of the missing units warehouseId could provide
+func (a *Allocation) coverage(stock map[string]map[string]int, warehouseId string) int {
+	covered := 0
+	for goodId, missing := range a.Missing {
+		covered += min(missing, max(a.available(stock, warehouseId, goodId), 0))
+	}
+	return covered
+}
+
+// fewestWarehouses tries to use as few warehouses as possible, by repeatedly
+// choosing the warehouse that can provide the largest part of what is still missing
+type fewestWarehouses struct{}
+
+func (fewestWarehouses) Allocate(lines map[string]int, stock map[string]map[string]int) Allocation {
+	a := newAllocation(lines)
+	a.fewest(stock, sortedKeys(stock))
+	return a
+}
+
+func (a *Allocation) fewest(stock map[string]map[string]int, candidates []string) {
+	candidates = slices.Clone(candidates)
+	for len(a.Missing) > 0 && len(candidates) > 0 {
+		best, bestCoverage := -1, 0
+		for i, warehouseId := range candidates {
+			if c := a.coverage(stock, warehouseId); c > bestCoverage {
+				best, bestCoverage = i, c
+			}
+		}
+		if best == -1 {
+			return
+		}
+
+		a.fill(stock, candidates[best:best+1])
+		candidates = slices.Delete(candidates, best, best+1)
+	}
+}
+
+// homeWarehouse takes everything it can from the home warehouse, and
+// allocates the rest like fewestWarehouses
+type homeWarehouse struct {
+	home string
+}
+
+func (h homeWarehouse) Allocate(lines map[string]int, stock map[string]map[string]int) Allocation {
+	a := newAllocation(lines)
+	a.fill(stock, []string{h.home})
+	a.fewest(stock, slices.DeleteFunc(sortedKeys(stock), func(id string) bool { return id == h.home }))
+	return a
+}
+
+// nearest uses warehouses by increasing distance from the destination.
+// Warehouses with unknown location are used last.
+type nearest struct {
+	destination messages.Coordinates
+	locations   map[string]messages.Coordinates
+}
+
+func (n nearest) Allocate(lines map[string]int, stock map[string]map[string]int) Allocation {
+	warehouses := sortedKeys(stock)
+	slices.SortStableFunc(warehouses, func(a, b string) int {
+		return compareDistance(n.distance(a), n.distance(b))
+	})
+
+	alloc := newAllocation(lines)
+	alloc.fill(stock, warehouses)
+	return alloc
+}
+
+func (n nearest) distance(warehouseId string) float64 {
+	loc, ok := n.locations[warehouseId]
+	if !ok {
+		return math.Inf(1)
+	}
+	return haversine(n.destination, loc)
+}
+
+func compareDistance(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// haversine returns the great-circle distance in kilometers between two points
+func haversine(a, b messages.Coordinates) float64 {
+	const earthRadius = 6371.0
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(b.Lat - a.Lat)
+	dLon := toRad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// balance spreads the load by taking each good from the warehouse that has
+// the most of it, so that stock levels among warehouses even out over time
+type balance struct{}
+
+func (balance) Allocate(lines map[string]int, stock map[string]map[string]int) Allocation {
+	a := newAllocation(lines)
+	warehouses := sortedKeys(stock)
+
+	for _, goodId := range sortedKeys(a.Missing) {
+		byAvailability := slices.Clone(warehouses)
+		slices.SortStableFunc(byAvailability, func(x, y string) int {
+			return stock[y][goodId] - stock[x][goodId]
+		})
+		for _, warehouseId := range byAvailability {
+			a.take(warehouseId, goodId, a.available(stock, warehouseId, goodId))
+		}
+	}
+	return a
+}
+
+// priorityList uses warehouses in the given order, followed by every other warehouse sorted by id
+type priorityList struct {
+	priority []string
+}
+
+func (p priorityList) Allocate(lines map[string]int, stock map[string]map[string]int) Allocation {
+	warehouses := slices.Clone(p.priority)
+	for _, warehouseId := range sortedKeys(stock) {
+		if !slices.Contains(p.priority, warehouseId) {
+			warehouses = append(warehouses, warehouseId)
+		}
+	}
+
+	a := newAllocation(lines)
+	a.fill(stock, warehouses)
+	return a
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+var testStock = map[string]map[string]int{
+	"41": {"hat": 5, "scarf": 1},
+	"42": {"hat": 10, "scarf": 10},
+	"43": {"hat": 2},
+}
+
+func TestAllocator_FewestWarehouses(t *testing.T) {
+	_, a, err := NewAllocator(messages.AllocationOptions{Strategy: StrategyFewestWarehouses}, allocationConfig{})
+	require.NoError(t, err)
+
+	alloc := a.Allocate(map[string]int{"hat": 8, "scarf": 3}, testStock)
+	require.Empty(t, alloc.Missing)
+	require.Equal(t, map[string]map[string]int{"42": {"hat": 8, "scarf": 3}}, alloc.Parts)
+}
+
+func TestAllocator_Home(t *testing.T) {
+	_, a, err := NewAllocator(messages.AllocationOptions{Strategy: StrategyHome, HomeWarehouse: "41"}, allocationConfig{})
+	require.NoError(t, err)
+
+	alloc := a.Allocate(map[string]int{"hat": 8, "scarf": 3}, testStock)
+	require.Empty(t, alloc.Missing)
+	require.Equal(t, map[string]map[string]int{
+		"41": {"hat": 5, "scarf": 1},
+		"42": {"hat": 3, "scarf": 2},
+	}, alloc.Parts)
+}
+
+func TestAllocator_Nearest(t *testing.T) {
+	cfg := allocationConfig{locations: map[string]messages.Coordinates{
+		"41": {Lat: 45.40, Lon: 11.87}, // Padova
+		"42": {Lat: 45.46, Lon: 9.19},  // Milano
+		"43": {Lat: 45.44, Lon: 12.33}, // Venezia
+	}}
+	venice := messages.Coordinates{Lat: 45.43, Lon: 12.32}
+
+	_, a, err := NewAllocator(messages.AllocationOptions{Strategy: StrategyNearest, Destination: &venice}, cfg)
+	require.NoError(t, err)
+
+	alloc := a.Allocate(map[string]int{"hat": 4}, testStock)
+	require.Equal(t, map[string]map[string]int{"43": {"hat": 2}, "41": {"hat": 2}}, alloc.Parts)
+
+	_, _, err = NewAllocator(messages.AllocationOptions{Strategy: StrategyNearest}, cfg)
+	require.Error(t, err)
+}
+
+func TestAllocator_Balance(t *testing.T) {
+	_, a, err := NewAllocator(messages.AllocationOptions{Strategy: StrategyBalance}, allocationConfig{})
+	require.NoError(t, err)
+
+	alloc := a.Allocate(map[string]int{"hat": 12}, testStock)
+	require.Equal(t, map[string]map[string]int{"42": {"hat": 10}, "41": {"hat": 2}}, alloc.Parts)
+}
+
+func TestAllocator_Priority(t *testing.T) {
+	cfg := allocationConfig{priority: []string{"43", "41"}}
+	_, a, err := NewAllocator(messages.AllocationOptions{Strategy: StrategyPriority}, cfg)
+	require.NoError(t, err)
+
+	alloc := a.Allocate(map[string]int{"hat": 20}, testStock)
+	require.Equal(t, map[string]int{"hat": 3}, alloc.Missing)
+	require.Equal(t, map[string]map[string]int{
+		"43": {"hat": 2},
+		"41": {"hat": 5},
+		"42": {"hat": 10},
+	}, alloc.Parts)
+}
+
+func TestAllocator_Unknown(t *testing.T) {
+	_, _, err := NewAllocator(messages.AllocationOptions{Strategy: "random"}, allocationConfig{})
+	require.Error(t, err)
+}
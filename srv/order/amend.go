@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/nats-io/nats.go"
+)
+
+// errOrderChanged is returned when an amendment was computed on lines that are no longer the lines of the order
+var errOrderChanged = errors.New("order changed")
+
+// checkAmend returns an error if the order cannot be amended, assuming its lines are before
+func (o *order) checkAmend(before []messages.OrderCreatedItem) error {
+	// once fulfilling starts, goods are being picked and the order cannot change anymore
+	if o.Status != messages.OrderStatusConfirmed {
+		return fmt.Errorf("%w: order %s cannot be amended while %s", errInvalidTransition, o.ID, o.Status)
+	}
+	if !slices.Equal(o.Items, before) {
+		return fmt.Errorf("%w: order %s", errOrderChanged, o.ID)
+	}
+	return nil
+}
+
+// amendment is the effect of changing the lines of an order
+type amendment struct {
+	after []messages.OrderCreatedItem
+	// increase contains, for each good, the amount that must be reserved
+	increase map[string]int
+	// restock lists the parts that are no longer needed
+	restock   []messages.OrderCreateWarehouse
+	backorder []messages.OrderCreatedItem
+}
+
+// amend computes how the order changes when its lines are updated with the given amounts.
+//
+// Removed goods are taken from the backorder first, and then from the parts allocated last.
+func (o *order) amend(changes map[string]int) amendment {
+	lines := make(map[string]int)
+	for _, item := range o.Items {
+		lines[item.GoodId] += item.Amount
+	}
+	backorder := make(map[string]int)
+	for _, item := range o.Backorder {
+		backorder[item.GoodId] += item.Amount
+	}
+
+	a := amendment{increase: make(map[string]int), restock: make([]messages.OrderCreateWarehouse, 0)}
+	decrease := make(map[string]int)
+	for goodId, amount := range changes {
+		delta := amount - lines[goodId]
+		switch {
+		case delta > 0:
+			a.increase[goodId] = delta
+		case delta < 0:
+			fromBackorder := min(-delta, backorder[goodId])
+			backorder[goodId] -= fromBackorder
+			if -delta > fromBackorder {
+				decrease[goodId] = -delta - fromBackorder
+			}
+		}
+		lines[goodId] = amount
+	}
+
+	for i := len(o.Warehouses) - 1; i >= 0 && len(decrease) > 0; i-- {
+		w := o.Warehouses[i]
+		restock := messages.OrderCreateWarehouse{WarehouseId: w.WarehouseId, ReservationId: w.ReservationId}
+		for _, part := range w.Parts {
+			amount := min(part.Amount, decrease[part.GoodId])
+			if amount == 0 {
+				continue
+			}
+			restock.Parts = append(restock.Parts, messages.OrderCreatedItem{GoodId: part.GoodId, Amount: amount})
+			decrease[part.GoodId] -= amount
+			if decrease[part.GoodId] == 0 {
+				delete(decrease, part.GoodId)
+			}
+		}
+		if len(restock.Parts) > 0 {
+			a.restock = append(a.restock, restock)
+		}
+	}
+
+	for goodId, amount := range lines {
+		if amount == 0 {
+			delete(lines, goodId)
+		}
+	}
+	for goodId, amount := range backorder {
+		if amount == 0 {
+			delete(backorder, goodId)
+		}
+	}
+	a.after = toOrderItems(lines)
+	a.backorder = toOrderItems(backorder)
+	return a
+}
+
+// applyAmendment applies an already checked amendment
+func (o *order) applyAmendment(msg messages.OrderAmended, ts time.Time) {
+	o.Items = msg.After
+	for _, w := range msg.Warehouses {
+		o.Warehouses = append(o.Warehouses, messages.OrderWarehouse{OrderCreateWarehouse: w})
+	}
+
+	for _, restock := range msg.Restock {
+		for i := range o.Warehouses {
+			if o.Warehouses[i].ReservationId != restock.ReservationId {
+				continue
+			}
+			parts := slices.Clone(o.Warehouses[i].Parts)
+			for _, removed := range restock.Parts {
+				for j := range parts {
+					if parts[j].GoodId == removed.GoodId {
+						parts[j].Amount -= removed.Amount
+					}
+				}
+			}
+			o.Warehouses[i].Parts = slices.DeleteFunc(parts, func(part messages.OrderCreatedItem) bool {
+				return part.Amount <= 0
+			})
+		}
+	}
+	// warehouses left without parts are no longer part of the order
+	o.Warehouses = slices.DeleteFunc(o.Warehouses, func(w messages.OrderWarehouse) bool {
+		return len(w.Parts) == 0
+	})
+
+	if msg.Pricing != nil {
+		o.Pricing = msg.Pricing
+	}
+	o.Backorder = msg.Backorder
+	if o.BackorderStatus == messages.BackorderOpen && len(msg.Backorder) == 0 {
+		o.BackorderStatus = messages.BackorderFulfilled
+	}
+
+	o.Amendments = append(o.Amendments, messages.OrderAmendment{
+		Before: msg.Before,
+		After:  msg.After,
+		Reason: msg.Reason,
+		At:     ts,
+	})
+}
+
+// validateAmendment checks the lines of an amended order against the order limits.
+// Only goods that are added or increased must be orderable: goods archived after the order was
+// created can still be kept or reduced. Kits cannot be added, since orders with kits cannot be amended.
+func validateAmendment(ctx context.Context, a amendment, cfg validationConfig, lookup catalogLookup) ([]messages.OrderViolation, error) {
+	goods := make([]string, 0, len(a.after))
+	lines := make(map[string]int, len(a.after))
+	for _, item := range a.after {
+		goods = append(goods, item.GoodId)
+		lines[item.GoodId] = item.Amount
+	}
+
+	kits := make([]messages.OrderViolation, 0)
+	violations, err := validateLines(ctx, goods, lines, cfg, func(ctx context.Context, goodId string) (*messages.CatalogItem, error) {
+		if a.increase[goodId] == 0 {
+			return &messages.CatalogItem{Id: goodId}, nil
+		}
+		item, err := lookup(ctx, goodId)
+		if item != nil && len(item.Components) > 0 {
+			kits = append(kits, messages.OrderViolation{
+				GoodId:  goodId,
+				Code:    "kit_in_amendment",
+				Message: "kits cannot be added to existing orders",
+			})
+			// the kit itself is reported above
+			return &messages.CatalogItem{Id: goodId}, nil
+		}
+		return item, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(violations, kits...), nil
+}
+
+// AmendOrderHandler is the handler for `order.amend`.
+//
+// Added goods are reserved (possibly in warehouses not used by the order yet), and removed goods are
+// given back to the warehouses that were going to ship them. It responds with the amended order.
+func AmendOrderHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.AmendOrder
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	changes := make(map[string]int, len(req.Items))
+	for _, item := range req.Items {
+		if item.GoodId == "" || item.Amount < 0 {
+			natsutil.Respond(msg, natsutil.InvalidRequest)
+			return
+		}
+		changes[item.GoodId] = item.Amount
+	}
+
+	state := s.State()
+	_, allocator, err := NewAllocator(messages.AllocationOptions{}, state.allocation)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid allocation configuration", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidAllocation)
+		return
+	}
+
+	state.stock.Lock()
+	defer state.stock.Unlock()
+
+	store := &state.orders
+	store.Lock()
+	o, ok := store.m[req.ID]
+	if !ok {
+		store.Unlock()
+		natsutil.Respond(msg, natsutil.OrderNotFound)
+		return
+	}
+	if len(o.Kits) > 0 {
+		store.Unlock()
+		natsutil.Respond(msg, natsutil.OrderHasKits)
+		return
+	}
+	before := slices.Clone(o.Items)
+	if err := o.checkAmend(before); err != nil {
+		store.Unlock()
+		natsutil.Respond(msg, natsutil.OrderNotAmendable)
+		return
+	}
+	a := o.amend(changes)
+	seq := o.seq
+	prevPricing := o.Pricing
+	priority := o.Priority
+	store.Unlock()
+
+	if len(a.after) == 0 {
+		natsutil.Respond(msg, natsutil.EmptyOrder)
+		return
+	}
+
+	violations, err := validateAmendment(ctx, a, state.validation, state.catalog)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error validating order", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	if len(violations) > 0 {
+		natsutil.RespondWithDetails(msg, natsutil.InvalidOrder, violations)
+		return
+	}
+
+	// orders created before prices were introduced are left without pricing
+	var pricing *messages.OrderPricing
+	if prevPricing != nil {
+		pricing, violations, err = priceOrder(ctx, a.after, prevPricing.Currency, prevPricing.TaxRate, state.catalog, knownPrices(prevPricing), time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "Error pricing order", "error", err)
+			natsutil.Respond(msg, natsutil.KvError)
+			return
+		}
+		if len(violations) > 0 {
+			natsutil.RespondWithDetails(msg, natsutil.InvalidOrder, violations)
+			return
+		}
+	}
+
+	store.Lock()
+	allocation := allocator.Allocate(a.increase, availableStock(state.stock.m, store, priority, req.ID, nil))
+	// stock held by scheduled orders with a lower priority is taken by the amended order, once it is amended
+	preempted := preemptions(state.stock.m, store, priority, req.ID, allocation.Parts)
+	store.Unlock()
+	if len(allocation.Missing) > 0 {
+		natsutil.Respond(msg, natsutil.InsufficientStock)
+		return
+	}
+
+	saga, err := state.sagas.Start(ctx, allocationSagaId(req.ID, "amend", seq))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error starting amendment saga", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+
+	warehouses, err := reserveParts(ctx, state, saga, allocator, allocation.Parts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reserving stock", "error", err, "order", req.ID)
+		abortSaga(ctx, state.sagas, saga)
+		if errors.Is(err, errReservationFailed) {
+			natsutil.Respond(msg, natsutil.ReservationFailed)
+		} else {
+			natsutil.Respond(msg, natsutil.NatsError)
+		}
+		return
+	}
+
+	store.Lock()
+	err = publishOrderEvent(ctx, s.JetStream(), store, req.ID, "amended", messages.OrderAmended{
+		ID:         req.ID,
+		Before:     before,
+		After:      a.after,
+		Warehouses: warehouses,
+		Restock:    a.restock,
+		Backorder:  a.backorder,
+		Pricing:    pricing,
+		Reason:     req.Reason,
+	})
+	if err == nil {
+		preempt(ctx, s.JetStream(), store, preempted, req.ID)
+	}
+	store.Unlock()
+	switch {
+	case errors.Is(err, errOrderChanged):
+		abortSaga(ctx, state.sagas, saga)
+		natsutil.Respond(msg, natsutil.OrderChanged)
+		return
+	case errors.Is(err, errInvalidTransition):
+		// e.g. the order was cancelled while reserving the stock
+		abortSaga(ctx, state.sagas, saga)
+		natsutil.Respond(msg, natsutil.OrderNotAmendable)
+		return
+	case err != nil:
+		slog.ErrorContext(ctx, "Error sending the order amended message", "error", err)
+		abortSaga(ctx, state.sagas, saga)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	if err = state.sagas.Complete(ctx, saga); err != nil {
+		slog.ErrorContext(ctx, "Error completing amendment saga", "error", err, "saga", saga.ID)
+	}
+
+	slog.InfoContext(ctx, "Order amended", "order", req.ID, "reserved", len(warehouses), "restocked", len(a.restock))
+
+	store.Lock()
+	payload, err := json.Marshal(store.m[req.ID].Order)
+	store.Unlock()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+	_ = msg.Respond(payload)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrder_Amend(t *testing.T) {
+	st := newOrderStore()
+	id := uuid.New()
+	w41 := messages.OrderCreateWarehouse{WarehouseId: "41", ReservationId: uuid.New(), Parts: []messages.OrderCreatedItem{
+		{GoodId: "hat", Amount: 3},
+		{GoodId: "shoe", Amount: 2},
+	}}
+	w42 := messages.OrderCreateWarehouse{WarehouseId: "42", ReservationId: uuid.New(), Parts: []messages.OrderCreatedItem{
+		{GoodId: "hat", Amount: 2},
+	}}
+	items := []messages.OrderCreatedItem{{GoodId: "hat", Amount: 6}, {GoodId: "shoe", Amount: 2}}
+
+	require.NoError(t, applyEvent(t, &st, 1, id, "created", messages.OrderCreated{
+		ID:        id,
+		Items:     items,
+		Backorder: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 1}},
+	}))
+	require.NoError(t, applyEvent(t, &st, 2, id, "reserved", messages.OrderReserved{ID: id, Warehouses: []messages.OrderCreateWarehouse{w41, w42}}))
+	require.NoError(t, applyEvent(t, &st, 3, id, "confirmed", messages.OrderConfirmed{ID: id}))
+
+	// 4 hats less: 1 from the backorder, 2 from the last warehouse, 1 from the first one.
+	// Shoes are removed, and socks added.
+	a := st.m[id].amend(map[string]int{"hat": 2, "shoe": 0, "sock": 4})
+	require.Equal(t, []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}, {GoodId: "sock", Amount: 4}}, a.after)
+	require.Equal(t, map[string]int{"sock": 4}, a.increase)
+	require.Empty(t, a.backorder)
+	require.Equal(t, []messages.OrderCreateWarehouse{
+		{WarehouseId: "42", ReservationId: w42.ReservationId, Parts: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}}},
+		{WarehouseId: "41", ReservationId: w41.ReservationId, Parts: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 1}, {GoodId: "shoe", Amount: 2}}},
+	}, a.restock)
+
+	w43 := messages.OrderCreateWarehouse{WarehouseId: "43", ReservationId: uuid.New(), Parts: []messages.OrderCreatedItem{{GoodId: "sock", Amount: 4}}}
+	require.NoError(t, applyEvent(t, &st, 4, id, "amended", messages.OrderAmended{
+		ID:         id,
+		Before:     items,
+		After:      a.after,
+		Warehouses: []messages.OrderCreateWarehouse{w43},
+		Restock:    a.restock,
+		Backorder:  a.backorder,
+	}))
+
+	o := st.m[id]
+	require.Equal(t, a.after, o.Items)
+	require.Equal(t, messages.BackorderFulfilled, o.BackorderStatus)
+	require.Len(t, o.Amendments, 1)
+	require.Len(t, o.Warehouses, 2)
+	require.Equal(t, "41", o.Warehouses[0].WarehouseId)
+	require.Equal(t, []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}}, o.Warehouses[0].Parts)
+	require.Equal(t, "43", o.Warehouses[1].WarehouseId)
+
+	// an amendment computed on the old lines is refused
+	body, err := json.Marshal(messages.OrderAmended{ID: id, Before: items, After: items})
+	require.NoError(t, err)
+	require.ErrorIs(t, st.check(orderSubject(id, "amended"), body), errOrderChanged)
+
+	// orders being fulfilled cannot be amended
+	require.NoError(t, applyEvent(t, &st, 5, id, "fulfilling", messages.OrderStatusChanged{ID: id, Status: messages.OrderStatusFulfilling}))
+	body, err = json.Marshal(messages.OrderAmended{ID: id, Before: o.Items, After: o.Items})
+	require.NoError(t, err)
+	require.ErrorIs(t, st.check(orderSubject(id, "amended"), body), errInvalidTransition)
+}
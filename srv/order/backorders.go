@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+)
+
+// notifyBackorders wakes up AllocateBackordersLoop, without blocking if it is already going to run
+func notifyBackorders(state *orderState) {
+	select {
+	case state.backorders <- struct{}{}:
+	default:
+	}
+}
+
+// AllocateBackordersLoop allocates the open backorders every time it is notified that new stock arrived
+func AllocateBackordersLoop(ctx context.Context, s *common.Service[orderState]) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.State().backorders:
+			allocateBackorders(ctx, s)
+		}
+	}
+}
+
+// backorder is an open backorder waiting for stock
+type backorder struct {
+	id        uuid.UUID
+	seq       uint64
+	priority  int
+	lines     map[string]int
+	createdAt time.Time
+}
+
+// openBackorders returns the open backorders that can be allocated, higher priorities first, then oldest orders first.
+//
+// store MUST be locked
+func openBackorders(store *orderStore) []backorder {
+	queue := make([]backorder, 0)
+	for _, o := range store.m {
+		if o.checkBackorderAllocation() != nil {
+			continue
+		}
+		lines := make(map[string]int, len(o.Backorder))
+		for _, item := range o.Backorder {
+			lines[item.GoodId] += item.Amount
+		}
+		queue = append(queue, backorder{id: o.ID, seq: o.seq, priority: o.Priority, lines: lines, createdAt: o.CreatedAt})
+	}
+	slices.SortFunc(queue, func(a, b backorder) int {
+		if a.priority != b.priority {
+			return b.priority - a.priority
+		}
+		return a.createdAt.Compare(b.createdAt)
+	})
+	return queue
+}
+
+// allocateBackorders reserves the available stock for the open backorders, by priority and then in FIFO order.
+// Backorders are allocated partially if there is not enough stock for all of their goods.
+func allocateBackorders(ctx context.Context, s *common.Service[orderState]) {
+	state := s.State()
+
+	_, allocator, err := NewAllocator(messages.AllocationOptions{}, state.allocation)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid allocation configuration", "error", err)
+		return
+	}
+
+	state.stock.Lock()
+	defer state.stock.Unlock()
+
+	store := &state.orders
+	store.Lock()
+	queue := openBackorders(store)
+	store.Unlock()
+
+	// stock reserved for earlier backorders is not removed from state.stock until warehouses commit it
+	reserved := make([]messages.OrderCreateWarehouse, 0)
+	for _, b := range queue {
+		store.Lock()
+		allocation := allocator.Allocate(b.lines, availableStock(state.stock.m, store, b.priority, b.id, reserved))
+		// stock held by scheduled orders with a lower priority is taken by the backorder, once it is allocated
+		preempted := preemptions(remainingStock(state.stock.m, reserved, nil), store, b.priority, b.id, allocation.Parts)
+		store.Unlock()
+		if len(allocation.Parts) == 0 {
+			continue
+		}
+
+		warehouses, err := allocateBackorder(ctx, s, allocator, b, allocation, preempted)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error allocating backorder", "error", err, "order", b.id)
+			continue
+		}
+		reserved = append(reserved, warehouses...)
+	}
+}
+
+// allocateBackorder reserves the parts of allocation for a single backorder, publishes the allocation,
+// and then preempts the given scheduled orders. state.stock MUST be locked
+func allocateBackorder(ctx context.Context, s *common.Service[orderState], allocator Allocator, b backorder, allocation Allocation, preempted []uuid.UUID) ([]messages.OrderCreateWarehouse, error) {
+	state := s.State()
+
+	saga, err := state.sagas.Start(ctx, allocationSagaId(b.id, "backorder", b.seq))
+	if err != nil {
+		return nil, err
+	}
+
+	warehouses, err := reserveParts(ctx, state, saga, allocator, allocation.Parts)
+	if err != nil {
+		// the stock will be allocated with the next stock update
+		abortSaga(ctx, state.sagas, saga)
+		return nil, err
+	}
+
+	store := &state.orders
+	store.Lock()
+	err = publishOrderEvent(ctx, s.JetStream(), store, b.id, "backorder_allocated", messages.OrderBackorderAllocated{
+		ID:         b.id,
+		Warehouses: warehouses,
+		Remaining:  toOrderItems(allocation.Missing),
+	})
+	if err == nil {
+		preempt(ctx, s.JetStream(), store, preempted, b.id)
+	}
+	store.Unlock()
+	if err != nil {
+		// e.g. the order was cancelled while reserving the stock
+		abortSaga(ctx, state.sagas, saga)
+		return nil, err
+	}
+
+	if err = state.sagas.Complete(ctx, saga); err != nil {
+		slog.ErrorContext(ctx, "Error completing backorder saga", "error", err, "saga", saga.ID)
+	}
+
+	slog.InfoContext(ctx, "Backorder allocated", "order", b.id, "warehouses", len(warehouses), "remaining", len(allocation.Missing))
+	return warehouses, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWarehouses accepts every reservation requested to the warehouses, and records them
+type fakeWarehouses struct {
+	sync.Mutex
+	reserved map[string][]messages.ReserveStock
+}
+
+func newTestOrderService(t *testing.T, ctx context.Context) (*common.Service[orderState], *fakeWarehouses) {
+	nc := common.NewInProcessNATSServer(t)
+	t.Cleanup(nc.Close)
+
+	s := common.NewService(ctx, nc, orderState{
+		stock:      stockState{m: make(map[string]map[string]int)},
+		allocation: allocationConfig{strategy: StrategyFewestWarehouses},
+		orders:     newOrderStore(),
+		backorders: make(chan struct{}, 1),
+	})
+	require.NoError(t, common.CreateStream(ctx, s.JetStream(), common.StockUpdatesStreamConfig))
+	require.NoError(t, common.CreateStream(ctx, s.JetStream(), common.OrdersStreamConfig))
+
+	kv, err := s.JetStream().CreateOrUpdateKeyValue(ctx, common.OrderSagasKeyValueConfig)
+	require.NoError(t, err)
+	s.State().sagas = NewSagaCoordinator(kv, time.Second)
+	s.State().sagas.RegisterAction(ActionReserve, reserveAction{nc: nc})
+
+	warehouses := &fakeWarehouses{reserved: make(map[string][]messages.ReserveStock)}
+	_, err = nc.Subscribe("warehouse.reserve.*", func(msg *nats.Msg) {
+		var req messages.ReserveStock
+		require.NoError(t, json.Unmarshal(msg.Data, &req))
+		warehouses.Lock()
+		warehouses.reserved[msg.Subject] = append(warehouses.reserved[msg.Subject], req)
+		warehouses.Unlock()
+		_ = msg.Respond([]byte("ok"))
+	})
+	require.NoError(t, err)
+	_, err = nc.Subscribe("warehouse.release.*", func(msg *nats.Msg) { _ = msg.Respond([]byte("ok")) })
+	require.NoError(t, err)
+
+	return s, warehouses
+}
+
+// createBackorderedOrder creates a confirmed order, whose goods are all backordered
+func createBackorderedOrder(t *testing.T, ctx context.Context, s *common.Service[orderState], backorder []messages.OrderCreatedItem) uuid.UUID {
+	store := &s.State().orders
+	store.Lock()
+	defer store.Unlock()
+
+	id := uuid.New()
+	js := s.JetStream()
+	require.NoError(t, publishOrderEvent(ctx, js, store, id, "created", messages.OrderCreated{ID: id, Items: backorder, Backorder: backorder, CreatedAt: time.Now()}))
+	require.NoError(t, publishOrderEvent(ctx, js, store, id, "reserved", messages.OrderReserved{ID: id}))
+	require.NoError(t, publishOrderEvent(ctx, js, store, id, "confirmed", messages.OrderConfirmed{ID: id}))
+	return id
+}
+
+// updateStock publishes stock updates, and applies them with StockUpdateHandler
+func updateStock(t *testing.T, ctx context.Context, s *common.Service[orderState], warehouseId string, updates ...messages.StockUpdate) {
+	for _, update := range updates {
+		body, err := json.Marshal(update)
+		require.NoError(t, err)
+		_, err = s.JetStream().Publish(ctx, "stock_updates."+warehouseId, body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.RegisterJsHandlerExisting(common.StockUpdatesStreamConfig.Name, StockUpdateHandler))
+}
+
+func TestStockUpdateHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	s, _ := newTestOrderService(t, ctx)
+
+	updateStock(t, ctx, s, "41",
+		messages.StockUpdate{{GoodId: "hat", Amount: 5}, {GoodId: "scarf", Amount: 1}},
+		messages.StockUpdate{{GoodId: "hat", Amount: 3}},
+	)
+
+	// stock updates carry the new amounts, not the differences
+	require.Equal(t, map[string]map[string]int{"41": {"hat": 3, "scarf": 1}}, s.State().stock.m)
+	// the backorders are allocated with the new stock
+	require.Len(t, s.State().backorders, 1)
+}
+
+func TestAllocateBackorders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	s, warehouses := newTestOrderService(t, ctx)
+
+	id := createBackorderedOrder(t, ctx, s, []messages.OrderCreatedItem{{GoodId: "hat", Amount: 3}})
+
+	// without stock there is nothing to allocate
+	allocateBackorders(ctx, s)
+	require.Empty(t, warehouses.reserved)
+	require.Equal(t, messages.BackorderOpen, s.State().orders.m[id].BackorderStatus)
+
+	updateStock(t, ctx, s, "41", messages.StockUpdate{{GoodId: "hat", Amount: 5}})
+	allocateBackorders(ctx, s)
+
+	require.Len(t, warehouses.reserved["warehouse.reserve.41"], 1)
+	require.Equal(t, []messages.ReserveStockItem{{GoodId: "hat", Amount: 3}}, warehouses.reserved["warehouse.reserve.41"][0].RequestedStock)
+
+	o := s.State().orders.m[id]
+	require.Equal(t, messages.BackorderFulfilled, o.BackorderStatus)
+	require.Empty(t, o.Backorder)
+	require.Len(t, o.Warehouses, 1)
+	require.Equal(t, "41", o.Warehouses[0].WarehouseId)
+	require.Equal(t, warehouses.reserved["warehouse.reserve.41"][0].ID, o.Warehouses[0].ReservationId)
+}
+
+func TestAllocateBackorders_Partial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	s, warehouses := newTestOrderService(t, ctx)
+
+	id := createBackorderedOrder(t, ctx, s, []messages.OrderCreatedItem{{GoodId: "hat", Amount: 5}, {GoodId: "scarf", Amount: 1}})
+
+	updateStock(t, ctx, s, "41", messages.StockUpdate{{GoodId: "hat", Amount: 2}})
+	allocateBackorders(ctx, s)
+
+	// the available stock is allocated, and the rest keeps waiting
+	require.Equal(t, []messages.ReserveStockItem{{GoodId: "hat", Amount: 2}}, warehouses.reserved["warehouse.reserve.41"][0].RequestedStock)
+	o := s.State().orders.m[id]
+	require.Equal(t, messages.BackorderOpen, o.BackorderStatus)
+	require.ElementsMatch(t, []messages.OrderCreatedItem{{GoodId: "hat", Amount: 3}, {GoodId: "scarf", Amount: 1}}, o.Backorder)
+
+	// the rest is allocated once more stock arrives
+	updateStock(t, ctx, s, "42", messages.StockUpdate{{GoodId: "hat", Amount: 3}, {GoodId: "scarf", Amount: 1}})
+	allocateBackorders(ctx, s)
+
+	require.Len(t, warehouses.reserved["warehouse.reserve.42"], 1)
+	require.ElementsMatch(t, []messages.ReserveStockItem{{GoodId: "hat", Amount: 3}, {GoodId: "scarf", Amount: 1}}, warehouses.reserved["warehouse.reserve.42"][0].RequestedStock)
+	require.Equal(t, messages.BackorderFulfilled, s.State().orders.m[id].BackorderStatus)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/nats-io/nats.go"
+)
+
+// CancelOrderHandler is the handler for `order.cancel`.
+//
+// The stock is given back by the warehouses when they receive the `cancelled` event:
+// reservations are released if the order was not confirmed yet, otherwise the parts
+// that have not been shipped are put back in stock.
+func CancelOrderHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.CancelOrder
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	store := &s.State().orders
+	store.Lock()
+	defer store.Unlock()
+
+	o, ok := store.m[req.ID]
+	if !ok {
+		natsutil.Respond(msg, natsutil.OrderNotFound)
+		return
+	}
+
+	event := messages.OrderCancelled{
+		ID:      req.ID,
+		Reason:  req.Reason,
+		Forced:  req.Force,
+		Release: make([]messages.OrderCreateWarehouse, 0),
+		Restock: make([]messages.OrderCreateWarehouse, 0),
+	}
+	for _, w := range o.Warehouses {
+		switch {
+		case o.Status == messages.OrderStatusReserved:
+			event.Release = append(event.Release, w.OrderCreateWarehouse)
+		case !w.Shipped && o.Status != messages.OrderStatusShipped:
+			event.Restock = append(event.Restock, w.OrderCreateWarehouse)
+		}
+	}
+
+	// pending orders have no reservation yet: order.create releases them when it notices the cancellation
+	err := publishOrderEvent(ctx, s.JetStream(), store, req.ID, "cancelled", event)
+	switch {
+	case errors.Is(err, errOrderShipped):
+		natsutil.Respond(msg, natsutil.OrderShipped)
+		return
+	case errors.Is(err, errInvalidTransition):
+		slog.InfoContext(ctx, "Refused order cancellation", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidTransition)
+		return
+	case err != nil:
+		slog.ErrorContext(ctx, "Error sending the order cancelled message", "error", err)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Order cancelled", "order", req.ID, "forced", req.Force,
+		"released", len(event.Release), "restocked", len(event.Restock))
+	_ = msg.Respond([]byte("ok"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// customerLookup returns the customer with the given id, or nil if there is none
+type customerLookup func(ctx context.Context, id uuid.UUID) (*messages.Customer, error)
+
+// kvCustomerLookup looks up customers in the customers KV bucket
+func kvCustomerLookup(kv jetstream.KeyValue) customerLookup {
+	return func(ctx context.Context, id uuid.UUID) (*messages.Customer, error) {
+		entry, err := kv.Get(ctx, id.String())
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get customer %s: %w", id, err)
+		}
+
+		var c messages.Customer
+		if err := json.Unmarshal(entry.Value(), &c); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal customer %s: %w", id, err)
+		}
+		return &c, nil
+	}
+}
+
+// resolveShipTo returns the address where the order in data is shipped, or nil if the order has neither
+// a customer nor a shipping address.
+//
+// Addresses referenced by id are looked up among the ones of the customer, and copied in the order, so
+// that later changes to the customer do not move orders already placed.
+func resolveShipTo(ctx context.Context, data []byte, lookup customerLookup) (*messages.Address, []messages.OrderViolation, error) {
+	var req struct {
+		CustomerId string            `json:"customer_id"`
+		ShipTo     *messages.Address `json:"ship_to"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		// already reported by validateOrder
+		return nil, nil, nil
+	}
+
+	var customer *messages.Customer
+	if req.CustomerId != "" {
+		id, err := uuid.Parse(req.CustomerId)
+		if err == nil {
+			customer, err = lookup(ctx, id)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if customer == nil {
+			return nil, []messages.OrderViolation{{
+				Field:   "customer_id",
+				Code:    "unknown_customer",
+				Message: "the customer does not exist",
+			}}, nil
+		}
+	}
+
+	switch {
+	case req.ShipTo != nil && req.ShipTo.ID != uuid.Nil:
+		if customer != nil {
+			for _, a := range customer.Addresses {
+				if a.ID == req.ShipTo.ID {
+					return &a, nil, nil
+				}
+			}
+		}
+		return nil, []messages.OrderViolation{{
+			Field:   "ship_to.id",
+			Code:    "unknown_address",
+			Message: "the address is not one of the addresses of the customer",
+		}}, nil
+	case req.ShipTo != nil:
+		if req.ShipTo.Line1 == "" || req.ShipTo.City == "" || req.ShipTo.Country == "" {
+			return nil, []messages.OrderViolation{{
+				Field:   "ship_to",
+				Code:    "invalid_address",
+				Message: "line1, city and country are required",
+			}}, nil
+		}
+		return req.ShipTo, nil, nil
+	case customer != nil && len(customer.Addresses) > 0:
+		return &customer.Addresses[0], nil, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// shipToDestination makes the "nearest" strategy ship from the warehouses closest to the shipping address,
+// unless the request has its own destination
+func shipToDestination(opts *messages.AllocationOptions, shipTo *messages.Address) {
+	if opts.Destination == nil && shipTo != nil {
+		opts.Destination = shipTo.Coordinates
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveShipTo(t *testing.T) {
+	ctx := context.Background()
+	home := messages.Address{ID: uuid.New(), Line1: "Via Roma 1", City: "Padova", Country: "IT", Coordinates: &messages.Coordinates{Lat: 45.4, Lon: 11.9}}
+	office := messages.Address{ID: uuid.New(), Line1: "Via Trieste 63", City: "Padova", Country: "IT"}
+	customer := messages.Customer{ID: uuid.New(), Name: "Ada", Addresses: []messages.Address{home, office}}
+	lookup := func(_ context.Context, id uuid.UUID) (*messages.Customer, error) {
+		if id == customer.ID {
+			return &customer, nil
+		}
+		return nil, nil
+	}
+
+	resolve := func(req messages.CreateOrder) (*messages.Address, []string) {
+		data, err := json.Marshal(req)
+		require.NoError(t, err)
+		shipTo, violations, err := resolveShipTo(ctx, data, lookup)
+		require.NoError(t, err)
+		return shipTo, violationCodes(violations)
+	}
+
+	shipTo, codes := resolve(messages.CreateOrder{})
+	require.Nil(t, shipTo)
+	require.Empty(t, codes)
+
+	// the first address is the default one
+	shipTo, codes = resolve(messages.CreateOrder{CustomerId: &customer.ID})
+	require.Empty(t, codes)
+	require.Equal(t, home, *shipTo)
+
+	shipTo, codes = resolve(messages.CreateOrder{CustomerId: &customer.ID, ShipTo: &messages.Address{ID: office.ID}})
+	require.Empty(t, codes)
+	require.Equal(t, office, *shipTo)
+
+	other := messages.Address{Line1: "Piazza Bra 1", City: "Verona", Country: "IT"}
+	shipTo, codes = resolve(messages.CreateOrder{ShipTo: &other})
+	require.Empty(t, codes)
+	require.Equal(t, other, *shipTo)
+
+	unknown := uuid.New()
+	_, codes = resolve(messages.CreateOrder{CustomerId: &unknown})
+	require.Equal(t, []string{"unknown_customer"}, codes)
+
+	_, codes = resolve(messages.CreateOrder{ShipTo: &messages.Address{ID: office.ID}})
+	require.Equal(t, []string{"unknown_address"}, codes)
+
+	_, codes = resolve(messages.CreateOrder{ShipTo: &messages.Address{City: "Verona"}})
+	require.Equal(t, []string{"invalid_address"}, codes)
+
+	_, violations, err := resolveShipTo(ctx, []byte(`{"customer_id":"nope"}`), lookup)
+	require.NoError(t, err)
+	require.Equal(t, []string{"unknown_customer"}, violationCodes(violations))
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/alimitedgroup/PoC/common"
@@ -13,6 +15,7 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 // PingHandler is the handler for `order.ping`
@@ -20,144 +23,571 @@ func PingHandler(_ context.Context, _ *common.Service[orderState], msg *nats.Msg
 	_ = msg.Respond([]byte("pong"))
 }
 
-// CreateOrderHandler is the handler for `order.create`
+// CreateOrderHandler is the handler for `order.create`.
+//
+// Requests carrying an idempotency key are executed only once: retries get the original response.
 func CreateOrderHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	response := s.State().idempotency.Do(ctx, "order.create", msg, func(id uuid.UUID) []byte {
+		return createOrder(ctx, s, msg, id)
+	})
+	_ = msg.Respond(response)
+}
+
+// createOrder creates the order requested by msg with the given id, and returns the response to send back
+func createOrder(ctx context.Context, s *common.Service[orderState], msg *nats.Msg, orderId uuid.UUID) []byte {
+	var state = s.State()
+
+	violations, err := validateOrder(ctx, msg.Data, state.validation, state.catalog)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error validating order", "error", err)
+		return natsutil.ErrorResponse(natsutil.KvError)
+	}
+	shipTo, more, err := resolveShipTo(ctx, msg.Data, state.customers)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error resolving the shipping address", "error", err)
+		return natsutil.ErrorResponse(natsutil.KvError)
+	}
+	violations = append(violations, more...)
+	if len(violations) > 0 {
+		return natsutil.ErrorResponseWithDetails(natsutil.InvalidOrder, violations)
+	}
+
 	var req messages.CreateOrder
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
 		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
-		natsutil.Respond(msg, natsutil.InvalidRequest)
-		return
+		return natsutil.ErrorResponse(natsutil.InvalidRequest)
+	}
+	shipToDestination(&req.Allocation, shipTo)
+	// orders are priced, allocated and stored in the base units of their goods
+	if err := toBaseUnits(ctx, &req, state.catalog); err != nil {
+		slog.ErrorContext(ctx, "Error converting units of measure", "error", err)
+		return natsutil.ErrorResponse(natsutil.KvError)
 	}
 
-	var state = s.State()
+	now := time.Now()
+	violations = validateSchedule(req, now)
+	pricing, more, err := priceRequest(ctx, state, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error pricing order", "error", err)
+		return natsutil.ErrorResponse(natsutil.KvError)
+	}
+	violations = append(violations, more...)
+	if len(violations) > 0 {
+		return natsutil.ErrorResponseWithDetails(natsutil.InvalidOrder, violations)
+	}
+	scheduled := state.scheduling.isScheduled(req.ShipDate, now)
+
+	// kits are priced above, and their components are allocated below
+	kits, err := expandKits(ctx, &req, state.catalog)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error expanding kits", "error", err)
+		return natsutil.ErrorResponse(natsutil.KvError)
+	}
+	violations, err = validateExpanded(ctx, req.Items, state.validation, state.catalog)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error validating order", "error", err)
+		return natsutil.ErrorResponse(natsutil.KvError)
+	}
+	if len(violations) > 0 {
+		return natsutil.ErrorResponseWithDetails(natsutil.InvalidOrder, violations)
+	}
+
+	_, allocator, err := NewAllocator(req.Allocation, state.allocation)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid allocation options", "error", err)
+		return natsutil.ErrorResponse(natsutil.InvalidAllocation)
+	}
 
 	state.stock.Lock()
 	defer state.stock.Unlock()
 
-	var remainingStock = make(map[string]int)
-	var totalRemainingStock = 0
-	for _, v := range req.Items {
-		remainingStock[v.GoodId] = v.Amount
-		totalRemainingStock += v.Amount
-	}
-	var usedStock = make(map[string]map[string]int)
-
-	// NOTE: naive implementation, use all the stock of the warehouse to fulfill the order, if it's not enough
-	// check each warehouse for stock
-	for warehouseId, m := range state.stock.m {
-		if totalRemainingStock == 0 {
-			break
-		}
-
-		for goodId, amount := range m {
-			used := 0
-			if remainingStock[goodId] > 0 {
-				if amount >= remainingStock[goodId] {
-					used = remainingStock[goodId]
-				} else {
-					used = amount
-				}
-			}
-			// will use "used" amount of this warehouse for the order
-			remainingStock[goodId] -= used
-			totalRemainingStock -= used
-			if used > 0 {
-				if usedStock[warehouseId] == nil {
-					usedStock[warehouseId] = make(map[string]int)
-				}
-				usedStock[warehouseId][goodId] = used
-			}
+	store := &state.orders
+	store.Lock()
+	allocation := allocator.Allocate(orderLines(req), availableStock(state.stock.m, store, req.Priority, uuid.Nil, nil))
+	store.Unlock()
+
+	// if something is missing, then we don't have enough stock to fulfill the order,
+	// unless the client accepts receiving the missing goods later, or the stock can still arrive before the ship date
+	if len(allocation.Missing) > 0 && !req.AllowPartial && !scheduled {
+		return natsutil.ErrorResponse(natsutil.InsufficientStock)
+	}
+
+	// retries of a request with an idempotency key get the same order id, so that a retry executed after
+	// the original request was lost (e.g. because the service crashed) finds the order it created
+	opts := []jetstream.PublishOpt{jetstream.WithMsgID(orderSubject(orderId, "created"))}
+
+	created := messages.OrderCreated{
+		ID:         orderId,
+		Items:      toOrderItems(orderLines(req)),
+		Kits:       kits,
+		CustomerId: req.CustomerId,
+		ShipTo:     shipTo,
+		Pricing:    pricing,
+		ShipDate:   req.ShipDate,
+		Priority:   req.Priority,
+		CreatedAt:  now,
+	}
+	if scheduled {
+		// the stock is allocated again when the order is released
+		created.Scheduled = true
+		created.AllowPartial = req.AllowPartial
+		created.Allocation = &req.Allocation
+	} else {
+		created.Backorder = toOrderItems(allocation.Missing)
+	}
+
+	// the order exists from now on, even if reserving its stock fails
+	store.Lock()
+	existing, exists := store.m[orderId]
+	var response []byte
+	if exists {
+		response = createdOrderResponse(existing)
+	} else {
+		err = publishOrderEvent(ctx, s.JetStream(), store, orderId, "created", created, opts...)
+	}
+	store.Unlock()
+	if exists {
+		slog.InfoContext(ctx, "Order already created by a previous request", "order", orderId, "status", existing.Status)
+		return response
+	}
+	if errors.Is(err, errDuplicateEvent) {
+		// the order is in the stream, but not in the store yet: its outcome is known once it is
+		slog.InfoContext(ctx, "Order created by a previous request is not loaded yet", "order", orderId)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the order created message", "error", err)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	if scheduled {
+		softReserve(ctx, s, scheduledOrder{id: orderId, priority: req.Priority}, allocation, nil)
+		slog.InfoContext(ctx, "Order scheduled", "order", orderId, "ship_date", req.ShipDate)
+		return []byte(orderId.String())
+	}
+
+	saga, err := state.sagas.Start(ctx, orderId.String())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error starting reservation saga", "error", err)
+		failOrder(ctx, s, orderId, "failed to start reservation")
+		return natsutil.ErrorResponse(natsutil.KvError)
+	}
+
+	warehouses, err := reserveParts(ctx, state, saga, allocator, allocation.Parts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reserving stock", "error", err, "order", orderId)
+		abortSaga(ctx, state.sagas, saga)
+		failOrder(ctx, s, orderId, err.Error())
+		if errors.Is(err, errReservationFailed) {
+			return natsutil.ErrorResponse(natsutil.ReservationFailed)
 		}
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	// orders are confirmed as soon as their stock is reserved: warehouses commit the reservations on `confirmed`
+	store.Lock()
+	err = publishOrderEvent(ctx, s.JetStream(), store, orderId, "reserved", messages.OrderReserved{ID: orderId, Warehouses: warehouses})
+	if err == nil {
+		err = publishOrderEvent(ctx, s.JetStream(), store, orderId, "confirmed", messages.OrderConfirmed{ID: orderId, Warehouses: warehouses})
+	}
+	store.Unlock()
+	if errors.Is(err, errInvalidTransition) {
+		// the order was cancelled while its stock was being reserved
+		slog.InfoContext(ctx, "Order cancelled while reserving stock", "order", orderId)
+		abortSaga(ctx, state.sagas, saga)
+		return natsutil.ErrorResponse(natsutil.OrderCancelledDuringCreation)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the order confirmed message", "error", err)
+		abortSaga(ctx, state.sagas, saga)
+		failOrder(ctx, s, orderId, "failed to confirm order")
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	// stock held by scheduled orders with a lower priority is taken by this order, once it is confirmed:
+	// orders that fail keep their holds
+	store.Lock()
+	preempt(ctx, s.JetStream(), store, preemptions(state.stock.m, store, req.Priority, orderId, allocation.Parts), orderId)
+	store.Unlock()
+
+	if err = state.sagas.Complete(ctx, saga); err != nil {
+		slog.ErrorContext(ctx, "Error completing reservation saga", "error", err, "saga", saga.ID)
+	}
+
+	// NOTE: don't update the stock here, it should be done in the warehouse service that will send back a stock_update event
+
+	return []byte(orderId.String())
+}
+
+// createdOrderResponse returns the response to a retry of the request that created o, according to what
+// happened to it: retries must not report orders that failed or were cancelled as created.
+//
+// store MUST be locked
+func createdOrderResponse(o *order) []byte {
+	switch o.Status {
+	case messages.OrderStatusFailed:
+		return natsutil.ErrorResponseWithDetails(natsutil.OrderFailed, o.ID)
+	case messages.OrderStatusCancelled:
+		return natsutil.ErrorResponse(natsutil.OrderCancelledDuringCreation)
+	default:
+		return []byte(o.ID.String())
+	}
+}
+
+// failOrder marks the order as failed, logging any error
+func failOrder(ctx context.Context, s *common.Service[orderState], id uuid.UUID, reason string) {
+	store := &s.State().orders
+	store.Lock()
+	defer store.Unlock()
+
+	err := publishOrderEvent(ctx, s.JetStream(), store, id, "failed", messages.OrderStatusChanged{
+		ID:     id,
+		Status: messages.OrderStatusFailed,
+		Reason: reason,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the order failed message", "error", err, "order", id)
+	}
+}
+
+// GetOrderHandler is the handler for `order.get`
+func GetOrderHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.GetOrder
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
 	}
 
-	// if there is still remaining stock, then we don't have enough stock to fulfill the order
-	if totalRemainingStock > 0 {
-		natsutil.Respond(msg, natsutil.InsufficientStock)
+	store := &s.State().orders
+	store.Lock()
+	o, ok := store.m[req.ID]
+	var payload []byte
+	var err error
+	if ok {
+		payload, err = json.Marshal(o.Order)
+	}
+	store.Unlock()
+
+	if !ok {
+		natsutil.Respond(msg, natsutil.OrderNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
 		return
 	}
 
-	// create and send all the reservations messages
-	// TODO: use concurrency
-	var warehouseReservationIds = make(map[string]uuid.UUID)
-	for warehouseId, m := range usedStock {
-		var items = make([]messages.ReserveStockItem, 0)
-		for goodId, amount := range m {
-			items = append(items, messages.ReserveStockItem{
-				GoodId: goodId,
-				Amount: amount,
-			})
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// ListOrdersHandler is the handler for `order.list`.
+//
+// Orders are sorted by creation time, and can be filtered by status and customer.
+func ListOrdersHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.ListOrders
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+			natsutil.Respond(msg, natsutil.InvalidRequest)
+			return
 		}
+	}
 
-		id := uuid.New()
-		warehouseReservationIds[warehouseId] = id
-		payload, err := json.Marshal(messages.ReserveStock{
-			ID:             id,
-			RequestedStock: items,
-		})
+	store := &s.State().orders
+	store.Lock()
+	orders := make([]messages.Order, 0, len(store.m))
+	for _, o := range store.m {
+		if req.CustomerId != nil && (o.CustomerId == nil || *o.CustomerId != *req.CustomerId) {
+			continue
+		}
+		if req.Status == "" || o.Status == req.Status {
+			orders = append(orders, o.Order)
+		}
+	}
+	slices.SortFunc(orders, func(a, b messages.Order) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	payload, err := json.Marshal(orders)
+	store.Unlock()
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// UpdateOrderStatusHandler is the handler for `order.update_status`.
+//
+// It moves orders along their lifecycle after confirmation (fulfilling, shipped, delivered):
+// the other transitions are performed by the order service itself.
+func UpdateOrderStatusHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.UpdateOrderStatus
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	switch req.Status {
+	case messages.OrderStatusFulfilling, messages.OrderStatusShipped, messages.OrderStatusDelivered:
+	default:
+		natsutil.Respond(msg, natsutil.InvalidStatus)
+		return
+	}
+
+	store := &s.State().orders
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.m[req.ID]; !ok {
+		natsutil.Respond(msg, natsutil.OrderNotFound)
+		return
+	}
+
+	err := publishOrderEvent(ctx, s.JetStream(), store, req.ID, string(req.Status), messages.OrderStatusChanged{
+		ID:          req.ID,
+		Status:      req.Status,
+		WarehouseId: req.WarehouseId,
+		Reason:      req.Reason,
+	})
+	if errors.Is(err, errInvalidTransition) {
+		slog.InfoContext(ctx, "Refused order status change", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidTransition)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the order status message", "error", err)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	_ = msg.Respond([]byte("ok"))
+}
+
+// MaxReservationAttempts is the number of times order.create tries to reserve stock,
+// moving the parts refused by a warehouse to other warehouses, before giving up
+const MaxReservationAttempts = 3
+
+// errReservationFailed is returned by reserveParts when warehouses refused to reserve the stock
+var errReservationFailed = errors.New("warehouses refused to reserve the stock")
+
+// reserveParts reserves the given parts concurrently with saga: if some warehouse refuses,
+// its part is moved to other warehouses, up to MaxReservationAttempts times.
+//
+// The saga is not aborted on failure, so that the caller can decide what to do with the reservations.
+// It returns the reservations made by this call. state.stock MUST be locked
+func reserveParts(ctx context.Context, state *orderState, saga *Saga, allocator Allocator, parts map[string]map[string]int) ([]messages.OrderCreateWarehouse, error) {
+	first := len(saga.Steps)
+	excluded := make(map[string]bool)
+
+	for attempt := 1; ; attempt++ {
+		steps, err := reserveSteps(parts)
 		if err != nil {
-			slog.ErrorContext(ctx, "Error marshaling response", "error", err)
-			natsutil.Respond(msg, natsutil.NatsError)
-			return
+			return nil, err
 		}
 
-		// send the reservation request
-		r, err := s.NatsConn().RequestMsg(&nats.Msg{
-			Subject: fmt.Sprintf("warehouse.reserve.%s", warehouseId),
-			Data:    payload,
-		}, time.Second*3)
+		failed, err := state.sagas.Execute(ctx, saga, steps)
 		if err != nil {
-			slog.ErrorContext(ctx, "Error sending the reserve message", "error", err)
-			natsutil.Respond(msg, natsutil.NatsError)
-			return
+			return nil, err
+		}
+
+		reserved, err := reservedWarehouses(saga.Steps[first:])
+		if err != nil {
+			return nil, err
+		}
+		if len(failed) == 0 {
+			return reserved, nil
+		}
+
+		missing := make(map[string]int)
+		for _, step := range failed {
+			var p reservePayload
+			if err := json.Unmarshal(step.Payload, &p); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal reserve payload: %w", err)
+			}
+			slog.WarnContext(ctx, "Warehouse refused reservation", "warehouse", p.WarehouseId, "error", step.Error, "attempt", attempt)
+			excluded[p.WarehouseId] = true
+			for _, item := range p.Reservation.RequestedStock {
+				missing[item.GoodId] += item.Amount
+			}
+		}
+
+		if attempt == MaxReservationAttempts {
+			return nil, errReservationFailed
+		}
+
+		// a refused step may still have reserved the stock, e.g. when the request timed out:
+		// release it before moving its part elsewhere, since the saga may end up completed
+		if err := state.sagas.CompensateFailed(ctx, saga); err != nil {
+			return nil, err
 		}
 
-		_ = r
-		// ACK the reservation response
-		// if err = r.Ack(); err != nil {
-		// 	slog.ErrorContext(ctx, "Error acking the response", "error", err)
-		// 	natsutil.Respond(msg, natsutil.NatsError)
-		// 	return
-		// }
+		realloc := allocator.Allocate(missing, remainingStock(state.stock.m, reserved, excluded))
+		if len(realloc.Missing) > 0 {
+			return nil, errReservationFailed
+		}
+		parts = realloc.Parts
 	}
+}
 
-	var order = messages.OrderCreated{
-		ID:         uuid.New(),
-		Warehouses: make([]messages.OrderCreateWarehouse, 0),
+// abortSaga aborts saga, logging any error: a saga that could not be aborted
+// is left in the KV bucket, and will be compensated by RecoverOrders on restart
+func abortSaga(ctx context.Context, sagas *SagaCoordinator, saga *Saga) {
+	if err := sagas.Abort(ctx, saga); err != nil {
+		slog.ErrorContext(ctx, "Error aborting saga", "error", err, "saga", saga.ID)
 	}
+}
 
-	for warehouseId, m := range usedStock {
-		var warehouseItems = make([]messages.OrderCreatedItem, 0)
-		for goodId, amount := range m {
-			warehouseItems = append(warehouseItems, messages.OrderCreatedItem{
-				GoodId: goodId,
-				Amount: amount,
-			})
+// remainingStock returns a copy of stock without the given reservations and the excluded warehouses
+func remainingStock(stock map[string]map[string]int, reserved []messages.OrderCreateWarehouse, excluded map[string]bool) map[string]map[string]int {
+	remaining := make(map[string]map[string]int)
+	for warehouseId, goods := range stock {
+		if excluded[warehouseId] {
+			continue
+		}
+		remaining[warehouseId] = make(map[string]int)
+		for goodId, amount := range goods {
+			remaining[warehouseId][goodId] = amount
+		}
+	}
+	for _, w := range reserved {
+		if remaining[w.WarehouseId] == nil {
+			continue
 		}
+		for _, part := range w.Parts {
+			remaining[w.WarehouseId][part.GoodId] -= part.Amount
+		}
+	}
+	return remaining
+}
 
-		// send the reservation id created before for this warehouse reservation
-		reservationId := warehouseReservationIds[warehouseId]
-		order.Warehouses = append(order.Warehouses, messages.OrderCreateWarehouse{
-			WarehouseId:   warehouseId,
-			ReservationId: reservationId,
-			Parts:         warehouseItems,
-		})
+// QuoteOrderHandler is the handler for `order.quote`.
+//
+// It computes the split `order.create` would use for the same request, without reserving anything.
+func QuoteOrderHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var state = s.State()
+
+	violations, err := validateOrder(ctx, msg.Data, state.validation, state.catalog)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error validating order", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	shipTo, more, err := resolveShipTo(ctx, msg.Data, state.customers)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error resolving the shipping address", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	violations = append(violations, more...)
+	if len(violations) > 0 {
+		natsutil.RespondWithDetails(msg, natsutil.InvalidOrder, violations)
+		return
 	}
 
-	payload, err := json.Marshal(order)
+	var req messages.CreateOrder
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+	shipToDestination(&req.Allocation, shipTo)
+	if err := toBaseUnits(ctx, &req, state.catalog); err != nil {
+		slog.ErrorContext(ctx, "Error converting units of measure", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+
+	pricing, violations, err := priceRequest(ctx, state, req)
 	if err != nil {
-		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
-		natsutil.Respond(msg, natsutil.NatsError)
+		slog.ErrorContext(ctx, "Error pricing order", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	if len(violations) > 0 {
+		natsutil.RespondWithDetails(msg, natsutil.InvalidOrder, violations)
 		return
 	}
 
-	_, err = s.JetStream().Publish(ctx, "orders", payload)
+	kits, err := expandKits(ctx, &req, state.catalog)
 	if err != nil {
-		slog.ErrorContext(ctx, "Error sending the order created message", "error", err)
-		natsutil.Respond(msg, natsutil.NatsError)
+		slog.ErrorContext(ctx, "Error expanding kits", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	violations, err = validateExpanded(ctx, req.Items, state.validation, state.catalog)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error validating order", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	if len(violations) > 0 {
+		natsutil.RespondWithDetails(msg, natsutil.InvalidOrder, violations)
 		return
 	}
 
-	// NOTE: don't update the stock here, it should be done in the warehouse service that will send back a stock_update event
+	strategy, allocator, err := NewAllocator(req.Allocation, state.allocation)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid allocation options", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidAllocation)
+		return
+	}
 
-	_ = msg.Respond([]byte(fmt.Sprintf("order created")))
+	state.stock.Lock()
+	state.orders.Lock()
+	allocation := allocator.Allocate(orderLines(req), availableStock(state.stock.m, &state.orders, req.Priority, uuid.Nil, nil))
+	state.orders.Unlock()
+	state.stock.Unlock()
+
+	quote := messages.OrderQuote{
+		Strategy:   strategy,
+		Warehouses: make([]messages.OrderQuoteWarehouse, 0, len(allocation.Parts)),
+		Missing:    toOrderItems(allocation.Missing),
+		Pricing:    pricing,
+		Kits:       kits,
+	}
+	for _, warehouseId := range sortedKeys(allocation.Parts) {
+		quote.Warehouses = append(quote.Warehouses, messages.OrderQuoteWarehouse{
+			WarehouseId: warehouseId,
+			Parts:       toOrderItems(allocation.Parts[warehouseId]),
+		})
+	}
+
+	payload, err := json.Marshal(quote)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// orderLines sums the requested amount of each good
+func orderLines(req messages.CreateOrder) map[string]int {
+	lines := make(map[string]int)
+	for _, v := range req.Items {
+		lines[v.GoodId] += v.Amount
+	}
+	return lines
+}
+
+// toOrderItems converts a map from good id to amount into a list sorted by good id
+func toOrderItems(m map[string]int) []messages.OrderCreatedItem {
+	items := make([]messages.OrderCreatedItem, 0, len(m))
+	for _, goodId := range sortedKeys(m) {
+		items = append(items, messages.OrderCreatedItem{GoodId: goodId, Amount: m[goodId]})
+	}
+	return items
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreatedOrderResponse(t *testing.T) {
+	id := uuid.New()
+	response := func(status messages.OrderStatus) []byte {
+		return createdOrderResponse(&order{Order: messages.Order{ID: id, Status: status}})
+	}
+
+	require.Equal(t, id.String(), string(response(messages.OrderStatusConfirmed)))
+	require.Equal(t, id.String(), string(response(messages.OrderStatusScheduled)))
+
+	// retries of orders that failed after being created must not report them as created
+	code, _, details, ok := natsutil.ParseErrorDetails(response(messages.OrderStatusFailed))
+	require.True(t, ok)
+	require.Equal(t, "order_failed", code)
+	require.JSONEq(t, `"`+id.String()+`"`, string(details))
+
+	code, _, ok = natsutil.ParseError(response(messages.OrderStatusCancelled))
+	require.True(t, ok)
+	require.Equal(t, "order_cancelled", code)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// Kits have no stock of their own: orders keep the kit lines for display, and reserve their components.
+// Kits are priced with their own price, so their components are not priced.
+
+// kitViolations checks the components of a kit: they must be in the catalog, and orderable
+func kitViolations(ctx context.Context, kit *messages.CatalogItem, lookup catalogLookup) ([]messages.OrderViolation, error) {
+	violations := make([]messages.OrderViolation, 0)
+	for _, c := range kit.Components {
+		item, err := lookup(ctx, c.GoodId)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil || item.Status == messages.CatalogItemArchived || len(item.Components) > 0 {
+			violations = append(violations, messages.OrderViolation{
+				GoodId:  kit.Id,
+				Code:    "unavailable_component",
+				Message: fmt.Sprintf("the component %s of the kit is not in the catalog, or cannot be ordered", c.GoodId),
+			})
+		}
+	}
+	return violations, nil
+}
+
+// expandKits replaces the kit lines of a validated request with their components, and returns the kit lines
+func expandKits(ctx context.Context, req *messages.CreateOrder, lookup catalogLookup) ([]messages.OrderKitLine, error) {
+	items := make([]messages.CreateOrderItem, 0, len(req.Items))
+	kits := make(map[string]*messages.OrderKitLine)
+	for _, line := range req.Items {
+		if kit, ok := kits[line.GoodId]; ok {
+			kit.Amount += line.Amount
+			continue
+		}
+		item, err := lookup(ctx, line.GoodId)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil || len(item.Components) == 0 {
+			items = append(items, line)
+			continue
+		}
+		kits[line.GoodId] = &messages.OrderKitLine{GoodId: line.GoodId, Amount: line.Amount, Components: item.Components}
+	}
+
+	lines := make([]messages.OrderKitLine, 0, len(kits))
+	for _, kit := range kits {
+		for _, c := range kit.Components {
+			// saturate instead of overflowing: the amount is refused by validateExpanded anyway
+			amount := math.MaxInt
+			if kit.Amount <= math.MaxInt/c.Amount {
+				amount = c.Amount * kit.Amount
+			}
+			items = append(items, messages.CreateOrderItem{GoodId: c.GoodId, Amount: amount})
+		}
+		lines = append(lines, *kit)
+	}
+	slices.SortFunc(lines, func(a, b messages.OrderKitLine) int { return strings.Compare(a.GoodId, b.GoodId) })
+
+	req.Items = items
+	return lines, nil
+}
+
+// kitAvailability returns how many kits with the given components can be allocated from stock
+func kitAvailability(goodId string, components []messages.KitComponent, stock map[string]map[string]int) messages.KitAvailability {
+	availability := messages.KitAvailability{
+		GoodId:     goodId,
+		Warehouses: make(map[string]int),
+		Components: make([]messages.ComponentAvailability, 0, len(components)),
+	}
+	if len(components) == 0 {
+		return availability
+	}
+
+	for i, c := range components {
+		total := 0
+		for _, goods := range stock {
+			total += max(goods[c.GoodId], 0)
+		}
+		availability.Components = append(availability.Components, messages.ComponentAvailability{KitComponent: c, Stock: total})
+		if i == 0 || total/c.Amount < availability.Available {
+			availability.Available = total / c.Amount
+		}
+	}
+
+	for warehouseId, goods := range stock {
+		kits := -1
+		for _, c := range components {
+			if n := max(goods[c.GoodId], 0) / c.Amount; kits == -1 || n < kits {
+				kits = n
+			}
+		}
+		if kits > 0 {
+			availability.Warehouses[warehouseId] = kits
+		}
+	}
+	return availability
+}
+
+// KitAvailabilityHandler is the handler for `order.kit_availability`. The stock held by scheduled orders
+// is not available, as for orders with the default priority.
+func KitAvailabilityHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.GetKitAvailability
+	if err := json.Unmarshal(msg.Data, &req); err != nil || req.GoodId == "" {
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	state := s.State()
+	kit, err := state.catalog(ctx, req.GoodId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting kit", "error", err)
+		natsutil.Respond(msg, natsutil.KvError)
+		return
+	}
+	if kit == nil || len(kit.Components) == 0 {
+		natsutil.Respond(msg, natsutil.KitNotFound)
+		return
+	}
+
+	state.stock.Lock()
+	state.orders.Lock()
+	availability := kitAvailability(kit.Id, kit.Components, availableStock(state.stock.m, &state.orders, 0, uuid.Nil, nil))
+	state.orders.Unlock()
+	state.stock.Unlock()
+
+	payload, err := json.Marshal(availability)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+var testSet = messages.CatalogItem{Id: "set", Components: []messages.KitComponent{
+	{GoodId: "hat", Amount: 1},
+	{GoodId: "scarf", Amount: 2},
+}}
+
+func TestValidateOrder_Kits(t *testing.T) {
+	ctx := context.Background()
+	cfg := validationConfig{maxLineAmount: 10, maxLines: 5, maxOrderAmount: 20}
+
+	catalog := testCatalog(testSet, messages.CatalogItem{Id: "hat"}, messages.CatalogItem{Id: "scarf"})
+	violations, err := validateOrder(ctx, []byte(`{"items":[{"good_id":"set","amount":2}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+
+	catalog = testCatalog(testSet, messages.CatalogItem{Id: "hat"}, messages.CatalogItem{Id: "scarf", Status: messages.CatalogItemArchived})
+	violations, err = validateOrder(ctx, []byte(`{"items":[{"good_id":"set","amount":2}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"unavailable_component"}, violationCodes(violations))
+	require.Equal(t, "set", violations[0].GoodId)
+
+	// the limits apply to the components reserved for the kits too, merged with the other lines
+	catalog = testCatalog(testSet, messages.CatalogItem{Id: "hat"}, messages.CatalogItem{Id: "scarf"})
+	req := messages.CreateOrder{Items: []messages.CreateOrderItem{{GoodId: "set", Amount: 5}, {GoodId: "scarf", Amount: 1}}}
+	_, err = expandKits(ctx, &req, catalog)
+	require.NoError(t, err)
+	violations, err = validateExpanded(ctx, req.Items, cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"line_limit"}, violationCodes(violations))
+	require.Equal(t, "scarf", violations[0].GoodId)
+}
+
+func TestExpandKits(t *testing.T) {
+	req := messages.CreateOrder{Items: []messages.CreateOrderItem{
+		{GoodId: "set", Amount: 2},
+		{GoodId: "hat", Amount: 1},
+		{GoodId: "set", Amount: 1},
+	}}
+	kits, err := expandKits(context.Background(), &req, testCatalog(testSet, messages.CatalogItem{Id: "hat"}))
+	require.NoError(t, err)
+
+	require.Equal(t, []messages.OrderKitLine{{GoodId: "set", Amount: 3, Components: testSet.Components}}, kits)
+	require.Equal(t, map[string]int{"hat": 4, "scarf": 6}, orderLines(req))
+
+	// amounts saturate instead of overflowing
+	req = messages.CreateOrder{Items: []messages.CreateOrderItem{{GoodId: "set", Amount: math.MaxInt/2 + 1}}}
+	_, err = expandKits(context.Background(), &req, testCatalog(testSet))
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"hat": math.MaxInt/2 + 1, "scarf": math.MaxInt}, orderLines(req))
+}
+
+func TestKitAvailability(t *testing.T) {
+	stock := map[string]map[string]int{
+		"1": {"hat": 3, "scarf": 1},
+		"2": {"hat": 1, "scarf": 6},
+		"3": {"scarf": -1},
+	}
+	availability := kitAvailability("set", testSet.Components, stock)
+
+	// hats limit the kits to 4, and scarves to 3: they can be shipped from different warehouses
+	require.Equal(t, 3, availability.Available)
+	require.Equal(t, map[string]int{"2": 1}, availability.Warehouses)
+	require.Equal(t, []messages.ComponentAvailability{
+		{KitComponent: messages.KitComponent{GoodId: "hat", Amount: 1}, Stock: 4},
+		{KitComponent: messages.KitComponent{GoodId: "scarf", Amount: 2}, Stock: 7},
+	}, availability.Components)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/nats-io/nats.go"
@@ -18,9 +19,28 @@ type stockState struct {
 }
 
 type orderState struct {
-	stock stockState
+	stock       stockState
+	allocation  allocationConfig
+	sagas       *SagaCoordinator
+	orders      orderStore
+	returns     returnStore
+	idempotency *common.IdempotencyStore
+	validation  validationConfig
+	pricing     pricingConfig
+	scheduling  schedulingConfig
+	catalog     catalogLookup
+	customers   customerLookup
+	// backorders is notified when new stock arrives, see AllocateBackordersLoop
+	backorders chan struct{}
 }
 
+// ReservationTimeout is the deadline for reserving (or releasing) the stock of an order in all warehouses
+const ReservationTimeout = 3 * time.Second
+
+// IdempotencyStaleAfter is how long an order.create request can be in progress before a retry with the same
+// idempotency key takes over. It must be longer than the worst case duration of order.create.
+const IdempotencyStaleAfter = time.Minute
+
 func setupObservability(ctx context.Context, otlpUrl string) func(context.Context) {
 	otelshutdown := common.SetupOTelSDK(ctx, otlpUrl)
 
@@ -41,8 +61,39 @@ func main() {
 		return
 	}
 
+	allocation, err := loadAllocationConfig()
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid allocation configuration", "error", err)
+		return
+	}
+
+	validation, err := loadValidationConfig()
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid validation configuration", "error", err)
+		return
+	}
+
+	pricing, err := loadPricingConfig()
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid pricing configuration", "error", err)
+		return
+	}
+
+	scheduling, err := loadSchedulingConfig()
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid scheduling configuration", "error", err)
+		return
+	}
+
 	svc := common.NewService(ctx, nc, orderState{
-		stock: stockState{sync.Mutex{}, make(map[string]map[string]int)},
+		stock:      stockState{sync.Mutex{}, make(map[string]map[string]int)},
+		allocation: allocation,
+		orders:     newOrderStore(),
+		returns:    newReturnStore(),
+		validation: validation,
+		pricing:    pricing,
+		scheduling: scheduling,
+		backorders: make(chan struct{}, 1),
 	})
 
 	if common.CreateStream(ctx, svc.JetStream(), common.StockUpdatesStreamConfig) != nil {
@@ -54,9 +105,93 @@ func main() {
 		return
 	}
 
+	if common.CreateStream(ctx, svc.JetStream(), common.ReturnsStreamConfig) != nil {
+		slog.ErrorContext(ctx, "Failed to create stream", "stream", common.ReturnsStreamConfig.Name)
+		return
+	}
+	if common.CreateStream(ctx, svc.JetStream(), common.SerialsStreamConfig) != nil {
+		slog.ErrorContext(ctx, "Failed to create stream", "stream", common.SerialsStreamConfig.Name)
+		return
+	}
+
+	kv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.OrderSagasKeyValueConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create key-value store", "error", err)
+		return
+	}
+	svc.State().sagas = NewSagaCoordinator(kv, ReservationTimeout)
+	svc.State().sagas.RegisterAction(ActionReserve, reserveAction{nc: nc})
+
+	idempotencyKv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.IdempotencyKeyValueConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create key-value store", "error", err)
+		return
+	}
+	svc.State().idempotency = common.NewIdempotencyStore(idempotencyKv, IdempotencyStaleAfter)
+
+	catalogKv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.CatalogKeyValueConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create key-value store", "error", err)
+		return
+	}
+	svc.State().catalog = kvCatalogLookup(catalogKv)
+
+	customersKv, err := svc.JetStream().CreateOrUpdateKeyValue(ctx, common.CustomersKeyValueConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create key-value store", "error", err)
+		return
+	}
+	svc.State().customers = kvCustomerLookup(customersKv)
+
+	// rebuild the orders from their events, then keep following the stream from where the replay stopped
+	err = svc.RegisterJsHandlerExisting(common.OrdersStreamConfig.Name, OrderEventHandler, common.WithSubjectFilter("orders.>"))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to replay orders", "error", err)
+		return
+	}
+	svc.RegisterJsHandler(
+		common.OrdersStreamConfig.Name,
+		OrderEventHandler,
+		common.WithSubjectFilter("orders.>"),
+		common.WithStartSequence(svc.State().orders.seq+1),
+	)
+
+	err = svc.RegisterJsHandlerExisting(common.ReturnsStreamConfig.Name, ReturnEventHandler, common.WithSubjectFilter("returns.>"))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to replay returns", "error", err)
+		return
+	}
+	svc.RegisterJsHandler(
+		common.ReturnsStreamConfig.Name,
+		ReturnEventHandler,
+		common.WithSubjectFilter("returns.>"),
+		common.WithStartSequence(svc.State().returns.seq+1),
+	)
+
+	if err = RecoverOrders(ctx, svc); err != nil {
+		slog.ErrorContext(ctx, "Failed to recover interrupted orders", "error", err)
+		return
+	}
+
 	svc.RegisterJsHandler(common.StockUpdatesStreamConfig.Name, StockUpdateHandler, common.WithSubjectFilter("stock_updates.>"))
+	go AllocateBackordersLoop(ctx, svc)
+	go ScheduleOrdersLoop(ctx, svc)
 	svc.RegisterHandler("order.ping", PingHandler)
 	svc.RegisterHandler("order.create", CreateOrderHandler)
+	svc.RegisterHandler("order.quote", QuoteOrderHandler)
+	svc.RegisterHandler("order.get", GetOrderHandler)
+	svc.RegisterHandler("order.list", ListOrdersHandler)
+	svc.RegisterHandler("order.update_status", UpdateOrderStatusHandler)
+	svc.RegisterHandler("order.cancel", CancelOrderHandler)
+	svc.RegisterHandler("order.amend", AmendOrderHandler)
+	svc.RegisterHandler("order.good_usage", GoodUsageHandler)
+	svc.RegisterHandler("order.kit_availability", KitAvailabilityHandler)
+	svc.RegisterHandler("return.open", OpenReturnHandler)
+	svc.RegisterHandler("return.receive", ReceiveReturnHandler)
+	svc.RegisterHandler("return.inspect", InspectReturnHandler)
+	svc.RegisterHandler("return.get", GetReturnHandler)
+	svc.RegisterHandler("return.list", ListReturnsHandler)
+	svc.RegisterHandler("serial.trace", TraceSerialHandler)
 
 	// Wait for ctrl-c, and gracefully stop service
 	c := make(chan os.Signal, 1)
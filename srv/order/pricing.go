@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+)
+
+// DefaultCurrency is the currency of orders that do not choose one, see loadPricingConfig
+const DefaultCurrency = "EUR"
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// pricingConfig contains how orders are priced
+type pricingConfig struct {
+	currency string
+	// taxRate is in basis points
+	taxRate int
+}
+
+// loadPricingConfig reads the default currency from ORDER_CURRENCY, and the tax rate (in basis points,
+// e.g. 2200 for 22%) from ORDER_TAX_RATE
+func loadPricingConfig() (pricingConfig, error) {
+	cfg := pricingConfig{currency: DefaultCurrency}
+
+	if currency := os.Getenv("ORDER_CURRENCY"); currency != "" {
+		if !currencyRegex.MatchString(currency) {
+			return cfg, fmt.Errorf("invalid ORDER_CURRENCY %q: must be an ISO 4217 code", currency)
+		}
+		cfg.currency = currency
+	}
+
+	if raw := os.Getenv("ORDER_TAX_RATE"); raw != "" {
+		rate, err := strconv.Atoi(raw)
+		if err != nil || rate < 0 {
+			return cfg, fmt.Errorf("invalid ORDER_TAX_RATE %q: must be a non-negative number of basis points", raw)
+		}
+		cfg.taxRate = rate
+	}
+
+	return cfg, nil
+}
+
+// effectivePrice returns the price of item in currency at the given time. When more prices are effective,
+// the one that started last wins, so that a new price list can be added without ending the previous one.
+func effectivePrice(item *messages.CatalogItem, currency string, at time.Time) (int64, bool) {
+	var found *messages.ItemPrice
+	for i, p := range item.Prices {
+		if p.Currency != currency || p.EffectiveFrom.After(at) || (p.EffectiveTo != nil && !p.EffectiveTo.After(at)) {
+			continue
+		}
+		if found == nil || p.EffectiveFrom.After(found.EffectiveFrom) {
+			found = &item.Prices[i]
+		}
+	}
+	if found == nil {
+		return 0, false
+	}
+	return found.Amount, true
+}
+
+// priceOrder prices the given lines. Goods in known keep the unit price they already have, the other ones
+// are priced with the catalog prices effective at the given time. Goods without a price are reported as violations.
+func priceOrder(ctx context.Context, lines []messages.OrderCreatedItem, currency string, taxRate int, lookup catalogLookup, known map[string]int64, at time.Time) (*messages.OrderPricing, []messages.OrderViolation, error) {
+	if !currencyRegex.MatchString(currency) {
+		return nil, []messages.OrderViolation{{
+			Field:   "currency",
+			Code:    "invalid_currency",
+			Message: "currency must be an ISO 4217 code",
+		}}, nil
+	}
+
+	pricing := &messages.OrderPricing{
+		Currency: currency,
+		Lines:    make([]messages.OrderPricedLine, 0, len(lines)),
+		TaxRate:  taxRate,
+	}
+	violations := make([]messages.OrderViolation, 0)
+
+	for _, line := range lines {
+		price, ok := known[line.GoodId]
+		if !ok {
+			item, err := lookup(ctx, line.GoodId)
+			if err != nil {
+				return nil, nil, err
+			}
+			if item != nil {
+				price, ok = effectivePrice(item, currency, at)
+			}
+		}
+		if !ok {
+			violations = append(violations, messages.OrderViolation{
+				GoodId:  line.GoodId,
+				Code:    "missing_price",
+				Message: fmt.Sprintf("the good has no price in %s", currency),
+			})
+			continue
+		}
+
+		pricing.Lines = append(pricing.Lines, messages.OrderPricedLine{
+			GoodId:    line.GoodId,
+			Amount:    line.Amount,
+			UnitPrice: price,
+			Total:     price * int64(line.Amount),
+		})
+		pricing.Subtotal += price * int64(line.Amount)
+	}
+
+	// tax is rounded half up to the minor unit
+	pricing.Tax = (pricing.Subtotal*int64(taxRate) + 5000) / 10000
+	pricing.Total = pricing.Subtotal + pricing.Tax
+	return pricing, violations, nil
+}
+
+// knownPrices returns the unit price of every good priced in p
+func knownPrices(p *messages.OrderPricing) map[string]int64 {
+	known := make(map[string]int64)
+	if p != nil {
+		for _, line := range p.Lines {
+			known[line.GoodId] = line.UnitPrice
+		}
+	}
+	return known
+}
+
+// priceRequest prices the lines of a `messages.CreateOrder` request at the current time
+func priceRequest(ctx context.Context, state *orderState, req messages.CreateOrder) (*messages.OrderPricing, []messages.OrderViolation, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = state.pricing.currency
+	}
+	return priceOrder(ctx, toOrderItems(orderLines(req)), currency, state.pricing.taxRate, state.catalog, nil, time.Now())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEffectivePrice(t *testing.T) {
+	jan := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)
+	item := &messages.CatalogItem{Id: "hat", Prices: []messages.ItemPrice{
+		{Currency: "EUR", Amount: 1000, EffectiveFrom: jan},
+		// a sale in February, overriding the list price
+		{Currency: "EUR", Amount: 800, EffectiveFrom: feb, EffectiveTo: &mar},
+		{Currency: "USD", Amount: 1100, EffectiveFrom: jan},
+	}}
+
+	_, ok := effectivePrice(item, "EUR", jan.Add(-time.Hour))
+	require.False(t, ok)
+
+	price, ok := effectivePrice(item, "EUR", jan)
+	require.True(t, ok)
+	require.Equal(t, int64(1000), price)
+
+	price, _ = effectivePrice(item, "EUR", feb.Add(time.Hour))
+	require.Equal(t, int64(800), price)
+
+	// EffectiveTo is excluded
+	price, _ = effectivePrice(item, "EUR", mar)
+	require.Equal(t, int64(1000), price)
+
+	price, _ = effectivePrice(item, "USD", mar)
+	require.Equal(t, int64(1100), price)
+
+	_, ok = effectivePrice(item, "GBP", mar)
+	require.False(t, ok)
+}
+
+func TestPriceOrder(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	catalog := testCatalog(
+		messages.CatalogItem{Id: "hat", Prices: []messages.ItemPrice{{Currency: "EUR", Amount: 1999, EffectiveFrom: now.Add(-time.Hour)}}},
+		messages.CatalogItem{Id: "shoe", Prices: []messages.ItemPrice{{Currency: "EUR", Amount: 4550, EffectiveFrom: now.Add(-time.Hour)}}},
+		messages.CatalogItem{Id: "sock"},
+	)
+	lines := []messages.OrderCreatedItem{{GoodId: "hat", Amount: 3}, {GoodId: "shoe", Amount: 1}}
+
+	pricing, violations, err := priceOrder(ctx, lines, "EUR", 2200, catalog, nil, now)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+	require.Equal(t, []messages.OrderPricedLine{
+		{GoodId: "hat", Amount: 3, UnitPrice: 1999, Total: 5997},
+		{GoodId: "shoe", Amount: 1, UnitPrice: 4550, Total: 4550},
+	}, pricing.Lines)
+	require.Equal(t, int64(10547), pricing.Subtotal)
+	// 22% of 105.47 is 23.2034, rounded to 23.20
+	require.Equal(t, int64(2320), pricing.Tax)
+	require.Equal(t, int64(12867), pricing.Total)
+
+	// known prices win over the catalog
+	pricing, violations, err = priceOrder(ctx, lines, "EUR", 0, catalog, map[string]int64{"hat": 1500}, now)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+	require.Equal(t, int64(1500), pricing.Lines[0].UnitPrice)
+	require.Equal(t, int64(9050), pricing.Total)
+
+	_, violations, err = priceOrder(ctx, []messages.OrderCreatedItem{{GoodId: "sock", Amount: 1}, {GoodId: "hat", Amount: 1}}, "USD", 0, catalog, nil, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"missing_price", "missing_price"}, violationCodes(violations))
+
+	_, violations, err = priceOrder(ctx, lines, "euro", 0, catalog, nil, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"invalid_currency"}, violationCodes(violations))
+}
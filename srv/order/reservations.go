@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// ActionReserve is the name of the saga action that reserves stock in a warehouse
+const ActionReserve = "reserve"
+
+// reservePayload is the payload of a reserve saga step
+type reservePayload struct {
+	WarehouseId string                `json:"warehouse_id"`
+	Reservation messages.ReserveStock `json:"reservation"`
+}
+
+// reserveAction reserves stock with `warehouse.reserve`, and releases it with `warehouse.release`
+type reserveAction struct {
+	nc *nats.Conn
+}
+
+func (a reserveAction) Execute(ctx context.Context, payload json.RawMessage) error {
+	var p reservePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("failed to unmarshal reserve payload: %w", err)
+	}
+
+	body, err := json.Marshal(p.Reservation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reservation: %w", err)
+	}
+
+	return a.request(ctx, fmt.Sprintf("warehouse.reserve.%s", p.WarehouseId), body)
+}
+
+func (a reserveAction) Compensate(ctx context.Context, payload json.RawMessage) error {
+	var p reservePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("failed to unmarshal reserve payload: %w", err)
+	}
+
+	body, err := json.Marshal(messages.ReleaseReservation{ID: p.Reservation.ID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal release: %w", err)
+	}
+
+	return a.request(ctx, fmt.Sprintf("warehouse.release.%s", p.WarehouseId), body)
+}
+
+// request sends a request to a warehouse, and checks that it replied "ok"
+func (a reserveAction) request(ctx context.Context, subject string, body []byte) error {
+	r, err := a.nc.RequestWithContext(ctx, subject, body)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", subject, err)
+	}
+	if string(r.Data) != "ok" {
+		return fmt.Errorf("request to %s refused: %s", subject, string(r.Data))
+	}
+	return nil
+}
+
+// reserveSteps creates a reserve saga step for each warehouse used by the given parts
+func reserveSteps(parts map[string]map[string]int) ([]SagaStep, error) {
+	steps := make([]SagaStep, 0, len(parts))
+	for _, warehouseId := range sortedKeys(parts) {
+		items := make([]messages.ReserveStockItem, 0, len(parts[warehouseId]))
+		for _, goodId := range sortedKeys(parts[warehouseId]) {
+			items = append(items, messages.ReserveStockItem{GoodId: goodId, Amount: parts[warehouseId][goodId]})
+		}
+
+		payload, err := json.Marshal(reservePayload{
+			WarehouseId: warehouseId,
+			Reservation: messages.ReserveStock{ID: uuid.New(), RequestedStock: items},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal reserve payload: %w", err)
+		}
+		steps = append(steps, SagaStep{Action: ActionReserve, Payload: payload})
+	}
+	return steps, nil
+}
+
+// reservedWarehouses returns the reservations made by the completed reserve steps among the given ones
+func reservedWarehouses(steps []SagaStep) ([]messages.OrderCreateWarehouse, error) {
+	warehouses := make([]messages.OrderCreateWarehouse, 0)
+	for _, step := range steps {
+		if step.Action != ActionReserve || step.Status != StepDone {
+			continue
+		}
+
+		var p reservePayload
+		if err := json.Unmarshal(step.Payload, &p); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal reserve payload: %w", err)
+		}
+
+		parts := make([]messages.OrderCreatedItem, 0, len(p.Reservation.RequestedStock))
+		for _, item := range p.Reservation.RequestedStock {
+			parts = append(parts, messages.OrderCreatedItem{GoodId: item.GoodId, Amount: item.Amount})
+		}
+		warehouses = append(warehouses, messages.OrderCreateWarehouse{
+			WarehouseId:   p.WarehouseId,
+			ReservationId: p.Reservation.ID,
+			Parts:         parts,
+		})
+	}
+	return warehouses, nil
+}
+
+// allocationSagaId returns the id of a saga reserving more stock for an existing order (e.g. to allocate its
+// backorder, or to amend it), started after the event with sequence seq
+func allocationSagaId(id uuid.UUID, kind string, seq uint64) string {
+	return fmt.Sprintf("%s.%s.%d", id, kind, seq)
+}
+
+// isAllocationSaga reports whether saga reserves more stock for an existing order, rather than the stock of a new order
+func isAllocationSaga(saga *Saga) bool {
+	return strings.Contains(saga.ID, ".")
+}
+
+// recoverAllocationSaga resolves an interrupted saga started by allocationSagaId: it is completed if its
+// reservations were recorded in the order, and aborted otherwise.
+//
+// store MUST be locked
+func recoverAllocationSaga(ctx context.Context, sagas *SagaCoordinator, store *orderStore, saga *Saga) error {
+	orderId, _, _ := strings.Cut(saga.ID, ".")
+	id, err := uuid.Parse(orderId)
+	if err != nil {
+		return fmt.Errorf("invalid saga id %q: %w", saga.ID, err)
+	}
+
+	reserved, err := reservedWarehouses(saga.Steps)
+	if err != nil {
+		return err
+	}
+
+	o, ok := store.m[id]
+	if saga.Status != SagaRunning || !ok || len(reserved) == 0 {
+		return sagas.Abort(ctx, saga)
+	}
+	for _, w := range o.Warehouses {
+		if w.ReservationId == reserved[0].ReservationId {
+			return sagas.Complete(ctx, saga)
+		}
+	}
+	return sagas.Abort(ctx, saga)
+}
+
+// RecoverOrders resolves the reservation sagas interrupted by a crash, using the state of their orders:
+// orders whose stock was fully reserved are confirmed, while the others are failed and their reservations released.
+// Interrupted allocations for existing orders are released, unless they were recorded in their order.
+//
+// The order store must have already been rebuilt from the `orders` stream.
+func RecoverOrders(ctx context.Context, s *common.Service[orderState]) error {
+	sagas := s.State().sagas
+	interrupted, err := sagas.Interrupted(ctx)
+	if err != nil {
+		return err
+	}
+
+	store := &s.State().orders
+	for _, saga := range interrupted {
+		if isAllocationSaga(saga) {
+			store.Lock()
+			err = recoverAllocationSaga(ctx, sagas, store, saga)
+			store.Unlock()
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to recover interrupted allocation", "error", err, "saga", saga.ID)
+			}
+			continue
+		}
+
+		id, err := uuid.Parse(saga.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Invalid saga id", "error", err, "saga", saga.ID)
+			continue
+		}
+
+		store.Lock()
+		status := messages.OrderStatus("")
+		var warehouses []messages.OrderCreateWarehouse
+		if o, ok := store.m[id]; ok {
+			status = o.Status
+			for _, w := range o.Warehouses {
+				warehouses = append(warehouses, w.OrderCreateWarehouse)
+			}
+		}
+
+		switch {
+		case saga.Status == SagaRunning && status == messages.OrderStatusReserved:
+			err = publishOrderEvent(ctx, s.JetStream(), store, id, "confirmed", messages.OrderConfirmed{ID: id, Warehouses: warehouses})
+			if err == nil {
+				err = sagas.Complete(ctx, saga)
+			}
+		case saga.Status == SagaRunning && status != messages.OrderStatusPending && status != messages.OrderStatusScheduled && status != "":
+			err = sagas.Complete(ctx, saga)
+		default:
+			err = sagas.Abort(ctx, saga)
+			if err == nil && status == messages.OrderStatusPending {
+				err = publishOrderEvent(ctx, s.JetStream(), store, id, "failed", messages.OrderStatusChanged{
+					ID:     id,
+					Status: messages.OrderStatusFailed,
+					Reason: "interrupted while reserving stock",
+				})
+			}
+		}
+		store.Unlock()
+
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to recover interrupted order", "error", err, "order", id)
+			continue
+		}
+		slog.InfoContext(ctx, "Recovered interrupted order", "order", id, "status", status)
+	}
+
+	return nil
+}
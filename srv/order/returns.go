@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// rma is the aggregate built from the events of a single return
+type rma struct {
+	messages.Return
+	// seq is the stream sequence of the last event applied to this return
+	seq uint64
+}
+
+// returnStore contains every return, and is rebuilt on startup by replaying the `returns` stream.
+//
+// Please note that the store should be locked before being used by calling its `Lock()` method.
+type returnStore struct {
+	sync.Mutex
+	m map[uuid.UUID]*rma
+	// seq is the stream sequence of the last event applied to the store
+	seq uint64
+}
+
+func newReturnStore() returnStore {
+	return returnStore{m: make(map[uuid.UUID]*rma)}
+}
+
+// returnSubject returns the subject where event is published for the return with the given id
+func returnSubject(id uuid.UUID, event string) string {
+	return fmt.Sprintf("returns.%s.%s", id, event)
+}
+
+// parseReturnSubject splits a subject in the form `returns.<id>.<event>`
+func parseReturnSubject(subject string) (uuid.UUID, string, error) {
+	parts := strings.SplitN(subject, ".", 3)
+	if len(parts) != 3 || parts[0] != "returns" {
+		return uuid.Nil, "", fmt.Errorf("unexpected return event subject %q", subject)
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid return id in subject %q: %w", subject, err)
+	}
+	return id, parts[2], nil
+}
+
+// apply applies an event read from the `returns` stream. Events that have already been applied are ignored.
+//
+// store MUST be locked
+func (st *returnStore) apply(subject string, data []byte, seq uint64, ts time.Time) error {
+	id, event, err := parseReturnSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	st.seq = max(st.seq, seq)
+	r := st.m[id]
+	if r != nil && seq <= r.seq {
+		return nil
+	}
+
+	if event == "opened" {
+		if r != nil {
+			return fmt.Errorf("return %s already exists", id)
+		}
+
+		var msg messages.ReturnOpened
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		st.m[id] = &rma{seq: seq, Return: messages.Return{
+			ID:        msg.ID,
+			OrderId:   msg.OrderId,
+			GoodId:    msg.GoodId,
+			Amount:    msg.Amount,
+			Reason:    msg.Reason,
+			Serials:   msg.Serials,
+			Status:    messages.ReturnStatusOpen,
+			CreatedAt: msg.CreatedAt,
+			UpdatedAt: ts,
+		}}
+		return nil
+	}
+
+	if r == nil {
+		return fmt.Errorf("received %s for unknown return", subject)
+	}
+
+	switch event {
+	case "received":
+		var msg messages.ReturnReceived
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if r.Status != messages.ReturnStatusOpen {
+			return fmt.Errorf("%w: return %s cannot be received while %s", errInvalidTransition, id, r.Status)
+		}
+		r.Status = messages.ReturnStatusReceived
+		r.WarehouseId = msg.WarehouseId
+
+	case "inspected":
+		var msg messages.ReturnInspected
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", subject, err)
+		}
+		if r.Status != messages.ReturnStatusReceived {
+			return fmt.Errorf("%w: return %s cannot be inspected while %s", errInvalidTransition, id, r.Status)
+		}
+		if msg.Resellable < 0 || msg.Damaged < 0 || msg.Resellable+msg.Damaged != r.Amount {
+			return fmt.Errorf("inspection of return %s does not match the returned amount", id)
+		}
+		if !r.validResellableSerials(msg.Resellable, msg.Serials) {
+			return fmt.Errorf("inspection of return %s does not match the returned serials", id)
+		}
+		r.Status = messages.ReturnStatusInspected
+		r.Resellable = msg.Resellable
+		r.Damaged = msg.Damaged
+		r.ResellableSerials = msg.Serials
+
+	default:
+		return fmt.Errorf("unknown return event %q", event)
+	}
+
+	r.seq = seq
+	r.UpdatedAt = ts
+	return nil
+}
+
+// check returns the error apply would return for the given event, without modifying the store.
+//
+// store MUST be locked
+func (st *returnStore) check(subject string, data []byte) error {
+	id, _, err := parseReturnSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	dry := newReturnStore()
+	if r, ok := st.m[id]; ok {
+		c := *r
+		dry.m[id] = &c
+	}
+	return dry.apply(subject, data, st.seq+1, time.Now())
+}
+
+// returned returns the amount of the given good already returned (or being returned) for an order.
+//
+// store MUST be locked
+func (st *returnStore) returned(orderId uuid.UUID, goodId string) int {
+	amount := 0
+	for _, r := range st.m {
+		if r.OrderId == orderId && r.GoodId == goodId {
+			amount += r.Amount
+		}
+	}
+	return amount
+}
+
+// shippedAmount returns the amount of the given good that has been shipped to the customer
+func (o *order) shippedAmount(goodId string) int {
+	all := o.Status == messages.OrderStatusShipped || o.Status == messages.OrderStatusDelivered
+	amount := 0
+	for _, w := range o.Warehouses {
+		if !all && !w.Shipped {
+			continue
+		}
+		for _, part := range w.Parts {
+			if part.GoodId == goodId {
+				amount += part.Amount
+			}
+		}
+	}
+	return amount
+}
+
+// publishReturnEvent publishes an event of the return with the given id, and applies it to the store.
+// Events that are not valid for the current state of the return are refused without being published.
+//
+// store MUST be locked
+func publishReturnEvent(ctx context.Context, js jetstream.JetStream, store *returnStore, id uuid.UUID, event string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal return event: %w", err)
+	}
+
+	subject := returnSubject(id, event)
+	if err := store.check(subject, body); err != nil {
+		return err
+	}
+
+	ack, err := js.Publish(ctx, subject, body)
+	if err != nil {
+		return fmt.Errorf("failed to publish return event: %w", err)
+	}
+
+	return store.apply(subject, body, ack.Sequence, time.Now())
+}
+
+// ReturnEventHandler applies the events of the `returns` stream to the return store
+func ReturnEventHandler(ctx context.Context, s *common.Service[orderState], msg jetstream.Msg) error {
+	meta, err := msg.Metadata()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting metadata for message", "error", err, "subject", msg.Subject())
+		return nil
+	}
+
+	store := &s.State().returns
+	store.Lock()
+	defer store.Unlock()
+
+	if err := store.apply(msg.Subject(), msg.Data(), meta.Sequence.Stream, meta.Timestamp); err != nil {
+		slog.ErrorContext(ctx, "Error applying return event", "error", err, "subject", msg.Subject())
+	}
+	return nil
+}
+
+// respondReturn sends the current state of a return. store MUST be locked
+func respondReturn(ctx context.Context, msg *nats.Msg, store *returnStore, id uuid.UUID) {
+	payload, err := json.Marshal(store.m[id].Return)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
+
+// OpenReturnHandler is the handler for `return.open`.
+//
+// Only goods that have been shipped, and not returned yet, can be returned.
+func OpenReturnHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.OpenReturn
+	if err := json.Unmarshal(msg.Data, &req); err != nil || req.GoodId == "" || req.Amount <= 0 {
+		slog.ErrorContext(ctx, "Invalid request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	orders := &s.State().orders
+	orders.Lock()
+	o, ok := orders.m[req.OrderId]
+	shipped := 0
+	if ok {
+		shipped = o.shippedAmount(req.GoodId)
+	}
+	orders.Unlock()
+	if !ok {
+		natsutil.Respond(msg, natsutil.OrderNotFound)
+		return
+	}
+
+	store := &s.State().returns
+	store.Lock()
+	defer store.Unlock()
+
+	if req.Amount > shipped-store.returned(req.OrderId, req.GoodId) {
+		natsutil.Respond(msg, natsutil.ReturnExceedsShipped)
+		return
+	}
+
+	valid, err := validReturnSerials(ctx, s.JetStream(), s.State().catalog, store, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking returned serials", "error", err)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+	if !valid {
+		natsutil.RespondWithDetails(msg, natsutil.InvalidSerials, req.Serials)
+		return
+	}
+
+	id := uuid.New()
+	err = publishReturnEvent(ctx, s.JetStream(), store, id, "opened", messages.ReturnOpened{
+		ID:        id,
+		OrderId:   req.OrderId,
+		GoodId:    req.GoodId,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+		Serials:   req.Serials,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the return opened message", "error", err)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Return opened", "return", id, "order", req.OrderId)
+	respondReturn(ctx, msg, store, id)
+}
+
+// ReceiveReturnHandler is the handler for `return.receive`: the goods arrived at the given warehouse
+func ReceiveReturnHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.ReceiveReturn
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	stock := &s.State().stock
+	stock.Lock()
+	_, known := stock.m[req.WarehouseId]
+	stock.Unlock()
+	if !known {
+		natsutil.Respond(msg, natsutil.UnknownWarehouse)
+		return
+	}
+
+	store := &s.State().returns
+	store.Lock()
+	defer store.Unlock()
+
+	r, ok := store.m[req.ID]
+	if !ok {
+		natsutil.Respond(msg, natsutil.ReturnNotFound)
+		return
+	}
+	if r.Status != messages.ReturnStatusOpen {
+		natsutil.Respond(msg, natsutil.ReturnInvalidTransition)
+		return
+	}
+
+	// the serials are published first, so that a failure can be retried: they are returned to the same warehouse again
+	if err := publishReturnedSerials(ctx, s.JetStream(), r.Return, req.WarehouseId); err != nil {
+		slog.ErrorContext(ctx, "Error publishing returned serials", "error", err, "return", req.ID)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	err := publishReturnEvent(ctx, s.JetStream(), store, req.ID, "received", messages.ReturnReceived{
+		ID:          req.ID,
+		WarehouseId: req.WarehouseId,
+	})
+	if errors.Is(err, errInvalidTransition) {
+		natsutil.Respond(msg, natsutil.ReturnInvalidTransition)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the return received message", "error", err)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	respondReturn(ctx, msg, store, req.ID)
+}
+
+// InspectReturnHandler is the handler for `return.inspect`.
+//
+// Resellable goods are put back in the stock of the warehouse that received them, while damaged goods are only recorded.
+func InspectReturnHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.InspectReturn
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	store := &s.State().returns
+	store.Lock()
+	defer store.Unlock()
+
+	r, ok := store.m[req.ID]
+	if !ok {
+		natsutil.Respond(msg, natsutil.ReturnNotFound)
+		return
+	}
+	if r.Status != messages.ReturnStatusReceived {
+		natsutil.Respond(msg, natsutil.ReturnInvalidTransition)
+		return
+	}
+	if req.Resellable < 0 || req.Damaged < 0 || req.Resellable+req.Damaged != r.Amount {
+		natsutil.Respond(msg, natsutil.InvalidInspection)
+		return
+	}
+	if !r.validResellableSerials(req.Resellable, req.Serials) {
+		natsutil.RespondWithDetails(msg, natsutil.InvalidSerials, req.Serials)
+		return
+	}
+
+	if req.Resellable > 0 {
+		if err := adjustStock(ctx, s.NatsConn(), r.Return, req.Resellable, req.Serials); err != nil {
+			slog.ErrorContext(ctx, "Error putting returned goods back in stock", "error", err, "return", r.ID)
+			natsutil.Respond(msg, natsutil.AdjustmentFailed)
+			return
+		}
+	}
+
+	err := publishReturnEvent(ctx, s.JetStream(), store, req.ID, "inspected", messages.ReturnInspected{
+		ID:         req.ID,
+		Resellable: req.Resellable,
+		Damaged:    req.Damaged,
+		Serials:    req.Serials,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the return inspected message", "error", err)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Return inspected", "return", r.ID, "resellable", req.Resellable, "damaged", req.Damaged)
+	respondReturn(ctx, msg, store, req.ID)
+}
+
+// adjustStock adds amount goods of the return, with the given serials, to the stock of the warehouse that received them.
+//
+// The id of the return is used as idempotency key, so that retrying an inspection never adds the goods twice.
+func adjustStock(ctx context.Context, nc *nats.Conn, r messages.Return, amount int, serials []string) error {
+	body, err := json.Marshal(messages.AdjustStock{
+		Items:  []messages.StockUpdateItem{{GoodId: r.GoodId, Amount: amount, Serials: serials}},
+		Reason: fmt.Sprintf("return %s", r.ID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal adjustment: %w", err)
+	}
+
+	req := nats.NewMsg(fmt.Sprintf("warehouse.adjust.%s", r.WarehouseId))
+	req.Data = body
+	req.Header.Set(common.IdempotencyHeader, fmt.Sprintf("return.%s", r.ID))
+
+	ctx, cancel := context.WithTimeout(ctx, ReservationTimeout)
+	defer cancel()
+	resp, err := nc.RequestMsgWithContext(ctx, req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", req.Subject, err)
+	}
+	if string(resp.Data) != "ok" {
+		return fmt.Errorf("request to %s refused: %s", req.Subject, string(resp.Data))
+	}
+	return nil
+}
+
+// GetReturnHandler is the handler for `return.get`
+func GetReturnHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.GetReturn
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	store := &s.State().returns
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.m[req.ID]; !ok {
+		natsutil.Respond(msg, natsutil.ReturnNotFound)
+		return
+	}
+	respondReturn(ctx, msg, store, req.ID)
+}
+
+// ListReturnsHandler is the handler for `return.list`.
+//
+// Returns are sorted by creation time, and can be filtered by order.
+func ListReturnsHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.ListReturns
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshaling request data", "error", err)
+			natsutil.Respond(msg, natsutil.InvalidRequest)
+			return
+		}
+	}
+
+	store := &s.State().returns
+	store.Lock()
+	returns := make([]messages.Return, 0, len(store.m))
+	for _, r := range store.m {
+		if req.OrderId == uuid.Nil || r.OrderId == req.OrderId {
+			returns = append(returns, r.Return)
+		}
+	}
+	store.Unlock()
+
+	slices.SortFunc(returns, func(a, b messages.Return) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	payload, err := json.Marshal(returns)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func applyReturnEvent(t *testing.T, st *returnStore, seq uint64, id uuid.UUID, event string, payload any) error {
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+	return st.apply(returnSubject(id, event), body, seq, time.Now())
+}
+
+func TestReturnStore_Lifecycle(t *testing.T) {
+	st := newReturnStore()
+	id, orderId := uuid.New(), uuid.New()
+
+	require.NoError(t, applyReturnEvent(t, &st, 1, id, "opened", messages.ReturnOpened{ID: id, OrderId: orderId, GoodId: "hat", Amount: 3}))
+	require.Equal(t, messages.ReturnStatusOpen, st.m[id].Status)
+	require.Equal(t, 3, st.returned(orderId, "hat"))
+	require.Equal(t, 0, st.returned(orderId, "shoe"))
+
+	// goods must be received before being inspected
+	require.ErrorIs(t, applyReturnEvent(t, &st, 2, id, "inspected", messages.ReturnInspected{ID: id, Resellable: 3}), errInvalidTransition)
+
+	require.NoError(t, applyReturnEvent(t, &st, 3, id, "received", messages.ReturnReceived{ID: id, WarehouseId: "41"}))
+	require.Equal(t, "41", st.m[id].WarehouseId)
+
+	body, err := json.Marshal(messages.ReturnInspected{ID: id, Resellable: 1, Damaged: 1})
+	require.NoError(t, err)
+	require.Error(t, st.check(returnSubject(id, "inspected"), body))
+
+	require.NoError(t, applyReturnEvent(t, &st, 4, id, "inspected", messages.ReturnInspected{ID: id, Resellable: 2, Damaged: 1}))
+	require.Equal(t, messages.ReturnStatusInspected, st.m[id].Status)
+	require.Equal(t, 2, st.m[id].Resellable)
+	require.Equal(t, 1, st.m[id].Damaged)
+}
+
+func TestOrder_ShippedAmount(t *testing.T) {
+	o := order{Order: messages.Order{
+		Status: messages.OrderStatusFulfilling,
+		Warehouses: []messages.OrderWarehouse{
+			{OrderCreateWarehouse: messages.OrderCreateWarehouse{WarehouseId: "41", Parts: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}}}, Shipped: true},
+			{OrderCreateWarehouse: messages.OrderCreateWarehouse{WarehouseId: "42", Parts: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 3}}}},
+		},
+	}}
+	require.Equal(t, 2, o.shippedAmount("hat"))
+
+	o.Status = messages.OrderStatusDelivered
+	require.Equal(t, 5, o.shippedAmount("hat"))
+	require.Equal(t, 0, o.shippedAmount("shoe"))
+}
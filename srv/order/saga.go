@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type SagaStatus string
+
+const (
+	// SagaRunning means that steps are still being executed, and the saga can still be completed or aborted
+	SagaRunning SagaStatus = "running"
+	// SagaCompensating means that the saga is being aborted, but not every step has been compensated yet
+	SagaCompensating SagaStatus = "compensating"
+	SagaCompleted    SagaStatus = "completed"
+	SagaAborted      SagaStatus = "aborted"
+)
+
+type StepStatus string
+
+const (
+	// StepRunning means that the step has been (or is about to be) executed, but its outcome is not known yet
+	StepRunning     StepStatus = "running"
+	StepDone        StepStatus = "done"
+	StepFailed      StepStatus = "failed"
+	StepCompensated StepStatus = "compensated"
+)
+
+// SagaStep is a single operation of a saga.
+//
+// Steps are plain data, so that they can be persisted and compensated by a
+// different process than the one that executed them (e.g. after a crash).
+type SagaStep struct {
+	// Action is the name of the SagaAction that executes this step
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload"`
+	Status  StepStatus      `json:"status"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Saga is a sequence of steps that must either all succeed, or all be compensated
+type Saga struct {
+	ID        string     `json:"id"`
+	Status    SagaStatus `json:"status"`
+	Steps     []SagaStep `json:"steps"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// SagaAction is an operation that can be part of a saga, along with the operation that undoes it.
+//
+// Compensate may be called even if Execute failed or was never completed, so it must be idempotent
+// and must succeed when there is nothing to undo.
+type SagaAction interface {
+	Execute(ctx context.Context, payload json.RawMessage) error
+	Compensate(ctx context.Context, payload json.RawMessage) error
+}
+
+// SagaCoordinator executes sagas, persisting their progress in a KV bucket
+// so that sagas interrupted by a crash can be compensated on restart
+type SagaCoordinator struct {
+	kv      jetstream.KeyValue
+	actions map[string]SagaAction
+	// timeout is the deadline for executing (or compensating) a batch of steps
+	timeout time.Duration
+	// mu protects the sagas while steps running concurrently update them
+	mu sync.Mutex
+}
+
+func NewSagaCoordinator(kv jetstream.KeyValue, timeout time.Duration) *SagaCoordinator {
+	return &SagaCoordinator{kv: kv, actions: make(map[string]SagaAction), timeout: timeout}
+}
+
+// RegisterAction makes action available to saga steps with the given name
+func (c *SagaCoordinator) RegisterAction(name string, action SagaAction) {
+	c.actions[name] = action
+}
+
+// Start creates a new, empty saga with the given id
+func (c *SagaCoordinator) Start(ctx context.Context, id string) (*Saga, error) {
+	saga := &Saga{ID: id, Status: SagaRunning, Steps: make([]SagaStep, 0)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.persist(ctx, saga); err != nil {
+		return nil, err
+	}
+	return saga, nil
+}
+
+// Execute adds the given steps to the saga, and executes them concurrently.
+//
+// It returns the steps that failed: these are not compensated automatically, so that the caller
+// can decide whether to try something else (after CompensateFailed), or to Abort the saga.
+func (c *SagaCoordinator) Execute(ctx context.Context, saga *Saga, steps []SagaStep) ([]SagaStep, error) {
+	c.mu.Lock()
+	first := len(saga.Steps)
+	for _, step := range steps {
+		if _, ok := c.actions[step.Action]; !ok {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("unknown saga action %q", step.Action)
+		}
+		step.Status = StepRunning
+		saga.Steps = append(saga.Steps, step)
+	}
+	// the steps must be persisted before running them, otherwise they could not be compensated after a crash
+	err := c.persist(ctx, saga)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := first; i < len(saga.Steps); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			c.mu.Lock()
+			step := saga.Steps[i]
+			c.mu.Unlock()
+
+			err := c.actions[step.Action].Execute(ctx, step.Payload)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if err != nil {
+				saga.Steps[i].Status = StepFailed
+				saga.Steps[i].Error = err.Error()
+			} else {
+				saga.Steps[i].Status = StepDone
+			}
+			if err := c.persist(context.WithoutCancel(ctx), saga); err != nil {
+				slog.ErrorContext(ctx, "Failed to persist saga step", "error", err, "saga", saga.ID)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	failed := make([]SagaStep, 0)
+	for _, step := range saga.Steps[first:] {
+		if step.Status == StepFailed {
+			failed = append(failed, step)
+		}
+	}
+	return failed, nil
+}
+
+// Complete marks the saga as successfully completed
+func (c *SagaCoordinator) Complete(ctx context.Context, saga *Saga) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saga.Status = SagaCompleted
+	return c.persist(ctx, saga)
+}
+
+// CompensateFailed compensates the steps of the saga that failed, as they may have taken effect anyway
+// (e.g. when a request timed out after being handled), before the saga goes on without them.
+//
+// Steps that could not be compensated are left failed, and are compensated again if the saga is aborted.
+func (c *SagaCoordinator) CompensateFailed(ctx context.Context, saga *Saga) error {
+	errs := c.compensate(ctx, saga, func(step SagaStep) bool { return step.Status == StepFailed })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.persist(ctx, saga); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Abort compensates every step of the saga that has not been compensated yet.
+//
+// If some compensation fails the saga is left in the SagaCompensating status, and is returned by Interrupted.
+func (c *SagaCoordinator) Abort(ctx context.Context, saga *Saga) error {
+	c.mu.Lock()
+	saga.Status = SagaCompensating
+	err := c.persist(ctx, saga)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	errs := c.compensate(ctx, saga, func(step SagaStep) bool { return step.Status != StepCompensated })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(errs) == 0 {
+		saga.Status = SagaAborted
+	}
+	if err := c.persist(context.WithoutCancel(ctx), saga); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// compensate compensates concurrently the steps of the saga selected by fn, marking them as compensated,
+// and returns the errors of the ones that could not be
+func (c *SagaCoordinator) compensate(ctx context.Context, saga *Saga, fn func(SagaStep) bool) []error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errs []error
+	for i := range saga.Steps {
+		if !fn(saga.Steps[i]) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			c.mu.Lock()
+			step := saga.Steps[i]
+			c.mu.Unlock()
+
+			action, ok := c.actions[step.Action]
+			if !ok {
+				c.mu.Lock()
+				errs = append(errs, fmt.Errorf("unknown saga action %q", step.Action))
+				c.mu.Unlock()
+				return
+			}
+			err := action.Compensate(ctx, step.Payload)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to compensate %s step: %w", step.Action, err))
+				return
+			}
+			saga.Steps[i].Status = StepCompensated
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Interrupted returns every saga that was left running or compensating, e.g. because the service crashed.
+//
+// The caller decides, for each of them, whether to Complete or Abort it.
+func (c *SagaCoordinator) Interrupted(ctx context.Context) ([]*Saga, error) {
+	keys, err := c.kv.Keys(ctx)
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sagas: %w", err)
+	}
+
+	interrupted := make([]*Saga, 0)
+	for _, key := range keys {
+		entry, err := c.kv.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get saga %s: %w", key, err)
+		}
+
+		var saga Saga
+		if err := json.Unmarshal(entry.Value(), &saga); err != nil {
+			slog.ErrorContext(ctx, "Failed to unmarshal saga", "error", err, "saga", key)
+			continue
+		}
+		if saga.Status == SagaRunning || saga.Status == SagaCompensating {
+			interrupted = append(interrupted, &saga)
+		}
+	}
+
+	return interrupted, nil
+}
+
+// persist saves the current state of the saga. c.mu MUST be locked
+func (c *SagaCoordinator) persist(ctx context.Context, saga *Saga) error {
+	saga.UpdatedAt = time.Now()
+
+	body, err := json.Marshal(saga)
+	if err != nil {
+		return fmt.Errorf("failed to marshal saga: %w", err)
+	}
+
+	if _, err = c.kv.Put(ctx, saga.ID, body); err != nil {
+		return fmt.Errorf("failed to persist saga: %w", err)
+	}
+	return nil
+}
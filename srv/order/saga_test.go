@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAction records executed and compensated payloads, and fails on payloads equal to "fail"
+type fakeAction struct {
+	sync.Mutex
+	executed    []string
+	compensated []string
+}
+
+func (a *fakeAction) Execute(_ context.Context, payload json.RawMessage) error {
+	a.Lock()
+	defer a.Unlock()
+	a.executed = append(a.executed, string(payload))
+	if string(payload) == `"fail"` {
+		return errors.New("refused")
+	}
+	return nil
+}
+
+func (a *fakeAction) Compensate(_ context.Context, payload json.RawMessage) error {
+	a.Lock()
+	defer a.Unlock()
+	a.compensated = append(a.compensated, string(payload))
+	return nil
+}
+
+func newTestCoordinator(t *testing.T, ctx context.Context) (*SagaCoordinator, *fakeAction) {
+	nc := common.NewInProcessNATSServer(t)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	kv, err := js.CreateOrUpdateKeyValue(ctx, common.OrderSagasKeyValueConfig)
+	require.NoError(t, err)
+
+	action := &fakeAction{}
+	c := NewSagaCoordinator(kv, time.Second)
+	c.RegisterAction("fake", action)
+	return c, action
+}
+
+func TestSagaCoordinator_AbortCompensatesEverything(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	c, action := newTestCoordinator(t, ctx)
+
+	saga, err := c.Start(ctx, "saga")
+	require.NoError(t, err)
+
+	failed, err := c.Execute(ctx, saga, []SagaStep{
+		{Action: "fake", Payload: json.RawMessage(`"a"`)},
+		{Action: "fake", Payload: json.RawMessage(`"fail"`)},
+		{Action: "fake", Payload: json.RawMessage(`"b"`)},
+	})
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	require.Equal(t, "refused", failed[0].Error)
+	require.ElementsMatch(t, []string{`"a"`, `"fail"`, `"b"`}, action.executed)
+
+	require.NoError(t, c.Abort(ctx, saga))
+	require.Equal(t, SagaAborted, saga.Status)
+	require.ElementsMatch(t, []string{`"a"`, `"fail"`, `"b"`}, action.compensated)
+}
+
+func TestSagaCoordinator_Interrupted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	c, action := newTestCoordinator(t, ctx)
+
+	completed, err := c.Start(ctx, "completed")
+	require.NoError(t, err)
+	_, err = c.Execute(ctx, completed, []SagaStep{{Action: "fake", Payload: json.RawMessage(`"c"`)}})
+	require.NoError(t, err)
+	require.NoError(t, c.Complete(ctx, completed))
+
+	// simulate a crash: the saga is left running
+	interrupted, err := c.Start(ctx, "interrupted")
+	require.NoError(t, err)
+	_, err = c.Execute(ctx, interrupted, []SagaStep{{Action: "fake", Payload: json.RawMessage(`"i"`)}})
+	require.NoError(t, err)
+
+	interruptedSagas, err := c.Interrupted(ctx)
+	require.NoError(t, err)
+	require.Len(t, interruptedSagas, 1)
+	require.Equal(t, "interrupted", interruptedSagas[0].ID)
+
+	require.NoError(t, c.Abort(ctx, interruptedSagas[0]))
+	require.Equal(t, []string{`"i"`}, action.compensated)
+
+	interruptedSagas, err = c.Interrupted(ctx)
+	require.NoError(t, err)
+	require.Empty(t, interruptedSagas)
+}
+
+func TestSagaCoordinator_CompensateFailed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	c, action := newTestCoordinator(t, ctx)
+
+	saga, err := c.Start(ctx, "saga")
+	require.NoError(t, err)
+
+	_, err = c.Execute(ctx, saga, []SagaStep{
+		{Action: "fake", Payload: json.RawMessage(`"a"`)},
+		{Action: "fake", Payload: json.RawMessage(`"fail"`)},
+	})
+	require.NoError(t, err)
+
+	// only the failed step is compensated, and the saga can still go on
+	require.NoError(t, c.CompensateFailed(ctx, saga))
+	require.Equal(t, []string{`"fail"`}, action.compensated)
+	require.Equal(t, StepDone, saga.Steps[0].Status)
+	require.Equal(t, StepCompensated, saga.Steps[1].Status)
+	require.Equal(t, SagaRunning, saga.Status)
+
+	// steps already compensated are not compensated again on abort
+	require.NoError(t, c.Abort(ctx, saga))
+	require.Equal(t, []string{`"fail"`, `"a"`}, action.compensated)
+}
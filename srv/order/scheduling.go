@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// DefaultScheduleLead is how long before their ship date scheduled orders are released, see loadSchedulingConfig
+const DefaultScheduleLead = 24 * time.Hour
+
+// SchedulerInterval is how often ScheduleOrdersLoop looks for orders to release
+const SchedulerInterval = 30 * time.Second
+
+// MaxPriority is the highest priority an order can have. The default priority is 0
+const MaxPriority = 9
+
+// schedulingConfig contains how scheduled orders are handled
+type schedulingConfig struct {
+	// lead is how long before their ship date scheduled orders reserve their stock
+	lead time.Duration
+}
+
+// loadSchedulingConfig reads the lead time of scheduled orders from ORDER_SCHEDULE_LEAD (e.g. "24h")
+func loadSchedulingConfig() (schedulingConfig, error) {
+	cfg := schedulingConfig{lead: DefaultScheduleLead}
+
+	if raw := os.Getenv("ORDER_SCHEDULE_LEAD"); raw != "" {
+		lead, err := time.ParseDuration(raw)
+		if err != nil || lead < 0 {
+			return cfg, fmt.Errorf("invalid ORDER_SCHEDULE_LEAD %q: must be a non-negative duration", raw)
+		}
+		cfg.lead = lead
+	}
+
+	return cfg, nil
+}
+
+// isScheduled reports whether an order shipping at shipDate is scheduled, instead of reserving its stock now
+func (cfg schedulingConfig) isScheduled(shipDate *time.Time, now time.Time) bool {
+	return shipDate != nil && shipDate.After(now.Add(cfg.lead))
+}
+
+// validateSchedule checks the ship date and the priority of a `messages.CreateOrder` request
+func validateSchedule(req messages.CreateOrder, now time.Time) []messages.OrderViolation {
+	violations := make([]messages.OrderViolation, 0)
+	if req.ShipDate != nil && req.ShipDate.Before(now) {
+		violations = append(violations, messages.OrderViolation{
+			Field:   "ship_date",
+			Code:    "invalid_ship_date",
+			Message: "the ship date is in the past",
+		})
+	}
+	if req.Priority < 0 || req.Priority > MaxPriority {
+		violations = append(violations, messages.OrderViolation{
+			Field:   "priority",
+			Code:    "invalid_priority",
+			Message: fmt.Sprintf("priority must be between 0 and %d", MaxPriority),
+		})
+	}
+	return violations
+}
+
+// heldStock returns the scheduled orders holding stock, in the order they keep it: higher priorities first,
+// then the ones shipping first.
+//
+// store MUST be locked
+func heldStock(store *orderStore, exclude uuid.UUID) []*order {
+	held := make([]*order, 0)
+	for _, o := range store.m {
+		if o.ID != exclude && o.Status == messages.OrderStatusScheduled && len(o.SoftReservation) > 0 {
+			held = append(held, o)
+		}
+	}
+	slices.SortFunc(held, compareScheduled)
+	return held
+}
+
+// compareScheduled sorts scheduled orders by priority (higher first), ship date and creation time
+func compareScheduled(a, b *order) int {
+	if a.Priority != b.Priority {
+		return b.Priority - a.Priority
+	}
+	if c := a.ShipDate.Compare(*b.ShipDate); c != 0 {
+		return c
+	}
+	return a.CreatedAt.Compare(b.CreatedAt)
+}
+
+// softReservations returns the stock held by the given orders, as parts of warehouses
+func softReservations(held []*order) []messages.OrderCreateWarehouse {
+	reserved := make([]messages.OrderCreateWarehouse, 0)
+	for _, o := range held {
+		for _, w := range o.SoftReservation {
+			reserved = append(reserved, messages.OrderCreateWarehouse{WarehouseId: w.WarehouseId, Parts: w.Parts})
+		}
+	}
+	return reserved
+}
+
+// availableStock returns the stock an order with the given priority can allocate: the stock held by scheduled
+// orders with the same or a higher priority, and the given reservations, are not available.
+//
+// store MUST be locked
+func availableStock(stock map[string]map[string]int, store *orderStore, priority int, exclude uuid.UUID, reserved []messages.OrderCreateWarehouse) map[string]map[string]int {
+	held := slices.DeleteFunc(heldStock(store, exclude), func(o *order) bool {
+		return o.Priority < priority
+	})
+	return remainingStock(stock, append(softReservations(held), reserved...), nil)
+}
+
+// preemptions returns the scheduled orders with a priority lower than the given one, whose stock is needed
+// once parts are allocated. The orders with the lowest priority and the latest ship date lose their stock first.
+//
+// store MUST be locked
+func preemptions(stock map[string]map[string]int, store *orderStore, priority int, exclude uuid.UUID, parts map[string]map[string]int) []uuid.UUID {
+	remaining := remainingStock(stock, asWarehouses(parts), nil)
+
+	preempted := make([]uuid.UUID, 0)
+	for _, o := range heldStock(store, exclude) {
+		fits := true
+		for _, w := range o.SoftReservation {
+			for _, part := range w.Parts {
+				if remaining[w.WarehouseId][part.GoodId] < part.Amount {
+					fits = false
+				}
+			}
+		}
+		if !fits && o.Priority < priority {
+			preempted = append(preempted, o.ID)
+			continue
+		}
+		for _, w := range o.SoftReservation {
+			for _, part := range w.Parts {
+				if remaining[w.WarehouseId] != nil {
+					remaining[w.WarehouseId][part.GoodId] -= part.Amount
+				}
+			}
+		}
+	}
+	return preempted
+}
+
+// preempt takes the stock held by the given scheduled orders, for the order by.
+//
+// store MUST be locked
+func preempt(ctx context.Context, js jetstream.JetStream, store *orderStore, ids []uuid.UUID, by uuid.UUID) {
+	for _, id := range ids {
+		err := publishOrderEvent(ctx, js, store, id, "preempted", messages.OrderPreempted{ID: id, By: by})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error sending the order preempted message", "error", err, "order", id)
+			continue
+		}
+		slog.InfoContext(ctx, "Soft reservation preempted", "order", id, "by", by)
+	}
+}
+
+// asWarehouses converts the parts of an allocation in a list of warehouses, sorted by id
+func asWarehouses(parts map[string]map[string]int) []messages.OrderCreateWarehouse {
+	warehouses := make([]messages.OrderCreateWarehouse, 0, len(parts))
+	for _, warehouseId := range sortedKeys(parts) {
+		warehouses = append(warehouses, messages.OrderCreateWarehouse{WarehouseId: warehouseId, Parts: toOrderItems(parts[warehouseId])})
+	}
+	return warehouses
+}
+
+// ScheduleOrdersLoop releases the scheduled orders whose ship date is close enough, and sets stock aside for the other ones
+func ScheduleOrdersLoop(ctx context.Context, s *common.Service[orderState]) {
+	ticker := time.NewTicker(SchedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			scheduleOrders(ctx, s, now)
+		}
+	}
+}
+
+// scheduledOrder is a snapshot of a scheduled order, taken by scheduleOrders
+type scheduledOrder struct {
+	id           uuid.UUID
+	seq          uint64
+	priority     int
+	shipDate     time.Time
+	lines        map[string]int
+	held         bool
+	allocation   messages.AllocationOptions
+	allowPartial bool
+}
+
+// scheduledOrders returns every scheduled order, in the order they get the stock.
+//
+// store MUST be locked
+func scheduledOrders(store *orderStore) []scheduledOrder {
+	scheduled := make([]*order, 0)
+	for _, o := range store.m {
+		if o.Status == messages.OrderStatusScheduled {
+			scheduled = append(scheduled, o)
+		}
+	}
+	slices.SortFunc(scheduled, compareScheduled)
+
+	queue := make([]scheduledOrder, 0, len(scheduled))
+	for _, o := range scheduled {
+		lines := make(map[string]int, len(o.Items))
+		for _, item := range o.Items {
+			lines[item.GoodId] += item.Amount
+		}
+		queue = append(queue, scheduledOrder{
+			id:           o.ID,
+			seq:          o.seq,
+			priority:     o.Priority,
+			shipDate:     *o.ShipDate,
+			lines:        lines,
+			held:         len(o.SoftReservation) > 0,
+			allocation:   o.allocation,
+			allowPartial: o.allowPartial,
+		})
+	}
+	return queue
+}
+
+// scheduleOrders releases the scheduled orders that are due at the given time, and sets stock aside
+// for the ones that do not hold any yet
+func scheduleOrders(ctx context.Context, s *common.Service[orderState], now time.Time) {
+	state := s.State()
+
+	state.stock.Lock()
+	defer state.stock.Unlock()
+
+	store := &state.orders
+	store.Lock()
+	queue := scheduledOrders(store)
+	store.Unlock()
+
+	// stock reserved for released orders is not removed from state.stock until warehouses commit it
+	reserved := make([]messages.OrderCreateWarehouse, 0)
+	for _, o := range queue {
+		due := !state.scheduling.isScheduled(&o.shipDate, now)
+		if !due && o.held {
+			continue
+		}
+
+		_, allocator, err := NewAllocator(o.allocation, state.allocation)
+		if err != nil {
+			slog.ErrorContext(ctx, "Invalid allocation options of scheduled order", "error", err, "order", o.id)
+			continue
+		}
+
+		store.Lock()
+		allocation := allocator.Allocate(o.lines, availableStock(state.stock.m, store, o.priority, o.id, reserved))
+		store.Unlock()
+
+		if !due {
+			softReserve(ctx, s, o, allocation, reserved)
+			continue
+		}
+
+		warehouses, err := releaseOrder(ctx, s, allocator, o, allocation, reserved, now)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error releasing scheduled order", "error", err, "order", o.id)
+			continue
+		}
+		reserved = append(reserved, warehouses...)
+	}
+}
+
+// softReserve sets stock aside for a scheduled order, if all of its goods are available
+func softReserve(ctx context.Context, s *common.Service[orderState], o scheduledOrder, allocation Allocation, reserved []messages.OrderCreateWarehouse) {
+	if len(allocation.Missing) > 0 {
+		return
+	}
+
+	state := s.State()
+	store := &state.orders
+	store.Lock()
+	defer store.Unlock()
+
+	stock := remainingStock(state.stock.m, reserved, nil)
+	preempt(ctx, s.JetStream(), store, preemptions(stock, store, o.priority, o.id, allocation.Parts), o.id)
+
+	warehouses := make([]messages.OrderQuoteWarehouse, 0, len(allocation.Parts))
+	for _, w := range asWarehouses(allocation.Parts) {
+		warehouses = append(warehouses, messages.OrderQuoteWarehouse{WarehouseId: w.WarehouseId, Parts: w.Parts})
+	}
+	err := publishOrderEvent(ctx, s.JetStream(), store, o.id, "soft_reserved", messages.OrderSoftReserved{ID: o.id, Warehouses: warehouses})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending the order soft reserved message", "error", err, "order", o.id)
+	}
+}
+
+// releaseOrder reserves the stock of a scheduled order, and confirms it.
+// Orders that do not allow partial fulfillment wait for the missing stock until their ship date, and then fail.
+//
+// state.stock MUST be locked
+func releaseOrder(ctx context.Context, s *common.Service[orderState], allocator Allocator, o scheduledOrder, allocation Allocation, reserved []messages.OrderCreateWarehouse, now time.Time) ([]messages.OrderCreateWarehouse, error) {
+	state := s.State()
+	store := &state.orders
+
+	if len(allocation.Missing) > 0 && !o.allowPartial {
+		if now.Before(o.shipDate) {
+			return nil, nil
+		}
+		failOrder(ctx, s, o.id, "not enough stock at the ship date")
+		return nil, nil
+	}
+
+	saga, err := state.sagas.Start(ctx, allocationSagaId(o.id, "scheduled", o.seq))
+	if err != nil {
+		return nil, err
+	}
+
+	warehouses, err := reserveParts(ctx, state, saga, allocator, allocation.Parts)
+	if err != nil {
+		// the order is released at the next run
+		abortSaga(ctx, state.sagas, saga)
+		return nil, err
+	}
+
+	store.Lock()
+	err = publishOrderEvent(ctx, s.JetStream(), store, o.id, "released", messages.OrderReleased{
+		ID:         o.id,
+		Warehouses: warehouses,
+		Backorder:  toOrderItems(allocation.Missing),
+	})
+	if err == nil {
+		// lower priorities lose their holds only once the order has its stock
+		stock := remainingStock(state.stock.m, reserved, nil)
+		preempt(ctx, s.JetStream(), store, preemptions(stock, store, o.priority, o.id, allocation.Parts), o.id)
+	}
+	store.Unlock()
+	if err != nil {
+		// e.g. the order was cancelled while reserving the stock
+		abortSaga(ctx, state.sagas, saga)
+		return nil, err
+	}
+
+	if err = state.sagas.Complete(ctx, saga); err != nil {
+		slog.ErrorContext(ctx, "Error completing scheduled order saga", "error", err, "saga", saga.ID)
+	}
+
+	slog.InfoContext(ctx, "Scheduled order released", "order", o.id, "warehouses", len(warehouses), "backorder", len(allocation.Missing))
+	return warehouses, nil
+}
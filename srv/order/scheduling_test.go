@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderStore_Scheduled(t *testing.T) {
+	st := newOrderStore()
+	id := uuid.New()
+	shipDate := time.Now().Add(72 * time.Hour)
+	soft := []messages.OrderQuoteWarehouse{{WarehouseId: "41", Parts: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}}}}
+
+	require.NoError(t, applyEvent(t, &st, 1, id, "created", messages.OrderCreated{
+		ID:           id,
+		Items:        []messages.OrderCreatedItem{{GoodId: "hat", Amount: 3}},
+		ShipDate:     &shipDate,
+		Scheduled:    true,
+		AllowPartial: true,
+		Allocation:   &messages.AllocationOptions{Strategy: StrategyBalance},
+	}))
+	o := st.m[id]
+	require.Equal(t, messages.OrderStatusScheduled, o.Status)
+	require.True(t, o.allowPartial)
+	require.Equal(t, StrategyBalance, o.allocation.Strategy)
+
+	// scheduled orders are not reserved nor confirmed like the other ones
+	require.ErrorIs(t, applyEvent(t, &st, 2, id, "reserved", messages.OrderReserved{ID: id}), errInvalidTransition)
+	require.ErrorIs(t, applyEvent(t, &st, 2, id, "preempted", messages.OrderPreempted{ID: id}), errInvalidTransition)
+
+	require.NoError(t, applyEvent(t, &st, 2, id, "soft_reserved", messages.OrderSoftReserved{ID: id, Warehouses: soft}))
+	require.Equal(t, soft, o.SoftReservation)
+	require.NoError(t, applyEvent(t, &st, 3, id, "preempted", messages.OrderPreempted{ID: id, By: uuid.New()}))
+	require.Empty(t, o.SoftReservation)
+	require.NoError(t, applyEvent(t, &st, 4, id, "soft_reserved", messages.OrderSoftReserved{ID: id, Warehouses: soft}))
+
+	w := messages.OrderCreateWarehouse{WarehouseId: "41", ReservationId: uuid.New(), Parts: soft[0].Parts}
+	require.NoError(t, applyEvent(t, &st, 5, id, "released", messages.OrderReleased{
+		ID:         id,
+		Warehouses: []messages.OrderCreateWarehouse{w},
+		Backorder:  []messages.OrderCreatedItem{{GoodId: "hat", Amount: 1}},
+	}))
+	require.Equal(t, messages.OrderStatusConfirmed, o.Status)
+	require.Empty(t, o.SoftReservation)
+	require.Equal(t, messages.BackorderOpen, o.BackorderStatus)
+	require.Len(t, o.Warehouses, 1)
+
+	require.ErrorIs(t, applyEvent(t, &st, 6, id, "released", messages.OrderReleased{ID: id}), errInvalidTransition)
+}
+
+func TestPreemptions(t *testing.T) {
+	st := newOrderStore()
+	stock := map[string]map[string]int{"41": {"hat": 10}}
+	shipDate := time.Now().Add(72 * time.Hour)
+	low, lowLater, high := uuid.New(), uuid.New(), uuid.New()
+
+	for i, o := range []struct {
+		id       uuid.UUID
+		priority int
+		shipDate time.Time
+	}{{low, 1, shipDate}, {lowLater, 1, shipDate.Add(time.Hour)}, {high, 5, shipDate}} {
+		seq := uint64(i * 10)
+		require.NoError(t, applyEvent(t, &st, seq+1, o.id, "created", messages.OrderCreated{ID: o.id, ShipDate: &o.shipDate, Priority: o.priority, Scheduled: true}))
+		require.NoError(t, applyEvent(t, &st, seq+2, o.id, "soft_reserved", messages.OrderSoftReserved{ID: o.id, Warehouses: []messages.OrderQuoteWarehouse{
+			{WarehouseId: "41", Parts: []messages.OrderCreatedItem{{GoodId: "hat", Amount: 3}}},
+		}}))
+	}
+
+	// orders only see the stock not held by orders with the same or a higher priority
+	require.Equal(t, 1, availableStock(stock, &st, 0, uuid.Nil, nil)["41"]["hat"])
+	require.Equal(t, 1, availableStock(stock, &st, 1, uuid.Nil, nil)["41"]["hat"])
+	require.Equal(t, 7, availableStock(stock, &st, 3, uuid.Nil, nil)["41"]["hat"])
+	require.Equal(t, 10, availableStock(stock, &st, 6, uuid.Nil, nil)["41"]["hat"])
+	require.Equal(t, 10, availableStock(stock, &st, 5, high, nil)["41"]["hat"])
+
+	// the order shipping last loses its stock first
+	parts := map[string]map[string]int{"41": {"hat": 4}}
+	require.Equal(t, []uuid.UUID{lowLater}, preemptions(stock, &st, 3, uuid.Nil, parts))
+
+	parts = map[string]map[string]int{"41": {"hat": 7}}
+	require.Equal(t, []uuid.UUID{low, lowLater}, preemptions(stock, &st, 3, uuid.Nil, parts))
+
+	// orders with the same priority keep their stock
+	require.Empty(t, preemptions(stock, &st, 1, uuid.Nil, parts))
+}
+
+func TestValidateSchedule(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	require.Empty(t, validateSchedule(messages.CreateOrder{ShipDate: &future, Priority: MaxPriority}, now))
+	require.Equal(t, []string{"invalid_ship_date", "invalid_priority"}, violationCodes(validateSchedule(messages.CreateOrder{ShipDate: &past, Priority: -1}, now)))
+
+	cfg := schedulingConfig{lead: 24 * time.Hour}
+	require.False(t, cfg.isScheduled(nil, now))
+	require.False(t, cfg.isScheduled(&future, now))
+	later := now.Add(48 * time.Hour)
+	require.True(t, cfg.isScheduled(&later, now))
+}
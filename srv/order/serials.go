@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Returns of serialised goods list the serials of the returned units, which must have been shipped with the order.
+// Warehouses publish the rest of the history of serials, see messages.SerialEvent.
+
+// validSerials returns whether serials are valid, distinct serial numbers
+func validSerials(serials []string) bool {
+	for i, serial := range serials {
+		if !messages.ValidSerial(serial) || slices.Contains(serials[:i], serial) {
+			return false
+		}
+	}
+	return true
+}
+
+// returnedSerial returns whether a serial of a good is part of a return of the order.
+//
+// store MUST be locked
+func (st *returnStore) returnedSerial(orderId uuid.UUID, goodId string, serial string) bool {
+	for _, r := range st.m {
+		if r.OrderId == orderId && r.GoodId == goodId && slices.Contains(r.Serials, serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// validReturnSerials returns whether the serials of a return request match its good: serialised goods need
+// a serial for each returned unit, shipped with the order and not returned yet, and other goods none.
+//
+// store MUST be locked
+func validReturnSerials(ctx context.Context, js jetstream.JetStream, lookup catalogLookup, store *returnStore, req messages.OpenReturn) (bool, error) {
+	item, err := lookup(ctx, req.GoodId)
+	if err != nil {
+		return false, err
+	}
+	if item == nil || !item.Serialised {
+		return len(req.Serials) == 0, nil
+	}
+	if len(req.Serials) != req.Amount || !validSerials(req.Serials) {
+		return false, nil
+	}
+
+	for _, serial := range req.Serials {
+		if store.returnedSerial(req.OrderId, req.GoodId, serial) {
+			return false, nil
+		}
+		last, _, err := common.LastSerialEvent(ctx, js, req.GoodId, serial)
+		if err != nil {
+			return false, err
+		}
+		if last == nil || last.Type != messages.SerialShipped || last.OrderId == nil || *last.OrderId != req.OrderId {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// validResellableSerials returns whether the serials of an inspection are among the serials of the return,
+// one for each resellable unit. Returns without serials take none.
+func (r *rma) validResellableSerials(resellable int, serials []string) bool {
+	if len(r.Serials) == 0 {
+		return len(serials) == 0
+	}
+	if len(serials) != resellable || !validSerials(serials) {
+		return false
+	}
+	for _, serial := range serials {
+		if !slices.Contains(r.Serials, serial) {
+			return false
+		}
+	}
+	return true
+}
+
+// publishReturnedSerials publishes that the serials of a return were received by a warehouse
+func publishReturnedSerials(ctx context.Context, js jetstream.JetStream, r messages.Return, warehouseId string) error {
+	for _, serial := range r.Serials {
+		_, err := common.PublishSerialEvent(ctx, js, messages.SerialEvent{
+			Serial:      serial,
+			GoodId:      r.GoodId,
+			Type:        messages.SerialReturned,
+			WarehouseId: warehouseId,
+			OrderId:     &r.OrderId,
+			ReturnId:    &r.ID,
+			Timestamp:   time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to publish returned serial %s: %w", serial, err)
+		}
+	}
+	return nil
+}
+
+// TraceSerialHandler is the handler for `serial.trace`
+func TraceSerialHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.TraceSerial
+	if err := json.Unmarshal(msg.Data, &req); err != nil || !messages.ValidSerial(req.Serial) {
+		slog.ErrorContext(ctx, "Invalid request data", "error", err)
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+	// good ids are part of the subject of the events
+	if req.GoodId != "" && uuid.Validate(req.GoodId) != nil {
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	events, err := common.SerialHistory(ctx, s.JetStream(), req.GoodId, req.Serial)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading serial history", "error", err, "serial", req.Serial)
+		natsutil.Respond(msg, natsutil.NatsError)
+		return
+	}
+	if len(events) == 0 {
+		natsutil.Respond(msg, natsutil.SerialNotFound)
+		return
+	}
+
+	payload, err := json.Marshal(events)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidReturnSerials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	nc := common.NewInProcessNATSServer(t)
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	require.NoError(t, common.CreateStream(ctx, js, common.SerialsStreamConfig))
+
+	phone := uuid.NewString()
+	orderId, otherOrder := uuid.New(), uuid.New()
+	lookup := testCatalog(
+		messages.CatalogItem{Id: phone, Name: "Phone", Serialised: true},
+		messages.CatalogItem{Id: "hat", Name: "Hat"},
+	)
+	for serial, order := range map[string]uuid.UUID{"SN-1": orderId, "SN-2": orderId, "SN-3": otherOrder} {
+		_, err := common.PublishSerialEvent(ctx, js, messages.SerialEvent{Serial: serial, GoodId: phone, Type: messages.SerialShipped, WarehouseId: "41", OrderId: &order})
+		require.NoError(t, err)
+	}
+	_, err = common.PublishSerialEvent(ctx, js, messages.SerialEvent{Serial: "SN-4", GoodId: phone, Type: messages.SerialReceived, WarehouseId: "41"})
+	require.NoError(t, err)
+
+	store := newReturnStore()
+	store.m[uuid.New()] = &rma{Return: messages.Return{OrderId: orderId, GoodId: phone, Amount: 1, Serials: []string{"SN-2"}}}
+
+	tests := []struct {
+		name  string
+		req   messages.OpenReturn
+		valid bool
+	}{
+		{"shipped with the order", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 1, Serials: []string{"SN-1"}}, true},
+		{"missing serials", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 1}, false},
+		{"fewer serials than units", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 2, Serials: []string{"SN-1"}}, false},
+		{"duplicate serials", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 2, Serials: []string{"SN-1", "SN-1"}}, false},
+		{"already returned", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 1, Serials: []string{"SN-2"}}, false},
+		{"shipped with another order", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 1, Serials: []string{"SN-3"}}, false},
+		{"still in stock", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 1, Serials: []string{"SN-4"}}, false},
+		{"never seen", messages.OpenReturn{OrderId: orderId, GoodId: phone, Amount: 1, Serials: []string{"SN-5"}}, false},
+		{"not serialised", messages.OpenReturn{OrderId: orderId, GoodId: "hat", Amount: 1}, true},
+		{"serials of a good that is not serialised", messages.OpenReturn{OrderId: orderId, GoodId: "hat", Amount: 1, Serials: []string{"SN-1"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := validReturnSerials(ctx, js, lookup, &store, tt.req)
+			require.NoError(t, err)
+			require.Equal(t, tt.valid, valid)
+		})
+	}
+}
+
+func TestReturnStore_ResellableSerials(t *testing.T) {
+	st := newReturnStore()
+	id := uuid.New()
+
+	require.NoError(t, applyReturnEvent(t, &st, 1, id, "opened", messages.ReturnOpened{ID: id, GoodId: "phone", Amount: 2, Serials: []string{"SN-1", "SN-2"}}))
+	require.NoError(t, applyReturnEvent(t, &st, 2, id, "received", messages.ReturnReceived{ID: id, WarehouseId: "41"}))
+
+	require.False(t, st.m[id].validResellableSerials(1, nil))
+	require.False(t, st.m[id].validResellableSerials(1, []string{"SN-3"}))
+	require.False(t, st.m[id].validResellableSerials(2, []string{"SN-1", "SN-1"}))
+	require.Error(t, applyReturnEvent(t, &st, 3, id, "inspected", messages.ReturnInspected{ID: id, Resellable: 1, Damaged: 1, Serials: []string{"SN-3"}}))
+
+	require.NoError(t, applyReturnEvent(t, &st, 4, id, "inspected", messages.ReturnInspected{ID: id, Resellable: 1, Damaged: 1, Serials: []string{"SN-2"}}))
+	require.Equal(t, []string{"SN-2"}, st.m[id].ResellableSerials)
+}
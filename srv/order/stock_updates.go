@@ -20,7 +20,7 @@ func StockUpdateHandler(ctx context.Context, s *common.Service[orderState], req
 			"Error unmarshalling message",
 			"error", err,
 			"subject", req.Subject(),
-			"message", req.Headers()["Nats-Msg-Id"][0],
+			"message", req.Headers().Get("Nats-Msg-Id"),
 		)
 		return nil
 	}
@@ -49,10 +49,14 @@ func StockUpdateHandler(ctx context.Context, s *common.Service[orderState], req
 		wStock = stock.m[warehouseId]
 	}
 
+	// stock updates contain the new amount of each good, not the difference
 	for _, row := range msg {
-		wStock[row.GoodId] += row.Amount
+		wStock[row.GoodId] = row.Amount
 	}
 
+	// new stock may be enough for some backorder
+	notifyBackorders(s.State())
+
 	slog.InfoContext(
 		ctx,
 		"Stock updated",
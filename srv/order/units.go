@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+)
+
+// Orders accept amounts in any unit of measure of their goods, and store them in the base unit of each good,
+// which is the one the stock is counted in.
+
+// baseAmount converts an amount of a good in the given unit to the base unit of the good. ok is false if the good
+// does not have such unit. Goods that are not in the catalog keep their amount, since validateLines refuses them.
+func baseAmount(ctx context.Context, lookup catalogLookup, goodId string, amount int, unit string) (int, bool, error) {
+	if unit == "" {
+		return amount, true, nil
+	}
+	item, err := lookup(ctx, goodId)
+	if err != nil || item == nil {
+		return amount, true, err
+	}
+
+	converted, err := item.ToBaseUnits(amount, unit)
+	switch {
+	case errors.Is(err, messages.ErrUnknownUnit):
+		return amount, false, nil
+	case errors.Is(err, messages.ErrAmountTooLarge):
+		// the amount is refused by the limits anyway
+		return math.MaxInt, true, nil
+	}
+	return converted, true, err
+}
+
+// toBaseUnits converts the lines of a validated request to the base units of their goods
+func toBaseUnits(ctx context.Context, req *messages.CreateOrder, lookup catalogLookup) error {
+	for i, line := range req.Items {
+		amount, _, err := baseAmount(ctx, lookup, line.GoodId, line.Amount, line.Unit)
+		if err != nil {
+			return err
+		}
+		req.Items[i] = messages.CreateOrderItem{GoodId: line.GoodId, Amount: amount}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+var testCan = messages.CatalogItem{Id: "can", Unit: "pcs", Units: []messages.ItemUnit{{Unit: "box", Factor: 12}}}
+
+func TestValidateOrder_Units(t *testing.T) {
+	ctx := context.Background()
+	cfg := validationConfig{maxLineAmount: 30, maxLines: 5, maxOrderAmount: 30}
+	catalog := testCatalog(testCan)
+
+	violations, err := validateOrder(ctx, []byte(`{"items":[{"good_id":"can","amount":2,"unit":"box"},{"good_id":"can","amount":6,"unit":"pcs"}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+
+	// limits apply to the amounts in base units
+	violations, err = validateOrder(ctx, []byte(`{"items":[{"good_id":"can","amount":3,"unit":"box"},{"good_id":"can","amount":1,"unit":"crate"}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"unknown_unit", "line_limit", "order_limit"}, violationCodes(violations))
+	require.Equal(t, "items[1].unit", violations[0].Field)
+
+	violations, err = validateOrder(ctx, []byte(`{"items":[{"good_id":"can","amount":9223372036854775807,"unit":"box"}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"line_limit", "order_limit"}, violationCodes(violations))
+}
+
+func TestToBaseUnits(t *testing.T) {
+	req := messages.CreateOrder{Items: []messages.CreateOrderItem{
+		{GoodId: "can", Amount: 2, Unit: "box"},
+		{GoodId: "can", Amount: 5},
+		{GoodId: "hat", Amount: 1, Unit: "pcs"},
+	}}
+	require.NoError(t, toBaseUnits(context.Background(), &req, testCatalog(testCan, messages.CatalogItem{Id: "hat", Unit: "pcs"})))
+	require.Equal(t, []messages.CreateOrderItem{
+		{GoodId: "can", Amount: 24},
+		{GoodId: "can", Amount: 5},
+		{GoodId: "hat", Amount: 1},
+	}, req.Items)
+}
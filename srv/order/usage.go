@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// openStatuses are the statuses of orders that still hold (or are waiting for) stock
+var openStatuses = []messages.OrderStatus{
+	messages.OrderStatusScheduled,
+	messages.OrderStatusPending,
+	messages.OrderStatusReserved,
+	messages.OrderStatusConfirmed,
+	messages.OrderStatusFulfilling,
+}
+
+// goodUsage returns the stock of goodId, and the open orders for it (or for it as a kit).
+//
+// stock and store MUST be locked
+func goodUsage(stock map[string]map[string]int, store *orderStore, goodId string) messages.GoodUsage {
+	usage := messages.GoodUsage{GoodId: goodId, Stock: make(map[string]int), OpenOrders: make([]uuid.UUID, 0)}
+
+	for warehouseId, goods := range stock {
+		if goods[goodId] > 0 {
+			usage.Stock[warehouseId] = goods[goodId]
+		}
+	}
+
+	hasGood := func(item messages.OrderCreatedItem) bool { return item.GoodId == goodId }
+	hasKit := func(kit messages.OrderKitLine) bool { return kit.GoodId == goodId }
+	for _, o := range store.m {
+		open := slices.Contains(openStatuses, o.Status) || o.BackorderStatus == messages.BackorderOpen
+		if open && (slices.ContainsFunc(o.Items, hasGood) || slices.ContainsFunc(o.Backorder, hasGood) || slices.ContainsFunc(o.Kits, hasKit)) {
+			usage.OpenOrders = append(usage.OpenOrders, o.ID)
+		}
+	}
+	slices.SortFunc(usage.OpenOrders, func(a, b uuid.UUID) int { return slices.Compare(a[:], b[:]) })
+
+	return usage
+}
+
+// GoodUsageHandler is the handler for `order.good_usage`, used by the catalog before deleting an item
+func GoodUsageHandler(ctx context.Context, s *common.Service[orderState], msg *nats.Msg) {
+	var req messages.GetGoodUsage
+	if err := json.Unmarshal(msg.Data, &req); err != nil || req.GoodId == "" {
+		natsutil.Respond(msg, natsutil.InvalidRequest)
+		return
+	}
+
+	stock := &s.State().stock
+	store := &s.State().orders
+	stock.Lock()
+	store.Lock()
+	usage := goodUsage(stock.m, store, req.GoodId)
+	store.Unlock()
+	stock.Unlock()
+
+	payload, err := json.Marshal(usage)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response", "error", err)
+		natsutil.Respond(msg, natsutil.MarshalError)
+		return
+	}
+
+	if err = msg.Respond(payload); err != nil {
+		slog.ErrorContext(ctx, "Error sending response to client", "error", err)
+	}
+}
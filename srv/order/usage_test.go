@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoodUsage(t *testing.T) {
+	st := newOrderStore()
+	open, closed, other := uuid.New(), uuid.New(), uuid.New()
+	hats := []messages.OrderCreatedItem{{GoodId: "hat", Amount: 1}}
+
+	require.NoError(t, applyEvent(t, &st, 1, open, "created", messages.OrderCreated{ID: open, Items: hats}))
+	require.NoError(t, applyEvent(t, &st, 2, closed, "created", messages.OrderCreated{ID: closed, Items: hats}))
+	require.NoError(t, applyEvent(t, &st, 3, closed, "cancelled", messages.OrderCancelled{ID: closed}))
+	require.NoError(t, applyEvent(t, &st, 4, other, "created", messages.OrderCreated{ID: other, Items: []messages.OrderCreatedItem{{GoodId: "scarf", Amount: 1}}}))
+
+	stock := map[string]map[string]int{"41": {"hat": 3, "scarf": 1}, "42": {"hat": 0}}
+
+	usage := goodUsage(stock, &st, "hat")
+	require.Equal(t, map[string]int{"41": 3}, usage.Stock)
+	require.Equal(t, []uuid.UUID{open}, usage.OpenOrders)
+	require.True(t, usage.InUse())
+
+	require.False(t, goodUsage(stock, &st, "sock").InUse())
+}
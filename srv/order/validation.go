@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Default limits applied to orders, see loadValidationConfig
+const (
+	DefaultMaxLineAmount  = 1000
+	DefaultMaxLines       = 100
+	DefaultMaxOrderAmount = 10000
+)
+
+// validationConfig contains the limits enforced on every order
+type validationConfig struct {
+	// maxLineAmount is the maximum amount of a single good, after merging duplicate lines
+	maxLineAmount int
+	// maxLines is the maximum number of different goods in an order
+	maxLines int
+	// maxOrderAmount is the maximum amount of goods in an order
+	maxOrderAmount int
+}
+
+// loadValidationConfig reads the order limits from ORDER_MAX_LINE_AMOUNT, ORDER_MAX_LINES and ORDER_MAX_AMOUNT
+func loadValidationConfig() (validationConfig, error) {
+	cfg := validationConfig{
+		maxLineAmount:  DefaultMaxLineAmount,
+		maxLines:       DefaultMaxLines,
+		maxOrderAmount: DefaultMaxOrderAmount,
+	}
+
+	for env, value := range map[string]*int{
+		"ORDER_MAX_LINE_AMOUNT": &cfg.maxLineAmount,
+		"ORDER_MAX_LINES":       &cfg.maxLines,
+		"ORDER_MAX_AMOUNT":      &cfg.maxOrderAmount,
+	} {
+		raw := os.Getenv(env)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid %s %q: must be a positive integer", env, raw)
+		}
+		*value = n
+	}
+
+	return cfg, nil
+}
+
+// catalogLookup returns the catalog item with the given id, or nil if there is none
+type catalogLookup func(ctx context.Context, goodId string) (*messages.CatalogItem, error)
+
+// kvCatalogLookup looks up catalog items in the catalog KV bucket
+func kvCatalogLookup(kv jetstream.KeyValue) catalogLookup {
+	return func(ctx context.Context, goodId string) (*messages.CatalogItem, error) {
+		entry, err := kv.Get(ctx, goodId)
+		if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrInvalidKey) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get catalog item %s: %w", goodId, err)
+		}
+
+		var item messages.CatalogItem
+		if err := json.Unmarshal(entry.Value(), &item); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal catalog item %s: %w", goodId, err)
+		}
+		return &item, nil
+	}
+}
+
+// rawOrderLine is a line of an order as sent by the client, before its amount is known to be an integer
+type rawOrderLine struct {
+	GoodId string          `json:"good_id"`
+	Amount json.RawMessage `json:"amount"`
+	Unit   string          `json:"unit"`
+}
+
+// validateOrder checks the lines of a `messages.CreateOrder` request, and returns every problem found.
+//
+// Amounts are converted to the base unit of their goods, and lines with the same good are merged
+// before checking the limits. The returned error is only set
+// if the catalog could not be queried.
+func validateOrder(ctx context.Context, data []byte, cfg validationConfig, lookup catalogLookup) ([]messages.OrderViolation, error) {
+	var req struct {
+		Items []rawOrderLine `json:"items"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return []messages.OrderViolation{{Code: "invalid_json", Message: err.Error()}}, nil
+	}
+
+	violations := make([]messages.OrderViolation, 0)
+	if len(req.Items) == 0 {
+		violations = append(violations, messages.OrderViolation{Field: "items", Code: "no_items", Message: "the order has no items"})
+	}
+
+	// lines merged by good, in the order they first appear
+	lines := make(map[string]int)
+	goods := make([]string, 0)
+	for i, line := range req.Items {
+		if line.GoodId == "" {
+			violations = append(violations, messages.OrderViolation{
+				Field:   fmt.Sprintf("items[%d].good_id", i),
+				Code:    "missing_good_id",
+				Message: "good_id is required",
+			})
+		}
+
+		amount, err := strconv.Atoi(string(line.Amount))
+		if err != nil || amount <= 0 {
+			violations = append(violations, messages.OrderViolation{
+				Field:   fmt.Sprintf("items[%d].amount", i),
+				GoodId:  line.GoodId,
+				Code:    "invalid_amount",
+				Message: fmt.Sprintf("amount must be a positive integer, got %s", orMissing(line.Amount)),
+			})
+			continue
+		}
+		if line.GoodId == "" {
+			continue
+		}
+		amount, ok, err := baseAmount(ctx, lookup, line.GoodId, amount, line.Unit)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			violations = append(violations, messages.OrderViolation{
+				Field:   fmt.Sprintf("items[%d].unit", i),
+				GoodId:  line.GoodId,
+				Code:    "unknown_unit",
+				Message: fmt.Sprintf("%q is not a unit of measure of the good", line.Unit),
+			})
+			continue
+		}
+
+		if _, ok := lines[line.GoodId]; !ok {
+			goods = append(goods, line.GoodId)
+		}
+		// saturate instead of overflowing: the amount is refused anyway
+		lines[line.GoodId] = min(lines[line.GoodId]+min(amount, cfg.maxOrderAmount+1), cfg.maxOrderAmount+1)
+	}
+
+	more, err := validateLines(ctx, goods, lines, cfg, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return append(violations, more...), nil
+}
+
+// validateLines checks merged order lines against the catalog and the limits. goods lists the goods
+// of lines in the order violations should be reported.
+func validateLines(ctx context.Context, goods []string, lines map[string]int, cfg validationConfig, lookup catalogLookup) ([]messages.OrderViolation, error) {
+	violations := make([]messages.OrderViolation, 0)
+	total := 0
+	for _, goodId := range goods {
+		amount := lines[goodId]
+		total += amount
+
+		if amount > cfg.maxLineAmount {
+			violations = append(violations, messages.OrderViolation{
+				GoodId:  goodId,
+				Code:    "line_limit",
+				Message: fmt.Sprintf("at most %d items of the same good can be ordered", cfg.maxLineAmount),
+			})
+		}
+
+		item, err := lookup(ctx, goodId)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case item == nil:
+			violations = append(violations, messages.OrderViolation{
+				GoodId:  goodId,
+				Code:    "unknown_good",
+				Message: "the good is not in the catalog",
+			})
+		case item.Status == messages.CatalogItemArchived:
+			violations = append(violations, messages.OrderViolation{
+				GoodId:  goodId,
+				Code:    "archived_good",
+				Message: "the good is archived, and cannot be ordered anymore",
+			})
+		case len(item.Components) > 0:
+			more, err := kitViolations(ctx, item, lookup)
+			if err != nil {
+				return nil, err
+			}
+			violations = append(violations, more...)
+		}
+	}
+
+	if len(goods) > cfg.maxLines {
+		violations = append(violations, messages.OrderViolation{
+			Field:   "items",
+			Code:    "too_many_lines",
+			Message: fmt.Sprintf("at most %d different goods can be ordered at once", cfg.maxLines),
+		})
+	}
+	if total > cfg.maxOrderAmount {
+		violations = append(violations, messages.OrderViolation{
+			Field:   "items",
+			Code:    "order_limit",
+			Message: fmt.Sprintf("at most %d items can be ordered at once", cfg.maxOrderAmount),
+		})
+	}
+
+	return violations, nil
+}
+
+// validateExpanded checks the lines of a request whose kits were replaced by their components (see expandKits)
+// against the limits: the components of kits are reserved, so they count towards the limits as well.
+func validateExpanded(ctx context.Context, items []messages.CreateOrderItem, cfg validationConfig, lookup catalogLookup) ([]messages.OrderViolation, error) {
+	lines := make(map[string]int)
+	goods := make([]string, 0)
+	for _, item := range items {
+		if _, ok := lines[item.GoodId]; !ok {
+			goods = append(goods, item.GoodId)
+		}
+		lines[item.GoodId] = min(lines[item.GoodId]+min(item.Amount, cfg.maxOrderAmount+1), cfg.maxOrderAmount+1)
+	}
+	return validateLines(ctx, goods, lines, cfg, lookup)
+}
+
+// orMissing formats a raw JSON value for an error message
+func orMissing(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "nothing"
+	}
+	return string(raw)
+}
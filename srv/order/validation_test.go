@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+func testCatalog(items ...messages.CatalogItem) catalogLookup {
+	return func(_ context.Context, goodId string) (*messages.CatalogItem, error) {
+		for _, item := range items {
+			if item.Id == goodId {
+				return &item, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+func violationCodes(violations []messages.OrderViolation) []string {
+	codes := make([]string, 0, len(violations))
+	for _, v := range violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestValidateOrder(t *testing.T) {
+	ctx := context.Background()
+	cfg := validationConfig{maxLineAmount: 10, maxLines: 2, maxOrderAmount: 15}
+	catalog := testCatalog(
+		messages.CatalogItem{Id: "hat"},
+		messages.CatalogItem{Id: "shoe", Status: messages.CatalogItemActive},
+		messages.CatalogItem{Id: "sock", Status: messages.CatalogItemArchived},
+	)
+
+	violations, err := validateOrder(ctx, []byte(`{"items":[{"good_id":"hat","amount":3},{"good_id":"shoe","amount":2},{"good_id":"hat","amount":4}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+
+	// every violation is reported at once
+	violations, err = validateOrder(ctx, []byte(`{"items":[
+		{"good_id":"hat","amount":0},
+		{"good_id":"hat","amount":-1},
+		{"good_id":"hat","amount":1.5},
+		{"good_id":"hat","amount":"5"},
+		{"amount":1},
+		{"good_id":"sock","amount":1},
+		{"good_id":"ghost","amount":1}
+	]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"invalid_amount", "invalid_amount", "invalid_amount", "invalid_amount",
+		"missing_good_id", "archived_good", "unknown_good",
+	}, violationCodes(violations))
+	require.Equal(t, "items[2].amount", violations[2].Field)
+
+	// limits apply after merging duplicate lines
+	violations, err = validateOrder(ctx, []byte(`{"items":[{"good_id":"hat","amount":6},{"good_id":"shoe","amount":6},{"good_id":"hat","amount":6}]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"line_limit", "order_limit"}, violationCodes(violations))
+	require.Equal(t, "hat", violations[0].GoodId)
+
+	violations, err = validateOrder(ctx, []byte(`{"items":[]}`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"no_items"}, violationCodes(violations))
+
+	violations, err = validateOrder(ctx, []byte(`{"items":`), cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"invalid_json"}, violationCodes(violations))
+}
+
+func TestValidateAmendment(t *testing.T) {
+	ctx := context.Background()
+	cfg := validationConfig{maxLineAmount: 10, maxLines: 5, maxOrderAmount: 100}
+	catalog := testCatalog(
+		messages.CatalogItem{Id: "hat", Status: messages.CatalogItemArchived},
+		messages.CatalogItem{Id: "sock", Status: messages.CatalogItemArchived},
+	)
+
+	// archived goods can be kept, but not increased
+	violations, err := validateAmendment(ctx, amendment{
+		after:    []messages.OrderCreatedItem{{GoodId: "hat", Amount: 2}, {GoodId: "sock", Amount: 11}},
+		increase: map[string]int{"sock": 1},
+	}, cfg, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"line_limit", "archived_good"}, violationCodes(violations))
+}
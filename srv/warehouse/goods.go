@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/nats-io/nats.go"
+)
+
+// lookupTimeout is how long add_stock and adjust wait for the catalog to resolve a barcode or a good
+const lookupTimeout = time.Second
+
+var (
+	// errUnknownBarcode is returned by resolveBarcodes when no catalog item has a barcode
+	errUnknownBarcode = errors.New("unknown barcode")
+	// errMissingGood is returned by resolveBarcodes for items with neither a good id nor a barcode, or with both
+	errMissingGood = errors.New("either good_id or barcode is required")
+	// errUnknownUnit is returned by convertUnits when goods are not in the catalog, or do not have the unit of their items
+	errUnknownUnit = errors.New("unknown unit of measure")
+	// errAmountTooLarge is returned by convertUnits when an amount does not fit an int once converted
+	errAmountTooLarge = errors.New("amount too large")
+	// errInvalidSerials is returned by checkSerials when the serials of items do not match their goods
+	errInvalidSerials = errors.New("invalid serial numbers")
+)
+
+// catalogItems are the catalog items fetched while resolving the goods of a request, by id
+type catalogItems map[string]messages.CatalogItem
+
+// requestItem sends a `catalog.get` or `catalog.lookup` request, and returns the item, or nil if there is none
+func requestItem(nc *nats.Conn, subject string, req any) (*messages.CatalogItem, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := nc.Request(subject, body, lookupTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", subject, err)
+	}
+	if code, description, ok := natsutil.ParseError(r.Data); ok {
+		if code == "not_found" || code == "invalid_request" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s refused the request: %s: %s", subject, code, description)
+	}
+
+	var item messages.CatalogItem
+	if err = json.Unmarshal(r.Data, &item); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal catalog item: %w", err)
+	}
+	return &item, nil
+}
+
+// catalogItem returns the catalog item of a good, asking the catalog unless it was already fetched,
+// or nil if the good is not in the catalog
+func (goods catalogItems) catalogItem(nc *nats.Conn, goodId string) (*messages.CatalogItem, error) {
+	if good, found := goods[goodId]; found {
+		return &good, nil
+	}
+	good, err := requestItem(nc, "catalog.get", messages.GetCatalogItem{Id: goodId})
+	if err != nil || good == nil {
+		return nil, err
+	}
+	goods[goodId] = *good
+	return good, nil
+}
+
+// resolveBarcodes replaces the barcodes of items with the ids of their goods, asking the catalog.
+// It returns the barcodes that are not in the catalog, along with errUnknownBarcode.
+func resolveBarcodes(nc *nats.Conn, items []messages.StockUpdateItem, goods catalogItems) ([]string, error) {
+	unknown := make([]string, 0)
+	for i, item := range items {
+		if item.Barcode == "" {
+			continue
+		}
+		if item.GoodId != "" {
+			return nil, errMissingGood
+		}
+
+		good, err := requestItem(nc, "catalog.lookup", messages.LookupCatalogItem{Barcode: item.Barcode})
+		if err != nil {
+			return nil, err
+		}
+		if good == nil {
+			unknown = append(unknown, item.Barcode)
+			continue
+		}
+		goods[good.Id] = *good
+		items[i].GoodId, items[i].Barcode = good.Id, ""
+	}
+
+	if len(unknown) > 0 {
+		return unknown, errUnknownBarcode
+	}
+	for _, item := range items {
+		if item.GoodId == "" {
+			return nil, errMissingGood
+		}
+	}
+	return nil, nil
+}
+
+// convertUnits converts the amounts of items in other units of measure to the base units of their goods,
+// asking the catalog. It returns the items whose goods do not have their unit, along with errUnknownUnit.
+func convertUnits(nc *nats.Conn, items []messages.StockUpdateItem, goods catalogItems) ([]messages.StockUpdateItem, error) {
+	unknown := make([]messages.StockUpdateItem, 0)
+	for i, item := range items {
+		if item.Unit == "" {
+			continue
+		}
+
+		good, err := goods.catalogItem(nc, item.GoodId)
+		if err != nil {
+			return nil, err
+		}
+		if good == nil {
+			unknown = append(unknown, item)
+			continue
+		}
+
+		amount, err := good.ToBaseUnits(item.Amount, item.Unit)
+		switch {
+		case errors.Is(err, messages.ErrUnknownUnit):
+			unknown = append(unknown, item)
+			continue
+		case errors.Is(err, messages.ErrAmountTooLarge):
+			return nil, errAmountTooLarge
+		}
+		items[i].Amount, items[i].Unit = amount, ""
+	}
+
+	if len(unknown) > 0 {
+		return unknown, errUnknownUnit
+	}
+	return nil, nil
+}
+
+// checkSerials checks that items of serialised goods have a distinct, valid serial for each unit they add
+// or remove, and that items of other goods have none. It returns the offending items, along with errInvalidSerials.
+func checkSerials(nc *nats.Conn, items []messages.StockUpdateItem, goods catalogItems) ([]messages.StockUpdateItem, error) {
+	invalid := make([]messages.StockUpdateItem, 0)
+	seen := make(map[string]bool)
+	for _, item := range items {
+		good, err := goods.catalogItem(nc, item.GoodId)
+		if err != nil {
+			return nil, err
+		}
+
+		serialised := good != nil && good.Serialised
+		valid := serialised && len(item.Serials) == max(item.Amount, -item.Amount) || !serialised && len(item.Serials) == 0
+		for _, serial := range item.Serials {
+			key := common.SerialSubject(item.GoodId, serial)
+			if !messages.ValidSerial(serial) || seen[key] {
+				valid = false
+			}
+			seen[key] = true
+		}
+		if !valid {
+			invalid = append(invalid, item)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return invalid, errInvalidSerials
+	}
+	return nil, nil
+}
+
+// resolveGoods replaces the barcodes of items with the ids of their goods, converts their amounts
+// to the base units of their goods, as carried by stock updates, and checks their serials.
+// It returns the response to send back if it fails.
+func resolveGoods(ctx context.Context, nc *nats.Conn, items []messages.StockUpdateItem) []byte {
+	goods := make(catalogItems)
+
+	unknownBarcodes, err := resolveBarcodes(nc, items, goods)
+	switch {
+	case errors.Is(err, errUnknownBarcode):
+		return natsutil.ErrorResponseWithDetails(natsutil.BarcodeNotFound, unknownBarcodes)
+	case errors.Is(err, errMissingGood):
+		return natsutil.ErrorResponse(natsutil.InvalidRequest)
+	case err != nil:
+		slog.ErrorContext(ctx, "Error resolving barcodes", "error", err)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	unknownUnits, err := convertUnits(nc, items, goods)
+	switch {
+	case errors.Is(err, errUnknownUnit):
+		return natsutil.ErrorResponseWithDetails(natsutil.UnknownUnit, unknownUnits)
+	case errors.Is(err, errAmountTooLarge):
+		return natsutil.ErrorResponse(natsutil.InvalidRequest)
+	case err != nil:
+		slog.ErrorContext(ctx, "Error converting units of measure", "error", err)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	invalidSerials, err := checkSerials(nc, items, goods)
+	switch {
+	case errors.Is(err, errInvalidSerials):
+		return natsutil.ErrorResponseWithDetails(natsutil.InvalidSerials, invalidSerials)
+	case err != nil:
+		slog.ErrorContext(ctx, "Error checking serial numbers", "error", err)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/stretchr/testify/require"
+)
+
+// testGoods returns the catalog items of the tests, as if they had already been fetched from the catalog
+func testGoods() catalogItems {
+	return catalogItems{
+		"socks": {Id: "socks", Units: []messages.ItemUnit{{Unit: "box", Factor: 12}}},
+		"phone": {Id: "phone", Serialised: true},
+	}
+}
+
+func TestConvertUnits(t *testing.T) {
+	items := []messages.StockUpdateItem{
+		{GoodId: "socks", Amount: 2, Unit: "box"},
+		{GoodId: "socks", Amount: -1, Unit: "box"},
+		{GoodId: "socks", Amount: 3},
+	}
+	unknown, err := convertUnits(nil, items, testGoods())
+	require.NoError(t, err)
+	require.Empty(t, unknown)
+	require.Equal(t, []messages.StockUpdateItem{
+		{GoodId: "socks", Amount: 24},
+		{GoodId: "socks", Amount: -12},
+		{GoodId: "socks", Amount: 3},
+	}, items)
+
+	items = []messages.StockUpdateItem{{GoodId: "socks", Amount: 1, Unit: "pallet"}, {GoodId: "phone", Amount: 1, Unit: "box"}}
+	unknown, err = convertUnits(nil, items, testGoods())
+	require.ErrorIs(t, err, errUnknownUnit)
+	require.Equal(t, items, unknown)
+
+	_, err = convertUnits(nil, []messages.StockUpdateItem{{GoodId: "socks", Amount: math.MaxInt / 2, Unit: "box"}}, testGoods())
+	require.ErrorIs(t, err, errAmountTooLarge)
+}
+
+func TestCheckSerials(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []messages.StockUpdateItem
+		valid bool
+	}{
+		{"a serial for each unit", []messages.StockUpdateItem{{GoodId: "phone", Amount: 2, Serials: []string{"SN-1", "SN-2"}}}, true},
+		{"a serial for each removed unit", []messages.StockUpdateItem{{GoodId: "phone", Amount: -1, Serials: []string{"SN-1"}}}, true},
+		{"fewer serials than units", []messages.StockUpdateItem{{GoodId: "phone", Amount: 2, Serials: []string{"SN-1"}}}, false},
+		{"invalid serial", []messages.StockUpdateItem{{GoodId: "phone", Amount: 1, Serials: []string{"SN 1"}}}, false},
+		{"same serial twice", []messages.StockUpdateItem{
+			{GoodId: "phone", Amount: 1, Serials: []string{"SN-1"}},
+			{GoodId: "phone", Amount: 1, Serials: []string{"SN-1"}},
+		}, false},
+		{"goods without serials", []messages.StockUpdateItem{{GoodId: "socks", Amount: 1}}, true},
+		{"serials of goods that are not serialised", []messages.StockUpdateItem{{GoodId: "socks", Amount: 1, Serials: []string{"SN-1"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invalid, err := checkSerials(nil, tt.items, testGoods())
+			if tt.valid {
+				require.NoError(t, err)
+				require.Empty(t, invalid)
+			} else {
+				require.ErrorIs(t, err, errInvalidSerials)
+				require.NotEmpty(t, invalid)
+			}
+		})
+	}
+}
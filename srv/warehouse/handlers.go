@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 // PingHandler is the handler for `warehouse.ping`
@@ -54,6 +59,7 @@ func ReserveHandler(ctx context.Context, s *common.Service[warehouseState], req
 
 	if ok {
 		// If the reservation request can be satisfied...
+		serials := pickSerials(stock, msg.RequestedStock)
 		err = PublishReservation(
 			ctx,
 			&s.State().reservation,
@@ -69,7 +75,7 @@ func ReserveHandler(ctx context.Context, s *common.Service[warehouseState], req
 				"Error publishing reservation",
 				"error", err,
 				"subject", req.Subject,
-				"message", req.Header["Nats-Msg-Id"][0],
+				"message", req.Header.Get("Nats-Msg-Id"),
 			)
 			_ = req.Respond([]byte("error"))
 			return
@@ -79,6 +85,14 @@ func ReserveHandler(ctx context.Context, s *common.Service[warehouseState], req
 			stock.r[s.GoodId] += s.Amount
 		}
 
+		// serialised goods are reserved by serial, so that orders ship the ones they were assigned
+		if err = reserveSerials(ctx, s.JetStream(), stock, msg.ID, serials); err != nil {
+			slog.ErrorContext(ctx, "Error reserving serials", "error", err, "reservation_id", msg.ID)
+			releaseFailedReservation(ctx, s, msg)
+			_ = req.Respond([]byte("error"))
+			return
+		}
+
 		_ = req.Respond([]byte("ok"))
 	} else {
 		_ = req.Respond([]byte("not enough stock"))
@@ -86,7 +100,87 @@ func ReserveHandler(ctx context.Context, s *common.Service[warehouseState], req
 
 }
 
+// releaseFailedReservation releases a reservation whose serials could not be reserved, along with the
+// serials reserved before the failure, so that its stock is not held until it expires. stock MUST be locked
+func releaseFailedReservation(ctx context.Context, s *common.Service[warehouseState], msg messages.ReserveStock) {
+	stock := &s.State().stock
+	reservations := &s.State().reservation
+
+	reservations.Lock()
+	defer reservations.Unlock()
+
+	if err := PublishReservationRemoved(ctx, reservations, s.JetStream(), msg.ID, "released"); err != nil {
+		// the reservation is still tracked, and expires along with its serials
+		slog.ErrorContext(ctx, "Error releasing reservation", "error", err, "reservation_id", msg.ID)
+		return
+	}
+	for _, item := range msg.RequestedStock {
+		stock.r[item.GoodId] -= item.Amount
+	}
+	if err := releaseSerials(ctx, s.JetStream(), stock, msg.ID); err != nil {
+		slog.ErrorContext(ctx, "Error releasing serials", "error", err, "reservation_id", msg.ID)
+	}
+}
+
+// ReleaseHandler is the handler for `warehouse.release`.
+//
+// Releasing an unknown (or already released) reservation is not an error, so that callers can safely retry.
+func ReleaseHandler(ctx context.Context, s *common.Service[warehouseState], req *nats.Msg) {
+	var msg messages.ReleaseReservation
+	err := json.Unmarshal(req.Data, &msg)
+	if err != nil {
+		_ = req.Respond([]byte(err.Error()))
+		return
+	}
+
+	stock := &s.State().stock
+	reservations := &s.State().reservation
+
+	stock.Lock()
+	defer stock.Unlock()
+	reservations.Lock()
+	defer reservations.Unlock()
+
+	i := reservations.find(msg.ID)
+	if i == -1 {
+		_ = req.Respond([]byte("ok"))
+		return
+	}
+	reservation := reservations.s[i]
+
+	err = PublishReservationRemoved(ctx, reservations, s.JetStream(), msg.ID, "released")
+	if err != nil {
+		slog.ErrorContext(ctx, "Error publishing reservation release", "error", err, "reservation_id", msg.ID)
+		_ = req.Respond([]byte("error"))
+		return
+	}
+
+	for _, item := range reservation.ReservedStock {
+		stock.r[item.GoodId] -= item.Amount
+	}
+
+	if err = releaseSerials(ctx, s.JetStream(), stock, msg.ID); err != nil {
+		slog.ErrorContext(ctx, "Error releasing serials", "error", err, "reservation_id", msg.ID)
+		_ = req.Respond([]byte("error"))
+		return
+	}
+
+	slog.InfoContext(ctx, "Reservation released", "reservation_id", msg.ID)
+	_ = req.Respond([]byte("ok"))
+}
+
+// AddStockHandler is the handler for `warehouse.add_stock`.
+//
+// Requests carrying an idempotency key are executed only once: retries get the original response.
 func AddStockHandler(ctx context.Context, s *common.Service[warehouseState], req *nats.Msg) {
+	response := s.State().idempotency.Do(ctx, fmt.Sprintf("add_stock.%s", warehouseId), req, func(id uuid.UUID) []byte {
+		return addStock(ctx, s, req, id)
+	})
+	_ = req.Respond(response)
+}
+
+// addStock adds the stock requested by req, whose retries share the given id, and returns the response to send back
+func addStock(ctx context.Context, s *common.Service[warehouseState], req *nats.Msg, id uuid.UUID) []byte {
 	var msg messages.StockUpdate
 	err := json.Unmarshal(req.Data, &msg)
 	if err != nil {
@@ -95,32 +189,69 @@ func AddStockHandler(ctx context.Context, s *common.Service[warehouseState], req
 			"Error unmarshalling message",
 			"error", err,
 			"subject", req.Subject,
-			"message", req.Header["Nats-Msg-Id"][0],
+			"message", req.Header.Get("Nats-Msg-Id"),
 		)
+		return natsutil.ErrorResponse(natsutil.InvalidRequest)
 	}
 
 	slog.DebugContext(ctx, "Received stock add request", "msg", msg)
 
+	if response := checkSerialsKey(req, msg); response != nil {
+		return response
+	}
+
+	// goods can be identified by barcode and counted in any of their units, while stock updates
+	// carry their ids and amounts in their base units
+	if response := resolveGoods(ctx, s.NatsConn(), msg); response != nil {
+		return response
+	}
+
 	stock := &s.State().stock
 
 	stock.Lock()
 	defer stock.Unlock()
 
+	// the stream discards updates with an already seen message id, so that a retry executed after
+	// the original request was lost does not add the stock twice
+	var opts []jetstream.PublishOpt
+	msgId := ""
+	if req.Header.Get(common.IdempotencyHeader) != "" {
+		msgId = fmt.Sprintf("add_stock.%s.%s", warehouseId, id)
+		opts = append(opts, jetstream.WithMsgID(msgId))
+	}
+
+	// the serials of serialised goods are published on their own stream before the stock is added,
+	// so that a retry completes the serials of a request that failed before adding its stock
+	serials, response := changeSerials(ctx, s.JetStream(), stock, msg, "", msgId)
+	if response != nil {
+		return response
+	}
+	if err = publishSerialChanges(ctx, s.JetStream(), stock, serials); err != nil {
+		slog.ErrorContext(ctx, "Error publishing serials", "error", err, "subject", req.Subject)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
 	// msg contains only increment in stock quantity, transform to absolute values using the stock state
 	for i, row := range msg {
 		msg[i].Amount += stock.s[row.GoodId]
+		msg[i].Serials = nil
 	}
 
-	err = SendStockUpdate(ctx, s.JetStream(), &msg)
+	err = SendStockUpdate(ctx, s.JetStream(), &msg, opts...)
+	if errors.Is(err, errDuplicateStockUpdate) {
+		// the stock was already added, and is part of the state rebuilt from the stream
+		slog.InfoContext(ctx, "Stock already added by a previous request", "subject", req.Subject)
+		return []byte("ok")
+	}
 	if err != nil {
 		slog.ErrorContext(
 			ctx,
 			"Error sending stock update",
 			"error", err,
 			"subject", req.Subject,
-			"message", req.Header["Nats-Msg-Id"][0],
+			"message", req.Header.Get("Nats-Msg-Id"),
 		)
-		return
+		return natsutil.ErrorResponse(natsutil.NatsError)
 	}
 
 	for _, row := range msg {
@@ -128,5 +259,97 @@ func AddStockHandler(ctx context.Context, s *common.Service[warehouseState], req
 		stock.s[row.GoodId] = row.Amount
 	}
 
-	_ = req.Respond([]byte("ok"))
+	return []byte("ok")
+}
+
+// checkSerialsKey returns the response to send back if items have serial numbers, but req has no idempotency key.
+// Serials are published before the stock update, and only the message ids derived from the key
+// let a retry tell the serials published by a failed attempt from the ones already in stock.
+func checkSerialsKey(req *nats.Msg, items []messages.StockUpdateItem) []byte {
+	if req.Header.Get(common.IdempotencyHeader) != "" {
+		return nil
+	}
+	for _, item := range items {
+		if len(item.Serials) > 0 {
+			return natsutil.ErrorResponse(natsutil.SerialsNeedIdempotencyKey)
+		}
+	}
+	return nil
+}
+
+// AdjustHandler is the handler for `warehouse.adjust`.
+//
+// Adjustments that would leave less stock than what is reserved are refused. Requests carrying
+// an idempotency key are executed only once: retries get the original response.
+func AdjustHandler(ctx context.Context, s *common.Service[warehouseState], req *nats.Msg) {
+	response := s.State().idempotency.Do(ctx, fmt.Sprintf("adjust.%s", warehouseId), req, func(id uuid.UUID) []byte {
+		return adjustStock(ctx, s, req, id)
+	})
+	_ = req.Respond(response)
+}
+
+// adjustStock applies the adjustment requested by req, whose retries share the given id, and returns the response to send back
+func adjustStock(ctx context.Context, s *common.Service[warehouseState], req *nats.Msg, id uuid.UUID) []byte {
+	var msg messages.AdjustStock
+	if err := json.Unmarshal(req.Data, &msg); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling message", "error", err, "subject", req.Subject)
+		return natsutil.ErrorResponse(natsutil.InvalidRequest)
+	}
+	if response := checkSerialsKey(req, msg.Items); response != nil {
+		return response
+	}
+	if response := resolveGoods(ctx, s.NatsConn(), msg.Items); response != nil {
+		return response
+	}
+
+	stock := &s.State().stock
+
+	stock.Lock()
+	defer stock.Unlock()
+
+	var opts []jetstream.PublishOpt
+	msgId := ""
+	if req.Header.Get(common.IdempotencyHeader) != "" {
+		msgId = fmt.Sprintf("adjust.%s.%s", warehouseId, id)
+		opts = append(opts, jetstream.WithMsgID(msgId))
+	}
+
+	serials, response := changeSerials(ctx, s.JetStream(), stock, msg.Items, msg.Reason, msgId)
+	if response != nil {
+		return response
+	}
+
+	// transform the adjustments to absolute values using the stock state
+	update := make(messages.StockUpdate, 0, len(msg.Items))
+	for _, item := range msg.Items {
+		amount := stock.s[item.GoodId] + item.Amount
+		if amount < stock.r[item.GoodId] {
+			return natsutil.ErrorResponse(natsutil.InsufficientStock)
+		}
+		update = append(update, messages.StockUpdateItem{GoodId: item.GoodId, Amount: amount})
+	}
+
+	// as in addStock, the serials are published before the stock update
+	if err := publishSerialChanges(ctx, s.JetStream(), stock, serials); err != nil {
+		slog.ErrorContext(ctx, "Error publishing serials", "error", err, "subject", req.Subject)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	err := SendStockUpdate(ctx, s.JetStream(), &update, opts...)
+	if errors.Is(err, errDuplicateStockUpdate) {
+		slog.InfoContext(ctx, "Stock already adjusted by a previous request", "subject", req.Subject)
+		return []byte("ok")
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending stock update", "error", err, "subject", req.Subject)
+		return natsutil.ErrorResponse(natsutil.NatsError)
+	}
+
+	for _, row := range update {
+		// stock MUST be locked
+		stock.s[row.GoodId] = row.Amount
+	}
+
+	slog.InfoContext(ctx, "Stock adjusted", "reason", msg.Reason, "goods", len(update))
+	return []byte("ok")
 }
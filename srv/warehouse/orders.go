@@ -4,73 +4,60 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
+	"strings"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-func OrdersCreatedHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
-	var msg messages.OrderCreated
+// OrderEventHandler dispatches the order events this warehouse is interested in
+func OrderEventHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	switch {
+	case strings.HasSuffix(req.Subject(), ".confirmed"), strings.HasSuffix(req.Subject(), ".backorder_allocated"), strings.HasSuffix(req.Subject(), ".released"):
+		return OrderConfirmedHandler(ctx, s, req)
+	case strings.HasSuffix(req.Subject(), ".cancelled"):
+		return OrderCancelledHandler(ctx, s, req)
+	case strings.HasSuffix(req.Subject(), ".amended"):
+		return OrderAmendedHandler(ctx, s, req)
+	default:
+		return nil
+	}
+}
+
+// OrderConfirmedHandler commits the reservations of confirmed orders, removing the goods from the stock.
+//
+// It also handles `backorder_allocated` and `released`, whose payloads list the new reservations the same way.
+func OrderConfirmedHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	var msg messages.OrderConfirmed
 	if err := json.Unmarshal(req.Data(), &msg); err != nil {
 		slog.ErrorContext(
 			ctx,
 			"Error unmarshalling message",
 			"error", err,
 			"subject", req.Subject(),
-			"message", req.Headers()["Nats-Msg-Id"][0],
+			"message", req.Headers().Get("Nats-Msg-Id"),
 		)
 		return err
 	}
 
-	var currentWarehouseRequest *messages.OrderCreateWarehouse = nil
-	for _, item := range msg.Warehouses {
-		if item.WarehouseId == warehouseId {
-			currentWarehouseRequest = &item
-			break
-		}
-	}
-	if currentWarehouseRequest == nil {
-		// This warehouse is not responsible for this order
-		return nil
-	}
-
 	reserv := &s.State().reservation
 	stock := &s.State().stock
 
-	reserv.Lock()
-	defer reserv.Unlock()
 	stock.Lock()
 	defer stock.Unlock()
+	reserv.Lock()
+	defer reserv.Unlock()
 
-	// search for the reservation id
-	// TODO: make "s" a map
-	var reservation *Reservation = nil
-	for i, r := range reserv.s {
-		slog.InfoContext(ctx, "Checking reservation", "reservation_id", r.Reservation.ID)
-		if r.Reservation.ID == currentWarehouseRequest.ReservationId {
-			reservation = &reserv.s[i]
-			break
-		}
+	stockUpdate, err := commitReservations(ctx, s, msg.ID, msg.Warehouses)
+	if err != nil {
+		return err
 	}
-	// TODO: handle this (?)
-	if reservation == nil {
-		slog.ErrorContext(ctx, "Reservation expired", "reservation_id", currentWarehouseRequest.ReservationId)
+	if len(stockUpdate) == 0 {
 		return nil
 	}
 
-	stockUpdate := messages.StockUpdate(make([]messages.StockUpdateItem, 0, len(currentWarehouseRequest.Parts)))
-	for _, item := range reservation.ReservedStock {
-		// update stock and reservation state
-		stock.r[item.GoodId] -= item.Amount
-		stock.s[item.GoodId] -= item.Amount
-		// add the updated stock state to the stockUpdate message
-		stockUpdate = append(stockUpdate, messages.StockUpdateItem{
-			GoodId: item.GoodId,
-			Amount: stock.s[item.GoodId],
-		})
-	}
-
 	// send the stock update message to the stream
 	if err := SendStockUpdate(ctx, s.JetStream(), &stockUpdate); err != nil {
 		slog.ErrorContext(
@@ -78,10 +65,189 @@ func OrdersCreatedHandler(ctx context.Context, s *common.Service[warehouseState]
 			"Error sending stock update",
 			"error", err,
 			"subject", req.Subject(),
-			"message", req.Headers()["Nats-Msg-Id"][0],
+			"message", req.Headers().Get("Nats-Msg-Id"),
 		)
 		return nil
 	}
 
 	return nil
 }
+
+// OrderCancelledHandler gives back the stock of cancelled orders: reservations that
+// were not committed are released, and goods that were not shipped are put back in stock
+func OrderCancelledHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	var msg messages.OrderCancelled
+	if err := json.Unmarshal(req.Data(), &msg); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling message", "error", err, "subject", req.Subject())
+		return err
+	}
+
+	reserv := &s.State().reservation
+	stock := &s.State().stock
+
+	stock.Lock()
+	defer stock.Unlock()
+	reserv.Lock()
+	defer reserv.Unlock()
+
+	for _, item := range msg.Release {
+		if item.WarehouseId != warehouseId {
+			continue
+		}
+
+		i := reserv.find(item.ReservationId)
+		if i == -1 {
+			// already expired
+			continue
+		}
+		reservation := reserv.s[i]
+
+		if err := PublishReservationRemoved(ctx, reserv, s.JetStream(), reservation.ID, "released"); err != nil {
+			slog.ErrorContext(ctx, "Error releasing reservation", "error", err, "reservation_id", reservation.ID)
+			return err
+		}
+		for _, part := range reservation.ReservedStock {
+			stock.r[part.GoodId] -= part.Amount
+		}
+		if err := releaseSerials(ctx, s.JetStream(), stock, reservation.ID); err != nil {
+			slog.ErrorContext(ctx, "Error releasing serials", "error", err, "reservation_id", reservation.ID)
+			return err
+		}
+	}
+
+	if err := restockSerials(ctx, s.JetStream(), stock, msg.ID, msg.Restock); err != nil {
+		slog.ErrorContext(ctx, "Error restocking serials", "error", err, "order", msg.ID)
+		return err
+	}
+	stockUpdate := restockParts(stock, msg.Restock)
+	if len(stockUpdate) == 0 {
+		return nil
+	}
+
+	if err := SendStockUpdate(ctx, s.JetStream(), &stockUpdate); err != nil {
+		slog.ErrorContext(ctx, "Error sending stock update", "error", err, "subject", req.Subject())
+		return err
+	}
+	applyStockUpdate(stock, stockUpdate)
+
+	slog.InfoContext(ctx, "Order cancelled", "order", msg.ID, "restocked", len(stockUpdate))
+	return nil
+}
+
+// OrderAmendedHandler commits the reservations made for the goods added to an order,
+// and puts back in stock the goods removed from it
+func OrderAmendedHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	var msg messages.OrderAmended
+	if err := json.Unmarshal(req.Data(), &msg); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling message", "error", err, "subject", req.Subject())
+		return err
+	}
+
+	reserv := &s.State().reservation
+	stock := &s.State().stock
+
+	stock.Lock()
+	defer stock.Unlock()
+	reserv.Lock()
+	defer reserv.Unlock()
+
+	stockUpdate, err := commitReservations(ctx, s, msg.ID, msg.Warehouses)
+	if err != nil {
+		return err
+	}
+	if err := restockSerials(ctx, s.JetStream(), stock, msg.ID, msg.Restock); err != nil {
+		slog.ErrorContext(ctx, "Error restocking serials", "error", err, "order", msg.ID)
+		return err
+	}
+	stockUpdate = append(stockUpdate, restockParts(stock, msg.Restock)...)
+	if len(stockUpdate) == 0 {
+		return nil
+	}
+
+	if err := SendStockUpdate(ctx, s.JetStream(), &stockUpdate); err != nil {
+		slog.ErrorContext(ctx, "Error sending stock update", "error", err, "subject", req.Subject())
+		return err
+	}
+	applyStockUpdate(stock, stockUpdate)
+
+	slog.InfoContext(ctx, "Order amended", "order", msg.ID)
+	return nil
+}
+
+// commitReservations commits the reservations of this warehouse among the given ones, removing their
+// goods from the stock and shipping their serials with the order. It returns the stock update to send.
+// stock and reservations MUST be locked
+func commitReservations(ctx context.Context, s *common.Service[warehouseState], orderId uuid.UUID, warehouses []messages.OrderCreateWarehouse) (messages.StockUpdate, error) {
+	reserv := &s.State().reservation
+	stock := &s.State().stock
+
+	// an order can hold more than one reservation in the same warehouse,
+	// for example when part of it was moved here after another warehouse refused it
+	stockUpdate := messages.StockUpdate(make([]messages.StockUpdateItem, 0))
+	for _, item := range warehouses {
+		if item.WarehouseId != warehouseId {
+			// This warehouse is not responsible for this part of the order
+			continue
+		}
+
+		// TODO: handle this (?)
+		i := reserv.find(item.ReservationId)
+		if i == -1 {
+			slog.ErrorContext(ctx, "Reservation expired", "reservation_id", item.ReservationId)
+			continue
+		}
+		reservation := reserv.s[i]
+
+		if err := PublishReservationRemoved(ctx, reserv, s.JetStream(), reservation.ID, "committed"); err != nil {
+			slog.ErrorContext(ctx, "Error committing reservation", "error", err, "reservation_id", reservation.ID)
+			return nil, err
+		}
+		if err := shipSerials(ctx, s.JetStream(), stock, reservation.ID, orderId); err != nil {
+			slog.ErrorContext(ctx, "Error shipping serials", "error", err, "reservation_id", reservation.ID)
+			return nil, err
+		}
+
+		for _, item := range reservation.ReservedStock {
+			// update stock and reservation state
+			stock.r[item.GoodId] -= item.Amount
+			stock.s[item.GoodId] -= item.Amount
+			// add the updated stock state to the stockUpdate message
+			stockUpdate = append(stockUpdate, messages.StockUpdateItem{
+				GoodId: item.GoodId,
+				Amount: stock.s[item.GoodId],
+			})
+		}
+	}
+	return stockUpdate, nil
+}
+
+// restockParts returns the stock update that puts back in stock the parts of this warehouse among the given ones.
+// The stock is left unchanged, so that it is only updated once the update is published, see applyStockUpdate.
+// stock MUST be locked
+func restockParts(stock *stockState, parts []messages.OrderCreateWarehouse) messages.StockUpdate {
+	stockUpdate := messages.StockUpdate(make([]messages.StockUpdateItem, 0))
+	restocked := make(map[string]int)
+	for _, item := range parts {
+		if item.WarehouseId != warehouseId {
+			continue
+		}
+		for _, part := range item.Parts {
+			if _, found := restocked[part.GoodId]; !found {
+				restocked[part.GoodId] = stock.s[part.GoodId]
+			}
+			restocked[part.GoodId] += part.Amount
+			stockUpdate = append(stockUpdate, messages.StockUpdateItem{
+				GoodId: part.GoodId,
+				Amount: restocked[part.GoodId],
+			})
+		}
+	}
+	return stockUpdate
+}
+
+// applyStockUpdate sets the stock of the goods of a published stock update. stock MUST be locked
+func applyStockUpdate(stock *stockState, stockUpdate messages.StockUpdate) {
+	for _, item := range stockUpdate {
+		stock.s[item.GoodId] = item.Amount
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
@@ -29,7 +31,30 @@ type reservationState struct {
 	s []Reservation
 }
 
+// find returns the index of the reservation with the given id, or -1 if there is none.
+// reservations MUST be locked
+func (r *reservationState) find(id uuid.UUID) int {
+	for i, reservation := range r.s {
+		if reservation.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes the reservation at index i, and returns it.
+// reservations MUST be locked
+func (r *reservationState) remove(i int) Reservation {
+	reservation := r.s[i]
+	r.s = append(r.s[:i], r.s[i+1:]...)
+	return reservation
+}
+
 func ReservationHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	if strings.HasSuffix(req.Subject(), ".released") || strings.HasSuffix(req.Subject(), ".committed") {
+		return reservationRemovedHandler(ctx, s, req)
+	}
+
 	// TODO: maybe create reservation id in this handler and not from the external caller
 	var msg messages.Reservation
 	err := json.Unmarshal(req.Data(), &msg)
@@ -39,7 +64,7 @@ func ReservationHandler(ctx context.Context, s *common.Service[warehouseState],
 			"Error unmarshalling message",
 			"error", err,
 			"subject", req.Subject(),
-			"message", req.Headers()["Nats-Msg-Id"][0],
+			"message", req.Headers().Get("Nats-Msg-Id"),
 		)
 		return nil
 	}
@@ -50,26 +75,68 @@ func ReservationHandler(ctx context.Context, s *common.Service[warehouseState],
 			ctx, "Error getting metadata for message",
 			"error", err,
 			"subject", req.Subject(),
-			"message", req.Headers()["Nats-Msg-Id"][0],
+			"message", req.Headers().Get("Nats-Msg-Id"),
 		)
 		return nil
 	}
 
+	stock := &s.State().stock
 	reservations := &s.State().reservation
+	stock.Lock()
+	defer stock.Unlock()
 	reservations.Lock()
 	defer reservations.Unlock()
 
+	// reservations made by this instance are already tracked by PublishReservation:
+	// only the ones replayed after a restart need to be added
+	if i := reservations.find(msg.ID); i != -1 {
+		reservations.s[i].seq = meta.Sequence.Stream
+		reservations.s[i].ts = meta.Timestamp
+		return nil
+	}
+
 	// reservations MUST be locked
 	reservations.s = append(reservations.s, Reservation{
 		Reservation: msg,
 		seq:         meta.Sequence.Stream,
 		ts:          meta.Timestamp,
 	})
+	for _, item := range msg.ReservedStock {
+		stock.r[item.GoodId] += item.Amount
+	}
 
 	return nil
 }
 
-func removeReservationsLoop(ctx context.Context, reservations *reservationState) {
+// reservationRemovedHandler handles the events published when a reservation is released or committed
+func reservationRemovedHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	var msg messages.ReleaseReservation
+	err := json.Unmarshal(req.Data(), &msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling message", "error", err, "subject", req.Subject())
+		return nil
+	}
+
+	stock := &s.State().stock
+	reservations := &s.State().reservation
+	stock.Lock()
+	defer stock.Unlock()
+	reservations.Lock()
+	defer reservations.Unlock()
+
+	// live releases are already applied by the handler that published them:
+	// this only does something while replaying the stream after a restart
+	if i := reservations.find(msg.ID); i != -1 {
+		reservation := reservations.remove(i)
+		for _, item := range reservation.ReservedStock {
+			stock.r[item.GoodId] -= item.Amount
+		}
+	}
+
+	return nil
+}
+
+func removeReservationsLoop(ctx context.Context, js jetstream.JetStream, stock *stockState, reservations *reservationState) {
 	t := time.NewTicker(5 * time.Second)
 
 	for {
@@ -77,29 +144,71 @@ func removeReservationsLoop(ctx context.Context, reservations *reservationState)
 		case <-ctx.Done():
 			return
 		case <-t.C:
+			stock.Lock()
 			reservations.Lock()
-			for i, reservation := range reservations.s {
+			kept := reservations.s[:0]
+			for _, reservation := range reservations.s {
 				if reservation.ts.Add(ReservationTimeout).After(time.Now()) {
-					reservations.s = append(reservations.s[:i], reservations.s[i+1:]...)
+					kept = append(kept, reservation)
+					continue
+				}
+				for _, item := range reservation.ReservedStock {
+					stock.r[item.GoodId] -= item.Amount
+				}
+				if err := releaseSerials(ctx, js, stock, reservation.ID); err != nil {
+					slog.ErrorContext(ctx, "Error releasing serials of expired reservation", "error", err, "reservation_id", reservation.ID)
 				}
+				slog.InfoContext(ctx, "Reservation expired", "reservation_id", reservation.ID)
 			}
+			reservations.s = kept
 			reservations.Unlock()
+			stock.Unlock()
 		}
 	}
 }
 
+// PublishReservation publishes a new reservation, and starts tracking it
 func PublishReservation(ctx context.Context, reservations *reservationState, js jetstream.JetStream, msg messages.Reservation) error {
 	reservations.Lock()
 	defer reservations.Unlock()
 
 	body, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal stock update: %w", err)
+		return fmt.Errorf("failed to marshal reservation: %w", err)
+	}
+
+	ack, err := js.Publish(ctx, fmt.Sprintf("reservations.%s", warehouseId), body)
+	if err != nil {
+		return fmt.Errorf("failed to publish reservation: %w", err)
+	}
+
+	reservations.s = append(reservations.s, Reservation{
+		Reservation: msg,
+		seq:         ack.Sequence,
+		ts:          time.Now(),
+	})
+
+	return nil
+}
+
+// PublishReservationRemoved publishes the event signaling that a reservation was either released or committed
+// (depending on the value of kind), and stops tracking it.
+//
+// Unlike PublishReservation, the caller MUST already hold the lock on reservations
+func PublishReservationRemoved(ctx context.Context, reservations *reservationState, js jetstream.JetStream, id uuid.UUID, kind string) error {
+	body, err := json.Marshal(messages.ReleaseReservation{ID: id})
+	if err != nil {
+		return fmt.Errorf("failed to marshal reservation removal: %w", err)
 	}
 
-	_, err = js.Publish(ctx, fmt.Sprintf("reservations.%s", warehouseId), body)
+	_, err = js.Publish(ctx, fmt.Sprintf("reservations.%s.%s", warehouseId, kind), body)
 	if err != nil {
-		return fmt.Errorf("failed to publish stock update: %w", err)
+		return fmt.Errorf("failed to publish reservation removal: %w", err)
+	}
+
+	// reservations MUST be locked
+	if i := reservations.find(id); i != -1 {
+		reservations.remove(i)
 	}
 
 	return nil
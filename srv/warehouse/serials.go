@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Serialised goods have a serial number for each unit in stock. The `serials` stream is the source of truth
+// for where each serial is: the warehouse keeps the serials whose last event happened here, to pick the ones
+// to reserve, ship and remove. Stock added before a good was serialised has no serials, so reservations
+// take the serials available, if any.
+
+// serialEntry is the state of a serial number whose last event happened in this warehouse
+type serialEntry struct {
+	last messages.SerialEventType
+	// reservation holds the serial while last is SerialReserved
+	reservation uuid.UUID
+	// order is the order the serial was shipped with
+	order uuid.UUID
+	// seq is the sequence number of the last event in the stream
+	seq uint64
+	// msgId is the message id of the last event, set when it was published by a request with an idempotency key
+	msgId string
+}
+
+// applySerialEvent updates the serials of the warehouse with an event published at the given sequence.
+// Events older than the known ones are ignored, since the warehouse applies its own events when publishing them.
+// stock MUST be locked
+func (stock *stockState) applySerialEvent(event messages.SerialEvent, seq uint64, msgId string) {
+	stock.serialsSeq = max(stock.serialsSeq, seq)
+
+	serials := stock.serials[event.GoodId]
+	if entry, found := serials[event.Serial]; found && entry.seq >= seq {
+		return
+	}
+	if event.WarehouseId != warehouseId {
+		delete(serials, event.Serial)
+		return
+	}
+
+	if serials == nil {
+		serials = make(map[string]*serialEntry)
+		stock.serials[event.GoodId] = serials
+	}
+	entry := &serialEntry{last: event.Type, seq: seq, msgId: msgId}
+	if event.ReservationId != nil {
+		entry.reservation = *event.ReservationId
+	}
+	if event.OrderId != nil {
+		entry.order = *event.OrderId
+	}
+	serials[event.Serial] = entry
+}
+
+// serialsWhere returns the serials of a good in this warehouse matching fn, sorted.
+// stock MUST be locked
+func (stock *stockState) serialsWhere(goodId string, fn func(*serialEntry) bool) []string {
+	serials := make([]string, 0)
+	for _, serial := range slices.Sorted(maps.Keys(stock.serials[goodId])) {
+		if fn(stock.serials[goodId][serial]) {
+			serials = append(serials, serial)
+		}
+	}
+	return serials
+}
+
+// available returns whether a serial can be reserved or removed
+func (entry *serialEntry) available() bool {
+	return entry.last.InStock() && entry.last != messages.SerialReserved
+}
+
+// SerialEventHandler keeps the serials of the warehouse up to date with the events published by
+// other services, such as the returns received by the order service
+func SerialEventHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
+	var event messages.SerialEvent
+	if err := json.Unmarshal(req.Data(), &event); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling message", "error", err, "subject", req.Subject())
+		return nil
+	}
+
+	meta, err := req.Metadata()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting metadata for message", "error", err, "subject", req.Subject())
+		return nil
+	}
+
+	stock := &s.State().stock
+	stock.Lock()
+	defer stock.Unlock()
+
+	stock.applySerialEvent(event, meta.Sequence.Stream, req.Headers().Get(jetstream.MsgIDHeader))
+	return nil
+}
+
+// publishSerialEvent publishes an event of a serial, provided its last event is still at sequence expected
+// (zero for serials without events), and applies it. The event has the given message id, unless it is empty.
+// stock MUST be locked
+func publishSerialEvent(ctx context.Context, js jetstream.JetStream, stock *stockState, event messages.SerialEvent, expected uint64, msgId string) error {
+	event.WarehouseId = warehouseId
+	event.Timestamp = time.Now()
+	opts := []jetstream.PublishOpt{jetstream.WithExpectLastSequencePerSubject(expected)}
+	if msgId != "" {
+		opts = append(opts, jetstream.WithMsgID(msgId))
+	}
+	seq, err := common.PublishSerialEvent(ctx, js, event, opts...)
+	if err != nil {
+		return err
+	}
+	stock.applySerialEvent(event, seq, msgId)
+	return nil
+}
+
+// updateSerials publishes an event of the given type for each serial of a good in this warehouse.
+// stock MUST be locked
+func updateSerials(ctx context.Context, js jetstream.JetStream, stock *stockState, goodId string, serials []string, event messages.SerialEvent) error {
+	for _, serial := range serials {
+		event.GoodId, event.Serial = goodId, serial
+		if err := publishSerialEvent(ctx, js, stock, event, stock.serials[goodId][serial].seq, ""); err != nil {
+			return fmt.Errorf("failed to publish %s event of serial %s: %w", event.Type, serial, err)
+		}
+	}
+	return nil
+}
+
+// pickSerials chooses the serials to reserve for the requested stock: the first available ones, in order,
+// up to the requested amount of each good. stock MUST be locked
+func pickSerials(stock *stockState, requested []messages.ReserveStockItem) map[string][]string {
+	picked := make(map[string][]string)
+	for _, item := range requested {
+		available := stock.serialsWhere(item.GoodId, func(entry *serialEntry) bool { return entry.available() })
+		// the same good can be requested more than once
+		available = slices.DeleteFunc(available, func(serial string) bool { return slices.Contains(picked[item.GoodId], serial) })
+		picked[item.GoodId] = append(picked[item.GoodId], available[:min(item.Amount, len(available))]...)
+	}
+	return picked
+}
+
+// reserveSerials assigns the serials chosen by pickSerials to a reservation. stock MUST be locked
+func reserveSerials(ctx context.Context, js jetstream.JetStream, stock *stockState, reservationId uuid.UUID, picked map[string][]string) error {
+	for _, goodId := range slices.Sorted(maps.Keys(picked)) {
+		event := messages.SerialEvent{Type: messages.SerialReserved, ReservationId: &reservationId}
+		if err := updateSerials(ctx, js, stock, goodId, picked[goodId], event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reservedSerials returns the serials held by a reservation, by good id. stock MUST be locked
+func reservedSerials(stock *stockState, reservationId uuid.UUID) map[string][]string {
+	reserved := make(map[string][]string)
+	for goodId := range stock.serials {
+		serials := stock.serialsWhere(goodId, func(entry *serialEntry) bool {
+			return entry.last == messages.SerialReserved && entry.reservation == reservationId
+		})
+		if len(serials) > 0 {
+			reserved[goodId] = serials
+		}
+	}
+	return reserved
+}
+
+// releaseSerials makes the serials of a released or expired reservation available again. stock MUST be locked
+func releaseSerials(ctx context.Context, js jetstream.JetStream, stock *stockState, reservationId uuid.UUID) error {
+	reserved := reservedSerials(stock, reservationId)
+	for _, goodId := range slices.Sorted(maps.Keys(reserved)) {
+		event := messages.SerialEvent{Type: messages.SerialReleased, ReservationId: &reservationId}
+		if err := updateSerials(ctx, js, stock, goodId, reserved[goodId], event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shipSerials ships the serials of a reservation committed for an order. stock MUST be locked
+func shipSerials(ctx context.Context, js jetstream.JetStream, stock *stockState, reservationId uuid.UUID, orderId uuid.UUID) error {
+	reserved := reservedSerials(stock, reservationId)
+	for _, goodId := range slices.Sorted(maps.Keys(reserved)) {
+		event := messages.SerialEvent{Type: messages.SerialShipped, ReservationId: &reservationId, OrderId: &orderId}
+		if err := updateSerials(ctx, js, stock, goodId, reserved[goodId], event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restockSerials puts back in stock the serials shipped with an order for the parts of this warehouse among
+// the given ones, as restockParts does with their amounts. stock MUST be locked
+func restockSerials(ctx context.Context, js jetstream.JetStream, stock *stockState, orderId uuid.UUID, parts []messages.OrderCreateWarehouse) error {
+	for _, item := range parts {
+		if item.WarehouseId != warehouseId {
+			continue
+		}
+		for _, part := range item.Parts {
+			shipped := stock.serialsWhere(part.GoodId, func(entry *serialEntry) bool {
+				return entry.last == messages.SerialShipped && entry.order == orderId
+			})
+			event := messages.SerialEvent{Type: messages.SerialRestocked, OrderId: &orderId}
+			if err := updateSerials(ctx, js, stock, part.GoodId, shipped[:min(part.Amount, len(shipped))], event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serialChange is an event to publish for a serial, before its stock is updated
+type serialChange struct {
+	event messages.SerialEvent
+	// expected is the sequence of the last event of the serial, which must not change in the meantime
+	expected uint64
+	msgId    string
+}
+
+// changeSerials returns the events of the serials added and removed by the items of `warehouse.add_stock`
+// and `warehouse.adjust`, or the response to send back if some serials cannot be added or removed.
+// Added serials must not be in stock anywhere, and removed ones must be available in this warehouse.
+//
+// Each event has a message id starting with msgIdPrefix, unless it is empty: a retry of a request whose
+// events were published, in full or in part, skips the serials whose last event is the one it published.
+// stock MUST be locked
+func changeSerials(ctx context.Context, js jetstream.JetStream, stock *stockState, items []messages.StockUpdateItem, reason string, msgIdPrefix string) ([]serialChange, []byte) {
+	changes := make([]serialChange, 0)
+	inStock := make([]string, 0)
+	unavailable := make([]string, 0)
+
+	for _, item := range items {
+		for _, serial := range item.Serials {
+			msgId := ""
+			if msgIdPrefix != "" {
+				msgId = fmt.Sprintf("%s.%s.%s", msgIdPrefix, item.GoodId, serial)
+				if entry, found := stock.serials[item.GoodId][serial]; found && entry.msgId == msgId {
+					continue
+				}
+			}
+
+			if item.Amount < 0 {
+				entry, found := stock.serials[item.GoodId][serial]
+				if !found || !entry.available() {
+					unavailable = append(unavailable, serial)
+					continue
+				}
+				changes = append(changes, serialChange{
+					event:    messages.SerialEvent{Serial: serial, GoodId: item.GoodId, Type: messages.SerialRemoved, Reason: reason},
+					expected: entry.seq,
+					msgId:    msgId,
+				})
+				continue
+			}
+
+			last, seq, err := common.LastSerialEvent(ctx, js, item.GoodId, serial)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error getting last event of serial", "error", err, "serial", serial)
+				return nil, natsutil.ErrorResponse(natsutil.NatsError)
+			}
+
+			event := messages.SerialEvent{Serial: serial, GoodId: item.GoodId, Type: messages.SerialReceived, Reason: reason}
+			switch {
+			case last == nil:
+			case last.Type.InStock():
+				inStock = append(inStock, serial)
+				continue
+			case last.Type == messages.SerialRemoved && last.WarehouseId != warehouseId:
+				event.Type, event.FromWarehouseId = messages.SerialMoved, last.WarehouseId
+			case last.Type == messages.SerialShipped, last.Type == messages.SerialReturned:
+				event.Type, event.OrderId, event.ReturnId = messages.SerialRestocked, last.OrderId, last.ReturnId
+			}
+			changes = append(changes, serialChange{event: event, expected: seq, msgId: msgId})
+		}
+	}
+
+	if len(inStock) > 0 {
+		return nil, natsutil.ErrorResponseWithDetails(natsutil.SerialInStock, inStock)
+	}
+	if len(unavailable) > 0 {
+		return nil, natsutil.ErrorResponseWithDetails(natsutil.SerialUnavailable, unavailable)
+	}
+	return changes, nil
+}
+
+// publishSerialChanges publishes the events returned by changeSerials. stock MUST be locked
+func publishSerialChanges(ctx context.Context, js jetstream.JetStream, stock *stockState, changes []serialChange) error {
+	for _, change := range changes {
+		if err := publishSerialEvent(ctx, js, stock, change.event, change.expected, change.msgId); err != nil {
+			return fmt.Errorf("failed to publish %s event of serial %s: %w", change.event.Type, change.event.Serial, err)
+		}
+	}
+	return nil
+}
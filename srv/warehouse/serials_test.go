@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alimitedgroup/PoC/common"
+	"github.com/alimitedgroup/PoC/common/messages"
+	"github.com/alimitedgroup/PoC/common/natsutil"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStock() *stockState {
+	return &stockState{s: make(map[string]int), r: make(map[string]int), serials: make(map[string]map[string]*serialEntry)}
+}
+
+// newTestSerialsStream returns a JetStream context with the `serials` stream
+func newTestSerialsStream(t *testing.T, ctx context.Context) jetstream.JetStream {
+	nc := common.NewInProcessNATSServer(t)
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	require.NoError(t, common.CreateStream(ctx, js, common.SerialsStreamConfig))
+	return js
+}
+
+func TestApplySerialEvent(t *testing.T) {
+	stock := newTestStock()
+	reservation := uuid.New()
+
+	stock.applySerialEvent(messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialReceived, WarehouseId: warehouseId}, 1, "")
+	stock.applySerialEvent(messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialReserved, WarehouseId: warehouseId, ReservationId: &reservation}, 3, "")
+	require.Equal(t, &serialEntry{last: messages.SerialReserved, reservation: reservation, seq: 3}, stock.serials["phone"]["SN-1"])
+
+	// events older than the known ones were already applied when publishing them
+	stock.applySerialEvent(messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialReceived, WarehouseId: warehouseId}, 2, "")
+	require.Equal(t, messages.SerialReserved, stock.serials["phone"]["SN-1"].last)
+	require.Equal(t, uint64(3), stock.serialsSeq)
+
+	// serials whose last event happened in another warehouse are not here anymore
+	stock.applySerialEvent(messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialMoved, WarehouseId: "other"}, 4, "")
+	require.NotContains(t, stock.serials["phone"], "SN-1")
+	require.Equal(t, uint64(4), stock.serialsSeq)
+}
+
+func TestPickSerials(t *testing.T) {
+	stock := newTestStock()
+	reservation := uuid.New()
+	for i, serial := range []string{"SN-3", "SN-1", "SN-2", "SN-4"} {
+		stock.applySerialEvent(messages.SerialEvent{Serial: serial, GoodId: "phone", Type: messages.SerialReceived, WarehouseId: warehouseId}, uint64(i+1), "")
+	}
+	stock.applySerialEvent(messages.SerialEvent{Serial: "SN-1", GoodId: "phone", Type: messages.SerialReserved, WarehouseId: warehouseId, ReservationId: &reservation}, 5, "")
+	stock.applySerialEvent(messages.SerialEvent{Serial: "SN-9", GoodId: "tablet", Type: messages.SerialReceived, WarehouseId: warehouseId}, 6, "")
+
+	tests := []struct {
+		name      string
+		requested []messages.ReserveStockItem
+		picked    map[string][]string
+	}{
+		{"first available, in order", []messages.ReserveStockItem{{GoodId: "phone", Amount: 2}}, map[string][]string{"phone": {"SN-2", "SN-3"}}},
+		{"same good requested twice", []messages.ReserveStockItem{{GoodId: "phone", Amount: 1}, {GoodId: "phone", Amount: 2}}, map[string][]string{"phone": {"SN-2", "SN-3", "SN-4"}}},
+		{"fewer serials than the amount", []messages.ReserveStockItem{{GoodId: "phone", Amount: 5}, {GoodId: "tablet", Amount: 2}}, map[string][]string{"phone": {"SN-2", "SN-3", "SN-4"}, "tablet": {"SN-9"}}},
+		{"good without serials", []messages.ReserveStockItem{{GoodId: "hat", Amount: 1}}, map[string][]string{"hat": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.picked, pickSerials(stock, tt.requested))
+		})
+	}
+}
+
+func TestChangeSerials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	js := newTestSerialsStream(t, ctx)
+	stock := newTestStock()
+
+	orderId := uuid.New()
+	for _, event := range []messages.SerialEvent{
+		{Serial: "SN-1", GoodId: "phone", Type: messages.SerialReceived, WarehouseId: "other"},
+		{Serial: "SN-2", GoodId: "phone", Type: messages.SerialRemoved, WarehouseId: "other"},
+		{Serial: "SN-3", GoodId: "phone", Type: messages.SerialShipped, WarehouseId: "other", OrderId: &orderId},
+	} {
+		_, err := common.PublishSerialEvent(ctx, js, event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, publishSerialEvent(ctx, js, stock, messages.SerialEvent{Serial: "SN-5", GoodId: "phone", Type: messages.SerialReceived}, 0, ""))
+
+	t.Run("added serials", func(t *testing.T) {
+		changes, response := changeSerials(ctx, js, stock, []messages.StockUpdateItem{{GoodId: "phone", Amount: 3, Serials: []string{"SN-2", "SN-3", "SN-4"}}}, "", "")
+		require.Nil(t, response)
+		require.Len(t, changes, 3)
+
+		require.Equal(t, messages.SerialMoved, changes[0].event.Type)
+		require.Equal(t, "other", changes[0].event.FromWarehouseId)
+		require.Equal(t, messages.SerialRestocked, changes[1].event.Type)
+		require.Equal(t, &orderId, changes[1].event.OrderId)
+		require.Equal(t, messages.SerialReceived, changes[2].event.Type)
+		require.Zero(t, changes[2].expected)
+	})
+
+	t.Run("added serials already in stock", func(t *testing.T) {
+		_, response := changeSerials(ctx, js, stock, []messages.StockUpdateItem{{GoodId: "phone", Amount: 3, Serials: []string{"SN-1", "SN-4", "SN-5"}}}, "", "")
+		require.Equal(t, natsutil.ErrorResponseWithDetails(natsutil.SerialInStock, []string{"SN-1", "SN-5"}), response)
+	})
+
+	t.Run("removed serials", func(t *testing.T) {
+		changes, response := changeSerials(ctx, js, stock, []messages.StockUpdateItem{{GoodId: "phone", Amount: -1, Serials: []string{"SN-5"}}}, "damaged", "")
+		require.Nil(t, response)
+		require.Len(t, changes, 1)
+		require.Equal(t, messages.SerialRemoved, changes[0].event.Type)
+		require.Equal(t, "damaged", changes[0].event.Reason)
+
+		_, response = changeSerials(ctx, js, stock, []messages.StockUpdateItem{{GoodId: "phone", Amount: -2, Serials: []string{"SN-1", "SN-5"}}}, "", "")
+		require.Equal(t, natsutil.ErrorResponseWithDetails(natsutil.SerialUnavailable, []string{"SN-1"}), response)
+	})
+
+	t.Run("retries skip the serials they published", func(t *testing.T) {
+		items := []messages.StockUpdateItem{{GoodId: "phone", Amount: 2, Serials: []string{"SN-6", "SN-7"}}}
+		changes, response := changeSerials(ctx, js, stock, items, "", "add_stock.request")
+		require.Nil(t, response)
+		require.Len(t, changes, 2)
+
+		// the first attempt fails after publishing one of the serials
+		require.NoError(t, publishSerialChanges(ctx, js, stock, changes[:1]))
+
+		changes, response = changeSerials(ctx, js, stock, items, "", "add_stock.request")
+		require.Nil(t, response)
+		require.Len(t, changes, 1)
+		require.Equal(t, "SN-7", changes[0].event.Serial)
+
+		// other requests still find the serial in stock
+		_, response = changeSerials(ctx, js, stock, items, "", "add_stock.other")
+		require.Equal(t, natsutil.ErrorResponseWithDetails(natsutil.SerialInStock, []string{"SN-6"}), response)
+	})
+}
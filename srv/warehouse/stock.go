@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -16,13 +17,18 @@ import (
 // stock contains the currently stocked items inside of the field `s`,
 // and the amounts of items that have been reserved, inside the `r` field.
 // Each of these fields is a map from good id to stocked (or reserved) amount.
+// The serial numbers of serialised goods in this warehouse are inside the `serials`
+// field, from good id to serial, see applySerialEvent.
 //
 // Please note that this singleton should be locked before being used by
 // calling its `Lock()` method.
 type stockState struct {
 	sync.Mutex
-	s map[string]int
-	r map[string]int
+	s       map[string]int
+	r       map[string]int
+	serials map[string]map[string]*serialEntry
+	// serialsSeq is the sequence of the last event of the `serials` stream that was applied
+	serialsSeq uint64
 }
 
 func StockUpdateHandler(ctx context.Context, s *common.Service[warehouseState], req jetstream.Msg) error {
@@ -54,21 +60,28 @@ func StockUpdateHandler(ctx context.Context, s *common.Service[warehouseState],
 	return nil
 }
 
-func SendStockUpdate(ctx context.Context, js jetstream.JetStream, msg *messages.StockUpdate) error {
+// errDuplicateStockUpdate is returned by SendStockUpdate when JetStream discards the update as a duplicate
+// of one published with the same message id
+var errDuplicateStockUpdate = errors.New("duplicate stock update")
+
+func SendStockUpdate(ctx context.Context, js jetstream.JetStream, msg *messages.StockUpdate, opts ...jetstream.PublishOpt) error {
 	body, err := json.Marshal(msg)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to marshal value as JSON", "error", err)
 		return err
 	}
 
-	_, err = js.PublishMsg(ctx, &nats.Msg{
+	ack, err := js.PublishMsg(ctx, &nats.Msg{
 		Subject: fmt.Sprintf("stock_updates.%s", warehouseId),
 		Data:    body,
-	})
+	}, opts...)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to publish message", "error", err)
 		return err
 	}
+	if ack.Duplicate {
+		return errDuplicateStockUpdate
+	}
 
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 
 	"github.com/alimitedgroup/PoC/common"
 	"github.com/nats-io/nats.go"
@@ -17,8 +18,13 @@ import (
 type warehouseState struct {
 	stock       stockState
 	reservation reservationState
+	idempotency *common.IdempotencyStore
 }
 
+// IdempotencyStaleAfter is how long an add_stock request can be in progress before a retry with the same
+// idempotency key takes over
+const IdempotencyStaleAfter = 30 * time.Second
+
 var meter = otel.Meter("github.com/alimitedgroup/PoC/srv/warehouse")
 var warehouseId = os.Getenv("WAREHOUSE_ID")
 
@@ -52,7 +58,7 @@ func main() {
 	defer nc.Close()
 
 	srv := common.NewService(ctx, nc, warehouseState{
-		stock:       stockState{sync.Mutex{}, make(map[string]int), make(map[string]int)},
+		stock:       stockState{s: make(map[string]int), r: make(map[string]int), serials: make(map[string]map[string]*serialEntry)},
 		reservation: reservationState{sync.Mutex{}, make([]Reservation, 0)},
 	})
 
@@ -65,6 +71,8 @@ func main() {
 	srv.RegisterHandler(fmt.Sprintf("warehouse.ping.%s", warehouseId), PingHandler)
 	srv.RegisterHandler(fmt.Sprintf("warehouse.add_stock.%s", warehouseId), AddStockHandler)
 	srv.RegisterHandler(fmt.Sprintf("warehouse.reserve.%s", warehouseId), ReserveHandler)
+	srv.RegisterHandler(fmt.Sprintf("warehouse.release.%s", warehouseId), ReleaseHandler)
+	srv.RegisterHandler(fmt.Sprintf("warehouse.adjust.%s", warehouseId), AdjustHandler)
 
 	slog.InfoContext(ctx, "Service setup successful", "service", "warehouse", "warehouseId", warehouseId)
 
@@ -90,15 +98,47 @@ func InitWarehouse(ctx context.Context, srv *common.Service[warehouseState]) err
 	if err != nil {
 		return fmt.Errorf("failed to create reservations stream: %w", err)
 	}
+	err = common.CreateStream(ctx, srv.JetStream(), common.SerialsStreamConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create serials stream: %w", err)
+	}
+
+	kv, err := srv.JetStream().CreateOrUpdateKeyValue(ctx, common.IdempotencyKeyValueConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency key-value store: %w", err)
+	}
+	srv.State().idempotency = common.NewIdempotencyStore(kv, IdempotencyStaleAfter)
 
 	srv.RegisterJsHandlerExisting(common.StockUpdatesStreamConfig.Name, StockUpdateHandler, common.WithSubjectFilter("stock_updates.>"))
 	slog.InfoContext(ctx, "Stock updates handled", "stock", srv.State().stock.r)
 
-	srv.RegisterJsHandler(common.ReservationStreamConfig.Name, ReservationHandler, common.WithSubjectFilter("reservations.>"))
+	// rebuild the serials from their events, then keep following the stream from where the replay stopped,
+	// since other services publish events too
+	err = srv.RegisterJsHandlerExisting(common.SerialsStreamConfig.Name, SerialEventHandler, common.WithSubjectFilter("serials.>"))
+	if err != nil {
+		return fmt.Errorf("failed to replay serials: %w", err)
+	}
+	srv.RegisterJsHandler(
+		common.SerialsStreamConfig.Name,
+		SerialEventHandler,
+		common.WithSubjectFilter("serials.>"),
+		common.WithStartSequence(srv.State().stock.serialsSeq+1),
+	)
+
+	srv.RegisterJsHandler(common.ReservationStreamConfig.Name, ReservationHandler, common.WithSubjectsFilter([]string{
+		fmt.Sprintf("reservations.%s", warehouseId),
+		fmt.Sprintf("reservations.%s.>", warehouseId),
+	}))
 	slog.InfoContext(ctx, "Reservations handled", "reservation", srv.State().reservation.s)
-	go removeReservationsLoop(ctx, &srv.State().reservation)
-
-	srv.RegisterJsHandler(common.OrdersStreamConfig.Name, OrdersCreatedHandler, common.WithSubjectFilter("orders"))
+	go removeReservationsLoop(ctx, srv.JetStream(), &srv.State().stock, &srv.State().reservation)
+
+	// the consumer is durable, so that after a restart order events are neither missed nor applied twice
+	srv.RegisterJsHandler(
+		common.OrdersStreamConfig.Name,
+		OrderEventHandler,
+		common.WithSubjectsFilter([]string{"orders.*.confirmed", "orders.*.backorder_allocated", "orders.*.released", "orders.*.amended", "orders.*.cancelled"}),
+		common.WithDurable(fmt.Sprintf("warehouse-%s-orders", warehouseId)),
+	)
 
 	return nil
 }